@@ -0,0 +1,225 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/pkg/errors"
+	"github.com/schafer14/obs/internal/attachments"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// resultKey matches the result keys attachments may be uploaded to. They are
+// the keys that can be filtered on.
+var resultKey = regexp.MustCompile(`^[A-Za-z0-9 _-]+$`)
+
+// maxAttachments is the most files uploaded by one request. Each file is
+// limited in size, so this limits how much one request can store.
+const maxAttachments = 20
+
+// Attach handles a multipart/form-data request that uploads attachments to an
+// observation. Each file is stored as an attachment named by its file name,
+// and a new revision of the observation is saved whose result references the
+// attachment under the name of the form field. Several files uploaded with
+// the same field are referenced as a list. At most maxAttachments files are
+// uploaded at a time. Attachments stored by the request
+// are removed again when the request fails, so none are left that no revision
+// references.
+func (o *ObservationHandler) Attach(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	prev, ok := o.find(w, r)
+	if !ok {
+		return
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		RespondError(ctx, w, Error{errors.New("attachments must be uploaded as multipart/form-data"), http.StatusUnsupportedMediaType, []FieldError{}})
+		return
+	}
+
+	var created []attachments.Attachment
+	attached := false
+	defer func() {
+		if !attached {
+			o.removeAttachments(created)
+		}
+	}()
+
+	var keys []string
+	refs := map[string][]bson.M{}
+	files := 0
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			RespondError(ctx, w, Error{errors.Wrap(err, "reading upload"), http.StatusBadRequest, []FieldError{}})
+			return
+		}
+		if part.FileName() == "" {
+			part.Close()
+			continue
+		}
+		files++
+		if files > maxAttachments {
+			part.Close()
+			err := errors.Errorf("uploads may have at most %d files", maxAttachments)
+			RespondError(ctx, w, Error{err, http.StatusRequestEntityTooLarge, []FieldError{}})
+			return
+		}
+
+		key := part.FormName()
+		if !resultKey.MatchString(key) {
+			err := errors.Errorf("field %q must only contain letters, numbers, spaces, _ and -", key)
+			RespondError(ctx, w, Error{err, http.StatusUnprocessableEntity, []FieldError{{Field: key, Error: err.Error()}}})
+			return
+		}
+
+		mediaType, _, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if err != nil {
+			mediaType = ""
+		}
+
+		a, isNew, err := attachments.Upload(ctx, o.attachments, o.store, attachments.Attachment{
+			ObservationID: prev.ID,
+			Name:          path.Base(part.FileName()),
+			MediaType:     mediaType,
+			CreatedBy:     currentUserID(r),
+			CreatedAt:     time.Now(),
+		}, part, o.attachmentSize)
+		part.Close()
+		if err != nil {
+			switch err {
+			case attachments.ErrorInvalidName:
+				RespondError(ctx, w, Error{err, http.StatusUnprocessableEntity, []FieldError{{Field: key, Error: err.Error()}}})
+			case attachments.ErrorTooLarge:
+				err = errors.Errorf("attachment %s exceeds the limit of %d bytes", part.FileName(), o.attachmentSize)
+				RespondError(ctx, w, Error{err, http.StatusRequestEntityTooLarge, []FieldError{}})
+			case attachments.ErrorExists:
+				Respond(ctx, w, map[string]string{"error": fmt.Sprintf("observation already has an attachment named %s", path.Base(part.FileName()))}, http.StatusConflict)
+			default:
+				RespondError(ctx, w, errors.Wrap(err, "uploading attachment"))
+			}
+			return
+		}
+		if isNew {
+			created = append(created, a)
+		}
+
+		if _, ok := refs[key]; !ok {
+			keys = append(keys, key)
+		}
+		refs[key] = append(refs[key], a.Reference())
+	}
+
+	if len(keys) == 0 {
+		err := errors.New("no files were uploaded")
+		RespondError(ctx, w, Error{err, http.StatusUnprocessableEntity, []FieldError{}})
+		return
+	}
+
+	newObs := prev.AsNew()
+	newObs.Result = bson.M{}
+	for k, v := range prev.Result {
+		newObs.Result[k] = v
+	}
+	for _, key := range keys {
+		if len(refs[key]) == 1 {
+			newObs.Result[key] = refs[key][0]
+			continue
+		}
+		newObs.Result[key] = refs[key]
+	}
+
+	attached = o.revise(w, r, prev, newObs)
+}
+
+// removeAttachments removes attachments stored for a request that failed. The
+// client may have left, so they are removed even when the request is
+// cancelled. Attachments that cannot be removed are only wasted space, so
+// failures are logged.
+func (o *ObservationHandler) removeAttachments(as []attachments.Attachment) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	for _, a := range as {
+		if err := attachments.Remove(ctx, o.attachments, o.store, a); err != nil {
+			fmt.Printf("Unhandled error: %v\n", errors.Wrapf(err, "removing attachment %s of observation %s", a.Name, a.ObservationID))
+		}
+	}
+}
+
+// Attachments handles an http request for the attachments of an observation.
+func (o *ObservationHandler) Attachments(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	obs, ok := o.find(w, r)
+	if !ok {
+		return
+	}
+
+	as, err := o.attachments.List(ctx, obs.ID)
+	if err != nil {
+		RespondError(ctx, w, err)
+		return
+	}
+
+	if as == nil {
+		as = []attachments.Attachment{}
+	}
+
+	Respond(ctx, w, as, http.StatusOK)
+}
+
+// Attachment handles an http request that downloads an attachment of an
+// observation. The content is streamed from the store, and the SHA-256 hash
+// of the content is its ETag.
+func (o *ObservationHandler) Attachment(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	a, err := o.attachments.Find(ctx, chi.URLParam(r, "id"), chi.URLParam(r, "name"))
+	if err != nil {
+		if err == attachments.ErrorNotFound {
+			Respond(ctx, w, map[string]string{"error": "attachment not found"}, http.StatusNotFound)
+			return
+		}
+		RespondError(ctx, w, err)
+		return
+	}
+
+	etag := strconv.Quote(a.SHA256)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	rc, err := attachments.Open(ctx, o.store, a)
+	if err != nil {
+		RespondError(ctx, w, err)
+		return
+	}
+	defer rc.Close()
+
+	w.Header().Set("Content-Type", a.MediaType)
+	w.Header().Set("Content-Length", strconv.FormatInt(a.Size, 10))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": a.Name}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := io.Copy(w, rc); err != nil {
+		fmt.Printf("Unhandled error: %v\n", errors.Wrapf(err, "streaming attachment %s", a.Name))
+	}
+}
@@ -23,3 +23,10 @@ func (a *AuthHandler) CurrentlyLoggedIn(w http.ResponseWriter, r *http.Request)
 
 	Respond(ctx, w, u, http.StatusOK)
 }
+
+// currentUserID returns the id of the user making a request. It relies on the
+// authboss middleware having loaded the user into the request context.
+func currentUserID(r *http.Request) string {
+	pid, _ := r.Context().Value(authboss.CTXKeyPID).(string)
+	return pid
+}
@@ -1,16 +1,14 @@
 package handlers
 
 import (
+	"context"
 	"net/http"
-
-	"github.com/schafer14/obs/internal/platform/database"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
 // Check provides support for orchestration health checks.
 type Check struct {
 	build   string
-	db      *mongo.Database
+	health  func(ctx context.Context) error
 	version string
 }
 
@@ -28,15 +26,17 @@ func (c *Check) Health(w http.ResponseWriter, r *http.Request) {
 		Version: c.version,
 	}
 
-	// Check if the database is ready.
-	if err := database.Check(ctx, c.db.Client()); err != nil {
-
-		// If the database is not ready we will tell the client and use a 500
-		// status. Do not respond by just returning an error because further up in
-		// the call stack will interpret that as an unhandled error.
-		health.Status = "db not ready"
-		Respond(ctx, w, health, http.StatusInternalServerError)
-		return
+	// Check if the database is ready. APIs without a database are always ready.
+	if c.health != nil {
+		if err := c.health(ctx); err != nil {
+
+			// If the database is not ready we will tell the client and use a 500
+			// status. Do not respond by just returning an error because further up in
+			// the call stack will interpret that as an unhandled error.
+			health.Status = "db not ready"
+			Respond(ctx, w, health, http.StatusInternalServerError)
+			return
+		}
 	}
 
 	health.Status = "ok"
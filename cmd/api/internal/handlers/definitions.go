@@ -2,13 +2,32 @@ package handlers
 
 import (
 	"net/http"
+	"sort"
 
 	"github.com/schafer14/obs/internal/definitions"
+	"github.com/schafer14/obs/internal/linkeddata"
 )
 
+// GetDefinitions handles an http request for the definitions of feature types,
+// properties and property types. They are described with the SOSA ontology
+// when the client accepts RDF.
 func GetDefinitions(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
+	if format, ok := linkedDataFormat(r); ok {
+		var g linkeddata.Graph
+		slugs := make([]string, 0, len(definitions.Data))
+		for slug := range definitions.Data {
+			slugs = append(slugs, slug)
+		}
+		sort.Strings(slugs)
+		for _, slug := range slugs {
+			g.FeatureType(definitions.Data[slug])
+		}
+		RespondGraph(ctx, w, format, &g, http.StatusOK)
+		return
+	}
+
 	Respond(ctx, w, definitions.Data, http.StatusOK)
 	return
 }
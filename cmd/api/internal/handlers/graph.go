@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/schafer14/obs/internal/graph"
+	"github.com/schafer14/obs/internal/observations"
+)
+
+// GraphHandler handles requests that traverse the graph of the features,
+// properties and processes of observations.
+type GraphHandler struct {
+	graph graph.Graph
+}
+
+// Features handles an http request for the features observed by the process
+// query parameter that also have observations of each property query
+// parameter. Properties may be repeated or separated by commas.
+func (h *GraphHandler) Features(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	values := r.URL.Query()
+
+	var properties []string
+	for _, property := range values["property"] {
+		for _, id := range strings.Split(property, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				properties = append(properties, id)
+			}
+		}
+	}
+
+	features, err := h.graph.Features(ctx, graph.Traversal{Process: strings.TrimSpace(values.Get("process")), Properties: properties})
+	if err != nil {
+		if vError, ok := err.(*observations.ValidationError); ok {
+			Respond(ctx, w, vError, http.StatusUnprocessableEntity)
+			return
+		}
+		RespondError(ctx, w, errors.Wrap(err, "traversing graph"))
+		return
+	}
+
+	Respond(ctx, w, features, http.StatusOK)
+}
@@ -1,17 +1,21 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"reflect"
+	"strconv"
 	"strings"
 
 	en "github.com/go-playground/locales/en"
 	ut "github.com/go-playground/universal-translator"
 	"github.com/pkg/errors"
+	"github.com/schafer14/obs/internal/linkeddata"
+	"github.com/volatiletech/authboss"
 	validator "gopkg.in/go-playground/validator.v9"
 	en_translations "gopkg.in/go-playground/validator.v9/translations/en"
 )
@@ -89,6 +93,126 @@ func DecodeAny(r io.Reader, val interface{}) error {
 	return nil
 }
 
+// flusher finds the flusher of a response writer. Authboss wraps responses in
+// a writer that keeps the client state and cannot flush, so the writer it
+// wraps is flushed instead once the client state has been written with the
+// header. False is returned when no writer can flush.
+func flusher(w http.ResponseWriter) (http.Flusher, bool) {
+	for {
+		if f, ok := w.(http.Flusher); ok {
+			return f, true
+		}
+		u, ok := w.(authboss.UnderlyingResponseWriter)
+		if !ok {
+			return nil, false
+		}
+		w = u.UnderlyingResponseWriter()
+	}
+}
+
+// mediaType returns the lower cased media type of a Content-Type header
+// without any parameters.
+func mediaType(contentType string) string {
+	s := strings.ToLower(strings.TrimSpace(contentType))
+	if i := strings.Index(s, ";"); i > -1 {
+		s = strings.TrimSpace(s[:i])
+	}
+	return s
+}
+
+// negotiate picks the media type in offers that an Accept header prefers. Media
+// types are preferred by their quality, and then by the order of offers, so the
+// first offer is picked when the header is empty or accepts anything. An empty
+// string is returned when none of the offers are acceptable.
+func negotiate(accept string, offers ...string) string {
+	if strings.TrimSpace(accept) == "" && len(offers) > 0 {
+		return offers[0]
+	}
+
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		q := 0.0
+		for _, rng := range strings.Split(accept, ",") {
+			if rq, ok := acceptQuality(rng, offer); ok && rq > q {
+				q = rq
+			}
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+
+	return best
+}
+
+// acceptQuality reports the quality a media range of an Accept header gives to
+// a media type, and whether the range matches the media type at all.
+func acceptQuality(rng, offer string) (float64, bool) {
+	params := strings.Split(rng, ";")
+	typ := mediaType(params[0])
+
+	matches := typ == offer || typ == "*/*" ||
+		(strings.HasSuffix(typ, "/*") && strings.HasPrefix(offer, strings.TrimSuffix(typ, "*")))
+	if !matches {
+		return 0, false
+	}
+
+	q := 1.0
+	for _, param := range params[1:] {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(kv) == 2 && strings.ToLower(kv[0]) == "q" {
+			if v, err := strconv.ParseFloat(kv[1], 64); err == nil {
+				q = v
+			}
+		}
+	}
+
+	return q, true
+}
+
+// linkedDataFormat finds the RDF serialization an Accept header prefers over
+// JSON. False is returned when JSON is preferred.
+func linkedDataFormat(r *http.Request) (linkeddata.Format, bool) {
+	offers := []string{"application/json"}
+	for _, format := range linkeddata.Formats {
+		offers = append(offers, format.MediaType)
+	}
+
+	mediaType := negotiate(r.Header.Get("Accept"), offers...)
+	for _, format := range linkeddata.Formats {
+		if format.MediaType == mediaType {
+			return format, true
+		}
+	}
+
+	return linkeddata.Format{}, false
+}
+
+// RespondGraph writes an RDF graph and sends it to the client.
+func RespondGraph(ctx context.Context, w http.ResponseWriter, format linkeddata.Format, g *linkeddata.Graph, statusCode int) {
+	var buf bytes.Buffer
+	if err := format.Write(&buf, g); err != nil {
+		RespondError(ctx, w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", format.MediaType)
+	w.WriteHeader(statusCode)
+	if _, err := buf.WriteTo(w); err != nil {
+		fmt.Printf("Unhandled error: %v\n", errors.Wrap(err, "writing graph"))
+	}
+}
+
+// baseURL is the scheme and host the client made a request to, which links
+// in responses are relative to.
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
 // RespondError sends an error response back to the client.
 func RespondError(ctx context.Context, w http.ResponseWriter, err error) {
 
@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/schafer14/obs/internal/idempotency"
+)
+
+// maxIdempotencyKey is the length of the longest Idempotency-Key accepted.
+const maxIdempotencyKey = 255
+
+// maxObservationBytes is the size allowed for each observation of a batch
+// when the body of a request is read before it is processed.
+const maxObservationBytes = 64 << 10
+
+// idempotent makes requests with an Idempotency-Key header safe to retry. The
+// response to the first request with a key is recorded for the window and
+// replayed to retries of the request. A different request with the same key
+// is rejected with 409 Conflict. Requests without the header are processed as
+// usual.
+//
+// Responses with a 5xx status are not recorded, so a request that failed may
+// be retried with the same key.
+//
+// The body of a request with the header is read to fingerprint it before the
+// request is processed, so bodies over maxBody bytes are rejected with 413
+// Request Entity Too Large. Requests with the header are rejected with 501 Not
+// Implemented when there is no repository of idempotency keys.
+func idempotent(repo idempotency.Repository, window time.Duration, maxBody int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+
+			key := r.Header.Get("Idempotency-Key")
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if repo == nil {
+				RespondError(ctx, w, Error{errors.New("Idempotency-Key is not supported by the database driver"), http.StatusNotImplemented, []FieldError{}})
+				return
+			}
+			if len(key) > maxIdempotencyKey {
+				err := fmt.Errorf("Idempotency-Key must be at most %d characters", maxIdempotencyKey)
+				RespondError(ctx, w, Error{err, http.StatusUnprocessableEntity, []FieldError{}})
+				return
+			}
+
+			body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBody))
+			if err != nil {
+				RespondError(ctx, w, Error{fmt.Errorf("request body must be at most %d bytes", maxBody), http.StatusRequestEntityTooLarge, []FieldError{}})
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+			user := currentUserID(r)
+			fingerprint := idempotency.Fingerprint(r.Method, r.URL.Path, r.URL.RawQuery, r.Header.Get("Content-Type"), body)
+			rec, claimed, err := repo.Begin(ctx, user, key, fingerprint, time.Now(), window)
+			switch {
+			case err == idempotency.ErrorConflict || err == idempotency.ErrorInProgress:
+				RespondError(ctx, w, Error{err, http.StatusConflict, []FieldError{}})
+				return
+			case err != nil:
+				RespondError(ctx, w, errors.Wrap(err, "claiming idempotency key"))
+				return
+			case !claimed:
+				replay(w, *rec.Response)
+				return
+			}
+
+			rw := &recorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rw, r)
+
+			// The client may have left, which is why it will retry, so the
+			// response is recorded even when the request is cancelled.
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			if rw.status >= http.StatusInternalServerError {
+				err = repo.Release(ctx, user, key)
+			} else {
+				err = repo.Complete(ctx, user, key, idempotency.Response{
+					Status:      rw.status,
+					ContentType: rw.Header().Get("Content-Type"),
+					Body:        rw.body.Bytes(),
+				})
+			}
+			if err != nil {
+				fmt.Printf("Unhandled error: %v\n", errors.Wrapf(err, "recording response to idempotency key %q", key))
+			}
+		})
+	}
+}
+
+// replay sends a recorded response. The Idempotent-Replayed header tells the
+// client the response was not made by processing the request again.
+func replay(w http.ResponseWriter, resp idempotency.Response) {
+	if resp.ContentType != "" {
+		w.Header().Set("Content-Type", resp.ContentType)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(resp.Status)
+	w.Write(resp.Body)
+}
+
+// recorder is a response writer that keeps a copy of the status and body of
+// the response it writes.
+type recorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+// WriteHeader records the status of the response.
+func (rw *recorder) WriteHeader(status int) {
+	if !rw.wroteHeader {
+		rw.status = status
+		rw.wroteHeader = true
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+// Write records the body of the response.
+func (rw *recorder) Write(b []byte) (int, error) {
+	rw.wroteHeader = true
+	rw.body.Write(b)
+	return rw.ResponseWriter.Write(b)
+}
@@ -1,21 +1,43 @@
 package handlers
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
 	"github.com/pkg/errors"
+	"github.com/schafer14/obs/internal/attachments"
 	"github.com/schafer14/obs/internal/definitions"
+	"github.com/schafer14/obs/internal/events"
+	"github.com/schafer14/obs/internal/export"
+	"github.com/schafer14/obs/internal/linkeddata"
 	"github.com/schafer14/obs/internal/observations"
-	"go.mongodb.org/mongo-driver/mongo"
+	"github.com/schafer14/obs/internal/omxml"
+	"github.com/schafer14/obs/internal/subscriptions"
 )
 
 type ObservationHandler struct {
-	db *mongo.Collection
+	db            observations.Repository
+	batchSize     int
+	exportTimeout time.Duration
+	broker        *subscriptions.Broker
+	publisher     events.Publisher
+
+	attachments    attachments.Repository
+	store          attachments.Store
+	attachmentSize int64
+
+	upgrader websocket.Upgrader
 }
 
 // Create handles an http request that creates a new observation.
@@ -39,61 +61,762 @@ func (o *ObservationHandler) Create(w http.ResponseWriter, r *http.Request) {
 		RespondError(ctx, w, errors.Wrap(err, "creating new observation"))
 		return
 	}
+	obs.ModifiedBy = currentUserID(r)
 
-	err = observations.Save(ctx, o.db, obs)
+	err = o.db.Save(ctx, obs)
 	if err != nil {
 		Respond(ctx, w, "unable to save observation", http.StatusInternalServerError)
 		return
 	}
+	o.broker.Notify()
+	o.publishCreated(ctx, now, obs)
 
 	Respond(ctx, w, obs, http.StatusCreated)
 }
 
+// BatchItem reports the outcome of creating a single observation in a batch.
+type BatchItem struct {
+	Index  int          `json:"index"`
+	ID     string       `json:"id,omitempty"`
+	Error  string       `json:"error,omitempty"`
+	Fields []FieldError `json:"fields,omitempty"`
+}
+
+// BatchReport reports the outcome of creating a batch of observations.
+type BatchReport struct {
+	Created int         `json:"created"`
+	Failed  int         `json:"failed"`
+	Items   []BatchItem `json:"items"`
+}
+
+// Batch handles an http request that creates many observations at once. The
+// body is either a JSON array or newline delimited JSON of new observations.
+// Valid observations are saved even when others in the batch are invalid.
+func (o *ObservationHandler) Batch(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	raws, err := decodeBatch(r, o.batchSize)
+	if err != nil {
+		RespondError(ctx, w, err)
+		return
+	}
+
+	report := BatchReport{Items: make([]BatchItem, len(raws))}
+	newObss := make([]observations.NewObservation, len(raws))
+	for i, raw := range raws {
+		report.Items[i].Index = i
+
+		if err := DecodeAny(bytes.NewReader(raw), &newObss[i]); err != nil {
+			report.Items[i].Error = err.Error()
+			if webErr, ok := err.(Error); ok {
+				report.Items[i].Fields = webErr.Fields
+			}
+		}
+	}
+
+	if err := o.saveBatch(r, newObss, &report); err != nil {
+		RespondError(ctx, w, err)
+		return
+	}
+
+	Respond(ctx, w, report, http.StatusOK)
+}
+
+// saveBatch creates and saves the observations of a batch and completes its
+// report. Items whose report already has an error could not be read and are
+// skipped. Valid observations are saved even when others are invalid.
+func (o *ObservationHandler) saveBatch(r *http.Request, newObss []observations.NewObservation, report *BatchReport) error {
+	now := time.Now()
+	var obss []observations.Observation
+	var indexes []int
+	for i, newObs := range newObss {
+		if report.Items[i].Error != "" {
+			continue
+		}
+
+		obs, err := observations.New(newObs, uuid.New().String(), now)
+		if err != nil {
+			report.Items[i].Error = err.Error()
+			if vError, ok := err.(*observations.ValidationError); ok {
+				report.Items[i].Error = vError.Err
+				for _, f := range vError.Fields {
+					report.Items[i].Fields = append(report.Items[i].Fields, FieldError{Field: f.Field, Error: f.Error})
+				}
+			}
+			continue
+		}
+		obs.ModifiedBy = currentUserID(r)
+
+		obss = append(obss, obs)
+		indexes = append(indexes, i)
+	}
+
+	failed, err := o.db.SaveMany(r.Context(), obss)
+	if err != nil {
+		return errors.Wrap(err, "saving observations")
+	}
+	if len(failed) < len(obss) {
+		o.broker.Notify()
+	}
+
+	var saved []observations.Observation
+	for j, obs := range obss {
+		i := indexes[j]
+		if err, ok := failed[j]; ok {
+			report.Items[i].Error = err.Error()
+			continue
+		}
+		report.Items[i].ID = obs.ID
+		saved = append(saved, obs)
+	}
+	o.publishCreated(r.Context(), now, saved...)
+
+	for _, item := range report.Items {
+		if item.ID == "" {
+			report.Failed++
+			continue
+		}
+		report.Created++
+	}
+
+	return nil
+}
+
+// ImportOMXML handles an http request that creates the observations of an
+// OGC Observations and Measurements XML document. The featureType and
+// propertyType query parameters are the feature and property type of
+// observations without featureType and propertyType parameters. Like a batch,
+// valid observations are saved even when others in the document are invalid,
+// and the report names the elements of each observation that could not be
+// read.
+func (o *ObservationHandler) ImportOMXML(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	opts := omxml.Options{
+		FeatureType:  r.URL.Query().Get("featureType"),
+		PropertyType: r.URL.Query().Get("propertyType"),
+		Limit:        o.batchSize,
+	}
+	items, err := omxml.Decode(r.Body, opts)
+	if err != nil {
+		if err == omxml.ErrTooManyObservations {
+			err = fmt.Errorf("document exceeds the limit of %d observations", o.batchSize)
+			RespondError(ctx, w, Error{err, http.StatusRequestEntityTooLarge, []FieldError{}})
+			return
+		}
+		RespondError(ctx, w, Error{err, http.StatusUnprocessableEntity, []FieldError{}})
+		return
+	}
+
+	report := BatchReport{Items: make([]BatchItem, len(items))}
+	newObss := make([]observations.NewObservation, len(items))
+	for i, item := range items {
+		report.Items[i].Index = i
+		newObss[i] = item.Observation
+
+		if len(item.Errors) > 0 {
+			report.Items[i].Error = "observation could not be read"
+			for _, f := range item.Errors {
+				report.Items[i].Fields = append(report.Items[i].Fields, FieldError{Field: f.Field, Error: f.Error})
+			}
+		}
+	}
+
+	if err := o.saveBatch(r, newObss, &report); err != nil {
+		RespondError(ctx, w, err)
+		return
+	}
+
+	Respond(ctx, w, report, http.StatusOK)
+}
+
+// publishCreated publishes an event for each observation that has been
+// created.
+func (o *ObservationHandler) publishCreated(ctx context.Context, now time.Time, obss ...observations.Observation) {
+	for _, obs := range obss {
+		o.publish(ctx, events.Created(obs, now))
+	}
+}
+
+// publish publishes an event about an observation, see publishEvent.
+func (o *ObservationHandler) publish(ctx context.Context, e events.Event) {
+	publishEvent(ctx, o.publisher, e)
+}
+
+// publishEvent publishes an event about an observation. The observation is
+// already saved, so an event that cannot be published does not fail the
+// request. Nothing is published without a publisher, as the events are then
+// relayed from where observations are stored, see events.Outbox.
+func publishEvent(ctx context.Context, p events.Publisher, e events.Event) {
+	if p == nil {
+		return
+	}
+	if err := p.Publish(ctx, e); err != nil {
+		fmt.Printf("Unhandled error: %v\n", errors.Wrapf(err, "publishing %s of observation %s", e.Type, e.Observation.ID))
+	}
+}
+
+// decodeBatch reads the items of a batch request without decoding them, so that
+// one malformed observation does not fail the whole batch. Requests with a
+// newline delimited JSON content type are read line by line, otherwise the
+// body must be a JSON array.
+func decodeBatch(r *http.Request, limit int) ([]json.RawMessage, error) {
+	tooLarge := Error{fmt.Errorf("batch exceeds the limit of %d observations", limit), http.StatusRequestEntityTooLarge, []FieldError{}}
+
+	var raws []json.RawMessage
+	switch mediaType(r.Header.Get("Content-Type")) {
+	case "application/x-ndjson", "application/ndjson":
+		scanner := bufio.NewScanner(r.Body)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			if len(raws) == limit {
+				return nil, tooLarge
+			}
+			raws = append(raws, json.RawMessage(append([]byte{}, line...)))
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, Error{fmt.Errorf("Unable to process ndjson request body"), http.StatusUnprocessableEntity, []FieldError{}}
+		}
+
+	default:
+		// The array is read an item at a time, so a batch over the limit is
+		// rejected without reading the rest of it.
+		invalid := Error{fmt.Errorf("Unable to process json request body"), http.StatusUnprocessableEntity, []FieldError{}}
+		dec := json.NewDecoder(r.Body)
+		if t, err := dec.Token(); err != nil || t != json.Delim('[') {
+			return nil, invalid
+		}
+		for dec.More() {
+			if len(raws) == limit {
+				return nil, tooLarge
+			}
+			var raw json.RawMessage
+			if err := dec.Decode(&raw); err != nil {
+				return nil, invalid
+			}
+			raws = append(raws, raw)
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, invalid
+		}
+	}
+
+	return raws, nil
+}
+
+// Update handles an http request that replaces an observation with a new revision.
+func (o *ObservationHandler) Update(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	prev, ok := o.find(w, r)
+	if !ok {
+		return
+	}
+
+	var newObs observations.NewObservation
+	if err := Decode(r, &newObs); err != nil {
+		RespondError(ctx, w, err)
+		return
+	}
+
+	o.revise(w, r, prev, newObs)
+}
+
+// Patch handles an http request that amends some fields of an observation in a
+// new revision. Fields that are not in the request keep their current value.
+// Keys of the result and tags are merged into the current result and tags,
+// and keys set to null are removed from them, as in a JSON merge patch.
+func (o *ObservationHandler) Patch(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	prev, ok := o.find(w, r)
+	if !ok {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		RespondError(ctx, w, Error{errors.Wrap(err, "reading request"), http.StatusBadRequest, []FieldError{}})
+		return
+	}
+
+	newObs := prev.AsNew()
+	if err := DecodeAny(bytes.NewReader(body), &newObs); err != nil {
+		RespondError(ctx, w, err)
+		return
+	}
+	for k, v := range newObs.Result {
+		if v == nil {
+			delete(newObs.Result, k)
+		}
+	}
+
+	// Tags are strings, so a tag set to null is decoded as an empty tag.
+	// The tags set to null are found in the body instead.
+	var removed struct {
+		Tags map[string]*string `json:"tags"`
+	}
+	if err := json.Unmarshal(body, &removed); err == nil {
+		for k, v := range removed.Tags {
+			if v == nil {
+				delete(newObs.Tags, k)
+			}
+		}
+	}
+
+	o.revise(w, r, prev, newObs)
+}
+
+// History handles an http request for every revision of an observation.
+func (o *ObservationHandler) History(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	id := chi.URLParam(r, "id")
+
+	revisions, err := o.db.History(ctx, id)
+	if err != nil {
+		if err == observations.ErrorNotFound {
+			Respond(ctx, w, map[string]string{"error": "observation not found"}, http.StatusNotFound)
+			return
+		}
+		RespondError(ctx, w, errors.Wrap(err, "fetching observation history"))
+		return
+	}
+
+	Respond(ctx, w, revisions, http.StatusOK)
+}
+
+// find fetches the observation identified in the url of a request. If the
+// observation cannot be fetched an error is sent to the client.
+func (o *ObservationHandler) find(w http.ResponseWriter, r *http.Request) (observations.Observation, bool) {
+	ctx := r.Context()
+
+	id := chi.URLParam(r, "id")
+
+	obs, err := o.db.Find(ctx, id)
+	if err != nil {
+		if err == observations.ErrorNotFound {
+			Respond(ctx, w, map[string]string{"error": "observation not found"}, http.StatusNotFound)
+			return obs, false
+		}
+		RespondError(ctx, w, errors.Wrap(err, "fetching observation"))
+		return obs, false
+	}
+
+	return obs, true
+}
+
+// revise saves a new revision of an observation and sends it to the client.
+// It reports whether the revision was saved.
+func (o *ObservationHandler) revise(w http.ResponseWriter, r *http.Request, prev observations.Observation, newObs observations.NewObservation) bool {
+	ctx := r.Context()
+
+	obs, err := observations.Revise(prev, newObs, currentUserID(r), time.Now())
+	if err != nil {
+		if vError, ok := err.(*observations.ValidationError); ok {
+			Respond(ctx, w, vError, http.StatusUnprocessableEntity)
+			return false
+		}
+		RespondError(ctx, w, errors.Wrap(err, "revising observation"))
+		return false
+	}
+
+	err = o.db.Supersede(ctx, obs)
+	if err != nil {
+		if err == observations.ErrorConflict {
+			Respond(ctx, w, map[string]string{"error": "observation has been modified"}, http.StatusConflict)
+			return false
+		}
+		RespondError(ctx, w, errors.Wrap(err, "saving observation revision"))
+		return false
+	}
+	o.broker.Notify()
+	o.publish(ctx, events.Revised(obs, obs.ModifiedAt))
+
+	Respond(ctx, w, obs, http.StatusOK)
+	return true
+}
+
 type SearchParams struct {
-	Filters []observations.Filter `json:"filters" validate:"omitempty,dive"`
+	Filters        []observations.Filter    `json:"filters" validate:"omitempty,dive"`
+	Where          *observations.Expression `json:"where" validate:"-"`
+	ValidAt        string                   `json:"validAt" validate:"-"`
+	ValidDuring    string                   `json:"validDuring" validate:"-"`
+	PhenomenonTime string                   `json:"phenomenonTime" validate:"-"`
+	Sort           []string                 `json:"sort" validate:"-"`
+	Limit          int                      `json:"limit" validate:"omitempty,min=1,max=1000"`
+	Cursor         string                   `json:"cursor"`
+	Unit           string                   `json:"unit"`
 }
 
-// Get handles an http request for listing observations.
+// Get handles an http request for listing observations. A page of observations
+// is returned, and when there are more observations the cursor for the next
+// page is sent in the X-Next-Cursor header and as a Link header.
+//
+// When the request asks for an export format, with the format query parameter
+// or the Accept header, every matching observation is exported instead.
 func (o *ObservationHandler) Get(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
-	var filters SearchParams
-	qs := r.URL.Query().Get("q")
-	if err := DecodeAny(strings.NewReader(qs), &filters); err != nil && r.ContentLength > 0 {
+	q, err := searchQuery(r)
+	if err != nil {
 		RespondError(ctx, w, err)
 		return
 	}
 
-	obs, err := observations.Get(ctx, o.db, filters.Filters...)
+	format, ok, err := exportFormat(r)
 	if err != nil {
+		RespondError(ctx, w, err)
+		return
+	}
+	if ok {
+		o.export(w, r, q, format)
+		return
+	}
+
+	page, err := o.db.Get(ctx, q)
+	if err != nil {
+		if vError, ok := err.(*observations.ValidationError); ok {
+			Respond(ctx, w, vError, http.StatusUnprocessableEntity)
+			return
+		}
 		RespondError(ctx, w, errors.Wrap(err, "fetching observations"))
 		return
 	}
 
+	obs := page.Observations
 	if obs == nil {
 		obs = []observations.Observation{}
 	}
 
+	if page.Next != "" {
+		next := *r.URL
+		values := next.Query()
+		values.Set("cursor", page.Next)
+		next.RawQuery = values.Encode()
+
+		w.Header().Set("X-Next-Cursor", page.Next)
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, next.RequestURI()))
+	}
+
+	if format, ok := linkedDataFormat(r); ok {
+		var g linkeddata.Graph
+		for _, ob := range obs {
+			g.Observation(ob, baseURL(r)+"/v1/observations")
+		}
+		RespondGraph(ctx, w, format, &g, http.StatusOK)
+		return
+	}
+
 	Respond(ctx, w, obs, http.StatusOK)
 }
 
-// Find handles an http request for finding a single observation.
-func (o *ObservationHandler) Find(w http.ResponseWriter, r *http.Request) {
+// exportFormat finds the export format a request asks for. The format query
+// parameter is one of json, csv, geojson, ndjson or omxml and takes precedence over
+// the Accept header. False is returned when observations should be listed as
+// JSON pages.
+func exportFormat(r *http.Request) (export.Format, bool, error) {
+	if name := r.URL.Query().Get("format"); name != "" {
+		if name == "json" {
+			return export.Format{}, false, nil
+		}
+		format, ok := export.Lookup(name)
+		if !ok {
+			err := fmt.Errorf("format must be one of json, csv, geojson, ndjson or omxml")
+			return export.Format{}, false, Error{err, http.StatusUnprocessableEntity, []FieldError{}}
+		}
+		return format, true, nil
+	}
+
+	offers := []string{"application/json"}
+	for _, format := range export.Formats {
+		offers = append(offers, format.MediaType)
+	}
+	offers = append(offers, "application/ndjson")
+
+	switch mediaType := negotiate(r.Header.Get("Accept"), offers...); mediaType {
+	case "", "application/json":
+		return export.Format{}, false, nil
+	case "application/ndjson":
+		return export.NDJSON, true, nil
+	default:
+		for _, format := range export.Formats {
+			if format.MediaType == mediaType {
+				return format, true, nil
+			}
+		}
+		return export.Format{}, false, nil
+	}
+}
+
+// export streams every observation matching a query in an export format. The
+// observations are written as they are read from the database, so exports
+// are not paged. CSV exports read the observations twice, first to find the
+// columns of their results and tags and then to write them. Cells of CSV
+// exports that spreadsheets would evaluate as formulas, those starting with
+// =, +, -, @, a tab or a carriage return, are prefixed with a quote so they
+// are opened as text.
+func (o *ObservationHandler) export(w http.ResponseWriter, r *http.Request, q observations.Query, format export.Format) {
 	ctx := r.Context()
+	if o.exportTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.exportTimeout)
+		defer cancel()
+	}
 
-	id := chi.URLParam(r, "id")
+	if err := q.Validate(); err != nil {
+		if vError, ok := err.(*observations.ValidationError); ok {
+			Respond(ctx, w, vError, http.StatusUnprocessableEntity)
+			return
+		}
+		RespondError(ctx, w, err)
+		return
+	}
+
+	// Scales are checked before the response starts, as an observation that
+	// cannot be converted could not be reported once it has.
+	if err := o.db.Convertible(ctx, q); err != nil {
+		if vError, ok := err.(*observations.ValidationError); ok {
+			Respond(ctx, w, vError, http.StatusUnprocessableEntity)
+			return
+		}
+		RespondError(ctx, w, errors.Wrap(err, "checking scales"))
+		return
+	}
+
+	var enc export.Encoder
+	switch format {
+	case export.CSV:
+		columns := export.NewColumns()
+		if err := o.db.Stream(ctx, q, columns.Add); err != nil {
+			if err == export.ErrTooManyColumns {
+				RespondError(ctx, w, Error{err, http.StatusUnprocessableEntity, []FieldError{}})
+				return
+			}
+			RespondError(ctx, w, errors.Wrap(err, "finding export columns"))
+			return
+		}
+		enc = export.NewCSV(w, columns)
+	case export.GeoJSON:
+		enc = export.NewGeoJSON(w)
+	case export.OMXML:
+		enc = omxml.NewEncoder(w)
+	default:
+		enc = export.NewNDJSON(w)
+	}
+
+	w.Header().Set("Content-Type", format.MediaType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="observations.%s"`, format.Extension))
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := flusher(w)
+	exported := 0
+	err := o.db.Stream(ctx, q, func(obs observations.Observation) error {
+		if err := enc.Encode(obs); err != nil {
+			return err
+		}
+		exported++
+		if flusher != nil && exported%100 == 0 {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = enc.Close()
+	}
 
-	obs, err := observations.Find(ctx, o.db, id)
 	if err != nil {
-		if err == observations.ErrorNotFound {
-			Respond(ctx, w, map[string]string{"error": "observation not found"}, http.StatusNotFound)
+		// The response has started so the error cannot be sent. The
+		// connection is closed instead so the client sees the export is
+		// incomplete rather than a truncated file that looks complete.
+		fmt.Printf("Unhandled error: %v\n", errors.Wrap(err, "exporting observations"))
+		abort(w)
+	}
+}
+
+// abort closes the connection of a response that has already started.
+func abort(w http.ResponseWriter) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return
+	}
+
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	conn.Close()
+}
+
+// Aggregate handles an http request for statistics over the results of
+// observations. The observations are searched for with the same parameters
+// as Get. The field, bucket and comma separated functions query parameters
+// describe the statistics to compute.
+func (o *ObservationHandler) Aggregate(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	q, err := searchQuery(r)
+	if err != nil {
+		RespondError(ctx, w, err)
+		return
+	}
+
+	values := r.URL.Query()
+	a := observations.Aggregation{
+		Query:  q,
+		Field:  values.Get("field"),
+		Bucket: values.Get("bucket"),
+	}
+	if functions := values.Get("functions"); functions != "" {
+		a.Functions = strings.Split(functions, ",")
+	}
+
+	series, err := o.db.Aggregate(ctx, a)
+	if err != nil {
+		if vError, ok := err.(*observations.ValidationError); ok {
+			Respond(ctx, w, vError, http.StatusUnprocessableEntity)
 			return
 		}
-		RespondError(ctx, w, errors.Wrap(err, "fetching observation"))
+		RespondError(ctx, w, errors.Wrap(err, "aggregating observations"))
 		return
 	}
 
-	Respond(ctx, w, obs, http.StatusOK)
+	Respond(ctx, w, series, http.StatusOK)
+}
+
+// Latest handles an http request for the most recent observation of each
+// property of some features. Features are given as comma separated ids in
+// the feature query parameter, which may be repeated. The optional asOf
+// query parameter is an RFC3339 time to find the observations known then.
+func (o *ObservationHandler) Latest(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	values := r.URL.Query()
+
+	var features []string
+	for _, feature := range values["feature"] {
+		for _, id := range strings.Split(feature, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				features = append(features, id)
+			}
+		}
+	}
+
+	var asOf time.Time
+	if t := values.Get("asOf"); t != "" {
+		var err error
+		if asOf, err = time.Parse(time.RFC3339Nano, t); err != nil {
+			err := fmt.Errorf("asOf must be an RFC3339 time")
+			RespondError(ctx, w, Error{err, http.StatusUnprocessableEntity, []FieldError{}})
+			return
+		}
+	}
+
+	obss, err := o.db.Latest(ctx, features, asOf)
+	if err != nil {
+		if vError, ok := err.(*observations.ValidationError); ok {
+			Respond(ctx, w, vError, http.StatusUnprocessableEntity)
+			return
+		}
+		RespondError(ctx, w, errors.Wrap(err, "fetching latest observations"))
+		return
+	}
+
+	Respond(ctx, w, obss, http.StatusOK)
+}
+
+// searchQuery reads the search parameters of a request. The parameters are a
+// JSON document in the q query parameter. The time periods, sort order, limit,
+// cursor and unit may also be given as their own query parameters, so the next
+// page of a search can be requested by only changing the cursor.
+func searchQuery(r *http.Request) (observations.Query, error) {
+	var params SearchParams
+
+	values := r.URL.Query()
+	if qs := values.Get("q"); qs != "" {
+		if err := DecodeAny(strings.NewReader(qs), &params); err != nil {
+			return observations.Query{}, err
+		}
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > observations.MaxLimit {
+			err := fmt.Errorf("limit must be a number between 1 and %d", observations.MaxLimit)
+			return observations.Query{}, Error{err, http.StatusUnprocessableEntity, []FieldError{}}
+		}
+		params.Limit = n
+	}
+
+	for name, param := range map[string]*string{
+		"validAt":        &params.ValidAt,
+		"validDuring":    &params.ValidDuring,
+		"phenomenonTime": &params.PhenomenonTime,
+		"unit":           &params.Unit,
+	} {
+		if v := values.Get(name); v != "" {
+			*param = v
+		}
+	}
+
+	if sort := values.Get("sort"); sort != "" {
+		params.Sort = strings.Split(sort, ",")
+	}
+
+	if cursor := values.Get("cursor"); cursor != "" {
+		params.Cursor = cursor
+	}
+
+	return observations.Query{
+		Filters:        params.Filters,
+		Where:          params.Where,
+		ValidAt:        params.ValidAt,
+		ValidDuring:    params.ValidDuring,
+		PhenomenonTime: params.PhenomenonTime,
+		Sort:           params.Sort,
+		Limit:          params.Limit,
+		Cursor:         params.Cursor,
+		Unit:           params.Unit,
+	}, nil
+}
+
+// Find handles an http request for finding a single observation.
+func (o *ObservationHandler) Find(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	obs, ok := o.find(w, r)
+	if !ok {
+		return
+	}
+
+	if format, ok := linkedDataFormat(r); ok {
+		var g linkeddata.Graph
+		g.Observation(obs, baseURL(r)+"/v1/observations")
+		RespondGraph(ctx, w, format, &g, http.StatusOK)
+		return
+	}
+
+	// Observations are JSON unless XML is preferred, including when the
+	// Accept header matches neither.
+	switch negotiate(r.Header.Get("Accept"), "application/json", omxml.MediaType, "text/xml") {
+	case omxml.MediaType, "text/xml":
+		data, err := omxml.Marshal(obs)
+		if err != nil {
+			RespondError(ctx, w, errors.Wrap(err, "encoding observation"))
+			return
+		}
+		w.Header().Set("Content-Type", omxml.MediaType)
+		w.WriteHeader(http.StatusOK)
+		if _, err := w.Write(data); err != nil {
+			fmt.Printf("Unhandled error: %v\n", errors.Wrap(err, "writing observation"))
+		}
+	default:
+		Respond(ctx, w, obs, http.StatusOK)
+	}
 }
 
 // Generic makes an observation on a specific type based from the Definitions data store.
@@ -168,12 +891,15 @@ func (o *ObservationHandler) Generic(featureTypeSlug string) func(w http.Respons
 			RespondError(ctx, w, errors.Wrap(err, "creating new observation"))
 			return
 		}
+		obs.ModifiedBy = currentUserID(r)
 
-		err = observations.Save(ctx, o.db, obs)
+		err = o.db.Save(ctx, obs)
 		if err != nil {
 			Respond(ctx, w, "unable to save observation", http.StatusInternalServerError)
 			return
 		}
+		o.broker.Notify()
+		o.publishCreated(ctx, now, obs)
 
 		Respond(ctx, w, obs, http.StatusOK)
 		return
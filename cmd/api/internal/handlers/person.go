@@ -8,11 +8,10 @@ import (
 	"github.com/pkg/errors"
 	"github.com/schafer14/obs/internal/observations"
 	"github.com/schafer14/obs/internal/people"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
 type PersonHandler struct {
-	personCollection *mongo.Collection
+	people people.Repository
 }
 
 func (p *PersonHandler) Create(w http.ResponseWriter, r *http.Request) {
@@ -35,7 +34,7 @@ func (p *PersonHandler) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = people.Save(ctx, p.personCollection, person)
+	err = p.people.Save(ctx, person)
 	if err != nil {
 		Respond(ctx, w, "unable to save observation", http.StatusInternalServerError)
 		return
@@ -48,7 +47,7 @@ func (p *PersonHandler) Create(w http.ResponseWriter, r *http.Request) {
 func (p *PersonHandler) Get(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
-	persons, err := people.Get(ctx, p.personCollection)
+	persons, err := p.people.Get(ctx)
 	if err != nil {
 		RespondError(ctx, w, errors.Wrap(err, "fetching people"))
 		return
@@ -67,9 +66,9 @@ func (p *PersonHandler) Find(w http.ResponseWriter, r *http.Request) {
 
 	id := chi.URLParam(r, "id")
 
-	person, err := people.Find(ctx, p.personCollection, id)
+	person, err := p.people.Find(ctx, id)
 	if err != nil {
-		if err == observations.ErrorNotFound {
+		if err == people.ErrorNotFound {
 			Respond(ctx, w, map[string]string{"error": "person not found"}, http.StatusNotFound)
 			return
 		}
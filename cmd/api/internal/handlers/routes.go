@@ -1,51 +1,125 @@
 package handlers
 
 import (
+	"context"
+	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/cors"
-	"github.com/gorilla/context"
+	gcontext "github.com/gorilla/context"
+	"github.com/schafer14/obs/internal/attachments"
+	"github.com/schafer14/obs/internal/events"
+	"github.com/schafer14/obs/internal/graph"
+	"github.com/schafer14/obs/internal/idempotency"
+	"github.com/schafer14/obs/internal/observations"
+	"github.com/schafer14/obs/internal/people"
+	"github.com/schafer14/obs/internal/subscriptions"
+	"github.com/schafer14/obs/internal/webhooks"
 	"github.com/volatiletech/authboss"
 	"github.com/volatiletech/authboss/confirm"
 	"github.com/volatiletech/authboss/expire"
 	"github.com/volatiletech/authboss/lock"
 	"github.com/volatiletech/authboss/remember"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
-type Collections struct {
-	Observations string
-	People       string
+// Repositories are where the API keeps its data. Each may be backed by mongo
+// or held in memory, so the API can run without a database. Users are kept
+// in the server storer of authboss.
+//
+// Created and revised observations are published to Events. Events is nil
+// when the events of observations are relayed from where they are stored, see
+// events.Outbox. Health checks the storage is ready to accept requests,
+// and is not called when it is nil. Graph is traversed for the relationships
+// between observations, and its routes are left out when it is nil.
+//
+// Webhooks, Attachments and Idempotency are nil when the storage cannot keep
+// them. Their routes, and requests with an Idempotency-Key, are then answered
+// with 501 Not Implemented rather than kept where they would be lost.
+type Repositories struct {
+	Observations observations.Repository
+	People       people.Repository
+	Webhooks     webhooks.Repository
+	Attachments  attachments.Repository
+	Idempotency  idempotency.Repository
+	Store        attachments.Store
+	Events       events.Publisher
+	Graph        graph.Graph
+	Health       func(ctx context.Context) error
 }
 
-func API(build string, db *mongo.Database, ab *authboss.Authboss, cfg Collections, corsMid *cors.Cors, version string) chi.Router {
+// Limits restricts the size of requests the API will process. Responses to
+// requests with an Idempotency-Key are replayed for the IdempotencyWindow.
+// WebSocket subscriptions are only accepted from the same origin as the API
+// or from one of the AllowedOrigins, which are the origins allowed by CORS.
+type Limits struct {
+	BatchSize         int
+	ExportTimeout     time.Duration
+	AttachmentSize    int64
+	IdempotencyWindow time.Duration
+	AllowedOrigins    []string
+}
+
+// importTimeout limits requests that save a batch of observations. A full
+// batch takes longer than the request timeout to read and save.
+const importTimeout = 30 * time.Second
+
+// bodySize is the largest body of a request that is read whole before it is
+// processed, which is a batch of the largest observations.
+func (l Limits) bodySize() int64 {
+	size := int64(l.BatchSize) * maxObservationBytes
+	if size < maxEntityBytes {
+		return maxEntityBytes
+	}
+	return size
+}
+
+// API creates the routes of the API. Subscriptions are woken through the
+// broker when observations are saved, and end when it is closed.
+func API(build string, repos Repositories, broker *subscriptions.Broker, ab *authboss.Authboss, limits Limits, corsMid *cors.Cors, version string) chi.Router {
 	r := chi.NewRouter()
 
 	// Middleware
-	r.Use(context.ClearHandler)
+	r.Use(gcontext.ClearHandler)
 	r.Use(middleware.RequestID)
 	r.Use(middleware.RealIP)
 	r.Use(middleware.Logger)
-	r.Use(middleware.AllowContentType("application/json"))
-	r.Use(middleware.Throttle(50))
+	r.Use(middleware.AllowContentType("application/json", "application/x-ndjson", "application/ndjson", "application/xml", "text/xml", "multipart/form-data"))
+	r.Use(unless(subscribing, middleware.Throttle(50)))
 	r.Use(corsMid.Handler)
-	r.Use(middleware.Timeout(time.Second))
+	r.Use(unless(streaming, middleware.Timeout(time.Second)))
 	r.Use(middleware.Compress(5))
 	r.Use(middleware.Recoverer)
 	r.Use(ab.LoadClientStateMiddleware)
 	r.Use(remember.Middleware(ab))
 
-	// Define collections that will be used
-	obsColl := db.Collection(cfg.Observations)
-	personColl := db.Collection(cfg.People)
 	// Define handlers
 	authHandler := AuthHandler{ab}
-	checkHandler := Check{build, db, version}
-	oHandler := &ObservationHandler{obsColl}
-	personHandler := &PersonHandler{personColl}
+	checkHandler := Check{build, repos.Health, version}
+	oHandler := &ObservationHandler{
+		db:             repos.Observations,
+		batchSize:      limits.BatchSize,
+		exportTimeout:  limits.ExportTimeout,
+		broker:         broker,
+		publisher:      repos.Events,
+		attachments:    repos.Attachments,
+		store:          repos.Store,
+		attachmentSize: limits.AttachmentSize,
+		upgrader:       newUpgrader(limits.AllowedOrigins),
+	}
+	personHandler := &PersonHandler{repos.People}
+	stHandler := &SensorThingsHandler{db: repos.Observations, broker: broker, publisher: repos.Events}
+	webhookHandler := &WebhookHandler{repos.Webhooks}
+	graphHandler := &GraphHandler{repos.Graph}
+	idempotentCreate := idempotent(repos.Idempotency, limits.IdempotencyWindow, limits.bodySize())
+
+	attach, listAttachments, attachment := oHandler.Attach, oHandler.Attachments, oHandler.Attachment
+	if repos.Attachments == nil {
+		attach, listAttachments, attachment = unsupported("attachments"), unsupported("attachments"), unsupported("attachments")
+	}
 
 	// ======================================
 	// Protected routes
@@ -62,10 +136,49 @@ func API(build string, db *mongo.Database, ab *authboss.Authboss, cfg Collection
 		// Generic observation handler
 		r.Route("/v1/observations", func(r chi.Router) {
 			r.Get("/", oHandler.Get)
+			r.Get("/aggregate", oHandler.Aggregate)
+			r.Get("/latest", oHandler.Latest)
+			r.Get("/subscribe", oHandler.Subscribe)
 			r.Get("/{id}", oHandler.Find)
-			r.Post("/", oHandler.Create)
+			r.Get("/{id}/history", oHandler.History)
+			r.Get("/{id}/attachments", listAttachments)
+			r.Get("/{id}/attachments/{name}", attachment)
+			r.Post("/{id}/attachments", attach)
+			r.With(idempotentCreate).Post("/", oHandler.Create)
+			r.With(middleware.Timeout(importTimeout), idempotentCreate).Post("/batch", oHandler.Batch)
+			r.With(middleware.Timeout(importTimeout), idempotentCreate).Post("/omxml", oHandler.ImportOMXML)
+			r.Put("/{id}", oHandler.Update)
+			r.Patch("/{id}", oHandler.Patch)
 		})
 
+		// SensorThings API over observations
+		r.Route("/v1.1", func(r chi.Router) {
+			r.Get("/", stHandler.Root)
+			r.Get("/*", stHandler.Get)
+			r.Post("/*", stHandler.Create)
+			r.Patch("/*", stHandler.Update)
+		})
+
+		// Webhooks for observation events
+		if repos.Webhooks != nil {
+			r.Route("/v1/webhooks", func(r chi.Router) {
+				r.Get("/", webhookHandler.List)
+				r.Post("/", webhookHandler.Create)
+				r.Get("/{id}", webhookHandler.Find)
+				r.Delete("/{id}", webhookHandler.Delete)
+				r.Get("/{id}/deliveries", webhookHandler.Deliveries)
+			})
+		} else {
+			r.Handle("/v1/webhooks", unsupported("webhooks"))
+			r.Handle("/v1/webhooks/*", unsupported("webhooks"))
+		}
+
+		// Traversals of the features, properties and processes of
+		// observations
+		if repos.Graph != nil {
+			r.Get("/v1/graph/features", graphHandler.Features)
+		}
+
 		// Person router
 		r.Route("/v1/people", func(r chi.Router) {
 			r.Post("/", personHandler.Create)
@@ -100,3 +213,74 @@ func API(build string, db *mongo.Database, ab *authboss.Authboss, cfg Collection
 
 	return r
 }
+
+// unless applies a middleware to every request except those skip reports true
+// for.
+func unless(skip func(*http.Request) bool, mw func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		wrapped := mw(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if skip(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			wrapped.ServeHTTP(w, r)
+		})
+	}
+}
+
+// unsupported answers requests for a feature the storage of the API cannot
+// keep with 501 Not Implemented.
+func unsupported(feature string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := fmt.Errorf("%s are not supported by the database driver", feature)
+		RespondError(r.Context(), w, Error{err, http.StatusNotImplemented, []FieldError{}})
+	}
+}
+
+// streaming reports whether a request streams its response, or otherwise may
+// take longer than the request timeout. These requests set their own timeout.
+func streaming(r *http.Request) bool {
+	if subscribing(r) || transferring(r) || aggregating(r) || importing(r) {
+		return true
+	}
+	if r.Method != http.MethodGet || strings.TrimSuffix(r.URL.Path, "/") != "/v1/observations" {
+		return false
+	}
+
+	_, ok, _ := exportFormat(r)
+	return ok
+}
+
+// aggregating reports whether a request aggregates observations. Aggregations
+// read every matching observation, so they are limited by the timeout of the
+// repository instead, which is 30 seconds in mongo and postgres.
+func aggregating(r *http.Request) bool {
+	return r.Method == http.MethodGet && strings.TrimSuffix(r.URL.Path, "/") == "/v1/observations/aggregate"
+}
+
+// importing reports whether a request saves a batch of observations, either
+// as JSON or as an OMXML document. Batches are limited by the import timeout
+// instead.
+func importing(r *http.Request) bool {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	return r.Method == http.MethodPost && (path == "/v1/observations/batch" || path == "/v1/observations/omxml")
+}
+
+// subscribing reports whether a request subscribes to observations.
+// Subscriptions stay open until the client leaves, so they are not limited by
+// the request timeout or counted towards the limit of concurrent requests.
+func subscribing(r *http.Request) bool {
+	return r.Method == http.MethodGet && strings.TrimSuffix(r.URL.Path, "/") == "/v1/observations/subscribe"
+}
+
+// transferring reports whether a request uploads or downloads an attachment.
+// Attachments may be large, so transfers are not limited by the request
+// timeout.
+func transferring(r *http.Request) bool {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 4 || parts[0] != "v1" || parts[1] != "observations" || parts[3] != "attachments" {
+		return false
+	}
+	return (r.Method == http.MethodPost && len(parts) == 4) || (r.Method == http.MethodGet && len(parts) == 5)
+}
@@ -0,0 +1,763 @@
+package handlers_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/cors"
+	"github.com/gorilla/websocket"
+	"github.com/schafer14/obs/cmd/api/internal/handlers"
+	"github.com/schafer14/obs/internal/attachments"
+	"github.com/schafer14/obs/internal/auth"
+	"github.com/schafer14/obs/internal/events"
+	"github.com/schafer14/obs/internal/graph"
+	"github.com/schafer14/obs/internal/idempotency"
+	"github.com/schafer14/obs/internal/observations"
+	"github.com/schafer14/obs/internal/people"
+	"github.com/schafer14/obs/internal/subscriptions"
+	"github.com/schafer14/obs/internal/webhooks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/volatiletech/authboss"
+	abclientstate "github.com/volatiletech/authboss-clientstate"
+	abrenderer "github.com/volatiletech/authboss-renderer"
+	"github.com/volatiletech/authboss/defaults"
+	"golang.org/x/crypto/bcrypt"
+
+	_ "github.com/volatiletech/authboss/auth"
+	_ "github.com/volatiletech/authboss/logout"
+)
+
+const newObservation = `{
+	"feature": {"id": "https://example.com/banners-garden"},
+	"featureType": {"id": "urn:example:garden"},
+	"property": {"id": "urn:example:health"},
+	"propertyType": {"id": "urn:example:scale-1-5"},
+	"process": {"id": "urn:example:measurement:by-eye"},
+	"result": {"wisteria": 5},
+	"scale": "{score}"
+}`
+
+func TestHealthWithoutADatabase(t *testing.T) {
+
+	// Arrange
+	api, _ := serve(t)
+	defer api.Close()
+
+	// Act
+	res, err := http.Get(api.URL + "/health")
+	require.Nil(t, err, "checking health")
+	defer res.Body.Close()
+
+	// Assert
+	assert.Equal(t, http.StatusOK, res.StatusCode, "api not healthy")
+}
+
+func TestObservationsWithoutADatabase(t *testing.T) {
+
+	// Arrange
+	api, client := serve(t)
+	defer api.Close()
+
+	// Act
+	created, createdBody := send(t, client, http.MethodPost, api.URL+"/v1/observations", newObservation, "first")
+	replayed, replayedBody := send(t, client, http.MethodPost, api.URL+"/v1/observations", newObservation, "first")
+	var obs observations.Observation
+	require.Nil(t, json.Unmarshal(createdBody, &obs), "decoding created observation")
+	other, _ := send(t, client, http.MethodPost, api.URL+"/v1/observations", strings.Replace(newObservation, "urn:example:health", "urn:example:yield", 1), "")
+	found, foundBody := send(t, client, http.MethodGet, api.URL+"/v1/observations/"+obs.ID, "", "")
+	q := url.QueryEscape(`{"filters": [{"path": "propertyId", "op": "=", "match": "urn:example:health"}]}`)
+	listed, listedBody := send(t, client, http.MethodGet, api.URL+"/v1/observations?q="+q, "", "")
+	missing, _ := send(t, client, http.MethodGet, api.URL+"/v1/observations/missing", "", "")
+
+	// Assert
+	assert.Equal(t, http.StatusCreated, created.StatusCode, "observation not created")
+	assert.Equal(t, http.StatusCreated, other.StatusCode, "other observation not created")
+	assert.Equal(t, "true", replayed.Header.Get("Idempotent-Replayed"), "retry not replayed")
+	assert.Equal(t, createdBody, replayedBody, "replayed response mismatch")
+
+	assert.Equal(t, http.StatusOK, found.StatusCode, "observation not found")
+	var got observations.Observation
+	require.Nil(t, json.Unmarshal(foundBody, &got), "decoding observation")
+	assert.Equal(t, obs.ID, got.ID, "observation mismatch")
+	assert.Equal(t, "user@example.com", got.ModifiedBy, "author not recorded")
+
+	assert.Equal(t, http.StatusOK, listed.StatusCode, "observations not listed")
+	var page []observations.Observation
+	require.Nil(t, json.Unmarshal(listedBody, &page), "decoding observations")
+	require.Equal(t, 1, len(page), "observations not filtered or retried observation saved twice")
+	assert.Equal(t, obs.ID, page[0].ID, "filtered observation mismatch")
+
+	assert.Equal(t, http.StatusNotFound, missing.StatusCode, "missing observation found")
+}
+
+func TestFilteringForZeroAndEmptyValuesWithoutADatabase(t *testing.T) {
+
+	// Arrange
+	api, client := serve(t)
+	defer api.Close()
+	created, _ := send(t, client, http.MethodPost, api.URL+"/v1/observations", strings.Replace(newObservation, `{"wisteria": 5}`, `{"wisteria": 0}`, 1), "")
+	require.Equal(t, http.StatusCreated, created.StatusCode, "observation not created")
+	search := func(filters string) (*http.Response, []byte) {
+		return send(t, client, http.MethodGet, api.URL+"/v1/observations?q="+url.QueryEscape(`{"filters": [`+filters+`]}`), "", "")
+	}
+
+	// Act
+	zero, zeroBody := search(`{"path": "result.wisteria", "op": "=", "match": 0}`)
+	empty, emptyBody := search(`{"path": "result.wisteria", "op": "=", "match": ""}`)
+	missing, _ := search(`{"path": "result.wisteria", "op": "="}`)
+	unknown, _ := search(`{"path": "result.wisteria", "op": "=", "match": 0, "value": 0}`)
+
+	// Assert
+	require.Equal(t, http.StatusOK, zero.StatusCode, "filter for zero rejected")
+	var page []observations.Observation
+	require.Nil(t, json.Unmarshal(zeroBody, &page), "decoding observations")
+	assert.Equal(t, 1, len(page), "observation with zero not matched")
+
+	require.Equal(t, http.StatusOK, empty.StatusCode, "filter for an empty value rejected")
+	require.Nil(t, json.Unmarshal(emptyBody, &page), "decoding observations")
+	assert.Equal(t, 0, len(page), "observation with zero matched as empty")
+
+	assert.Equal(t, http.StatusUnprocessableEntity, missing.StatusCode, "filter without a match accepted")
+	assert.Equal(t, http.StatusUnprocessableEntity, unknown.StatusCode, "filter with an unknown field accepted")
+}
+
+func TestPeopleWithoutADatabase(t *testing.T) {
+
+	// Arrange
+	api, client := serve(t)
+	defer api.Close()
+
+	// Act
+	created, createdBody := send(t, client, http.MethodPost, api.URL+"/v1/people", `{"name": "Banner", "email": "banner@example.com"}`, "")
+	var person people.Person
+	require.Nil(t, json.Unmarshal(createdBody, &person), "decoding created person")
+	found, foundBody := send(t, client, http.MethodGet, api.URL+"/v1/people/"+person.ID, "", "")
+	missing, _ := send(t, client, http.MethodGet, api.URL+"/v1/people/missing", "", "")
+
+	// Assert
+	assert.Equal(t, http.StatusCreated, created.StatusCode, "person not created")
+	assert.Equal(t, http.StatusOK, found.StatusCode, "person not found")
+	assert.Equal(t, createdBody, foundBody, "person mismatch")
+	assert.Equal(t, http.StatusNotFound, missing.StatusCode, "missing person found")
+}
+
+func TestGraphWithoutADatabase(t *testing.T) {
+
+	// Arrange
+	api, client := serve(t)
+	defer api.Close()
+	created, _ := send(t, client, http.MethodPost, api.URL+"/v1/observations", newObservation, "")
+	require.Equal(t, http.StatusCreated, created.StatusCode, "observation not created")
+
+	// Act
+	query := "?process=" + url.QueryEscape("urn:example:measurement:by-eye") + "&property=" + url.QueryEscape("urn:example:health")
+	traversed, traversedBody := send(t, client, http.MethodGet, api.URL+"/v1/graph/features"+query, "", "")
+	invalid, _ := send(t, client, http.MethodGet, api.URL+"/v1/graph/features", "", "")
+
+	// Assert
+	assert.Equal(t, http.StatusOK, traversed.StatusCode, "graph not traversed")
+	var features []graph.Vertex
+	require.Nil(t, json.Unmarshal(traversedBody, &features), "decoding features")
+	require.Equal(t, 1, len(features), "observed feature not found")
+	assert.Equal(t, "https://example.com/banners-garden", features[0].ID, "feature mismatch")
+
+	assert.Equal(t, http.StatusUnprocessableEntity, invalid.StatusCode, "traversal without a start accepted")
+}
+
+func TestPatchingObservationsWithoutADatabase(t *testing.T) {
+
+	// Arrange
+	api, client := serve(t)
+	defer api.Close()
+	body := `{
+		"feature": {"id": "https://example.com/banners-garden"},
+		"featureType": {"id": "urn:example:garden"},
+		"property": {"id": "urn:example:health"},
+		"propertyType": {"id": "urn:example:scale-1-5"},
+		"process": {"id": "urn:example:measurement:by-eye"},
+		"result": {"wisteria": 5, "roses": 3},
+		"tags": {"season": "spring"}
+	}`
+	_, createdBody := send(t, client, http.MethodPost, api.URL+"/v1/observations", body, "")
+	var obs observations.Observation
+	require.Nil(t, json.Unmarshal(createdBody, &obs), "decoding created observation")
+
+	// Act
+	patched, patchedBody := send(t, client, http.MethodPatch, api.URL+"/v1/observations/"+obs.ID, `{"result": {"wisteria": 2, "roses": null}}`, "")
+	_, historyBody := send(t, client, http.MethodGet, api.URL+"/v1/observations/"+obs.ID+"/history", "", "")
+
+	// Assert
+	assert.Equal(t, http.StatusOK, patched.StatusCode, "observation not patched")
+	var revised observations.Observation
+	require.Nil(t, json.Unmarshal(patchedBody, &revised), "decoding patched observation")
+	assert.Equal(t, 2, revised.Revision, "revision not saved")
+	assert.Equal(t, []string{"result"}, revised.Changes, "changes mismatch")
+	assert.Equal(t, map[string]interface{}{"wisteria": float64(2)}, map[string]interface{}(revised.Result), "result not patched")
+	assert.Equal(t, map[string]string{"season": "spring"}, revised.Tags, "tags not kept")
+
+	var revisions []observations.Observation
+	require.Nil(t, json.Unmarshal(historyBody, &revisions), "decoding history")
+	require.Equal(t, 2, len(revisions), "revisions mismatch")
+	assert.Equal(t, map[string]interface{}{"wisteria": float64(5), "roses": float64(3)}, map[string]interface{}(revisions[0].Result), "previous revision changed")
+}
+
+func TestRemovingTagsWithAPatch(t *testing.T) {
+
+	// Arrange
+	api, client := serve(t)
+	defer api.Close()
+	body := strings.Replace(newObservation, `"scale"`, `"tags": {"season": "spring", "weather": "rain", "gardener": "banner"}, "scale"`, 1)
+	_, createdBody := send(t, client, http.MethodPost, api.URL+"/v1/observations", body, "")
+	var obs observations.Observation
+	require.Nil(t, json.Unmarshal(createdBody, &obs), "decoding created observation")
+
+	// Act
+	patched, patchedBody := send(t, client, http.MethodPatch, api.URL+"/v1/observations/"+obs.ID, `{"tags": {"season": "summer", "weather": null, "gardener": ""}}`, "")
+
+	// Assert
+	require.Equal(t, http.StatusOK, patched.StatusCode, "observation not patched")
+	var revised observations.Observation
+	require.Nil(t, json.Unmarshal(patchedBody, &revised), "decoding patched observation")
+	assert.Equal(t, map[string]string{"season": "summer", "gardener": ""}, revised.Tags, "tags not patched")
+	assert.Equal(t, []string{"tags"}, revised.Changes, "changes mismatch")
+}
+
+func TestPatchingObservationsWithALegacyScale(t *testing.T) {
+
+	// Arrange
+	repo := observations.NewMemory()
+	api, client := serveWith(t, handlers.Repositories{Observations: repo, People: people.NewMemory()})
+	defer api.Close()
+	var newObs observations.NewObservation
+	require.Nil(t, json.Unmarshal([]byte(newObservation), &newObs), "decoding observation")
+	obs, err := observations.New(newObs, "7c1e2d2e-91b5-4b43-9f0a-5d2b7c9a3b11", time.Now())
+	require.Nil(t, err, "creating observation")
+	obs.Scale = "out of five"
+	require.Nil(t, repo.Save(context.Background(), obs), "saving observation")
+
+	// Act
+	patched, patchedBody := send(t, client, http.MethodPatch, api.URL+"/v1/observations/"+obs.ID, `{"tags": {"season": "spring"}}`, "")
+
+	// Assert
+	require.Equal(t, http.StatusOK, patched.StatusCode, "observation with a legacy scale not patched")
+	var revised observations.Observation
+	require.Nil(t, json.Unmarshal(patchedBody, &revised), "decoding patched observation")
+	assert.Equal(t, "out of five", revised.Scale, "legacy scale not kept")
+}
+
+func TestFailedAttachmentsAreRemoved(t *testing.T) {
+
+	// Arrange
+	records := attachments.NewMemory()
+	api, client := serveWith(t, handlers.Repositories{
+		Observations: observations.NewMemory(),
+		People:       people.NewMemory(),
+		Attachments:  records,
+		Store:        attachments.NewMemoryStore(),
+	})
+	defer api.Close()
+	_, createdBody := send(t, client, http.MethodPost, api.URL+"/v1/observations", newObservation, "")
+	var obs observations.Observation
+	require.Nil(t, json.Unmarshal(createdBody, &obs), "decoding created observation")
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	photo, err := mw.CreateFormFile("photo", "photo.png")
+	require.Nil(t, err, "creating photo")
+	photo.Write([]byte("wisteria"))
+	large, err := mw.CreateFormFile("scan", "scan.bin")
+	require.Nil(t, err, "creating scan")
+	large.Write(make([]byte, 2048))
+	require.Nil(t, mw.Close(), "closing upload")
+
+	// Act
+	req, err := http.NewRequest(http.MethodPost, api.URL+"/v1/observations/"+obs.ID+"/attachments", &body)
+	require.Nil(t, err, "creating request")
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	res, err := client.Do(req)
+	require.Nil(t, err, "uploading attachments")
+	res.Body.Close()
+
+	// Assert
+	assert.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode, "upload status mismatch")
+	as, err := records.List(context.Background(), obs.ID)
+	require.Nil(t, err, "listing attachments")
+	assert.Empty(t, as, "attachments of a failed upload kept")
+}
+
+func TestUploadingTooManyAttachments(t *testing.T) {
+
+	// Arrange
+	records := attachments.NewMemory()
+	api, client := serveWith(t, handlers.Repositories{
+		Observations: observations.NewMemory(),
+		People:       people.NewMemory(),
+		Attachments:  records,
+		Store:        attachments.NewMemoryStore(),
+	})
+	defer api.Close()
+	_, createdBody := send(t, client, http.MethodPost, api.URL+"/v1/observations", newObservation, "")
+	var obs observations.Observation
+	require.Nil(t, json.Unmarshal(createdBody, &obs), "decoding created observation")
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for i := 0; i < 21; i++ {
+		photo, err := mw.CreateFormFile("photos", fmt.Sprintf("photo-%d.png", i))
+		require.Nil(t, err, "creating photo")
+		photo.Write([]byte("wisteria"))
+	}
+	require.Nil(t, mw.Close(), "closing upload")
+
+	// Act
+	req, err := http.NewRequest(http.MethodPost, api.URL+"/v1/observations/"+obs.ID+"/attachments", &body)
+	require.Nil(t, err, "creating request")
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	res, err := client.Do(req)
+	require.Nil(t, err, "uploading attachments")
+	res.Body.Close()
+
+	// Assert
+	assert.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode, "upload status mismatch")
+	as, err := records.List(context.Background(), obs.ID)
+	require.Nil(t, err, "listing attachments")
+	assert.Empty(t, as, "attachments of a rejected upload kept")
+}
+
+func TestBatchesOverTheLimit(t *testing.T) {
+
+	// Arrange
+	api, client := serve(t)
+	defer api.Close()
+	obs := `{"feature": {"id": "https://example.com/banners-garden"}, "featureType": {"id": "urn:example:garden"}, "property": {"id": "urn:example:wisteria"}, "propertyType": {"id": "urn:example:scale"}, "process": {"id": "urn:example:by-eye"}, "result": {"wisteria": 5}}`
+
+	// The items after the limit are not valid, so the batch is only
+	// rejected as too large when it is not read past the limit.
+	over := "[" + strings.Repeat(obs+",", 101) + " wisteria"
+
+	// Act
+	accepted, acceptedBody := send(t, client, http.MethodPost, api.URL+"/v1/observations/batch", "["+obs+","+obs+"]", "")
+	rejected, _ := send(t, client, http.MethodPost, api.URL+"/v1/observations/batch", over, "")
+	malformed, _ := send(t, client, http.MethodPost, api.URL+"/v1/observations/batch", "["+obs+", wisteria]", "")
+	object, _ := send(t, client, http.MethodPost, api.URL+"/v1/observations/batch", obs, "")
+
+	// Assert
+	assert.Equal(t, http.StatusOK, accepted.StatusCode, "batch within the limit rejected")
+	var report handlers.BatchReport
+	require.Nil(t, json.Unmarshal(acceptedBody, &report), "decoding report")
+	assert.Equal(t, 2, len(report.Items), "items mismatch")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rejected.StatusCode, "batch over the limit status mismatch")
+	assert.Equal(t, http.StatusUnprocessableEntity, malformed.StatusCode, "malformed batch status mismatch")
+	assert.Equal(t, http.StatusUnprocessableEntity, object.StatusCode, "batch that is not an array status mismatch")
+}
+
+func TestFindingObservationsInEachFormat(t *testing.T) {
+
+	// Arrange
+	api, client := serve(t)
+	defer api.Close()
+	body := `{"feature": {"id": "https://example.com/banners-garden"}, "featureType": {"id": "urn:example:garden"}, "property": {"id": "urn:example:wisteria"}, "propertyType": {"id": "urn:example:scale"}, "process": {"id": "urn:example:by-eye"}, "result": {"wisteria": 5}}`
+	_, createdBody := send(t, client, http.MethodPost, api.URL+"/v1/observations", body, "")
+	var obs observations.Observation
+	require.Nil(t, json.Unmarshal(createdBody, &obs), "decoding created observation")
+
+	accepts := map[string]string{
+		"":                                  "application/json",
+		"text/html":                         "application/json",
+		"text/html, application/json;q=0.5": "application/json",
+		"application/xml":                   "application/xml",
+		"text/xml":                          "application/xml",
+	}
+
+	for accept, contentType := range accepts {
+		req, err := http.NewRequest(http.MethodGet, api.URL+"/v1/observations/"+obs.ID, nil)
+		require.Nil(t, err, "creating request")
+		req.Header.Set("Accept", accept)
+
+		// Act
+		res, err := client.Do(req)
+		require.Nil(t, err, "finding observation")
+		res.Body.Close()
+
+		// Assert
+		assert.Equal(t, http.StatusOK, res.StatusCode, "status mismatch for %q", accept)
+		assert.Equal(t, contentType, mediaType(res.Header.Get("Content-Type")), "content type mismatch for %q", accept)
+	}
+}
+
+func TestExportingFormulasAsText(t *testing.T) {
+
+	// Arrange
+	api, client := serve(t)
+	defer api.Close()
+	body := `{
+		"feature": {"id": "https://example.com/banners-garden", "label": "+SUM(1,2)"},
+		"featureType": {"id": "urn:example:garden"},
+		"property": {"id": "urn:example:health"},
+		"propertyType": {"id": "urn:example:scale-1-5"},
+		"process": {"id": "urn:example:measurement:by-eye"},
+		"result": {"note": "=HYPERLINK(\"https://example.org\")", "wisteria": -5},
+		"tags": {"by": "@banner", "season": "-spring"}
+	}`
+	send(t, client, http.MethodPost, api.URL+"/v1/observations", body, "")
+
+	// Act
+	res, exported := send(t, client, http.MethodGet, api.URL+"/v1/observations?format=csv", "", "")
+
+	// Assert
+	require.Equal(t, http.StatusOK, res.StatusCode, "export status mismatch")
+	rows, err := csv.NewReader(bytes.NewReader(exported)).ReadAll()
+	require.Nil(t, err, "reading csv")
+	require.Equal(t, 2, len(rows), "row count mismatch")
+	row := map[string]string{}
+	for i, name := range rows[0] {
+		row[name] = rows[1][i]
+	}
+	assert.Equal(t, "'+SUM(1,2)", row["featureLabel"], "label formula not escaped")
+	assert.Equal(t, `'=HYPERLINK("https://example.org")`, row["result.note"], "result formula not escaped")
+	assert.Equal(t, "-5", row["result.wisteria"], "negative number escaped")
+	assert.Equal(t, "'@banner", row["tags.by"], "tag formula not escaped")
+	assert.Equal(t, "'-spring", row["tags.season"], "tag formula not escaped")
+}
+
+func TestSubscribingFromOtherOrigins(t *testing.T) {
+
+	// Arrange
+	api, client := serve(t)
+	defer api.Close()
+	dialer := websocket.Dialer{Jar: client.Jar}
+	subscribe := "ws" + strings.TrimPrefix(api.URL, "http") + "/v1/observations/subscribe"
+
+	origins := map[string]int{
+		"https://garden.example.com": http.StatusSwitchingProtocols,
+		api.URL:                      http.StatusSwitchingProtocols,
+		"https://evil.example.org":   http.StatusForbidden,
+		"https://example.com.evil":   http.StatusForbidden,
+	}
+
+	for origin, status := range origins {
+
+		// Act
+		conn, res, _ := dialer.Dial(subscribe, http.Header{"Origin": []string{origin}})
+		if conn != nil {
+			conn.Close()
+		}
+
+		// Assert
+		require.NotNil(t, res, "subscribing from %s", origin)
+		assert.Equal(t, status, res.StatusCode, "subscription from %s", origin)
+	}
+}
+
+func TestSubscribingToServerSentEvents(t *testing.T) {
+
+	// Arrange
+	api, client := serve(t)
+	defer api.Close()
+	res, err := client.Get(api.URL + "/v1/observations/subscribe")
+	require.Nil(t, err, "subscribing")
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode, "subscription status mismatch")
+
+	// Act
+	send(t, client, http.MethodPost, api.URL+"/v1/observations", newObservation, "")
+
+	// Assert
+	events := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			if strings.HasPrefix(scanner.Text(), "event: ") {
+				events <- strings.TrimPrefix(scanner.Text(), "event: ")
+				return
+			}
+		}
+	}()
+	select {
+	case e := <-events:
+		assert.Equal(t, subscriptions.Created, e, "event type mismatch")
+	case <-time.After(5 * time.Second):
+		t.Fatal("event not sent")
+	}
+}
+
+func TestShuttingDownWithSubscriptions(t *testing.T) {
+
+	// Arrange
+	broker := subscriptions.NewBroker()
+	api, client := serveWithBroker(t, handlers.Repositories{Observations: observations.NewMemory(), People: people.NewMemory()}, broker)
+	defer api.Close()
+	api.Config.RegisterOnShutdown(broker.Close)
+	res, err := client.Get(api.URL + "/v1/observations/subscribe")
+	require.Nil(t, err, "subscribing")
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode, "subscription status mismatch")
+
+	// Act
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = api.Config.Shutdown(ctx)
+
+	// Assert
+	require.Nil(t, err, "shutdown waited for the subscription")
+	_, err = ioutil.ReadAll(res.Body)
+	assert.Nil(t, err, "subscription not ended cleanly")
+}
+
+func TestRequiringLoginWithoutADatabase(t *testing.T) {
+
+	// Arrange
+	api, _ := serve(t)
+	defer api.Close()
+
+	// Act
+	res, err := http.Get(api.URL + "/v1/observations")
+	require.Nil(t, err, "listing observations")
+	defer res.Body.Close()
+
+	// Assert
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode, "anonymous request accepted")
+}
+
+func TestRetryingRequestsWithAnIdempotencyKey(t *testing.T) {
+
+	// Arrange
+	api, client := serve(t)
+	defer api.Close()
+	body := `{"feature": {"id": "https://example.com/banners-garden"}, "featureType": {"id": "urn:example:garden"}, "property": {"id": "urn:example:wisteria"}, "propertyType": {"id": "urn:example:scale"}, "process": {"id": "urn:example:by-eye"}, "result": {"wisteria": 5}}`
+
+	// Act
+	first, firstBody := send(t, client, http.MethodPost, api.URL+"/v1/observations", body, "wisteria")
+	retry, retryBody := send(t, client, http.MethodPost, api.URL+"/v1/observations", body, "wisteria")
+	otherQuery, _ := send(t, client, http.MethodPost, api.URL+"/v1/observations?featureType=urn:example:garden", body, "wisteria")
+
+	// Assert
+	assert.Equal(t, http.StatusCreated, first.StatusCode, "first request status mismatch")
+	assert.Equal(t, http.StatusCreated, retry.StatusCode, "retry status mismatch")
+	assert.Equal(t, string(firstBody), string(retryBody), "retry not replayed")
+	assert.Equal(t, http.StatusConflict, otherQuery.StatusCode, "request with another query replayed")
+}
+
+func TestRetryingRequestsLargerThanABatch(t *testing.T) {
+
+	// Arrange
+	api, client := serve(t)
+	defer api.Close()
+	body := "[" + strings.Repeat(" ", 100*64<<10) + "]"
+
+	// Act
+	res, _ := send(t, client, http.MethodPost, api.URL+"/v1/observations/batch", body, "wisteria")
+
+	// Assert
+	assert.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode, "body larger than a batch read")
+}
+
+func TestAggregatingWithoutTheRequestTimeout(t *testing.T) {
+
+	// Arrange
+	repo := &deadlines{Repository: observations.NewMemory()}
+	api, client := serveWith(t, handlers.Repositories{Observations: repo, People: people.NewMemory()})
+	defer api.Close()
+
+	// Act
+	listed, _ := send(t, client, http.MethodGet, api.URL+"/v1/observations", "", "")
+	aggregated, _ := send(t, client, http.MethodGet, api.URL+"/v1/observations/aggregate?field=result.wisteria&bucket=day&functions=mean", "", "")
+
+	// Assert
+	assert.Equal(t, http.StatusOK, listed.StatusCode, "list status mismatch")
+	assert.Equal(t, http.StatusOK, aggregated.StatusCode, "aggregation status mismatch")
+	assert.True(t, repo.get, "list not limited by the request timeout")
+	assert.False(t, repo.aggregate, "aggregation limited by the request timeout")
+}
+
+func TestSavingBatchesWithoutTheRequestTimeout(t *testing.T) {
+
+	// Arrange
+	repo := &deadlines{Repository: observations.NewMemory()}
+	api, client := serveWith(t, handlers.Repositories{Observations: repo, People: people.NewMemory()})
+	defer api.Close()
+
+	// Act
+	res, _ := send(t, client, http.MethodPost, api.URL+"/v1/observations/batch", "["+newObservation+"]", "")
+	batch := repo.saveMany
+	imported, err := client.Post(api.URL+"/v1/observations/omxml?propertyType=urn:example:metres", "application/xml", strings.NewReader(`<om:OM_Observation gml:id="obs1"
+    xmlns:om="http://www.opengis.net/om/2.0"
+    xmlns:gml="http://www.opengis.net/gml/3.2"
+    xmlns:xlink="http://www.w3.org/1999/xlink"
+    xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">
+  <om:phenomenonTime>
+    <gml:TimeInstant gml:id="t1">
+      <gml:timePosition>2020-03-02T10:00:00Z</gml:timePosition>
+    </gml:TimeInstant>
+  </om:phenomenonTime>
+  <om:resultTime xlink:href="#t1"/>
+  <om:procedure xlink:href="urn:example:gauge:7"/>
+  <om:observedProperty xlink:href="urn:example:water-level"/>
+  <om:featureOfInterest xlink:href="https://example.com/weirs/12"/>
+  <om:result xsi:type="gml:MeasureType" uom="m">1.42</om:result>
+</om:OM_Observation>`))
+	require.Nil(t, err, "importing omxml")
+	imported.Body.Close()
+
+	// Assert
+	assert.Equal(t, http.StatusOK, res.StatusCode, "batch status mismatch")
+	assert.True(t, batch > time.Second, "batch limited by the request timeout")
+	assert.Equal(t, http.StatusOK, imported.StatusCode, "import status mismatch")
+	assert.True(t, repo.saveMany > time.Second, "import limited by the request timeout")
+}
+
+func TestUnsupportedRepositories(t *testing.T) {
+
+	// Arrange
+	api, client := serveWith(t, handlers.Repositories{
+		Observations: observations.NewMemory(),
+		People:       people.NewMemory(),
+	})
+	defer api.Close()
+	obs := `{"feature": {"id": "https://example.com/banners-garden"}, "featureType": {"id": "urn:example:garden"}, "property": {"id": "urn:example:wisteria"}, "propertyType": {"id": "urn:example:scale"}, "process": {"id": "urn:example:by-eye"}, "result": {"wisteria": 5}}`
+
+	// Act
+	webhooks, _ := send(t, client, http.MethodGet, api.URL+"/v1/webhooks", "", "")
+	webhook, _ := send(t, client, http.MethodGet, api.URL+"/v1/webhooks/7c1e2d2e-91b5-4b43-9f0a-5d2b7c9a3b11", "", "")
+	attachments, _ := send(t, client, http.MethodGet, api.URL+"/v1/observations/7c1e2d2e-91b5-4b43-9f0a-5d2b7c9a3b11/attachments", "", "")
+	retried, _ := send(t, client, http.MethodPost, api.URL+"/v1/observations", obs, "wisteria")
+	created, _ := send(t, client, http.MethodPost, api.URL+"/v1/observations", obs, "")
+
+	// Assert
+	assert.Equal(t, http.StatusNotImplemented, webhooks.StatusCode, "webhooks status mismatch")
+	assert.Equal(t, http.StatusNotImplemented, webhook.StatusCode, "webhook status mismatch")
+	assert.Equal(t, http.StatusNotImplemented, attachments.StatusCode, "attachments status mismatch")
+	assert.Equal(t, http.StatusNotImplemented, retried.StatusCode, "idempotent request status mismatch")
+	assert.Equal(t, http.StatusCreated, created.StatusCode, "request without an Idempotency-Key rejected")
+}
+
+// deadlines is a repository that records whether searches and aggregations
+// had a deadline, and how long batches had left to be saved.
+type deadlines struct {
+	observations.Repository
+	get, aggregate bool
+	saveMany       time.Duration
+}
+
+// SaveMany records how long the batch had left to be saved.
+func (d *deadlines) SaveMany(ctx context.Context, obss []observations.Observation) (map[int]error, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		d.saveMany = time.Until(deadline)
+	}
+	return d.Repository.SaveMany(ctx, obss)
+}
+
+// Get records whether the search had a deadline.
+func (d *deadlines) Get(ctx context.Context, q observations.Query) (observations.Page, error) {
+	_, d.get = ctx.Deadline()
+	return d.Repository.Get(ctx, q)
+}
+
+// Aggregate records whether the aggregation had a deadline.
+func (d *deadlines) Aggregate(ctx context.Context, a observations.Aggregation) ([]observations.Series, error) {
+	_, d.aggregate = ctx.Deadline()
+	return d.Repository.Aggregate(ctx, a)
+}
+
+// serve starts the API with every repository in memory, and returns a client
+// logged in as a confirmed user. The API must be closed when the test ends.
+func serve(t *testing.T) (*httptest.Server, *http.Client) {
+	g := graph.NewMemory()
+	return serveWith(t, handlers.Repositories{
+		Observations: observations.NewMemory(),
+		People:       people.NewMemory(),
+		Webhooks:     webhooks.NewMemory(),
+		Attachments:  attachments.NewMemory(),
+		Idempotency:  idempotency.NewMemory(),
+		Store:        attachments.NewMemoryStore(),
+		Events:       events.Fanout{events.NewMemory(), graph.Recorder{Graph: g}},
+		Graph:        g,
+	})
+}
+
+// serveWith starts the API with repositories, and returns a client logged in
+// as a confirmed user. The API must be closed when the test ends.
+func serveWith(t *testing.T, repos handlers.Repositories) (*httptest.Server, *http.Client) {
+	return serveWithBroker(t, repos, subscriptions.NewBroker())
+}
+
+// serveWithBroker starts the API with repositories and a broker of
+// subscriptions, and returns a client logged in as a confirmed user. The API
+// must be closed when the test ends.
+func serveWithBroker(t *testing.T, repos handlers.Repositories, broker *subscriptions.Broker) (*httptest.Server, *http.Client) {
+	ctx := context.Background()
+	users := auth.NewMemory()
+
+	password, err := bcrypt.GenerateFromPassword([]byte("Wisteria!5"), bcrypt.MinCost)
+	require.Nil(t, err, "hashing password")
+	user := &auth.User{Email: "user@example.com", Password: string(password), Confirmed: true}
+	require.Nil(t, users.Create(ctx, user), "creating user")
+
+	ab := authboss.New()
+	ab.Config.Storage.Server = users
+	ab.Config.Storage.SessionState = abclientstate.NewSessionStorer("observations", []byte("session-key"), nil)
+	ab.Config.Storage.CookieState = abclientstate.NewCookieStorer([]byte("cookie-key"), nil)
+	ab.Config.Core.ViewRenderer = defaults.JSONRenderer{}
+	defaults.SetCore(&ab.Config, true, false)
+	ab.Config.Core.Mailer = defaults.NewLogMailer(ioutil.Discard)
+	ab.Config.Core.MailRenderer = abrenderer.NewEmail("/v1/auth", "ab_views")
+	ab.Config.Paths.Mount = "/v1/auth"
+	require.Nil(t, ab.Init(), "configuring authboss")
+
+	limits := handlers.Limits{BatchSize: 100, ExportTimeout: time.Minute, AttachmentSize: 1024, IdempotencyWindow: time.Hour, AllowedOrigins: []string{"https://*.example.com"}}
+
+	api := httptest.NewServer(handlers.API("test", repos, broker, ab, limits, cors.New(cors.Options{}), "test"))
+
+	jar, err := cookiejar.New(nil)
+	require.Nil(t, err, "creating cookie jar")
+	client := &http.Client{Jar: jar}
+
+	_, body := send(t, client, http.MethodPost, api.URL+"/v1/auth/login", `{"email": "user@example.com", "password": "Wisteria!5"}`, "")
+	var login struct{ Status string }
+	require.Nil(t, json.Unmarshal(body, &login), "decoding login")
+	require.Equal(t, "success", login.Status, "logging in")
+
+	return api, client
+}
+
+// mediaType returns the media type of a Content-Type header without its
+// parameters.
+func mediaType(contentType string) string {
+	return strings.TrimSpace(strings.Split(contentType, ";")[0])
+}
+
+// send sends a request with a JSON body, and an Idempotency-Key header when
+// key is not empty, and returns the response and its body.
+func send(t *testing.T, client *http.Client, method, url, body, key string) (*http.Response, []byte) {
+	req, err := http.NewRequest(method, url, bytes.NewBufferString(body))
+	require.Nil(t, err, "creating request")
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+
+	res, err := client.Do(req)
+	require.Nil(t, err, "sending request")
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	require.Nil(t, err, "reading response")
+
+	return res, b
+}
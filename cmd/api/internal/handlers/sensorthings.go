@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/pkg/errors"
+	"github.com/schafer14/obs/internal/events"
+	"github.com/schafer14/obs/internal/observations"
+	"github.com/schafer14/obs/internal/sensorthings"
+	"github.com/schafer14/obs/internal/subscriptions"
+)
+
+// maxEntityBytes is the largest request body accepted for a SensorThings
+// entity.
+const maxEntityBytes = 1 << 20
+
+// SensorThingsHandler serves observations through the OGC SensorThings API.
+// Observations created and revised through it are published to the same
+// subscribers and publisher as those of ObservationHandler.
+type SensorThingsHandler struct {
+	db        observations.Repository
+	broker    *subscriptions.Broker
+	publisher events.Publisher
+}
+
+// publishing is a repository that publishes an event for each observation
+// saved or superseded through it, once it has been stored.
+type publishing struct {
+	observations.Repository
+	publisher events.Publisher
+}
+
+// Save persists an observation and publishes its creation.
+func (p publishing) Save(ctx context.Context, obs observations.Observation) error {
+	if err := p.Repository.Save(ctx, obs); err != nil {
+		return err
+	}
+	publishEvent(ctx, p.publisher, events.Created(obs, obs.ModifiedAt))
+	return nil
+}
+
+// Supersede persists a revision of an observation and publishes it.
+func (p publishing) Supersede(ctx context.Context, obs observations.Observation) error {
+	if err := p.Repository.Supersede(ctx, obs); err != nil {
+		return err
+	}
+	publishEvent(ctx, p.publisher, events.Revised(obs, obs.ModifiedAt))
+	return nil
+}
+
+// Root handles an http request for the entity sets of the SensorThings API.
+func (s *SensorThingsHandler) Root(w http.ResponseWriter, r *http.Request) {
+	Respond(r.Context(), w, sensorthings.Root(sensorThingsBase(r)), http.StatusOK)
+}
+
+// Get handles an http request for an entity or collection of entities.
+func (s *SensorThingsHandler) Get(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	opts, err := sensorthings.ParseOptions(r.URL.Query())
+	if err != nil {
+		s.respondError(w, r, err)
+		return
+	}
+
+	res, err := sensorthings.Read(ctx, s.db, sensorThingsBase(r), chi.URLParam(r, "*"), opts)
+	if err != nil {
+		s.respondError(w, r, err)
+		return
+	}
+
+	Respond(ctx, w, res, http.StatusOK)
+}
+
+// Create handles an http request that creates an entity in a collection.
+func (s *SensorThingsHandler) Create(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxEntityBytes))
+	if err != nil {
+		RespondError(ctx, w, Error{fmt.Errorf("request body must be at most %d bytes", maxEntityBytes), http.StatusRequestEntityTooLarge, []FieldError{}})
+		return
+	}
+
+	entity, err := sensorthings.Create(ctx, publishing{s.db, s.publisher}, sensorThingsBase(r), chi.URLParam(r, "*"), body, currentUserID(r), time.Now())
+	if err != nil {
+		s.respondError(w, r, err)
+		return
+	}
+
+	s.broker.Notify()
+
+	w.Header().Set("Location", fmt.Sprint(entity["@iot.selfLink"]))
+	Respond(ctx, w, entity, http.StatusCreated)
+}
+
+// Update handles an http request that amends an entity.
+func (s *SensorThingsHandler) Update(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxEntityBytes))
+	if err != nil {
+		RespondError(ctx, w, Error{fmt.Errorf("request body must be at most %d bytes", maxEntityBytes), http.StatusRequestEntityTooLarge, []FieldError{}})
+		return
+	}
+
+	entity, err := sensorthings.Update(ctx, publishing{s.db, s.publisher}, sensorThingsBase(r), chi.URLParam(r, "*"), body, currentUserID(r), time.Now())
+	if err != nil {
+		s.respondError(w, r, err)
+		return
+	}
+	s.broker.Notify()
+
+	Respond(ctx, w, entity, http.StatusOK)
+}
+
+// respondError sends the error of a SensorThings request to the client.
+func (s *SensorThingsHandler) respondError(w http.ResponseWriter, r *http.Request, err error) {
+	ctx := r.Context()
+
+	if vError, ok := err.(*observations.ValidationError); ok {
+		Respond(ctx, w, vError, http.StatusUnprocessableEntity)
+		return
+	}
+
+	switch err {
+	case sensorthings.ErrorNotFound:
+		Respond(ctx, w, map[string]string{"error": err.Error()}, http.StatusNotFound)
+	case sensorthings.ErrorReadOnly:
+		Respond(ctx, w, map[string]string{"error": err.Error()}, http.StatusMethodNotAllowed)
+	case sensorthings.ErrorNotSupported:
+		Respond(ctx, w, map[string]string{"error": err.Error()}, http.StatusNotImplemented)
+	case observations.ErrorConflict:
+		Respond(ctx, w, map[string]string{"error": "observation has been modified"}, http.StatusConflict)
+	default:
+		RespondError(ctx, w, errors.Wrap(err, "handling SensorThings request"))
+	}
+}
+
+// sensorThingsBase is the url of the root of the SensorThings API, which links
+// in responses are relative to.
+func sensorThingsBase(r *http.Request) string {
+	return baseURL(r) + "/v1.1"
+}
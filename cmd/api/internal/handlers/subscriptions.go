@@ -0,0 +1,233 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	"github.com/schafer14/obs/internal/observations"
+	"github.com/schafer14/obs/internal/subscriptions"
+)
+
+// keepAlive is how often an idle subscription sends a message so proxies do
+// not close the connection.
+const keepAlive = 30 * time.Second
+
+// writeTimeout is how long a subscription waits to send an event before the
+// client is considered gone.
+const writeTimeout = 10 * time.Second
+
+// newUpgrader creates an upgrader of subscription requests to WebSockets.
+// Browsers do not apply CORS to WebSockets and send the session cookie with
+// them, so the upgrader only accepts requests from the same origin or one of
+// the allowed origins. Origins are matched as they are by the CORS
+// middleware, where * matches any origin and may be used once in an origin,
+// such as https://*.example.com.
+func newUpgrader(allowed []string) websocket.Upgrader {
+	return websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				return true
+			}
+			if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+				return true
+			}
+
+			origin = strings.ToLower(origin)
+			for _, a := range allowed {
+				a = strings.ToLower(a)
+				if a == "*" || a == origin {
+					return true
+				}
+				if i := strings.Index(a, "*"); i >= 0 {
+					prefix, suffix := a[:i], a[i+1:]
+					if len(origin) >= len(prefix)+len(suffix) && strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+						return true
+					}
+				}
+			}
+			return false
+		},
+	}
+}
+
+// Subscribe handles an http request that follows observations as they are
+// saved. It takes the same filters as listing observations and sends an event
+// for each matching observation, over a WebSocket when the request is a
+// WebSocket upgrade and as Server-Sent Events otherwise.
+//
+// Subscriptions end when the broker is closed as the server shuts down.
+// Only observations saved after the subscription starts are sent. A client
+// that reconnects with the token of the last event it received, in the token
+// query parameter or the Last-Event-ID header, is sent the observations it
+// missed.
+func (o *ObservationHandler) Subscribe(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	q, err := searchQuery(r)
+	if err != nil {
+		RespondError(ctx, w, err)
+		return
+	}
+	if err := q.Validate(); err != nil {
+		if vError, ok := err.(*observations.ValidationError); ok {
+			Respond(ctx, w, vError, http.StatusUnprocessableEntity)
+			return
+		}
+		RespondError(ctx, w, err)
+		return
+	}
+
+	from := observations.TokenAt(time.Now())
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		token = r.Header.Get("Last-Event-ID")
+	}
+	if token != "" {
+		if from, err = observations.ParseToken(token); err != nil {
+			RespondError(ctx, w, Error{err, http.StatusUnprocessableEntity, []FieldError{{Field: "token", Error: err.Error()}}})
+			return
+		}
+	}
+
+	if websocket.IsWebSocketUpgrade(r) {
+		o.subscribeWebSocket(w, r, q, from)
+		return
+	}
+	o.subscribeEvents(w, r, q, from)
+}
+
+// subscribeEvents sends the events of a subscription as Server-Sent Events.
+// The id of each event is its token, which browsers send in the
+// Last-Event-ID header when they reconnect.
+func (o *ObservationHandler) subscribeEvents(w http.ResponseWriter, r *http.Request, q observations.Query, from observations.Token) {
+	ctx := r.Context()
+
+	flusher, ok := flusher(w)
+	if !ok {
+		RespondError(ctx, w, errors.New("streaming is not supported"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// Events and keep alive comments are written from different goroutines.
+	var mu sync.Mutex
+	write := func(msg string) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if _, err := fmt.Fprint(w, msg); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		ticker := time.NewTicker(keepAlive)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := write(": keep-alive\n\n"); err != nil {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	err := subscriptions.Follow(ctx, o.db, o.broker, q, from, func(e subscriptions.Event) error {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		return write(fmt.Sprintf("id: %s\nevent: %s\ndata: %s\n\n", e.Token, e.Type, data))
+	})
+	if err != nil && ctx.Err() == nil {
+		fmt.Printf("Unhandled error: %v\n", errors.Wrap(err, "following observations"))
+	}
+}
+
+// subscribeWebSocket sends the events of a subscription as JSON messages over
+// a WebSocket. Messages from the client are ignored.
+func (o *ObservationHandler) subscribeWebSocket(w http.ResponseWriter, r *http.Request, q observations.Query, from observations.Token) {
+	conn, err := o.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already responded to the client.
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	// Reading handles pings and closes from the client, which end the
+	// subscription.
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	var mu sync.Mutex
+	write := func(messageType int, data []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		return conn.WriteMessage(messageType, data)
+	}
+
+	go func() {
+		ticker := time.NewTicker(keepAlive)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := write(websocket.PingMessage, nil); err != nil {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	err = subscriptions.Follow(ctx, o.db, o.broker, q, from, func(e subscriptions.Event) error {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		return write(websocket.TextMessage, data)
+	})
+	switch {
+	case err == nil:
+		// The broker is closed as the server shuts down.
+		write(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"))
+	case ctx.Err() == nil:
+		fmt.Printf("Unhandled error: %v\n", errors.Wrap(err, "following observations"))
+		write(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "subscription failed"))
+	}
+}
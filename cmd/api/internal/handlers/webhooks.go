@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/schafer14/obs/internal/observations"
+	"github.com/schafer14/obs/internal/webhooks"
+)
+
+// deliveryLimit is the most deliveries listed when a request does not set a
+// limit.
+const deliveryLimit = 50
+
+// WebhookHandler handles requests for the webhooks of the current user.
+type WebhookHandler struct {
+	webhooks webhooks.Repository
+}
+
+// Create handles an http request that creates a new webhook.
+func (h *WebhookHandler) Create(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var nw webhooks.NewWebhook
+	if err := Decode(r, &nw); err != nil {
+		RespondError(ctx, w, err)
+		return
+	}
+
+	hook, err := webhooks.New(nw, uuid.New().String(), currentUserID(r), time.Now())
+	if err != nil {
+		if vError, ok := err.(*observations.ValidationError); ok {
+			Respond(ctx, w, vError, http.StatusUnprocessableEntity)
+			return
+		}
+		RespondError(ctx, w, errors.Wrap(err, "creating new webhook"))
+		return
+	}
+
+	if err := h.webhooks.Save(ctx, hook); err != nil {
+		RespondError(ctx, w, err)
+		return
+	}
+
+	Respond(ctx, w, hook, http.StatusCreated)
+}
+
+// List handles an http request for listing the webhooks of the current user.
+func (h *WebhookHandler) List(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	hooks, err := h.webhooks.List(ctx, currentUserID(r))
+	if err != nil {
+		RespondError(ctx, w, err)
+		return
+	}
+
+	if hooks == nil {
+		hooks = []webhooks.Webhook{}
+	}
+
+	Respond(ctx, w, hooks, http.StatusOK)
+}
+
+// Find handles an http request for finding a single webhook.
+func (h *WebhookHandler) Find(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	hook, ok := h.find(w, r)
+	if !ok {
+		return
+	}
+
+	Respond(ctx, w, hook, http.StatusOK)
+}
+
+// Delete handles an http request that deletes a webhook.
+func (h *WebhookHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	err := h.webhooks.Delete(ctx, chi.URLParam(r, "id"), currentUserID(r))
+	if err != nil {
+		if err == webhooks.ErrorNotFound {
+			Respond(ctx, w, map[string]string{"error": "webhook not found"}, http.StatusNotFound)
+			return
+		}
+		RespondError(ctx, w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Deliveries handles an http request for the delivery log of a webhook. The
+// latest deliveries are listed first, up to the limit query parameter.
+func (h *WebhookHandler) Deliveries(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	limit := deliveryLimit
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > 1000 {
+			err = errors.New("limit must be a number between 1 and 1000")
+			RespondError(ctx, w, Error{err, http.StatusUnprocessableEntity, []FieldError{{Field: "limit", Error: err.Error()}}})
+			return
+		}
+		limit = n
+	}
+
+	hook, ok := h.find(w, r)
+	if !ok {
+		return
+	}
+
+	deliveries, err := h.webhooks.Deliveries(ctx, hook.ID, limit)
+	if err != nil {
+		RespondError(ctx, w, err)
+		return
+	}
+
+	if deliveries == nil {
+		deliveries = []webhooks.Delivery{}
+	}
+
+	Respond(ctx, w, deliveries, http.StatusOK)
+}
+
+// find fetches the webhook identified in the url of a request. Only webhooks
+// created by the current user are found. If the webhook cannot be fetched an
+// error is sent to the client.
+func (h *WebhookHandler) find(w http.ResponseWriter, r *http.Request) (webhooks.Webhook, bool) {
+	ctx := r.Context()
+
+	hook, err := h.webhooks.Find(ctx, chi.URLParam(r, "id"), currentUserID(r))
+	if err != nil {
+		if err == webhooks.ErrorNotFound {
+			Respond(ctx, w, map[string]string{"error": "webhook not found"}, http.StatusNotFound)
+			return hook, false
+		}
+		RespondError(ctx, w, errors.Wrap(err, "fetching webhook"))
+		return hook, false
+	}
+
+	return hook, true
+}
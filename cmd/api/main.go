@@ -8,19 +8,34 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	driver "github.com/arangodb/go-driver"
 	"github.com/ardanlabs/conf"
 	"github.com/go-chi/cors"
 	"github.com/gorilla/sessions"
 	"github.com/pkg/errors"
 	"github.com/schafer14/obs/cmd/api/internal/handlers"
+	"github.com/schafer14/obs/internal/attachments"
 	"github.com/schafer14/obs/internal/auth"
+	"github.com/schafer14/obs/internal/events"
+	"github.com/schafer14/obs/internal/graph"
+	"github.com/schafer14/obs/internal/idempotency"
+	"github.com/schafer14/obs/internal/observations"
+	"github.com/schafer14/obs/internal/people"
+	"github.com/schafer14/obs/internal/platform/arango"
 	"github.com/schafer14/obs/internal/platform/database"
+	"github.com/schafer14/obs/internal/platform/firestore"
+	"github.com/schafer14/obs/internal/platform/postgres"
+	"github.com/schafer14/obs/internal/subscriptions"
+	"github.com/schafer14/obs/internal/webhooks"
 	"github.com/volatiletech/authboss"
 	abclientstate "github.com/volatiletech/authboss-clientstate"
 	abrenderer "github.com/volatiletech/authboss-renderer"
 	"github.com/volatiletech/authboss/defaults"
+	"go.mongodb.org/mongo-driver/mongo"
 
 	_ "github.com/volatiletech/authboss/auth"
 	_ "github.com/volatiletech/authboss/confirm"
@@ -49,21 +64,73 @@ func run() error {
 	// Read Configuration
 	// =============================================== //
 	var cfg struct {
-		APIHost string `conf:"default:0.0.0.0:3000"`
-		Cors    struct {
+		APIHost         string        `conf:"default:0.0.0.0:3000"`
+		ShutdownTimeout time.Duration `conf:"default:5s,help:wait for requests in progress to finish when the api stops"`
+		Cors            struct {
 			AllowedHosts []string `conf:"default:*"`
 		}
 		Database struct {
-			Uri         string `conf:"default:mongodb://localhost:27017"`
-			Name        string `conf:"default:observations"`
+			Driver          string `conf:"help:mongo postgres firestore or memory and firestore by default when a firestore project is set or mongo otherwise"`
+			Uri             string `conf:"default:mongodb://localhost:27017,noprint"`
+			Name            string `conf:"default:observations"`
+			TLSCaFile       string `conf:"help:PEM file of the certificate authorities trusted to sign the certificate of mongo"`
+			TLSCertFile     string `conf:"help:PEM file of the client certificate and its private key"`
+			AuthSource      string `conf:"help:database the credentials in the uri are checked against"`
+			ReplicaSet      string
+			ReadPreference  string        `conf:"help:primary primaryPreferred secondary secondaryPreferred or nearest"`
+			WriteConcern    string        `conf:"help:majority or the number of members that acknowledge writes"`
+			MaxPoolSize     uint64        `conf:"default:100"`
+			MinPoolSize     uint64        `conf:"default:0"`
+			ConnectAttempts int           `conf:"default:5"`
+			ConnectBackoff  time.Duration `conf:"default:1s,help:wait after the first failed connection and twice as long after each failure after that"`
+			Postgres        struct {
+				Uri string `conf:"default:postgres://localhost:5432/observations?sslmode=disable,noprint"`
+			}
 			Collections struct {
 				Users        string `conf:"default:users"`
 				Sessions     string `conf:"default:sessions"`
 				Observations string `conf:"default:observations"`
 				People       string `conf:"default:people"`
 				Groups       string `conf:"default:groups"`
+				Webhooks     string `conf:"default:webhooks"`
+				Deliveries   string `conf:"default:deliveries"`
+				Attachments  string `conf:"default:attachments"`
+				Idempotency  string `conf:"default:idempotency"`
 			}
 		}
+		Firestore struct {
+			Project string `conf:"help:Google Cloud project of the firestore database"`
+		}
+		Events struct {
+			Broker        string        `conf:"default:memory,help:memory or nats"`
+			NatsURL       string        `conf:"default:nats://localhost:4222,noprint"`
+			SubjectPrefix string        `conf:"default:obs"`
+			RelayInterval time.Duration `conf:"default:5s"`
+		}
+		Graph struct {
+			Driver         string `conf:"default:memory,help:memory or arango"`
+			Build          bool   `conf:"help:record every saved observation in an arango graph when the api starts"`
+			ArangoURL      string `conf:"default:http://localhost:8529"`
+			ArangoDatabase string `conf:"default:observations"`
+			ArangoUsername string
+			ArangoPassword string `conf:"noprint"`
+		}
+		Webhooks struct {
+			DeliveryInterval time.Duration `conf:"default:5s"`
+			Backoff          time.Duration `conf:"default:30s,help:wait before the first retry of a failed delivery"`
+			MaxAttempts      int           `conf:"default:8"`
+			AllowPrivate     bool          `conf:"default:false,help:deliver webhooks to loopback and private addresses"`
+		}
+		Observations struct {
+			BatchLimit        int           `conf:"default:1000"`
+			ExportTimeout     time.Duration `conf:"default:10m"`
+			IdempotencyWindow time.Duration `conf:"default:24h,help:how long responses to requests with an Idempotency-Key are replayed"`
+		}
+		Attachments struct {
+			Store   string `conf:"help:gridfs, filesystem or memory, defaults to gridfs with mongo and memory otherwise"`
+			Dir     string `conf:"default:attachments"`
+			MaxSize int64  `conf:"default:26214400,help:largest attachment in bytes"`
+		}
 		Auth struct {
 			CookieStoreKey    string `conf:"default:NpEPi8pEjKVjLGJ6kYCS+VTCzi6BUuDzU0wrwXyf5uDPArtlofn2AG6aTMiPmN3C909rsEWMNqJqhIVPGP3Exg==,noprint"`
 			SessionStoreKey   string `conf:"default:AbfYwmmt8UCwUuhd9qvfNA9UCuN1cVcKJN1ofbiky6xCyyBj20whe40rJa3Su0WOWLWcPpO1taqJdsEI/65+JA==,noprint"`
@@ -98,14 +165,304 @@ func run() error {
 	}
 	log.Printf("main : Config :\n%v\n", out)
 
+	// =============================================== //
+	// Configure events
+	// =============================================== //
+	var publisher events.Publisher
+	switch cfg.Events.Broker {
+	case "memory":
+		publisher = events.NewMemory()
+	case "nats":
+		nats, err := events.NewNATS(cfg.Events.NatsURL, cfg.Events.SubjectPrefix)
+		if err != nil {
+			return errors.Wrap(err, "configuring nats")
+		}
+		defer nats.Close()
+		publisher = nats
+	default:
+		return errors.Errorf("unknown event broker %q, must be memory or nats", cfg.Events.Broker)
+	}
+
+	// =============================================== //
+	// Configure graph
+	// =============================================== //
+	var g graph.Graph
+	var graphDB driver.Database
+	switch cfg.Graph.Driver {
+	case "memory":
+		g = graph.NewMemory()
+	case "arango":
+		log.Println("main : Started : Initializing arango database support")
+
+		var err error
+		graphDB, err = arango.Open(ctx, cfg.Graph.ArangoURL, cfg.Graph.ArangoDatabase, cfg.Graph.ArangoUsername, cfg.Graph.ArangoPassword)
+		if err != nil {
+			return errors.Wrap(err, "connecting to arango")
+		}
+		if err := graph.EnsureGraph(ctx, graphDB); err != nil {
+			return errors.Wrap(err, "creating graph")
+		}
+		g = graph.NewArango(graphDB)
+	default:
+		return errors.Errorf("unknown graph driver %q, must be memory or arango", cfg.Graph.Driver)
+	}
+
+	// The graph is built from the events of observations, wherever they are
+	// published from.
+	publisher = events.Fanout{publisher, graph.Recorder{Graph: g}}
+
 	// =============================================== //
 	// Configure database
 	// =============================================== //
-	log.Println("main : Started : Initializing arango database support")
+	var repos handlers.Repositories
+	var users auth.Repository
+	var db *mongo.Database
 
-	db, err := database.Open(ctx, cfg.Database.Uri, cfg.Database.Name)
-	if err != nil {
-		return errors.Wrap(err, "connecting to db")
+	// Deliveries of webhooks are scheduled in a queue, and events are
+	// relayed from a source, when the database keeps them.
+	var queue webhooks.Queue
+	var source events.Source
+
+	relayCtx, stopRelay := context.WithCancel(ctx)
+	defer stopRelay()
+
+	dbDriver := cfg.Database.Driver
+	if dbDriver == "" {
+		dbDriver = "mongo"
+		if cfg.Firestore.Project != "" {
+			dbDriver = "firestore"
+		}
+	}
+
+	switch dbDriver {
+	case "mongo", "postgres":
+		log.Println("main : Started : Initializing mongo database support")
+
+		var err error
+		db, err = database.Open(ctx, database.Config{
+			URI:             cfg.Database.Uri,
+			Name:            cfg.Database.Name,
+			TLSCAFile:       cfg.Database.TLSCaFile,
+			TLSCertFile:     cfg.Database.TLSCertFile,
+			AuthSource:      cfg.Database.AuthSource,
+			ReplicaSet:      cfg.Database.ReplicaSet,
+			ReadPreference:  cfg.Database.ReadPreference,
+			WriteConcern:    cfg.Database.WriteConcern,
+			MaxPoolSize:     cfg.Database.MaxPoolSize,
+			MinPoolSize:     cfg.Database.MinPoolSize,
+			ConnectAttempts: cfg.Database.ConnectAttempts,
+			ConnectBackoff:  cfg.Database.ConnectBackoff,
+		})
+		if err != nil {
+			return errors.Wrap(err, "connecting to db")
+		}
+		defer func() {
+			log.Println("main : Completed : Disconnecting from mongo")
+			if err := database.Close(ctx, db.Client()); err != nil {
+				log.Printf("main : Disconnecting from mongo : %v", err)
+			}
+		}()
+
+		idemColl := db.Collection(cfg.Database.Collections.Idempotency)
+		if err := idempotency.EnsureIndexes(ctx, idemColl); err != nil {
+			return errors.Wrap(err, "creating indexes")
+		}
+
+		attachmentColl := db.Collection(cfg.Database.Collections.Attachments)
+		if err := attachments.EnsureIndexes(ctx, attachmentColl); err != nil {
+			return errors.Wrap(err, "creating indexes")
+		}
+
+		webhookColl := db.Collection(cfg.Database.Collections.Webhooks)
+		deliveryColl := db.Collection(cfg.Database.Collections.Deliveries)
+		if err := webhooks.EnsureIndexes(ctx, webhookColl, deliveryColl); err != nil {
+			return errors.Wrap(err, "creating indexes")
+		}
+
+		hookRepo := webhooks.NewMongo(webhookColl, deliveryColl)
+		queue = hookRepo
+
+		repos = handlers.Repositories{
+			Webhooks:    hookRepo,
+			Attachments: attachments.NewMongo(attachmentColl),
+			Idempotency: idempotency.NewMongo(idemColl),
+			Health: func(ctx context.Context) error {
+				return database.Check(ctx, db.Client())
+			},
+		}
+		users = auth.NewStorer(db, auth.CollectionConfiguration{Users: cfg.Database.Collections.Users, Sessions: cfg.Database.Collections.Sessions})
+
+		// Observations are saved with their events, which are relayed from
+		// the observations, so the handlers do not publish events.
+		if dbDriver == "mongo" {
+			obsColl := db.Collection(cfg.Database.Collections.Observations)
+			if err := observations.EnsureIndexes(ctx, obsColl); err != nil {
+				return errors.Wrap(err, "creating indexes")
+			}
+
+			obsRepo := observations.NewMongo(obsColl)
+			repos.Observations = obsRepo
+			repos.People = people.NewMongo(db.Collection(cfg.Database.Collections.People))
+			source = obsRepo
+		}
+
+		// Postgres only stores observations and people, everything else is
+		// still stored in mongo. The observations and people in mongo are
+		// left as they are.
+		if dbDriver == "postgres" {
+			log.Println("main : Started : Initializing postgres database support for observations and people")
+
+			pg, err := postgres.Open(ctx, cfg.Database.Postgres.Uri)
+			if err != nil {
+				return errors.Wrap(err, "connecting to postgres")
+			}
+			defer pg.Close()
+
+			if err := observations.MigratePostgres(ctx, pg); err != nil {
+				return errors.Wrap(err, "migrating postgres")
+			}
+			if err := people.MigratePostgres(ctx, pg); err != nil {
+				return errors.Wrap(err, "migrating postgres")
+			}
+
+			pgRepo := observations.NewPostgres(pg)
+			repos.Observations = pgRepo
+			source = pgRepo
+			repos.People = people.NewPostgres(pg)
+			repos.Health = func(ctx context.Context) error {
+				if err := database.Check(ctx, db.Client()); err != nil {
+					return err
+				}
+				return postgres.Check(ctx, pg)
+			}
+		}
+	case "firestore":
+		log.Println("main : Started : Initializing firestore database support for observations, people and users")
+
+		if cfg.Firestore.Project == "" {
+			return errors.New("the firestore database driver needs a firestore project")
+		}
+
+		client, err := firestore.Open(ctx, cfg.Firestore.Project)
+		if err != nil {
+			return errors.Wrap(err, "connecting to firestore")
+		}
+		defer client.Close()
+
+		// Firestore only stores observations, people and users. Webhooks,
+		// attachments and idempotency keys are left out rather than kept in
+		// memory, where they would be lost, so their routes answer 501.
+		obsRepo := observations.NewFirestore(client, cfg.Database.Collections.Observations)
+		repos = handlers.Repositories{
+			Observations: obsRepo,
+			People:       people.NewFirestore(client, cfg.Database.Collections.People),
+			Health: func(ctx context.Context) error {
+				return firestore.Check(ctx, client)
+			},
+		}
+		users = auth.NewFirestore(client, cfg.Database.Collections.Users)
+		source = obsRepo
+	case "memory":
+		log.Println("main : Started : Initializing in memory storage, data is lost when the api stops")
+
+		hookRepo := webhooks.NewMemory()
+		queue = hookRepo
+
+		repos = handlers.Repositories{
+			Observations: observations.NewMemory(),
+			People:       people.NewMemory(),
+			Webhooks:     hookRepo,
+			Attachments:  attachments.NewMemory(),
+			Idempotency:  idempotency.NewMemory(),
+		}
+		users = auth.NewMemory()
+	default:
+		return errors.Errorf("unknown database driver %q, must be mongo, postgres, firestore or memory", cfg.Database.Driver)
+	}
+
+	// Webhooks are sent from the queue of deliveries kept with them, so they
+	// are delivered with every database that keeps webhooks.
+	if queue != nil {
+		dispatcher := webhooks.NewDispatcher(repos.Webhooks, queue)
+		dispatcher.Backoff = cfg.Webhooks.Backoff
+		dispatcher.MaxAttempts = cfg.Webhooks.MaxAttempts
+		dispatcher.AllowPrivate = cfg.Webhooks.AllowPrivate
+		publisher = events.Fanout{publisher, dispatcher}
+
+		go dispatcher.Run(relayCtx, cfg.Webhooks.DeliveryInterval, func(err error) {
+			log.Printf("main : Delivering webhooks : %v", err)
+		})
+	}
+
+	// Events are relayed from the observations they are saved with, or else
+	// published by the handlers as observations are saved.
+	if source != nil {
+		go events.NewOutbox(source).Run(relayCtx, publisher, cfg.Events.RelayInterval, func(err error) {
+			log.Printf("main : Relaying events : %v", err)
+		})
+	} else {
+		repos.Events = publisher
+	}
+
+	repos.Graph = g
+	if graphDB != nil {
+		check := repos.Health
+		repos.Health = func(ctx context.Context) error {
+			if check != nil {
+				if err := check(ctx); err != nil {
+					return err
+				}
+			}
+			return arango.Check(ctx, graphDB)
+		}
+	}
+
+	// A graph in memory starts empty, so it is built from the observations
+	// already saved. A graph in arango is only built when asked.
+	if cfg.Graph.Driver == "memory" || cfg.Graph.Build {
+		go func() {
+			if err := graph.Build(relayCtx, repos.Observations, g); err != nil {
+				log.Printf("main : Building graph : %v", err)
+			}
+		}()
+	}
+
+	// =============================================== //
+	// Configure attachments
+	// =============================================== //
+	storeKind := cfg.Attachments.Store
+	if storeKind == "" {
+		storeKind = "gridfs"
+		if db == nil {
+			storeKind = "memory"
+		}
+	}
+	if repos.Attachments == nil {
+		if cfg.Attachments.Store != "" {
+			return errors.Errorf("attachments are not supported by the %s database driver", dbDriver)
+		}
+		storeKind = ""
+	}
+
+	switch storeKind {
+	case "":
+		// The database driver cannot keep the records of attachments, so
+		// there are no files to store.
+	case "gridfs":
+		if db == nil {
+			return errors.New("gridfs attachments need the mongo database driver")
+		}
+		repos.Store = attachments.NewGridFS(db, cfg.Database.Collections.Attachments)
+	case "filesystem":
+		fs, err := attachments.NewFilesystem(cfg.Attachments.Dir)
+		if err != nil {
+			return errors.Wrap(err, "configuring attachment store")
+		}
+		repos.Store = fs
+	case "memory":
+		repos.Store = attachments.NewMemoryStore()
+	default:
+		return errors.Errorf("unknown attachment store %q, must be gridfs, filesystem or memory", cfg.Attachments.Store)
 	}
 
 	// =============================================== //
@@ -122,7 +479,7 @@ func run() error {
 	cstore.Options.Secure = false
 	cstore.MaxAge(int((30 * 24 * time.Hour) / time.Second))
 
-	ab.Config.Storage.Server = auth.NewStorer(db, auth.CollectionConfiguration{cfg.Database.Collections.Users, cfg.Database.Collections.Sessions})
+	ab.Config.Storage.Server = users
 	ab.Config.Storage.SessionState = sessionStorer
 	ab.Config.Storage.CookieState = abclientstate.NewCookieStorer(cookieStoreKey, nil)
 
@@ -145,8 +502,9 @@ func run() error {
 	// =============================================== //
 	cors := cors.New(cors.Options{
 		AllowedOrigins:   cfg.Cors.AllowedHosts,
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "Idempotency-Key", "Last-Event-ID"},
+		ExposedHeaders:   []string{"Link", "X-Next-Cursor", "Idempotent-Replayed"},
 		AllowCredentials: true,
 		MaxAge:           300, // Maximum value not ignored by any of major browsers
 	})
@@ -156,14 +514,57 @@ func run() error {
 	// =============================================== //
 	log.Println("main : Started : Initializing API support")
 
-	collections := handlers.Collections{
-		Observations: cfg.Database.Collections.Observations,
-		People:       cfg.Database.Collections.People,
+	limits := handlers.Limits{
+		BatchSize:         cfg.Observations.BatchLimit,
+		ExportTimeout:     cfg.Observations.ExportTimeout,
+		AttachmentSize:    cfg.Attachments.MaxSize,
+		IdempotencyWindow: cfg.Observations.IdempotencyWindow,
+		AllowedOrigins:    cfg.Cors.AllowedHosts,
 	}
 
-	router := handlers.API(build, db, ab, collections, cors, version)
+	broker := subscriptions.NewBroker()
+	router := handlers.API(build, repos, broker, ab, limits, cors, version)
 
-	http.ListenAndServe(cfg.APIHost, router)
+	api := http.Server{
+		Addr:    cfg.APIHost,
+		Handler: router,
+	}
+
+	// Subscriptions stream until the client leaves, so they are ended when
+	// the server shuts down rather than waited for.
+	api.RegisterOnShutdown(broker.Close)
+
+	serverErrors := make(chan error, 1)
+	go func() {
+		log.Printf("main : API listening on %s", api.Addr)
+		serverErrors <- api.ListenAndServe()
+	}()
+
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
+
+	// =============================================== //
+	// Shutdown
+	// =============================================== //
+	select {
+	case err := <-serverErrors:
+		return errors.Wrap(err, "starting api")
+
+	case sig := <-shutdown:
+		log.Printf("main : %v : Start shutdown", sig)
+
+		ctx, cancel := context.WithTimeout(ctx, cfg.ShutdownTimeout)
+		defer cancel()
+
+		// Requests in progress are given until the timeout to finish, and
+		// then the relays are stopped before the databases are closed.
+		err := api.Shutdown(ctx)
+		stopRelay()
+		if err != nil {
+			api.Close()
+			return errors.Wrap(err, "stopping api gracefully")
+		}
+	}
 
 	return nil
 }
@@ -21,9 +21,11 @@ require (
 	github.com/gorilla/csrf v1.6.2
 	github.com/gorilla/mux v1.6.2
 	github.com/gorilla/sessions v1.2.0
+	github.com/gorilla/websocket v1.4.2
 	github.com/jmoiron/sqlx v1.2.0
 	github.com/julienschmidt/httprouter v1.3.0 // indirect
 	github.com/justinas/nosurf v1.1.0
+	github.com/lib/pq v1.3.0
 	github.com/paulmach/go.geojson v1.4.0
 	github.com/pkg/errors v0.9.1
 	github.com/pquerna/otp v1.2.0 // indirect
@@ -34,6 +36,7 @@ require (
 	github.com/xeipuuv/gojsonschema v1.2.0
 	go.mongodb.org/mongo-driver v1.3.1
 	go.opencensus.io v0.22.3
+	golang.org/x/crypto v0.0.0-20200317142112-1b76d66859c6
 	google.golang.org/api v0.14.0
 	google.golang.org/grpc v1.21.1
 	gopkg.in/go-playground/assert.v1 v1.2.1
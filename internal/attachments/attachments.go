@@ -0,0 +1,273 @@
+// Package attachments stores the binary objects observations are made of,
+// such as photos, audio notes and documents.
+//
+// The content of an attachment is kept in a Store, in GridFS or on a local
+// filesystem, and a record of its name, media type, size and SHA-256 hash is
+// kept in a Repository. Attachments belong to an observation and are named
+// uniquely within it. The result of an observation references an attachment
+// with a Reference, so every revision of the observation can still be
+// downloaded.
+package attachments
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	// ErrorNotFound is returned when an attachment does not exist.
+	ErrorNotFound = errors.New("attachment not found")
+
+	// ErrorExists is returned when an observation already has a different
+	// attachment with the same name.
+	ErrorExists = errors.New("attachment already exists")
+
+	// ErrorTooLarge is returned when an attachment is larger than the limit.
+	ErrorTooLarge = errors.New("attachment is too large")
+
+	// ErrorInvalidName is returned when the name of an attachment is invalid.
+	ErrorInvalidName = errors.New("attachment names may only contain letters, numbers, ., _ and - and must start with a letter or number")
+)
+
+// validName matches the names of attachments. Names are used in urls and
+// file names so they are restricted to characters that are safe in both.
+var validName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+
+// Attachment is the record of a binary object attached to an observation.
+// Key identifies the content in the store.
+type Attachment struct {
+	ObservationID string    `json:"observationId"`
+	Name          string    `json:"name"`
+	MediaType     string    `json:"mediaType"`
+	Size          int64     `json:"size"`
+	SHA256        string    `json:"sha256"`
+	Key           string    `json:"-"`
+	CreatedBy     string    `json:"createdBy,omitempty"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+// Reference is the value placed in the result of an observation to reference
+// an attachment.
+func (a Attachment) Reference() bson.M {
+	return bson.M{
+		"attachment": a.Name,
+		"mediaType":  a.MediaType,
+		"size":       a.Size,
+		"sha256":     a.SHA256,
+	}
+}
+
+// ValidName reports whether a name may be used for an attachment.
+func ValidName(name string) bool {
+	return validName.MatchString(name)
+}
+
+// Upload stores the content of an attachment read from r and records it.
+// Content longer than limit bytes is rejected with ErrorTooLarge. When the
+// media type is empty it is detected from the content.
+//
+// Uploading the same content under the same name again returns the existing
+// attachment, so failed requests can be retried. Uploading different content
+// under a name that is in use fails with ErrorExists. Created reports whether
+// the attachment was stored by this upload rather than an earlier one.
+func Upload(ctx context.Context, records Repository, store Store, a Attachment, r io.Reader, limit int64) (attachment Attachment, created bool, err error) {
+	if !ValidName(a.Name) {
+		return a, false, ErrorInvalidName
+	}
+
+	prev, err := records.Find(ctx, a.ObservationID, a.Name)
+	if err != nil && err != ErrorNotFound {
+		return a, false, err
+	}
+	exists := err == nil
+
+	// Detect the media type from the start of the content when it is not
+	// known.
+	if a.MediaType == "" || a.MediaType == "application/octet-stream" {
+		head := make([]byte, 512)
+		n, err := io.ReadFull(r, head)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return a, false, errors.Wrap(err, "reading attachment")
+		}
+		a.MediaType = http.DetectContentType(head[:n])
+		r = io.MultiReader(bytes.NewReader(head[:n]), r)
+	}
+
+	hash := sha256.New()
+	counted := &limitedReader{r: io.TeeReader(r, hash), limit: limit}
+
+	a.Key = uuid.New().String()
+	if err := store.Put(ctx, a.Key, counted); err != nil {
+		if counted.exceeded {
+			return a, false, ErrorTooLarge
+		}
+		return a, false, errors.Wrap(err, "storing attachment")
+	}
+	a.Size = counted.n
+	a.SHA256 = hex.EncodeToString(hash.Sum(nil))
+
+	if !exists {
+		err = records.Save(ctx, a)
+		if err == nil {
+			return a, true, nil
+		}
+		if err != ErrorExists {
+			discard(store, a.Key)
+			return a, false, err
+		}
+
+		// Another request recorded the name while the content was stored.
+		if prev, err = records.Find(ctx, a.ObservationID, a.Name); err != nil {
+			discard(store, a.Key)
+			return a, false, err
+		}
+	}
+
+	discard(store, a.Key)
+	if prev.SHA256 != a.SHA256 {
+		return a, false, ErrorExists
+	}
+	return prev, false, nil
+}
+
+// Remove deletes the record and content of an attachment that is no longer
+// wanted, such as one uploaded for a revision that could not be saved.
+func Remove(ctx context.Context, records Repository, store Store, a Attachment) error {
+	if err := records.Delete(ctx, a.ObservationID, a.Name); err != nil {
+		return err
+	}
+	return errors.Wrapf(store.Delete(ctx, a.Key), "deleting attachment %s", a.Name)
+}
+
+// discard deletes content that will not be recorded. Content that cannot be
+// deleted is only wasted space, so failures are ignored.
+func discard(store Store, key string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	store.Delete(ctx, key)
+}
+
+// Save records an attachment. ErrorExists is returned if the observation
+// already has an attachment with the same name.
+func Save(ctx context.Context, collection *mongo.Collection, a Attachment) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if _, err := collection.InsertOne(ctx, a); err != nil {
+		if wErr, ok := err.(mongo.WriteException); ok {
+			for _, e := range wErr.WriteErrors {
+				if e.Code == 11000 {
+					return ErrorExists
+				}
+			}
+		}
+		return errors.Wrap(err, "saving attachment")
+	}
+
+	return nil
+}
+
+// Find retrieves the record of an attachment of an observation.
+func Find(ctx context.Context, collection *mongo.Collection, observationID, name string) (Attachment, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var a Attachment
+	err := collection.FindOne(ctx, bson.D{{Key: "observationid", Value: observationID}, {Key: "name", Value: name}}).Decode(&a)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return a, ErrorNotFound
+		}
+		return a, errors.Wrap(err, "finding attachment")
+	}
+
+	return a, nil
+}
+
+// Delete deletes the record of an attachment of an observation.
+func Delete(ctx context.Context, collection *mongo.Collection, observationID, name string) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := collection.DeleteOne(ctx, bson.D{{Key: "observationid", Value: observationID}, {Key: "name", Value: name}})
+	return errors.Wrap(err, "deleting attachment")
+}
+
+// List retrieves the records of the attachments of an observation, ordered by
+// name.
+func List(ctx context.Context, collection *mongo.Collection, observationID string) ([]Attachment, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "name", Value: 1}})
+	cursor, err := collection.Find(ctx, bson.D{{Key: "observationid", Value: observationID}}, opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching attachments")
+	}
+
+	var as []Attachment
+	if err := cursor.All(ctx, &as); err != nil {
+		return nil, errors.Wrap(err, "decoding attachments")
+	}
+
+	return as, nil
+}
+
+// Open opens the content of an attachment for reading. The caller must close
+// it.
+func Open(ctx context.Context, store Store, a Attachment) (io.ReadCloser, error) {
+	rc, err := store.Open(ctx, a.Key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening attachment %s", a.Name)
+	}
+	return rc, nil
+}
+
+// EnsureIndexes creates the index that names attachments uniquely within an
+// observation.
+func EnsureIndexes(ctx context.Context, collection *mongo.Collection) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "observationid", Value: 1}, {Key: "name", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return errors.Wrap(err, "creating attachment indexes")
+	}
+
+	return nil
+}
+
+// limitedReader counts the bytes read and fails once more than limit bytes
+// have been read.
+type limitedReader struct {
+	r        io.Reader
+	limit    int64
+	n        int64
+	exceeded bool
+}
+
+// Read reads from the underlying reader.
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.n > l.limit {
+		l.exceeded = true
+		return n, ErrorTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,134 @@
+package attachments_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/schafer14/obs/internal/attachments"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoringFilesOnTheFilesystem(t *testing.T) {
+
+	// Arrange
+	dir, err := ioutil.TempDir("", "attachments")
+	require.Nil(t, err, "creating directory")
+	defer os.RemoveAll(dir)
+	store, err := attachments.NewFilesystem(dir)
+	require.Nil(t, err, "creating store")
+	ctx := context.Background()
+	key := uuid.New().String()
+
+	// Act
+	require.Nil(t, store.Put(ctx, key, bytes.NewReader([]byte("wisteria"))), "storing content")
+	rc, err := store.Open(ctx, key)
+	require.Nil(t, err, "opening content")
+	content, err := ioutil.ReadAll(rc)
+	rc.Close()
+	require.Nil(t, err, "reading content")
+	require.Nil(t, store.Delete(ctx, key), "deleting content")
+
+	// Assert
+	assert.Equal(t, "wisteria", string(content), "content mismatch")
+	_, err = store.Open(ctx, key)
+	assert.Error(t, err, "deleted content opened")
+	assert.Error(t, store.Put(ctx, "../outside", bytes.NewReader(nil)), "key outside the directory accepted")
+	files, err := ioutil.ReadDir(dir)
+	require.Nil(t, err, "reading directory")
+	assert.Equal(t, 0, len(files), "files left in directory")
+}
+
+func TestAttachmentNames(t *testing.T) {
+
+	// Arrange
+	valid := []string{"photo.jpg", "audio-note_1.m4a", "Report.PDF"}
+	invalid := []string{"", ".hidden", "../photo.jpg", "photo 1.jpg", "photo/1.jpg"}
+
+	// Act and Assert
+	for _, name := range valid {
+		assert.True(t, attachments.ValidName(name), "valid name %q rejected", name)
+	}
+	for _, name := range invalid {
+		assert.False(t, attachments.ValidName(name), "invalid name %q accepted", name)
+	}
+}
+
+func TestUploadingAttachments(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Arrange
+	ctx := context.Background()
+	coll := db.Collection("attachments")
+	require.Nil(t, coll.Drop(ctx), "deleting collection")
+	require.Nil(t, attachments.EnsureIndexes(ctx, coll), "creating indexes")
+	store := attachments.NewGridFS(db, "attachments")
+
+	uploadAttachments(t, attachments.NewMongo(coll), store)
+}
+
+func TestUploadingAttachmentsInMemory(t *testing.T) {
+	uploadAttachments(t, attachments.NewMemory(), attachments.NewMemoryStore())
+}
+
+// uploadAttachments uploads attachments to a repository and store and checks
+// they can be found and read again.
+func uploadAttachments(t *testing.T, repo attachments.Repository, store attachments.Store) {
+
+	// Arrange
+	ctx := context.Background()
+	obsID := uuid.New().String()
+	png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 100)...)
+	sum := sha256.Sum256(png)
+	photo := attachments.Attachment{ObservationID: obsID, Name: "photo.png", CreatedBy: "banner", CreatedAt: time.Now()}
+
+	// Act
+	saved, created, err := attachments.Upload(ctx, repo, store, photo, bytes.NewReader(png), 1024)
+	require.Nil(t, err, "uploading attachment")
+	retried, retriedCreated, err := attachments.Upload(ctx, repo, store, photo, bytes.NewReader(png), 1024)
+	require.Nil(t, err, "uploading attachment again")
+	_, _, conflictErr := attachments.Upload(ctx, repo, store, photo, bytes.NewReader([]byte("different")), 1024)
+	large := attachments.Attachment{ObservationID: obsID, Name: "large.bin", CreatedAt: time.Now()}
+	_, _, largeErr := attachments.Upload(ctx, repo, store, large, bytes.NewReader(make([]byte, 2048)), 1024)
+
+	// Assert
+	assert.Equal(t, "image/png", saved.MediaType, "media type not detected")
+	assert.Equal(t, int64(len(png)), saved.Size, "size mismatch")
+	assert.Equal(t, hex.EncodeToString(sum[:]), saved.SHA256, "hash mismatch")
+	assert.True(t, created, "upload not created")
+	assert.Equal(t, saved.Key, retried.Key, "retried upload stored again")
+	assert.False(t, retriedCreated, "retried upload created")
+	assert.Equal(t, attachments.ErrorExists, conflictErr, "different content with the same name accepted")
+	assert.Equal(t, attachments.ErrorTooLarge, largeErr, "attachment over the limit accepted")
+
+	found, err := repo.Find(ctx, obsID, "photo.png")
+	require.Nil(t, err, "finding attachment")
+	rc, err := attachments.Open(ctx, store, found)
+	require.Nil(t, err, "opening attachment")
+	content, err := ioutil.ReadAll(rc)
+	rc.Close()
+	require.Nil(t, err, "reading attachment")
+	assert.Equal(t, png, content, "content mismatch")
+
+	list, err := repo.List(ctx, obsID)
+	require.Nil(t, err, "listing attachments")
+	assert.Equal(t, 1, len(list), "attachments mismatch")
+	_, err = repo.Find(ctx, obsID, "large.bin")
+	assert.Equal(t, attachments.ErrorNotFound, err, "attachment over the limit recorded")
+
+	require.Nil(t, attachments.Remove(ctx, repo, store, saved), "removing attachment")
+	_, err = repo.Find(ctx, obsID, "photo.png")
+	assert.Equal(t, attachments.ErrorNotFound, err, "removed attachment still recorded")
+	_, err = store.Open(ctx, saved.Key)
+	assert.Error(t, err, "removed attachment still stored")
+}
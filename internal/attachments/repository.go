@@ -0,0 +1,114 @@
+package attachments
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Repository keeps the records of attachments. Mongo keeps them in a mongo
+// collection, and Memory keeps them in the process so attachments can be used
+// without a database. The package functions of the same name describe each
+// method.
+type Repository interface {
+	Save(ctx context.Context, a Attachment) error
+	Find(ctx context.Context, observationID, name string) (Attachment, error)
+	List(ctx context.Context, observationID string) ([]Attachment, error)
+	Delete(ctx context.Context, observationID, name string) error
+}
+
+// Mongo is a repository of the records of attachments in a mongo collection.
+type Mongo struct {
+	collection *mongo.Collection
+}
+
+// NewMongo creates a repository of the records in a collection.
+func NewMongo(collection *mongo.Collection) *Mongo {
+	return &Mongo{collection: collection}
+}
+
+// Save records an attachment.
+func (m *Mongo) Save(ctx context.Context, a Attachment) error {
+	return Save(ctx, m.collection, a)
+}
+
+// Find retrieves the record of an attachment of an observation.
+func (m *Mongo) Find(ctx context.Context, observationID, name string) (Attachment, error) {
+	return Find(ctx, m.collection, observationID, name)
+}
+
+// List retrieves the records of the attachments of an observation, ordered
+// by name.
+func (m *Mongo) List(ctx context.Context, observationID string) ([]Attachment, error) {
+	return List(ctx, m.collection, observationID)
+}
+
+// Delete deletes the record of an attachment of an observation.
+func (m *Mongo) Delete(ctx context.Context, observationID, name string) error {
+	return Delete(ctx, m.collection, observationID, name)
+}
+
+// Memory is a repository of the records of attachments held in the process.
+// Records are lost when the process stops.
+type Memory struct {
+	mu      sync.RWMutex
+	records map[[2]string]Attachment
+}
+
+// NewMemory creates an empty repository of records.
+func NewMemory() *Memory {
+	return &Memory{records: map[[2]string]Attachment{}}
+}
+
+// Save records an attachment.
+func (m *Memory) Save(ctx context.Context, a Attachment) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := [2]string{a.ObservationID, a.Name}
+	if _, ok := m.records[id]; ok {
+		return ErrorExists
+	}
+	m.records[id] = a
+	return nil
+}
+
+// Find retrieves the record of an attachment of an observation.
+func (m *Memory) Find(ctx context.Context, observationID, name string) (Attachment, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	a, ok := m.records[[2]string{observationID, name}]
+	if !ok {
+		return a, ErrorNotFound
+	}
+	return a, nil
+}
+
+// List retrieves the records of the attachments of an observation, ordered
+// by name.
+func (m *Memory) List(ctx context.Context, observationID string) ([]Attachment, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var as []Attachment
+	for _, a := range m.records {
+		if a.ObservationID == observationID {
+			as = append(as, a)
+		}
+	}
+	sort.Slice(as, func(i, j int) bool { return as[i].Name < as[j].Name })
+
+	return as, nil
+}
+
+// Delete deletes the record of an attachment of an observation.
+func (m *Memory) Delete(ctx context.Context, observationID, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.records, [2]string{observationID, name})
+	return nil
+}
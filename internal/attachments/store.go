@@ -0,0 +1,208 @@
+package attachments
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Store keeps the content of attachments under a key.
+type Store interface {
+	Put(ctx context.Context, key string, r io.Reader) error
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// validKey matches the keys content is stored under.
+var validKey = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+// GridFS stores content in a GridFS bucket of a database.
+type GridFS struct {
+	db     *mongo.Database
+	bucket string
+}
+
+// NewGridFS creates a store in the bucket of a database with a name.
+func NewGridFS(db *mongo.Database, bucket string) *GridFS {
+	return &GridFS{db: db, bucket: bucket}
+}
+
+// open opens the bucket. Buckets are not safe for concurrent use, so one is
+// opened for each operation.
+func (g *GridFS) open() (*gridfs.Bucket, error) {
+	b, err := gridfs.NewBucket(g.db, options.GridFSBucket().SetName(g.bucket))
+	if err != nil {
+		return nil, errors.Wrap(err, "opening gridfs bucket")
+	}
+	return b, nil
+}
+
+// Put stores content read from r. Content that fails to be read is not
+// stored.
+func (g *GridFS) Put(ctx context.Context, key string, r io.Reader) error {
+	b, err := g.open()
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		b.SetWriteDeadline(deadline)
+	}
+
+	return b.UploadFromStreamWithID(key, key, r)
+}
+
+// Open opens the content stored under a key.
+func (g *GridFS) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	b, err := g.open()
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		b.SetReadDeadline(deadline)
+	}
+
+	return b.OpenDownloadStream(key)
+}
+
+// Delete deletes the content stored under a key.
+func (g *GridFS) Delete(ctx context.Context, key string) error {
+	b, err := g.open()
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		b.SetWriteDeadline(deadline)
+	}
+
+	if err := b.Delete(key); err != nil && err != gridfs.ErrFileNotFound {
+		return err
+	}
+	return nil
+}
+
+// Filesystem stores content as files in a directory.
+type Filesystem struct {
+	dir string
+}
+
+// NewFilesystem creates a store in a directory, creating the directory if it
+// does not exist.
+func NewFilesystem(dir string) (*Filesystem, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, errors.Wrap(err, "creating attachment directory")
+	}
+	return &Filesystem{dir: dir}, nil
+}
+
+// path is the file content is stored in. Keys are checked so they cannot name
+// files outside the directory.
+func (f *Filesystem) path(key string) (string, error) {
+	if !validKey.MatchString(key) {
+		return "", errors.Errorf("invalid attachment key %q", key)
+	}
+	return filepath.Join(f.dir, key), nil
+}
+
+// Put stores content read from r. The content is written to a temporary file
+// which is renamed once it is complete, so partial content is never opened.
+func (f *Filesystem) Put(ctx context.Context, key string, r io.Reader) error {
+	path, err := f.path(key)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(f.dir, ".upload-")
+	if err != nil {
+		return errors.Wrap(err, "creating attachment file")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "writing attachment file")
+	}
+
+	return errors.Wrap(os.Rename(tmp.Name(), path), "writing attachment file")
+}
+
+// Open opens the content stored under a key.
+func (f *Filesystem) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := f.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// Delete deletes the content stored under a key.
+func (f *Filesystem) Delete(ctx context.Context, key string) error {
+	path, err := f.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// MemoryStore stores content in the process. Content is lost when the
+// process stops.
+type MemoryStore struct {
+	mu      sync.RWMutex
+	content map[string][]byte
+}
+
+// NewMemoryStore creates an empty store in memory.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{content: map[string][]byte{}}
+}
+
+// Put stores content read from r. Content is only stored once it has all
+// been read, so partial content is never opened.
+func (m *MemoryStore) Put(ctx context.Context, key string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.content[key] = data
+	return nil
+}
+
+// Open opens the content stored under a key.
+func (m *MemoryStore) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	data, ok := m.content[key]
+	if !ok {
+		return nil, errors.Errorf("attachment key %q not found", key)
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// Delete deletes the content stored under a key.
+func (m *MemoryStore) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.content, key)
+	return nil
+}
@@ -11,6 +11,14 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
+// Repository stores users for authboss. Storer stores users in mongo,
+// Firestore stores them in a firestore collection, and Memory stores them in
+// the process so users can be used without a database.
+type Repository interface {
+	authboss.CreatingServerStorer
+	LoadByConfirmSelector(ctx context.Context, selector string) (authboss.ConfirmableUser, error)
+}
+
 type CollectionConfiguration struct {
 	Users    string
 	Sessions string
@@ -58,8 +66,10 @@ type User struct {
 // This pattern is useful in real code to ensure that
 // we've got the right interfaces implemented.
 var (
-	assertUser   = &User{}
-	assertStorer = &Storer{}
+	assertUser      = &User{}
+	assertStorer    = &Storer{}
+	assertMemory    = &Memory{}
+	assertFirestore = &Firestore{}
 
 	_ authboss.User            = assertUser
 	_ authboss.AuthableUser    = assertUser
@@ -72,6 +82,9 @@ var (
 
 	_ authboss.CreatingServerStorer   = assertStorer
 	_ authboss.ConfirmingServerStorer = assertStorer
+	_ Repository                      = assertStorer
+	_ Repository                      = assertMemory
+	_ Repository                      = assertFirestore
 	// _ authboss.RecoveringServerStorer  = assertStorer
 	// _ authboss.RememberingServerStorer = assertStorer
 )
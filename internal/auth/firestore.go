@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"context"
+	"net/url"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/pkg/errors"
+	"github.com/volatiletech/authboss"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Firestore stores users in a firestore collection, keyed by their email.
+type Firestore struct {
+	client *firestore.Client
+	users  *firestore.CollectionRef
+}
+
+// NewFirestore creates a store of the users in a collection.
+func NewFirestore(client *firestore.Client, collection string) *Firestore {
+	return &Firestore{client: client, users: client.Collection(collection)}
+}
+
+// user finds the document of the user with an email.
+func (f *Firestore) user(email string) *firestore.DocumentRef {
+	return f.users.Doc(url.PathEscape(email))
+}
+
+// Save the user
+func (f *Firestore) Save(ctx context.Context, user authboss.User) error {
+	u := user.(*User)
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	doc := f.user(u.Email)
+	err := f.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		if _, err := tx.Get(doc); err != nil {
+			return err
+		}
+		return tx.Set(doc, u)
+	})
+	if status.Code(err) == codes.NotFound {
+		return authboss.ErrUserNotFound
+	}
+
+	return errors.Wrap(err, "storing user")
+}
+
+// Load the user
+func (f *Firestore) Load(ctx context.Context, key string) (authboss.User, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	// Check to see if our key is actually an oauth2 pid
+	if provider, uid, err := authboss.ParseOAuth2PID(key); err == nil {
+		u, err := f.find(ctx, f.users.Where("OAuth2Provider", "==", provider).Where("OAuth2UID", "==", uid))
+		if err != nil {
+			return nil, err
+		}
+		return u, nil
+	}
+
+	snap, err := f.user(key).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, authboss.ErrUserNotFound
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching user")
+	}
+
+	var u User
+	if err := snap.DataTo(&u); err != nil {
+		return nil, errors.Wrap(err, "decoding user")
+	}
+
+	return &u, nil
+}
+
+// New user creation
+func (f *Firestore) New(_ context.Context) authboss.User {
+	return &User{}
+}
+
+// Create the user
+func (f *Firestore) Create(ctx context.Context, user authboss.User) error {
+	u := user.(*User)
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := f.user(u.Email).Create(ctx, u)
+	if status.Code(err) == codes.AlreadyExists {
+		return authboss.ErrUserFound
+	}
+
+	return errors.Wrap(err, "storing user")
+}
+
+// LoadByConfirmSelector looks a user up by confirmation token
+func (f *Firestore) LoadByConfirmSelector(ctx context.Context, selector string) (authboss.ConfirmableUser, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	u, err := f.find(ctx, f.users.Where("ConfirmSelector", "==", selector))
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// find retrieves the first user matching a query.
+func (f *Firestore) find(ctx context.Context, q firestore.Query) (*User, error) {
+	snaps, err := q.Limit(1).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching user")
+	}
+	if len(snaps) == 0 {
+		return nil, authboss.ErrUserNotFound
+	}
+
+	var u User
+	if err := snaps[0].DataTo(&u); err != nil {
+		return nil, errors.Wrap(err, "decoding user")
+	}
+
+	return &u, nil
+}
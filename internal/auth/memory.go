@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"context"
+	"sync"
+
+	"github.com/volatiletech/authboss"
+)
+
+// Memory stores users in the process. Users are lost when the process stops.
+type Memory struct {
+	mu    sync.RWMutex
+	users map[string]User
+}
+
+// NewMemory creates an empty store of users.
+func NewMemory() *Memory {
+	return &Memory{users: map[string]User{}}
+}
+
+// Save the user
+func (m *Memory) Save(_ context.Context, user authboss.User) error {
+	u := user.(*User)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[u.Email]; !ok {
+		return authboss.ErrUserNotFound
+	}
+	m.users[u.Email] = *u
+	return nil
+}
+
+// Load the user
+func (m *Memory) Load(_ context.Context, key string) (authboss.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	// Check to see if our key is actually an oauth2 pid
+	if provider, uid, err := authboss.ParseOAuth2PID(key); err == nil {
+		for _, u := range m.users {
+			if u.OAuth2Provider == provider && u.OAuth2UID == uid {
+				return &u, nil
+			}
+		}
+		return nil, authboss.ErrUserNotFound
+	}
+
+	u, ok := m.users[key]
+	if !ok {
+		return nil, authboss.ErrUserNotFound
+	}
+	return &u, nil
+}
+
+// New user creation
+func (m *Memory) New(_ context.Context) authboss.User {
+	return &User{}
+}
+
+// Create the user
+func (m *Memory) Create(_ context.Context, user authboss.User) error {
+	u := user.(*User)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[u.Email]; ok {
+		return authboss.ErrUserFound
+	}
+	m.users[u.Email] = *u
+	return nil
+}
+
+// LoadByConfirmSelector looks a user up by confirmation token
+func (m *Memory) LoadByConfirmSelector(_ context.Context, selector string) (authboss.ConfirmableUser, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, u := range m.users {
+		if u.ConfirmSelector == selector {
+			return &u, nil
+		}
+	}
+	return nil, authboss.ErrUserNotFound
+}
@@ -0,0 +1,103 @@
+// Package events publishes events about observations to message brokers.
+//
+// When observations are stored in mongo, postgres or firestore, each
+// revision of an observation is saved with a mark that its event has not been
+// published, in the same write as the revision. An outbox relays the events
+// of the marked revisions to a broker and then clears the mark, so an event
+// is not lost when the broker is unavailable or the API stops before the
+// event is published. Events may be published more than once, so consumers
+// should ignore events whose id they have already seen.
+//
+// The schema of events is versioned. Fields may be added to a version, but
+// fields are only removed or changed in a new version.
+package events
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/schafer14/obs/internal/observations"
+)
+
+// Version is the version of the schema of events.
+const Version = 1
+
+// Types of events.
+const (
+	// ObservationCreated is published when an observation is created.
+	ObservationCreated = "observation.created"
+
+	// ObservationRevised is published when a new revision of an observation
+	// is saved.
+	ObservationRevised = "observation.revised"
+)
+
+// Event is something that happened to an observation. Events are published
+// as JSON.
+type Event struct {
+	ID          string                   `json:"id"`
+	Type        string                   `json:"type"`
+	Version     int                      `json:"version"`
+	Time        time.Time                `json:"time"`
+	Observation observations.Observation `json:"observation"`
+}
+
+// Created creates the event for an observation being created.
+func Created(obs observations.Observation, now time.Time) Event {
+	return Event{
+		ID:          uuid.New().String(),
+		Type:        ObservationCreated,
+		Version:     Version,
+		Time:        now,
+		Observation: obs,
+	}
+}
+
+// Revised creates the event for a new revision of an observation.
+func Revised(obs observations.Observation, now time.Time) Event {
+	e := Created(obs, now)
+	e.Type = ObservationRevised
+	return e
+}
+
+// Saved creates the event for a revision of an observation that has been
+// saved, which is ObservationCreated for the first revision and
+// ObservationRevised for later revisions. The event happened when the
+// revision was modified, and its id is derived from the revision so the event
+// keeps its id each time it is published.
+func Saved(obs observations.Observation) Event {
+	e := Created(obs, obs.ModifiedAt)
+	if obs.Revision > 1 {
+		e.Type = ObservationRevised
+	}
+	e.ID = uuid.NewSHA1(uuid.NameSpaceURL, []byte(fmt.Sprintf("urn:observation:%s:%d", obs.ID, obs.Revision))).String()
+	return e
+}
+
+// Publisher publishes events to a message broker.
+type Publisher interface {
+	Publish(ctx context.Context, e Event) error
+}
+
+// Fanout publishes events to each of a list of publishers. Every publisher is
+// tried even when others fail, and the first failure is returned.
+//
+// Delivery is not tracked for each publisher. When an outbox relays to a
+// fanout and one publisher fails, the event is relayed again to every
+// publisher, including those it already reached. Publishers must take the
+// same event more than once, and subscribers must ignore events whose id they
+// have already seen.
+type Fanout []Publisher
+
+// Publish publishes an event to every publisher.
+func (f Fanout) Publish(ctx context.Context, e Event) error {
+	var first error
+	for _, p := range f {
+		if err := p.Publish(ctx, e); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,247 @@
+package events_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/schafer14/obs/internal/events"
+	"github.com/schafer14/obs/internal/observations"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemorySubscribers(t *testing.T) {
+
+	// Arrange
+	m := events.NewMemory()
+	var received []events.Event
+	unsubscribe := m.Subscribe(func(e events.Event) { received = append(received, e) })
+	first := events.Created(observations.Observation{ID: "first"}, time.Now())
+	second := events.Created(observations.Observation{ID: "second"}, time.Now())
+
+	// Act
+	require.Nil(t, m.Publish(context.Background(), first), "publishing event")
+	unsubscribe()
+	require.Nil(t, m.Publish(context.Background(), second), "publishing event")
+
+	// Assert
+	require.Equal(t, 1, len(received), "events received mismatch")
+	assert.Equal(t, first.ID, received[0].ID, "event mismatch")
+	assert.Equal(t, events.Version, received[0].Version, "event version mismatch")
+	assert.NotEqual(t, first.ID, second.ID, "event ids are not unique")
+}
+
+func TestPublishingToNATS(t *testing.T) {
+
+	// Arrange
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err, "listening")
+	defer l.Close()
+	published := make(chan string, 1)
+	go fakeNATS(l, published)
+
+	n, err := events.NewNATS("nats://banner:secret@"+l.Addr().String(), "obs")
+	require.Nil(t, err, "creating publisher")
+	defer n.Close()
+	e := events.Created(observations.Observation{ID: "7c1e2d2e-91b5-4b43-9f0a-5d2b7c9a3b11"}, time.Now())
+
+	// Act
+	err = n.Publish(context.Background(), e)
+
+	// Assert
+	require.Nil(t, err, "publishing event")
+	msg := <-published
+	assert.True(t, strings.HasPrefix(msg, "obs.observation.created "), "subject mismatch %q", msg)
+	var got events.Event
+	require.Nil(t, json.Unmarshal([]byte(msg[strings.Index(msg, "{"):]), &got), "decoding event")
+	assert.Equal(t, e.ID, got.ID, "event mismatch")
+	assert.Equal(t, e.Observation.ID, got.Observation.ID, "observation mismatch")
+}
+
+func TestInvalidNATSURLs(t *testing.T) {
+
+	// Arrange
+	urls := []string{"localhost:4222", "http://localhost:4222", "nats://"}
+
+	for _, u := range urls {
+
+		// Act
+		_, err := events.NewNATS(u, "obs")
+
+		// Assert
+		assert.Error(t, err, "invalid url %q accepted", u)
+	}
+}
+
+func TestEventsOfSavedRevisions(t *testing.T) {
+
+	// Arrange
+	now := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	first := observations.Observation{ID: "7c1e2d2e-91b5-4b43-9f0a-5d2b7c9a3b11", Revision: 1, ModifiedAt: now}
+	second := first
+	second.Revision = 2
+
+	// Act
+	created := events.Saved(first)
+	again := events.Saved(first)
+	revised := events.Saved(second)
+
+	// Assert
+	assert.Equal(t, events.ObservationCreated, created.Type, "first revision type mismatch")
+	assert.Equal(t, events.ObservationRevised, revised.Type, "later revision type mismatch")
+	assert.Equal(t, now, created.Time, "event time mismatch")
+	assert.Equal(t, created.ID, again.ID, "event id changed when published again")
+	assert.NotEqual(t, created.ID, revised.ID, "revisions share an event id")
+}
+
+func TestRelayingEvents(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Arrange
+	ctx := context.Background()
+	require.Nil(t, coll.Drop(ctx), "deleting collection")
+	repo := observations.NewMongo(coll)
+	outbox := events.NewOutbox(repo)
+	now := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	var saved []observations.Observation
+	for i := 0; i < 3; i++ {
+		obs := observations.Observation{ID: strconv.Itoa(i), Revision: 1, ModifiedAt: now.Add(time.Duration(i) * time.Minute)}
+		require.Nil(t, repo.Save(ctx, obs), "saving observation")
+		saved = append(saved, obs)
+	}
+	revision := saved[0]
+	revision.Revision, revision.ModifiedAt = 2, now.Add(time.Hour)
+	require.Nil(t, repo.Supersede(ctx, revision), "superseding observation")
+
+	broker := &flakyBroker{failAfter: 1}
+
+	// Act
+	failed, err := outbox.Relay(ctx, broker)
+	require.Error(t, err, "broker failure not reported")
+	broker.failAfter = -1
+	relayed, err := outbox.Relay(ctx, broker)
+	require.Nil(t, err, "relaying events")
+	again, err := outbox.Relay(ctx, broker)
+	require.Nil(t, err, "relaying events again")
+
+	// Assert
+	assert.Equal(t, 1, failed, "events relayed before failure mismatch")
+	assert.Equal(t, 3, relayed, "pending events not relayed")
+	assert.Equal(t, 0, again, "published events relayed again")
+	var ids, types []string
+	for _, e := range broker.published {
+		ids = append(ids, e.Observation.ID)
+		types = append(types, e.Type)
+	}
+	assert.Equal(t, []string{"0", "1", "2", "0"}, ids, "events not relayed in order")
+	assert.Equal(t, events.ObservationRevised, types[3], "revision not relayed as revised")
+}
+
+func TestRelayingToAFanoutWithAFailingPublisher(t *testing.T) {
+
+	// Arrange
+	ctx := context.Background()
+	now := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	source := &pending{observations: []observations.Observation{{ID: "7c1e2d2e-91b5-4b43-9f0a-5d2b7c9a3b11", Revision: 1, ModifiedAt: now}}}
+	memory := events.NewMemory()
+	var received []events.Event
+	memory.Subscribe(func(e events.Event) { received = append(received, e) })
+	broker := &flakyBroker{failAfter: 0}
+	outbox := events.NewOutbox(source)
+
+	// Act
+	failed, err := outbox.Relay(ctx, events.Fanout{memory, broker})
+	require.Error(t, err, "publisher failure not reported")
+	broker.failAfter = -1
+	relayed, err := outbox.Relay(ctx, events.Fanout{memory, broker})
+	require.Nil(t, err, "relaying events")
+
+	// Assert
+	assert.Equal(t, 0, failed, "event relayed when a publisher failed")
+	assert.Equal(t, 1, relayed, "event not relayed again")
+	require.Equal(t, 2, len(received), "event not published again to the publisher that took it")
+	assert.Equal(t, received[0].ID, received[1].ID, "event published again with another id")
+	require.Equal(t, 1, len(broker.published), "events published to the failed publisher mismatch")
+	assert.Equal(t, received[0].ID, broker.published[0].ID, "event mismatch")
+}
+
+// pending is a source of observations whose events have not been published.
+type pending struct {
+	observations []observations.Observation
+}
+
+// Unpublished returns the observations whose events have not been published.
+func (p *pending) Unpublished(ctx context.Context, limit int) ([]observations.Observation, error) {
+	if len(p.observations) > limit {
+		return p.observations[:limit], nil
+	}
+	return p.observations, nil
+}
+
+// MarkPublished removes an observation from the pending observations.
+func (p *pending) MarkPublished(ctx context.Context, obs observations.Observation) error {
+	for i, o := range p.observations {
+		if o.ID == obs.ID && o.Revision == obs.Revision {
+			p.observations = append(p.observations[:i], p.observations[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+// flakyBroker fails once failAfter events have been published.
+type flakyBroker struct {
+	failAfter int
+	published []events.Event
+}
+
+// Publish records an event unless the broker is failing.
+func (b *flakyBroker) Publish(ctx context.Context, e events.Event) error {
+	if b.failAfter >= 0 && len(b.published) >= b.failAfter {
+		return errors.New("broker is down")
+	}
+	b.published = append(b.published, e)
+	return nil
+}
+
+// fakeNATS accepts a single connection and speaks enough of the NATS protocol
+// to receive one message, which is sent to published as its subject, size
+// and payload.
+func fakeNATS(l net.Listener, published chan<- string) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	conn.Write([]byte(`INFO {"server_id":"test","auth_required":true}` + "\r\n"))
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch {
+		case strings.HasPrefix(line, "CONNECT "):
+			if !strings.Contains(line, `"pass":"secret"`) {
+				conn.Write([]byte("-ERR 'Authorization Violation'\r\n"))
+				return
+			}
+		case strings.HasPrefix(line, "PING"):
+			conn.Write([]byte("PONG\r\n"))
+		case strings.HasPrefix(line, "PUB "):
+			payload, _ := r.ReadString('\n')
+			published <- strings.TrimSpace(strings.TrimPrefix(line, "PUB ")) + " " + strings.TrimSpace(payload)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package events
+
+import (
+	"context"
+	"sync"
+)
+
+// Memory is a broker inside the process. Events published to it are passed
+// to its subscribers as they are published, and are not kept.
+type Memory struct {
+	mu          sync.Mutex
+	subscribers map[int]func(Event)
+	next        int
+}
+
+// NewMemory creates a broker without subscribers.
+func NewMemory() *Memory {
+	return &Memory{subscribers: map[int]func(Event){}}
+}
+
+// Publish passes an event to every subscriber.
+func (m *Memory) Publish(ctx context.Context, e Event) error {
+	m.mu.Lock()
+	subscribers := make([]func(Event), 0, len(m.subscribers))
+	for _, fn := range m.subscribers {
+		subscribers = append(subscribers, fn)
+	}
+	m.mu.Unlock()
+
+	for _, fn := range subscribers {
+		fn(e)
+	}
+	return nil
+}
+
+// Subscribe calls fn with each event published until the returned function
+// is called. Events are published once fn returns, so fn must not block.
+func (m *Memory) Subscribe(fn func(Event)) func() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := m.next
+	m.next++
+	m.subscribers[id] = fn
+
+	return func() {
+		m.mu.Lock()
+		delete(m.subscribers, id)
+		m.mu.Unlock()
+	}
+}
@@ -0,0 +1,81 @@
+package events
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/schafer14/obs/internal/observations"
+)
+
+// relayBatch is the most events relayed at a time.
+const relayBatch = 100
+
+// Source stores revisions of observations with a mark that their events have
+// not been published, which is written with the revision so that no event is
+// lost. observations.Mongo, observations.Postgres and observations.Firestore
+// are sources.
+type Source interface {
+	Unpublished(ctx context.Context, limit int) ([]observations.Observation, error)
+	MarkPublished(ctx context.Context, obs observations.Observation) error
+}
+
+// Outbox relays the events of observations from where they are stored to a
+// broker. The observations are the outbox, so observations are not published
+// to it. The events of observations saved before the outbox was used are not
+// published.
+type Outbox struct {
+	source Source
+}
+
+// NewOutbox creates an outbox of the observations in a source.
+func NewOutbox(source Source) *Outbox {
+	return &Outbox{source}
+}
+
+// Relay publishes the events of unpublished revisions to a broker in the
+// order they were saved and reports how many were published. Relaying stops
+// at the first event that cannot be published, so that events are published
+// in order once the broker is available.
+func (o *Outbox) Relay(ctx context.Context, p Publisher) (int, error) {
+	relayed := 0
+	for {
+		obss, err := o.source.Unpublished(ctx, relayBatch)
+		if err != nil {
+			return relayed, err
+		}
+
+		for _, obs := range obss {
+			if err := p.Publish(ctx, Saved(obs)); err != nil {
+				return relayed, errors.Wrapf(err, "publishing event of observation %s", obs.ID)
+			}
+			if err := o.source.MarkPublished(ctx, obs); err != nil {
+				return relayed, err
+			}
+			relayed++
+		}
+
+		if len(obss) < relayBatch {
+			return relayed, nil
+		}
+	}
+}
+
+// Run relays events to a broker every interval until the context is done.
+// Failures are reported to onError and retried at the next interval.
+func (o *Outbox) Run(ctx context.Context, p Publisher, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := o.Relay(ctx, p); err != nil && ctx.Err() == nil {
+			onError(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
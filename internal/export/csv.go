@@ -0,0 +1,259 @@
+package export
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/schafer14/obs/internal/observations"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MaxColumns is the most result and tag columns a CSV export may have.
+const MaxColumns = 1000
+
+// ErrTooManyColumns is returned when the observations being exported have
+// more than MaxColumns distinct result fields and tags.
+var ErrTooManyColumns = fmt.Errorf("observations have more than %d result fields and tags", MaxColumns)
+
+// fixedColumns are the columns every CSV export starts with.
+var fixedColumns = []string{
+	"id",
+	"phenomenonTime",
+	"resultTime",
+	"validInterval.startTime",
+	"validInterval.duration",
+	"phenomenonLocation",
+	"observationLocation",
+	"featureId",
+	"featureLabel",
+	"featureTypeId",
+	"propertyId",
+	"propertyLabel",
+	"propertyTypeId",
+	"processId",
+	"scale",
+	"revision",
+	"modifiedBy",
+	"modifiedAt",
+}
+
+// Columns collects the result fields and tags of observations. The columns of
+// a CSV export must be known before the first row is written, so they are
+// collected from the observations before they are exported.
+type Columns struct {
+	results map[string]bool
+	tags    map[string]bool
+}
+
+// NewColumns creates an empty set of columns.
+func NewColumns() *Columns {
+	return &Columns{results: map[string]bool{}, tags: map[string]bool{}}
+}
+
+// Add adds the result fields and tags of an observation to the columns.
+func (c *Columns) Add(obs observations.Observation) error {
+	for key := range flatten("", obs.Result) {
+		c.results[key] = true
+	}
+	for key := range obs.Tags {
+		c.tags[key] = true
+	}
+
+	if len(c.results)+len(c.tags) > MaxColumns {
+		return ErrTooManyColumns
+	}
+
+	return nil
+}
+
+// header lists the names of every column in order.
+func (c *Columns) header() (header, results, tags []string) {
+	results = sortedKeys(c.results)
+	tags = sortedKeys(c.tags)
+
+	header = append([]string{}, fixedColumns...)
+	for _, key := range results {
+		header = append(header, "result."+key)
+	}
+	for _, key := range tags {
+		header = append(header, "tags."+key)
+	}
+
+	return header, results, tags
+}
+
+// csvEncoder writes observations as rows of comma separated values.
+type csvEncoder struct {
+	w       *csv.Writer
+	header  []string
+	results []string
+	tags    []string
+	started bool
+}
+
+// NewCSV creates an encoder that writes comma separated values with a
+// column for each of the result fields and tags in columns. Nested result
+// fields are flattened to dotted column names such as result.soil.ph, and
+// arrays are written as JSON. Cells that look like formulas are escaped, see
+// escapeFormula.
+func NewCSV(w io.Writer, columns *Columns) Encoder {
+	header, results, tags := columns.header()
+	return &csvEncoder{w: csv.NewWriter(w), header: header, results: results, tags: tags}
+}
+
+// Encode writes an observation as a row, writing the header first.
+func (e *csvEncoder) Encode(obs observations.Observation) error {
+	if err := e.start(); err != nil {
+		return err
+	}
+
+	row := []string{
+		obs.ID,
+		cell(obs.PhenomenonTime),
+		cell(obs.ResultTime),
+		cell(obs.ValidInterval.StartTime),
+		cell(int64(obs.ValidInterval.Duration)),
+		cell(obs.PhenomenonLocation),
+		cell(obs.ObservationLocation),
+		obs.FeatureID,
+		obs.Feature.Label,
+		obs.FeatureTypeID,
+		obs.PropertyID,
+		obs.Property.Label,
+		obs.PropertyTypeID,
+		obs.ProcessID,
+		obs.Scale,
+		cell(obs.Revision),
+		obs.ModifiedBy,
+		cell(obs.ModifiedAt),
+	}
+
+	result := flatten("", obs.Result)
+	for _, key := range e.results {
+		row = append(row, cell(result[key]))
+	}
+	for _, key := range e.tags {
+		row = append(row, obs.Tags[key])
+	}
+
+	for i := range row {
+		row[i] = escapeFormula(row[i])
+	}
+
+	if err := e.w.Write(row); err != nil {
+		return errors.Wrap(err, "writing row")
+	}
+
+	return nil
+}
+
+// Close writes the header if no observations were exported and flushes any
+// buffered rows.
+func (e *csvEncoder) Close() error {
+	if err := e.start(); err != nil {
+		return err
+	}
+
+	e.w.Flush()
+	return errors.Wrap(e.w.Error(), "writing rows")
+}
+
+// start writes the header before the first row.
+func (e *csvEncoder) start() error {
+	if e.started {
+		return nil
+	}
+	e.started = true
+
+	return errors.Wrap(e.w.Write(e.header), "writing header")
+}
+
+// flatten converts nested fields of a result to a map keyed by their dotted
+// path.
+func flatten(prefix string, m map[string]interface{}) map[string]interface{} {
+	flat := map[string]interface{}{}
+	for key, v := range m {
+		path := prefix + key
+		switch v := v.(type) {
+		case bson.M:
+			for k, nested := range flatten(path+".", v) {
+				flat[k] = nested
+			}
+		case map[string]interface{}:
+			for k, nested := range flatten(path+".", v) {
+				flat[k] = nested
+			}
+		case bson.D:
+			for k, nested := range flatten(path+".", v.Map()) {
+				flat[k] = nested
+			}
+		default:
+			flat[path] = v
+		}
+	}
+
+	return flat
+}
+
+// cell formats a value as the text of a cell.
+func cell(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case int:
+		return strconv.Itoa(v)
+	case int32:
+		return strconv.FormatInt(int64(v), 10)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case time.Time:
+		if v.IsZero() {
+			return ""
+		}
+		return v.UTC().Format(time.RFC3339Nano)
+	case primitive.DateTime:
+		return cell(time.Unix(0, int64(v)*int64(time.Millisecond)))
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil || string(data) == "null" {
+		return ""
+	}
+	return string(data)
+}
+
+// escapeFormula stops spreadsheets from evaluating text that looks like a
+// formula by prefixing it with a quote. Numbers are left as they are.
+func escapeFormula(s string) string {
+	if s == "" || !strings.ContainsAny(s[:1], "=+-@\t\r") {
+		return s
+	}
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		return s
+	}
+	return "'" + s
+}
+
+// sortedKeys returns the keys of a set in order.
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,142 @@
+// Package export writes observations in formats used by spreadsheets, GIS
+// tools and data pipelines. Each encoder writes observations one at a time so
+// large queries can be streamed without holding every observation in memory.
+package export
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/schafer14/obs/internal/observations"
+)
+
+// Format is a format observations can be exported in.
+type Format struct {
+	Name      string
+	MediaType string
+	Extension string
+}
+
+var (
+	// CSV exports observations as comma separated values with a column for
+	// each field of the result and each tag.
+	CSV = Format{Name: "csv", MediaType: "text/csv", Extension: "csv"}
+
+	// GeoJSON exports observations as a FeatureCollection with the phenomenon
+	// location of each observation as its geometry.
+	GeoJSON = Format{Name: "geojson", MediaType: "application/geo+json", Extension: "geojson"}
+
+	// NDJSON exports observations as newline delimited JSON.
+	NDJSON = Format{Name: "ndjson", MediaType: "application/x-ndjson", Extension: "ndjson"}
+
+	// OMXML exports observations as the observationData of an OGC SOS
+	// GetObservationResponse, see package omxml.
+	OMXML = Format{Name: "omxml", MediaType: "application/xml", Extension: "xml"}
+)
+
+// Formats are the supported export formats.
+var Formats = []Format{CSV, GeoJSON, NDJSON, OMXML}
+
+// Lookup finds the export format with a name.
+func Lookup(name string) (Format, bool) {
+	for _, f := range Formats {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return Format{}, false
+}
+
+// Encoder writes observations in an export format. Close must be called
+// after the last observation to complete the export.
+type Encoder interface {
+	Encode(obs observations.Observation) error
+	Close() error
+}
+
+// ndjsonEncoder writes each observation as a line of JSON.
+type ndjsonEncoder struct {
+	enc *json.Encoder
+}
+
+// NewNDJSON creates an encoder that writes newline delimited JSON.
+func NewNDJSON(w io.Writer) Encoder {
+	return &ndjsonEncoder{json.NewEncoder(w)}
+}
+
+// Encode writes an observation as a line of JSON.
+func (e *ndjsonEncoder) Encode(obs observations.Observation) error {
+	return errors.Wrap(e.enc.Encode(obs), "encoding observation")
+}
+
+// Close completes the export.
+func (e *ndjsonEncoder) Close() error {
+	return nil
+}
+
+// geojsonEncoder writes observations as the features of a FeatureCollection.
+type geojsonEncoder struct {
+	w        io.Writer
+	features int
+}
+
+// NewGeoJSON creates an encoder that writes a GeoJSON FeatureCollection.
+// Observations without a phenomenon location are features with a null
+// geometry.
+func NewGeoJSON(w io.Writer) Encoder {
+	return &geojsonEncoder{w: w}
+}
+
+// feature is an observation as a GeoJSON feature.
+type feature struct {
+	Type       string                 `json:"type"`
+	ID         string                 `json:"id"`
+	Geometry   interface{}            `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// Encode writes an observation as a feature.
+func (e *geojsonEncoder) Encode(obs observations.Observation) error {
+	data, err := json.Marshal(obs)
+	if err != nil {
+		return errors.Wrap(err, "encoding observation")
+	}
+
+	var properties map[string]interface{}
+	if err := json.Unmarshal(data, &properties); err != nil {
+		return errors.Wrap(err, "encoding observation")
+	}
+	delete(properties, "phenomenonLocation")
+
+	f := feature{Type: "Feature", ID: obs.ID, Properties: properties}
+	if obs.PhenomenonLocation != nil {
+		f.Geometry = obs.PhenomenonLocation
+	}
+
+	var buf bytes.Buffer
+	if e.features == 0 {
+		buf.WriteString(`{"type":"FeatureCollection","features":[`)
+	} else {
+		buf.WriteString(",")
+	}
+	if err := json.NewEncoder(&buf).Encode(f); err != nil {
+		return errors.Wrap(err, "encoding observation")
+	}
+	e.features++
+
+	_, err = e.w.Write(buf.Bytes())
+	return errors.Wrap(err, "writing observation")
+}
+
+// Close ends the FeatureCollection.
+func (e *geojsonEncoder) Close() error {
+	end := "]}\n"
+	if e.features == 0 {
+		end = `{"type":"FeatureCollection","features":[]}` + "\n"
+	}
+
+	_, err := io.WriteString(e.w, end)
+	return errors.Wrap(err, "writing feature collection")
+}
@@ -0,0 +1,165 @@
+package export_test
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	geojson "github.com/paulmach/go.geojson"
+	"github.com/schafer14/obs/internal/export"
+	"github.com/schafer14/obs/internal/observations"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestCSVFlattensResultsAndTags(t *testing.T) {
+
+	// Arrange
+	obss := mkObss()
+	columns := export.NewColumns()
+	for _, obs := range obss {
+		require.Nil(t, columns.Add(obs), "adding columns")
+	}
+	var buf bytes.Buffer
+
+	// Act
+	enc := export.NewCSV(&buf, columns)
+	for _, obs := range obss {
+		require.Nil(t, enc.Encode(obs), "encoding observation")
+	}
+	require.Nil(t, enc.Close(), "closing export")
+
+	// Assert
+	rows, err := csv.NewReader(&buf).ReadAll()
+	require.Nil(t, err, "reading csv")
+	require.Equal(t, 3, len(rows), "row count mismatch")
+
+	row := map[string]string{}
+	for i, name := range rows[0] {
+		row[name] = rows[2][i]
+	}
+	assert.Equal(t, "b", row["id"], "id invalid")
+	assert.Equal(t, "2020-03-01T00:00:00Z", row["phenomenonTime"], "time invalid")
+	assert.Equal(t, "6.5", row["result.soil.ph"], "nested result invalid")
+	assert.Equal(t, `["roses","ferns"]`, row["result.plants"], "array result invalid")
+	assert.Equal(t, "", row["result.wisteria"], "missing result invalid")
+	assert.Equal(t, "Banner", row["tags.observed by"], "tag invalid")
+	assert.Equal(t, "'=1+1", row["result.note"], "formula not escaped")
+}
+
+func TestCSVWithoutObservationsHasHeader(t *testing.T) {
+
+	// Arrange
+	var buf bytes.Buffer
+
+	// Act
+	err := export.NewCSV(&buf, export.NewColumns()).Close()
+
+	// Assert
+	require.Nil(t, err, "closing export")
+	assert.True(t, strings.HasPrefix(buf.String(), "id,phenomenonTime,"), "header missing")
+}
+
+func TestTooManyColumns(t *testing.T) {
+
+	// Arrange
+	result := bson.M{}
+	for i := 0; i <= export.MaxColumns; i++ {
+		result[strings.Repeat("k", i+1)] = i
+	}
+
+	// Act
+	err := export.NewColumns().Add(observations.Observation{Result: result})
+
+	// Assert
+	assert.Equal(t, export.ErrTooManyColumns, err, "too many columns accepted")
+}
+
+func TestGeoJSONFeatureCollection(t *testing.T) {
+
+	// Arrange
+	var buf bytes.Buffer
+
+	// Act
+	enc := export.NewGeoJSON(&buf)
+	for _, obs := range mkObss() {
+		require.Nil(t, enc.Encode(obs), "encoding observation")
+	}
+	require.Nil(t, enc.Close(), "closing export")
+
+	// Assert
+	fc, err := geojson.UnmarshalFeatureCollection(buf.Bytes())
+	require.Nil(t, err, "decoding feature collection")
+	require.Equal(t, 2, len(fc.Features), "feature count mismatch")
+	assert.Equal(t, []float64{153.02, -27.47}, fc.Features[0].Geometry.Point, "geometry invalid")
+	assert.Nil(t, fc.Features[1].Geometry, "missing geometry not null")
+	assert.Equal(t, "urn:example:health", fc.Features[0].Properties["property"].(map[string]interface{})["id"], "properties invalid")
+	_, ok := fc.Features[0].Properties["phenomenonLocation"]
+	assert.False(t, ok, "geometry repeated in properties")
+}
+
+func TestEmptyGeoJSONFeatureCollection(t *testing.T) {
+
+	// Arrange
+	var buf bytes.Buffer
+
+	// Act
+	err := export.NewGeoJSON(&buf).Close()
+
+	// Assert
+	require.Nil(t, err, "closing export")
+	fc, err := geojson.UnmarshalFeatureCollection(buf.Bytes())
+	require.Nil(t, err, "decoding feature collection")
+	assert.Equal(t, 0, len(fc.Features), "features in empty collection")
+}
+
+func TestNDJSONLines(t *testing.T) {
+
+	// Arrange
+	var buf bytes.Buffer
+
+	// Act
+	enc := export.NewNDJSON(&buf)
+	for _, obs := range mkObss() {
+		require.Nil(t, enc.Encode(obs), "encoding observation")
+	}
+	require.Nil(t, enc.Close(), "closing export")
+
+	// Assert
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Equal(t, 2, len(lines), "line count mismatch")
+	var obs observations.Observation
+	require.Nil(t, json.Unmarshal([]byte(lines[1]), &obs), "decoding line")
+	assert.Equal(t, "b", obs.ID, "observation invalid")
+}
+
+// mkObss creates observations with nested results, tags and locations.
+func mkObss() []observations.Observation {
+	health := observations.Referenceable{ID: "urn:example:health", Label: "Health"}
+	return []observations.Observation{
+		{
+			ID:                 "a",
+			PhenomenonTime:     time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC),
+			PhenomenonLocation: geojson.NewPointGeometry([]float64{153.02, -27.47}),
+			Property:           health,
+			PropertyID:         health.ID,
+			Result:             bson.M{"wisteria": int64(5)},
+		},
+		{
+			ID:             "b",
+			PhenomenonTime: time.Date(2020, 3, 1, 10, 0, 0, 0, time.FixedZone("AEST", 10*60*60)),
+			Property:       health,
+			PropertyID:     health.ID,
+			Result: bson.M{
+				"soil":   bson.M{"ph": 6.5},
+				"plants": bson.A{"roses", "ferns"},
+				"note":   "=1+1",
+			},
+			Tags: map[string]string{"observed by": "Banner"},
+		},
+	}
+}
@@ -0,0 +1,184 @@
+package graph
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"time"
+
+	driver "github.com/arangodb/go-driver"
+	"github.com/pkg/errors"
+	"github.com/schafer14/obs/internal/observations"
+)
+
+// Names of the arango graph and its collections.
+const (
+	graphName = "observations"
+	edges     = "observations"
+)
+
+// collections are the vertex collections of each kind of vertex.
+var collections = map[string]string{
+	Feature:  "features",
+	Property: "properties",
+	Process:  "processes",
+}
+
+// EnsureGraph creates the graph of observations and its collections in an
+// arango database when it does not exist.
+func EnsureGraph(ctx context.Context, db driver.Database) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	exists, err := db.GraphExists(ctx, graphName)
+	if err != nil {
+		return errors.Wrap(err, "checking graph")
+	}
+	if exists {
+		return nil
+	}
+
+	options := driver.CreateGraphOptions{
+		EdgeDefinitions: []driver.EdgeDefinition{{
+			Collection: edges,
+			From:       []string{collections[Process], collections[Feature]},
+			To:         []string{collections[Feature], collections[Property]},
+		}},
+	}
+
+	// Another instance may create the graph first, which is a conflict.
+	_, err = db.CreateGraph(ctx, graphName, &options)
+	if err != nil && !driver.IsConflict(err) {
+		return errors.Wrap(err, "creating graph")
+	}
+
+	return nil
+}
+
+// Arango is a graph in an arango database. Vertices are keyed by a hash of
+// their id, as ids are urls which are not valid arango keys.
+type Arango struct {
+	db driver.Database
+}
+
+// NewArango creates a graph in an arango database. The graph must exist,
+// see EnsureGraph.
+func NewArango(db driver.Database) *Arango {
+	return &Arango{db: db}
+}
+
+// key returns the arango key of an id.
+func key(id string) string {
+	sum := sha1.Sum([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+// handle returns the arango id of a vertex.
+func handle(kind, id string) string {
+	return collections[kind] + "/" + key(id)
+}
+
+// edge is an edge of an observation as stored in arango.
+type edge struct {
+	From        string `json:"_from"`
+	To          string `json:"_to"`
+	Observation string `json:"observation"`
+	Revision    int    `json:"revision"`
+}
+
+// Record adds the feature, property and process of an observation to the
+// graph and replaces the edges of earlier revisions of the observation.
+// Vertices keep their label when an observation has none.
+func (a *Arango) Record(ctx context.Context, obs observations.Observation) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	feature, property, process := vertices(obs)
+	for _, v := range []Vertex{feature, property, process} {
+		err := a.exec(ctx, `
+			UPSERT { _key: @key }
+			INSERT MERGE(@vertex, { _key: @key })
+			UPDATE @vertex
+			IN @@collection`,
+			map[string]interface{}{"key": key(v.ID), "vertex": v, "@collection": collections[v.Kind]})
+		if err != nil {
+			return errors.Wrapf(err, "saving %s", v.Kind)
+		}
+	}
+
+	// An edge is only replaced by a later revision, as events for an
+	// observation may arrive out of order.
+	paths := map[string]edge{
+		key(obs.ID) + "-feature":  {From: handle(Process, process.ID), To: handle(Feature, feature.ID), Observation: obs.ID, Revision: obs.Revision},
+		key(obs.ID) + "-property": {From: handle(Feature, feature.ID), To: handle(Property, property.ID), Observation: obs.ID, Revision: obs.Revision},
+	}
+	for k, e := range paths {
+		err := a.exec(ctx, `
+			UPSERT { _key: @key }
+			INSERT MERGE(@edge, { _key: @key })
+			UPDATE OLD.revision > @edge.revision ? {} : @edge
+			IN @@edges`,
+			map[string]interface{}{"key": k, "edge": e, "@edges": edges})
+		if err != nil {
+			return errors.Wrap(err, "saving observation edges")
+		}
+	}
+
+	return nil
+}
+
+// exec runs a query that returns nothing.
+func (a *Arango) exec(ctx context.Context, query string, bindVars map[string]interface{}) error {
+	cursor, err := a.db.Query(ctx, query, bindVars)
+	if err != nil {
+		return err
+	}
+	return cursor.Close()
+}
+
+// Features finds the features matching a traversal, ordered by id. Features
+// are traversed from the process when there is one, or else from the first
+// property.
+func (a *Arango) Features(ctx context.Context, t Traversal) ([]Vertex, error) {
+	properties, err := validate(t)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	start, direction := handle(Process, t.Process), "OUTBOUND"
+	if t.Process == "" {
+		start, direction = handle(Property, properties[0]), "INBOUND"
+	}
+	if properties == nil {
+		properties = []string{}
+	}
+
+	query := `
+		WITH features, properties, processes
+		FOR f IN 1 ` + direction + ` @start @@edges
+			OPTIONS { bfs: true, uniqueVertices: "global" }
+			LET has = (FOR p IN 1 OUTBOUND f @@edges RETURN DISTINCT p.id)
+			FILTER LENGTH(INTERSECTION(@properties, has)) == LENGTH(@properties)
+			RETURN f`
+
+	cursor, err := a.db.Query(ctx, query, map[string]interface{}{"start": start, "properties": properties, "@edges": edges})
+	if err != nil {
+		return nil, errors.Wrap(err, "traversing graph")
+	}
+	defer cursor.Close()
+
+	features := []Vertex{}
+	for cursor.HasMore() {
+		var v Vertex
+		if _, err := cursor.ReadDocument(ctx, &v); err != nil {
+			return nil, errors.Wrap(err, "decoding features")
+		}
+		features = append(features, v)
+	}
+	sortVertices(features)
+
+	return features, nil
+}
@@ -0,0 +1,111 @@
+// Package graph keeps the relationships between the features, properties and
+// processes of observations as a graph.
+//
+// Features, properties and processes are the vertices of the graph, made from
+// the Referenceable fields of observations. Each observation is a path of two
+// edges, from the process that made it to its feature, and from its feature
+// to its property. A revision of an observation replaces its edges, so the
+// graph follows the latest revision of every observation.
+//
+// The graph answers questions that cross observations, such as which features
+// observed by a process also have an observation of a property.
+package graph
+
+import (
+	"context"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/schafer14/obs/internal/events"
+	"github.com/schafer14/obs/internal/observations"
+)
+
+// Kinds of vertices.
+const (
+	Feature  = "feature"
+	Property = "property"
+	Process  = "process"
+)
+
+// Vertex is a feature, property or process of observations. Type is the
+// feature type of features and the property type of properties.
+type Vertex struct {
+	ID    string `json:"id"`
+	Kind  string `json:"kind"`
+	Label string `json:"label,omitempty"`
+	Type  string `json:"type,omitempty"`
+}
+
+// Traversal finds features by the observations they have. A feature is found
+// when it was observed by the process, and it has an observation of each of
+// the properties by any process. Either may be left out, but not both.
+type Traversal struct {
+	Process    string
+	Properties []string
+}
+
+// Graph stores the features, properties and processes of observations and
+// traverses the relationships between them. Arango stores the graph in an
+// arango database, and Memory stores it in the process.
+type Graph interface {
+	Record(ctx context.Context, obs observations.Observation) error
+	Features(ctx context.Context, t Traversal) ([]Vertex, error)
+}
+
+// vertices returns the feature, property and process of an observation.
+func vertices(obs observations.Observation) (feature, property, process Vertex) {
+	feature = Vertex{ID: obs.Feature.ID, Kind: Feature, Label: obs.Feature.Label, Type: obs.FeatureType.ID}
+	property = Vertex{ID: obs.Property.ID, Kind: Property, Label: obs.Property.Label, Type: obs.PropertyType.ID}
+	process = Vertex{ID: obs.Process.ID, Kind: Process, Label: obs.Process.Label}
+	return feature, property, process
+}
+
+// validate checks a traversal starts somewhere, and returns its properties
+// without duplicates.
+func validate(t Traversal) ([]string, error) {
+	if t.Process == "" && len(t.Properties) == 0 {
+		return nil, &observations.ValidationError{
+			Err:    "traversal needs a process or a property",
+			Fields: []observations.FieldError{{Field: "process", Error: "process or property is required"}},
+		}
+	}
+
+	seen := map[string]bool{}
+	var properties []string
+	for _, p := range t.Properties {
+		if !seen[p] {
+			seen[p] = true
+			properties = append(properties, p)
+		}
+	}
+
+	return properties, nil
+}
+
+// sortVertices orders vertices by id, so traversals list features in the
+// same order in every graph.
+func sortVertices(vs []Vertex) {
+	sort.Slice(vs, func(i, j int) bool { return vs[i].ID < vs[j].ID })
+}
+
+// Recorder records the observation of each event in a graph. It is an
+// events.Publisher, so the graph is built as observations are created and
+// revised.
+type Recorder struct {
+	Graph Graph
+}
+
+// Publish records the observation of an event.
+func (r Recorder) Publish(ctx context.Context, e events.Event) error {
+	return errors.Wrap(r.Graph.Record(ctx, e.Observation), "recording observation in graph")
+}
+
+// Build records every observation in a repository in a graph, for
+// observations saved before the graph was kept.
+func Build(ctx context.Context, repo observations.Repository, g Graph) error {
+	err := repo.Stream(ctx, observations.Query{}, func(obs observations.Observation) error {
+		return g.Record(ctx, obs)
+	})
+
+	return errors.Wrap(err, "building graph")
+}
@@ -0,0 +1,193 @@
+package graph_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/schafer14/obs/internal/events"
+	"github.com/schafer14/obs/internal/graph"
+	"github.com/schafer14/obs/internal/observations"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryTraversesFeatures(t *testing.T) {
+
+	// Act and Assert
+	traverseFeatures(t, graph.NewMemory())
+}
+
+func TestArangoTraversesFeatures(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Act and Assert
+	traverseFeatures(t, arangoGraph(t))
+}
+
+func traverseFeatures(t *testing.T, g graph.Graph) {
+
+	// Arrange
+	ctx := context.Background()
+	ids := names("by-eye", "by-drone", "banners-garden", "wisteria-lane", "rose-court", "depression", "yield")
+	byEye, byDrone, garden, lane, court, depression, yield := ids[0], ids[1], ids[2], ids[3], ids[4], ids[5], ids[6]
+
+	for _, obs := range []observations.Observation{
+		observation(byEye, garden, depression, 1),
+		observation(byEye, garden, depression, 1),
+		observation(byEye, lane, yield, 1),
+		observation(byDrone, court, depression, 1),
+		observation(byDrone, garden, yield, 1),
+	} {
+		require.Nil(t, g.Record(ctx, obs), "recording observation")
+	}
+
+	// Act
+	observed, err := g.Features(ctx, graph.Traversal{Process: byEye})
+	require.Nil(t, err, "traversing from process")
+	depressed, err := g.Features(ctx, graph.Traversal{Properties: []string{depression}})
+	require.Nil(t, err, "traversing from property")
+	both, err := g.Features(ctx, graph.Traversal{Process: byEye, Properties: []string{depression}})
+	require.Nil(t, err, "traversing from process and property")
+	every, err := g.Features(ctx, graph.Traversal{Process: byEye, Properties: []string{depression, yield, depression}})
+	require.Nil(t, err, "traversing from process and properties")
+	unknown, err := g.Features(ctx, graph.Traversal{Process: "urn:example:unknown"})
+	require.Nil(t, err, "traversing from unknown process")
+
+	// Assert
+	assert.Equal(t, sorted(garden, lane), featureIDs(observed), "features observed by process")
+	assert.Equal(t, sorted(garden, court), featureIDs(depressed), "features with property")
+	assert.Equal(t, []string{garden}, featureIDs(both), "features observed by process with property")
+	assert.Equal(t, []string{garden}, featureIDs(every), "features observed by process with every property")
+	assert.Equal(t, []string{}, featureIDs(unknown), "features observed by unknown process")
+
+	require.Equal(t, 1, len(both), "feature not found")
+	assert.Equal(t, graph.Vertex{ID: garden, Kind: graph.Feature, Label: "Feature", Type: "urn:example:garden"}, both[0], "feature mismatch")
+}
+
+func TestMemoryFollowsRevisions(t *testing.T) {
+
+	// Act and Assert
+	followRevisions(t, graph.NewMemory())
+}
+
+func TestArangoFollowsRevisions(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Act and Assert
+	followRevisions(t, arangoGraph(t))
+}
+
+func followRevisions(t *testing.T, g graph.Graph) {
+
+	// Arrange
+	ctx := context.Background()
+	ids := names("by-eye", "banners-garden", "wisteria-lane", "depression")
+	byEye, garden, lane, depression := ids[0], ids[1], ids[2], ids[3]
+
+	first := observation(byEye, garden, depression, 1)
+	revised := first
+	revised.Feature = observations.Referenceable{ID: lane}
+	revised.Revision = 2
+
+	// Act
+	require.Nil(t, g.Record(ctx, first), "recording observation")
+	require.Nil(t, g.Record(ctx, revised), "recording revision")
+	require.Nil(t, g.Record(ctx, first), "recording earlier revision again")
+	observed, err := g.Features(ctx, graph.Traversal{Process: byEye})
+	require.Nil(t, err, "traversing from process")
+	depressed, err := g.Features(ctx, graph.Traversal{Properties: []string{depression}})
+	require.Nil(t, err, "traversing from property")
+
+	// Assert
+	assert.Equal(t, []string{lane}, featureIDs(observed), "features observed by process")
+	assert.Equal(t, []string{lane}, featureIDs(depressed), "features with property")
+}
+
+func TestTraversalsNeedAStart(t *testing.T) {
+
+	// Arrange
+	g := graph.NewMemory()
+
+	// Act
+	_, err := g.Features(context.Background(), graph.Traversal{})
+
+	// Assert
+	vError, ok := err.(*observations.ValidationError)
+	require.True(t, ok, "traversal without a start accepted: %v", err)
+	assert.Equal(t, "process", vError.Fields[0].Field, "field mismatch")
+}
+
+func TestBuildingAGraph(t *testing.T) {
+
+	// Arrange
+	ctx := context.Background()
+	repo := observations.NewMemory()
+	g := graph.NewMemory()
+	saved := observation("urn:example:by-eye", "https://example.com/banners-garden", "urn:example:depression", 1)
+	require.Nil(t, repo.Save(ctx, saved), "saving observation")
+	published := observation("urn:example:by-eye", "https://example.com/wisteria-lane", "urn:example:depression", 1)
+
+	// Act
+	require.Nil(t, graph.Build(ctx, repo, g), "building graph")
+	require.Nil(t, graph.Recorder{Graph: g}.Publish(ctx, events.Created(published, time.Now())), "publishing event")
+	observed, err := g.Features(ctx, graph.Traversal{Process: "urn:example:by-eye"})
+	require.Nil(t, err, "traversing from process")
+
+	// Assert
+	assert.Equal(t, []string{"https://example.com/banners-garden", "https://example.com/wisteria-lane"}, featureIDs(observed), "saved and published observations not in graph")
+}
+
+// arangoGraph creates the graph in the arango database of the package.
+func arangoGraph(t *testing.T) graph.Graph {
+	require.Nil(t, graph.EnsureGraph(context.Background(), db), "creating graph")
+	return graph.NewArango(db)
+}
+
+// observation creates an observation of a property of a feature by a process.
+func observation(process, feature, property string, revision int) observations.Observation {
+	return observations.Observation{
+		ID:           uuid.NewSHA1(uuid.NameSpaceURL, []byte(process+feature+property)).String(),
+		Feature:      observations.Referenceable{ID: feature, Label: "Feature"},
+		FeatureType:  observations.Referenceable{ID: "urn:example:garden"},
+		Property:     observations.Referenceable{ID: property},
+		PropertyType: observations.Referenceable{ID: "urn:example:scale-1-5"},
+		Process:      observations.Referenceable{ID: process},
+		Result:       map[string]interface{}{"wisteria": 5},
+		Revision:     revision,
+	}
+}
+
+// names creates ids that are unique to a test, so tests can share a graph.
+func names(names ...string) []string {
+	suffix := uuid.New().String()
+	ids := make([]string, len(names))
+	for i, name := range names {
+		ids[i] = "urn:example:" + name + ":" + suffix
+	}
+	return ids
+}
+
+// sorted returns ids in the order features are listed.
+func sorted(a, b string) []string {
+	if b < a {
+		return []string{b, a}
+	}
+	return []string{a, b}
+}
+
+// featureIDs returns the ids of vertices.
+func featureIDs(vs []graph.Vertex) []string {
+	ids := []string{}
+	for _, v := range vs {
+		ids = append(ids, v.ID)
+	}
+	return ids
+}
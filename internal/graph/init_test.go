@@ -0,0 +1,37 @@
+package graph_test
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"testing"
+
+	driver "github.com/arangodb/go-driver"
+	"github.com/schafer14/obs/internal/tests"
+)
+
+var db driver.Database
+
+// TestMain runs an arango database for this package.
+func TestMain(m *testing.M) {
+	t := &testing.T{}
+
+	flag.Parse()
+	var c *tests.Container
+	if !testing.Short() {
+		c = tests.SetupArango(t)
+		var err error
+		db, err = tests.ArangoTest(t, c)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	result := m.Run()
+
+	if !testing.Short() {
+		tests.TeardownDatabase(t, c)
+	}
+	os.Exit(result)
+}
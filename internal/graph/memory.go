@@ -0,0 +1,92 @@
+package graph
+
+import (
+	"context"
+	"sync"
+
+	"github.com/schafer14/obs/internal/observations"
+)
+
+// path is the edges of an observation, from its process to its feature and
+// from its feature to its property.
+type path struct {
+	revision int
+	process  string
+	feature  string
+	property string
+}
+
+// Memory is a graph held in the process. The graph is lost when the process
+// stops.
+type Memory struct {
+	mu       sync.RWMutex
+	vertices map[string]map[string]Vertex
+	paths    map[string]path
+}
+
+// NewMemory creates an empty graph.
+func NewMemory() *Memory {
+	return &Memory{
+		vertices: map[string]map[string]Vertex{Feature: {}, Property: {}, Process: {}},
+		paths:    map[string]path{},
+	}
+}
+
+// Record adds the feature, property and process of an observation to the
+// graph and replaces the edges of earlier revisions of the observation.
+func (m *Memory) Record(ctx context.Context, obs observations.Observation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if p, ok := m.paths[obs.ID]; ok && p.revision > obs.Revision {
+		return nil
+	}
+
+	feature, property, process := vertices(obs)
+	for _, v := range []Vertex{feature, property, process} {
+		if old, ok := m.vertices[v.Kind][v.ID]; ok && v.Label == "" {
+			v.Label = old.Label
+		}
+		m.vertices[v.Kind][v.ID] = v
+	}
+
+	m.paths[obs.ID] = path{revision: obs.Revision, process: process.ID, feature: feature.ID, property: property.ID}
+	return nil
+}
+
+// Features finds the features matching a traversal, ordered by id.
+func (m *Memory) Features(ctx context.Context, t Traversal) ([]Vertex, error) {
+	properties, err := validate(t)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	observed := map[string]bool{}
+	has := map[string]map[string]bool{}
+	for _, p := range m.paths {
+		if t.Process == "" || p.process == t.Process {
+			observed[p.feature] = true
+		}
+		if has[p.feature] == nil {
+			has[p.feature] = map[string]bool{}
+		}
+		has[p.feature][p.property] = true
+	}
+
+	features := []Vertex{}
+	for id := range observed {
+		found := true
+		for _, property := range properties {
+			found = found && has[id][property]
+		}
+		if found {
+			features = append(features, m.vertices[Feature][id])
+		}
+	}
+	sortVertices(features)
+
+	return features, nil
+}
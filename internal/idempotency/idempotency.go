@@ -0,0 +1,165 @@
+// Package idempotency records the responses to requests made with an
+// Idempotency-Key, so a client that retries a request is sent the response to
+// the first attempt instead of the request being processed again.
+//
+// A key is claimed by the first request made with it. The response is
+// recorded when the request is complete and kept for a window, during which
+// the same request with the same key is answered with the recorded response.
+// A different request with the same key is a conflict.
+package idempotency
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	// ErrorConflict is returned when a key was used for a different request.
+	ErrorConflict = errors.New("idempotency key was used for a different request")
+
+	// ErrorInProgress is returned when the request a key was claimed by has
+	// not completed.
+	ErrorInProgress = errors.New("a request with the idempotency key is in progress")
+)
+
+// lockTimeout is how long a claimed key waits for its response. Keys whose
+// request never completed, such as when the server stopped, may be claimed
+// again after it.
+const lockTimeout = time.Minute
+
+// Response is a recorded response to a request.
+type Response struct {
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+// Record is a key claimed by a request. Keys belong to a user, so users
+// cannot see the responses to each other's requests. Response is nil until
+// the request is complete.
+type Record struct {
+	User        string
+	Key         string
+	Fingerprint string
+	Response    *Response
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+}
+
+// Fingerprint identifies a request by its method, path, query, content type
+// and body. The query and content type change how the body is read, so they
+// are part of the request. Retries of a request have the same fingerprint.
+func Fingerprint(method, path, query, contentType string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(method + " " + path + "?" + query + "\n"))
+	h.Write([]byte(contentType + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Begin claims a key for a request with a fingerprint. When the key is
+// claimed true is returned, and the request should be processed and then
+// completed or released. Otherwise the record of the completed request is
+// returned so its response can be replayed. ErrorConflict is returned if the
+// key was used for a different request, and ErrorInProgress if the request
+// it was used for has not completed.
+func Begin(ctx context.Context, collection *mongo.Collection, user, key, fingerprint string, now time.Time, window time.Duration) (Record, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	rec := Record{
+		User:        user,
+		Key:         key,
+		Fingerprint: fingerprint,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(window),
+	}
+
+	// Expired records are removed by the database in the background, and
+	// abandoned claims are never removed, so both are deleted before the key
+	// is claimed.
+	_, err := collection.DeleteOne(ctx, bson.M{"user": user, "key": key, "$or": bson.A{
+		bson.M{"expiresat": bson.M{"$lte": now}},
+		bson.M{"response": nil, "createdat": bson.M{"$lte": now.Add(-lockTimeout)}},
+	}})
+	if err != nil {
+		return Record{}, false, errors.Wrap(err, "removing expired idempotency key")
+	}
+
+	_, err = collection.InsertOne(ctx, rec)
+	if err == nil {
+		return rec, true, nil
+	}
+	if !duplicate(err) {
+		return Record{}, false, errors.Wrap(err, "claiming idempotency key")
+	}
+
+	var prev Record
+	if err := collection.FindOne(ctx, bson.M{"user": user, "key": key}).Decode(&prev); err != nil {
+		return Record{}, false, errors.Wrap(err, "fetching idempotency key")
+	}
+
+	switch {
+	case prev.Fingerprint != fingerprint:
+		return prev, false, ErrorConflict
+	case prev.Response == nil:
+		return prev, false, ErrorInProgress
+	}
+
+	return prev, false, nil
+}
+
+// Complete records the response to the request that claimed a key.
+func Complete(ctx context.Context, collection *mongo.Collection, user, key string, resp Response) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := collection.UpdateOne(ctx, bson.M{"user": user, "key": key}, bson.M{"$set": bson.M{"response": resp}})
+	return errors.Wrap(err, "recording idempotent response")
+}
+
+// Release gives up the claim on a key without recording a response, so the
+// request may be retried. It is used when a request fails in a way a retry
+// might not.
+func Release(ctx context.Context, collection *mongo.Collection, user, key string) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := collection.DeleteOne(ctx, bson.M{"user": user, "key": key, "response": nil})
+	return errors.Wrap(err, "releasing idempotency key")
+}
+
+// duplicate reports whether an error is caused by a key that has already
+// been claimed.
+func duplicate(err error) bool {
+	wErr, ok := err.(mongo.WriteException)
+	if !ok {
+		return false
+	}
+	for _, e := range wErr.WriteErrors {
+		if e.Code == 11000 {
+			return true
+		}
+	}
+	return false
+}
+
+// EnsureIndexes creates the index that makes keys unique for each user and
+// the index that removes records once their window has passed.
+func EnsureIndexes(ctx context.Context, collection *mongo.Collection) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user", Value: 1}, {Key: "key", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "expiresat", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	return errors.Wrap(err, "creating idempotency indexes")
+}
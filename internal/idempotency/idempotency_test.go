@@ -0,0 +1,131 @@
+package idempotency_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/schafer14/obs/internal/idempotency"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFingerprintingRequests(t *testing.T) {
+
+	// Arrange
+	body := []byte(`{"result": {"wisteria": 5}}`)
+
+	// Act
+	first := idempotency.Fingerprint(http.MethodPost, "/v1/observations", "", "application/json", body)
+	retry := idempotency.Fingerprint(http.MethodPost, "/v1/observations", "", "application/json", []byte(`{"result": {"wisteria": 5}}`))
+	otherBody := idempotency.Fingerprint(http.MethodPost, "/v1/observations", "", "application/json", []byte(`{"result": {"wisteria": 4}}`))
+	otherPath := idempotency.Fingerprint(http.MethodPost, "/v1/observations/batch", "", "application/json", body)
+	otherQuery := idempotency.Fingerprint(http.MethodPost, "/v1/observations", "featureType=urn:example:garden", "application/json", body)
+	otherType := idempotency.Fingerprint(http.MethodPost, "/v1/observations", "", "application/x-ndjson", body)
+
+	// Assert
+	assert.Equal(t, first, retry, "retry has a different fingerprint")
+	assert.NotEqual(t, first, otherBody, "different body has the same fingerprint")
+	assert.NotEqual(t, first, otherPath, "different path has the same fingerprint")
+	assert.NotEqual(t, first, otherQuery, "different query has the same fingerprint")
+	assert.NotEqual(t, first, otherType, "different content type has the same fingerprint")
+}
+
+func TestReplayingResponses(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Arrange
+	ctx := context.Background()
+	coll := db.Collection("idempotency")
+	require.Nil(t, coll.Drop(ctx), "deleting collection")
+	require.Nil(t, idempotency.EnsureIndexes(ctx, coll), "creating indexes")
+
+	// Act and Assert
+	replayResponses(t, idempotency.NewMongo(coll))
+}
+
+func TestReplayingResponsesInMemory(t *testing.T) {
+
+	// Act and Assert
+	replayResponses(t, idempotency.NewMemory())
+}
+
+func TestReleasingKeys(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Arrange
+	ctx := context.Background()
+	coll := db.Collection("idempotency")
+	require.Nil(t, idempotency.EnsureIndexes(ctx, coll), "creating indexes")
+
+	// Act and Assert
+	releaseKeys(t, idempotency.NewMongo(coll))
+}
+
+func TestReleasingKeysInMemory(t *testing.T) {
+
+	// Act and Assert
+	releaseKeys(t, idempotency.NewMemory())
+}
+
+// replayResponses checks a repository replays the responses to completed
+// requests.
+func replayResponses(t *testing.T, repo idempotency.Repository) {
+	t.Helper()
+
+	// Arrange
+	ctx := context.Background()
+	key := uuid.New().String()
+	now := time.Now()
+	resp := idempotency.Response{Status: http.StatusCreated, ContentType: "application/json", Body: []byte(`{"id": "1"}`)}
+
+	// Act
+	_, claimed, err := repo.Begin(ctx, "banner", key, "a", now, time.Hour)
+	require.Nil(t, err, "claiming key")
+	_, _, inProgressErr := repo.Begin(ctx, "banner", key, "a", now, time.Hour)
+	require.Nil(t, repo.Complete(ctx, "banner", key, resp), "completing request")
+	rec, reclaimed, err := repo.Begin(ctx, "banner", key, "a", now, time.Hour)
+	require.Nil(t, err, "replaying key")
+	_, _, conflictErr := repo.Begin(ctx, "banner", key, "b", now, time.Hour)
+	_, otherUser, err := repo.Begin(ctx, "bruce", key, "b", now, time.Hour)
+	require.Nil(t, err, "claiming key of another user")
+	_, expired, err := repo.Begin(ctx, "banner", key, "b", now.Add(2*time.Hour), time.Hour)
+	require.Nil(t, err, "claiming expired key")
+
+	// Assert
+	assert.True(t, claimed, "key not claimed")
+	assert.Equal(t, idempotency.ErrorInProgress, inProgressErr, "key claimed twice")
+	assert.False(t, reclaimed, "completed key claimed again")
+	require.NotNil(t, rec.Response, "response not recorded")
+	assert.Equal(t, resp, *rec.Response, "response mismatch")
+	assert.Equal(t, idempotency.ErrorConflict, conflictErr, "different request with the same key accepted")
+	assert.True(t, otherUser, "keys are not separate for each user")
+	assert.True(t, expired, "expired key not claimed")
+}
+
+// releaseKeys checks a repository lets released keys be claimed again.
+func releaseKeys(t *testing.T, repo idempotency.Repository) {
+	t.Helper()
+
+	// Arrange
+	ctx := context.Background()
+	key := uuid.New().String()
+
+	// Act
+	_, _, err := repo.Begin(ctx, "banner", key, "a", time.Now(), time.Hour)
+	require.Nil(t, err, "claiming key")
+	require.Nil(t, repo.Release(ctx, "banner", key), "releasing key")
+	_, claimed, err := repo.Begin(ctx, "banner", key, "a", time.Now(), time.Hour)
+
+	// Assert
+	require.Nil(t, err, "claiming released key")
+	assert.True(t, claimed, "released key not claimed")
+}
@@ -0,0 +1,114 @@
+package idempotency
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Repository records the responses to requests made with a key. Mongo records
+// them in a mongo collection, and Memory records them in the process so keys
+// can be used without a database. The package functions of the same name
+// describe each method.
+type Repository interface {
+	Begin(ctx context.Context, user, key, fingerprint string, now time.Time, window time.Duration) (Record, bool, error)
+	Complete(ctx context.Context, user, key string, resp Response) error
+	Release(ctx context.Context, user, key string) error
+}
+
+// Mongo is a repository of keys in a mongo collection.
+type Mongo struct {
+	collection *mongo.Collection
+}
+
+// NewMongo creates a repository of the keys in a collection.
+func NewMongo(collection *mongo.Collection) *Mongo {
+	return &Mongo{collection: collection}
+}
+
+// Begin claims a key for a request with a fingerprint.
+func (m *Mongo) Begin(ctx context.Context, user, key, fingerprint string, now time.Time, window time.Duration) (Record, bool, error) {
+	return Begin(ctx, m.collection, user, key, fingerprint, now, window)
+}
+
+// Complete records the response to the request that claimed a key.
+func (m *Mongo) Complete(ctx context.Context, user, key string, resp Response) error {
+	return Complete(ctx, m.collection, user, key, resp)
+}
+
+// Release gives up the claim on a key without recording a response.
+func (m *Mongo) Release(ctx context.Context, user, key string) error {
+	return Release(ctx, m.collection, user, key)
+}
+
+// Memory is a repository of keys held in the process. Keys are lost when the
+// process stops, so requests cannot be safely retried across restarts.
+type Memory struct {
+	mu      sync.Mutex
+	records map[[2]string]Record
+}
+
+// NewMemory creates an empty repository of keys.
+func NewMemory() *Memory {
+	return &Memory{records: map[[2]string]Record{}}
+}
+
+// Begin claims a key for a request with a fingerprint.
+func (m *Memory) Begin(ctx context.Context, user, key, fingerprint string, now time.Time, window time.Duration) (Record, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := [2]string{user, key}
+	prev, ok := m.records[id]
+	if ok && (!prev.ExpiresAt.After(now) || (prev.Response == nil && !prev.CreatedAt.After(now.Add(-lockTimeout)))) {
+		ok = false
+	}
+
+	if !ok {
+		rec := Record{
+			User:        user,
+			Key:         key,
+			Fingerprint: fingerprint,
+			CreatedAt:   now,
+			ExpiresAt:   now.Add(window),
+		}
+		m.records[id] = rec
+		return rec, true, nil
+	}
+
+	switch {
+	case prev.Fingerprint != fingerprint:
+		return prev, false, ErrorConflict
+	case prev.Response == nil:
+		return prev, false, ErrorInProgress
+	}
+
+	return prev, false, nil
+}
+
+// Complete records the response to the request that claimed a key.
+func (m *Memory) Complete(ctx context.Context, user, key string, resp Response) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := [2]string{user, key}
+	if rec, ok := m.records[id]; ok {
+		rec.Response = &resp
+		m.records[id] = rec
+	}
+	return nil
+}
+
+// Release gives up the claim on a key without recording a response.
+func (m *Memory) Release(ctx context.Context, user, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := [2]string{user, key}
+	if rec, ok := m.records[id]; ok && rec.Response == nil {
+		delete(m.records, id)
+	}
+	return nil
+}
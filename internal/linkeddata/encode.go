@@ -0,0 +1,266 @@
+package linkeddata
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Format is an RDF serialization a graph can be written in.
+type Format struct {
+	Name      string
+	MediaType string
+	write     func(w io.Writer, g *Graph) error
+}
+
+var (
+	// JSONLD writes graphs as a flattened JSON-LD document with compact IRIs.
+	JSONLD = Format{Name: "jsonld", MediaType: "application/ld+json", write: writeJSONLD}
+
+	// Turtle writes graphs as Turtle with the triples of each subject grouped
+	// together.
+	Turtle = Format{Name: "turtle", MediaType: "text/turtle", write: writeTurtle}
+
+	// NTriples writes graphs as N-Triples with a triple on each line.
+	NTriples = Format{Name: "ntriples", MediaType: "application/n-triples", write: writeNTriples}
+)
+
+// Formats are the supported RDF serializations.
+var Formats = []Format{JSONLD, Turtle, NTriples}
+
+// Write writes a graph in a format.
+func (f Format) Write(w io.Writer, g *Graph) error {
+	return errors.Wrapf(f.write(w, g), "writing %s", f.Name)
+}
+
+// local matches the local names of IRIs that can be written as compact IRIs
+// without escaping.
+var local = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*$`)
+
+// compact writes an IRI as a prefixed name, or returns false when it is not
+// in one of the known namespaces.
+func compact(iri string) (string, bool) {
+	for _, p := range prefixes {
+		if strings.HasPrefix(iri, p.namespace) && local.MatchString(iri[len(p.namespace):]) {
+			return p.prefix + ":" + iri[len(p.namespace):], true
+		}
+	}
+	return "", false
+}
+
+// writeNTriples writes a graph as N-Triples.
+func writeNTriples(w io.Writer, g *Graph) error {
+	bw := bufio.NewWriter(w)
+	for _, t := range g.Triples {
+		fmt.Fprintf(bw, "%s %s %s .\n", ntriplesTerm(t.Subject), ntriplesTerm(t.Predicate), ntriplesTerm(t.Object))
+	}
+	return bw.Flush()
+}
+
+// ntriplesTerm writes a term as it is written in N-Triples.
+func ntriplesTerm(t Term) string {
+	switch t.Kind {
+	case Blank:
+		return "_:" + t.Value
+	case Literal:
+		if t.Datatype == "" || t.Datatype == XSD+"string" {
+			return quote(t.Value)
+		}
+		return quote(t.Value) + "^^<" + escapeIRI(t.Datatype) + ">"
+	}
+	return "<" + escapeIRI(t.Value) + ">"
+}
+
+// writeTurtle writes a graph as Turtle.
+func writeTurtle(w io.Writer, g *Graph) error {
+	bw := bufio.NewWriter(w)
+	for _, p := range prefixes {
+		fmt.Fprintf(bw, "@prefix %s: <%s> .\n", p.prefix, p.namespace)
+	}
+
+	for _, s := range subjects(g) {
+		fmt.Fprintf(bw, "\n%s", turtleTerm(s.subject))
+		for i, t := range s.triples {
+			sep := " ;\n   "
+			if i == 0 {
+				sep = ""
+			}
+			predicate := turtleTerm(t.Predicate)
+			if t.Predicate.Value == RDF+"type" {
+				predicate = "a"
+			}
+			fmt.Fprintf(bw, "%s %s %s", sep, predicate, turtleTerm(t.Object))
+		}
+		fmt.Fprint(bw, " .\n")
+	}
+
+	return bw.Flush()
+}
+
+// turtleTerm writes a term as it is written in Turtle.
+func turtleTerm(t Term) string {
+	switch t.Kind {
+	case IRI:
+		if name, ok := compact(t.Value); ok {
+			return name
+		}
+	case Literal:
+		if t.Datatype != "" && t.Datatype != XSD+"string" {
+			if name, ok := compact(t.Datatype); ok {
+				return quote(t.Value) + "^^" + name
+			}
+		}
+	}
+	return ntriplesTerm(t)
+}
+
+// subject is the triples of a subject in a graph.
+type subject struct {
+	subject Term
+	triples []Triple
+}
+
+// subjects groups the triples of a graph by subject, in the order subjects
+// are first used.
+func subjects(g *Graph) []subject {
+	var grouped []subject
+	index := map[Term]int{}
+	for _, t := range g.Triples {
+		i, ok := index[t.Subject]
+		if !ok {
+			i = len(grouped)
+			index[t.Subject] = i
+			grouped = append(grouped, subject{subject: t.Subject})
+		}
+		grouped[i].triples = append(grouped[i].triples, t)
+	}
+	return grouped
+}
+
+// writeJSONLD writes a graph as a flattened JSON-LD document. Each subject is
+// a node of the @graph with its properties keyed by compact IRIs.
+func writeJSONLD(w io.Writer, g *Graph) error {
+	context := map[string]string{}
+	for _, p := range prefixes {
+		context[p.prefix] = p.namespace
+	}
+
+	nodes := []map[string]interface{}{}
+	for _, s := range subjects(g) {
+		node := map[string]interface{}{"@id": jsonldID(s.subject)}
+		for _, t := range s.triples {
+			if t.Predicate.Value == RDF+"type" && t.Object.Kind == IRI {
+				node["@type"] = append(asSlice(node["@type"]), jsonldIRI(t.Object.Value))
+				continue
+			}
+			key := jsonldIRI(t.Predicate.Value)
+			node[key] = append(asSlice(node[key]), jsonldValue(t.Object))
+		}
+		for key, v := range node {
+			if values, ok := v.([]interface{}); ok && len(values) == 1 {
+				node[key] = values[0]
+			}
+		}
+		nodes = append(nodes, node)
+	}
+
+	enc := json.NewEncoder(w)
+	return enc.Encode(map[string]interface{}{"@context": context, "@graph": nodes})
+}
+
+// asSlice returns the values already held for a key of a JSON-LD node.
+func asSlice(v interface{}) []interface{} {
+	if values, ok := v.([]interface{}); ok {
+		return values
+	}
+	return nil
+}
+
+// jsonldIRI writes an IRI as a compact IRI when possible.
+func jsonldIRI(iri string) string {
+	if name, ok := compact(iri); ok {
+		return name
+	}
+	return iri
+}
+
+// jsonldID is the @id of a node.
+func jsonldID(t Term) string {
+	if t.Kind == Blank {
+		return "_:" + t.Value
+	}
+	return jsonldIRI(t.Value)
+}
+
+// jsonldValue writes the object of a triple as a JSON-LD value. Strings,
+// booleans and numbers are written as JSON values.
+func jsonldValue(t Term) interface{} {
+	if t.Kind != Literal {
+		return map[string]string{"@id": jsonldID(t)}
+	}
+
+	switch t.Datatype {
+	case "", XSD + "string":
+		return t.Value
+	case XSD + "boolean":
+		return t.Value == "true"
+	case XSD + "integer":
+		if n, err := strconv.ParseInt(t.Value, 10, 64); err == nil {
+			return n
+		}
+	case XSD + "double":
+		if f, err := strconv.ParseFloat(t.Value, 64); err == nil {
+			return map[string]interface{}{"@value": f, "@type": jsonldIRI(t.Datatype)}
+		}
+	}
+
+	return map[string]string{"@value": t.Value, "@type": jsonldIRI(t.Datatype)}
+}
+
+// quote writes a string literal with the escapes N-Triples and Turtle
+// require.
+func quote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			if r < 0x20 {
+				fmt.Fprintf(&b, `\u%04X`, r)
+				continue
+			}
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// escapeIRI escapes the characters that may not appear in an IRI reference.
+func escapeIRI(iri string) string {
+	var b strings.Builder
+	for _, r := range iri {
+		if r <= 0x20 || strings.ContainsRune(`<>"{}|^`+"`\\", r) {
+			fmt.Fprintf(&b, `\u%04X`, r)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,398 @@
+// Package linkeddata describes observations and definitions as RDF using the
+// SOSA/SSN ontology so they can be loaded into a triple store. Graphs can be
+// written as JSON-LD, Turtle or N-Triples.
+//
+// An observation is a sosa:Observation with its feature as the
+// sosa:hasFeatureOfInterest, its property as the sosa:observedProperty, its
+// process as the sosa:usedProcedure and its result as the sosa:hasResult.
+// Fields without a SOSA term use the obs vocabulary, and the fields of results
+// and tags use the result and tag vocabularies.
+package linkeddata
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	geojson "github.com/paulmach/go.geojson"
+	"github.com/schafer14/obs/internal/definitions"
+	"github.com/schafer14/obs/internal/observations"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Namespaces of the vocabularies used in graphs.
+const (
+	RDF       = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	RDFS      = "http://www.w3.org/2000/01/rdf-schema#"
+	XSD       = "http://www.w3.org/2001/XMLSchema#"
+	SOSA      = "http://www.w3.org/ns/sosa/"
+	SSN       = "http://www.w3.org/ns/ssn/"
+	Time      = "http://www.w3.org/2006/time#"
+	GeoSPARQL = "http://www.opengis.net/ont/geosparql#"
+	Obs       = "https://linked-data-land.appspot.com/vocab#"
+	Result    = "https://linked-data-land.appspot.com/vocab/result#"
+	Tag       = "https://linked-data-land.appspot.com/vocab/tag#"
+)
+
+// prefixes are the prefixes of namespaces used when graphs are written.
+var prefixes = []struct{ prefix, namespace string }{
+	{"rdf", RDF},
+	{"rdfs", RDFS},
+	{"xsd", XSD},
+	{"sosa", SOSA},
+	{"ssn", SSN},
+	{"time", Time},
+	{"geo", GeoSPARQL},
+	{"obs", Obs},
+	{"result", Result},
+	{"tag", Tag},
+}
+
+// TermKind is the kind of an RDF term.
+type TermKind int
+
+const (
+	// IRI terms name resources.
+	IRI TermKind = iota
+
+	// Blank terms are resources without a name that are local to a graph.
+	Blank
+
+	// Literal terms are values with a datatype.
+	Literal
+)
+
+// Term is an RDF term. Value is the IRI of IRI terms, the label of blank
+// terms and the lexical form of literals. Literals have a datatype IRI, with
+// xsd:string used when it is empty.
+type Term struct {
+	Kind     TermKind
+	Value    string
+	Datatype string
+}
+
+// Triple is an RDF statement that the subject has the predicate with the
+// value of the object.
+type Triple struct {
+	Subject   Term
+	Predicate Term
+	Object    Term
+}
+
+// Graph is a set of triples.
+type Graph struct {
+	Triples []Triple
+	blanks  int
+}
+
+// NewIRI creates an IRI term.
+func NewIRI(iri string) Term {
+	return Term{Kind: IRI, Value: iri}
+}
+
+// NewLiteral creates a literal term with a datatype.
+func NewLiteral(value, datatype string) Term {
+	return Term{Kind: Literal, Value: value, Datatype: datatype}
+}
+
+// Add adds a triple to the graph.
+func (g *Graph) Add(s, p, o Term) {
+	g.Triples = append(g.Triples, Triple{s, p, o})
+}
+
+// Blank creates a blank node that is unique in the graph.
+func (g *Graph) Blank() Term {
+	g.blanks++
+	return Term{Kind: Blank, Value: fmt.Sprintf("b%d", g.blanks)}
+}
+
+// ID converts the id of a feature, property, process or definition to an IRI.
+// Ids that are already URIs or URNs are used as they are and UUIDs are
+// converted to URNs.
+func ID(id string) string {
+	if u, err := url.Parse(id); err == nil && u.Scheme != "" {
+		return id
+	}
+	return "urn:uuid:" + id
+}
+
+// Observation adds the triples describing an observation to a graph. The IRI
+// of the observation is its id appended to base, which is the url that
+// observations are retrieved from.
+func (g *Graph) Observation(obs observations.Observation, base string) {
+	s := NewIRI(strings.TrimSuffix(base, "/") + "/" + url.PathEscape(obs.ID))
+
+	g.Add(s, NewIRI(RDF+"type"), NewIRI(SOSA+"Observation"))
+
+	feature := g.referenceable(obs.Feature)
+	g.Add(s, NewIRI(SOSA+"hasFeatureOfInterest"), feature)
+	g.Add(feature, NewIRI(RDF+"type"), NewIRI(SOSA+"FeatureOfInterest"))
+	g.Add(feature, NewIRI(RDF+"type"), g.referenceable(obs.FeatureType))
+
+	property := g.referenceable(obs.Property)
+	g.Add(s, NewIRI(SOSA+"observedProperty"), property)
+	g.Add(property, NewIRI(RDF+"type"), NewIRI(SOSA+"ObservableProperty"))
+	g.Add(s, NewIRI(Obs+"propertyType"), g.referenceable(obs.PropertyType))
+
+	process := g.referenceable(obs.Process)
+	g.Add(s, NewIRI(SOSA+"usedProcedure"), process)
+	g.Add(process, NewIRI(RDF+"type"), NewIRI(SOSA+"Procedure"))
+
+	phenomenonTime := g.Blank()
+	g.Add(s, NewIRI(SOSA+"phenomenonTime"), phenomenonTime)
+	g.Add(phenomenonTime, NewIRI(RDF+"type"), NewIRI(Time+"Instant"))
+	g.Add(phenomenonTime, NewIRI(Time+"inXSDDateTimeStamp"), dateTimeStamp(obs.PhenomenonTime))
+	g.Add(s, NewIRI(SOSA+"resultTime"), dateTime(obs.ResultTime))
+
+	validTime := g.Blank()
+	g.Add(s, NewIRI(Obs+"validTime"), validTime)
+	g.Add(validTime, NewIRI(RDF+"type"), NewIRI(Time+"Interval"))
+	g.instant(validTime, Time+"hasBeginning", obs.ValidInterval.StartTime)
+	if obs.ValidIntervalEnd != nil {
+		g.instant(validTime, Time+"hasEnd", *obs.ValidIntervalEnd)
+	}
+
+	result := g.Blank()
+	g.Add(s, NewIRI(SOSA+"hasResult"), result)
+	g.Add(result, NewIRI(RDF+"type"), NewIRI(SOSA+"Result"))
+	if v, ok := obs.Result["value"]; ok && len(obs.Result) == 1 {
+		if o, ok := g.value(v); ok {
+			g.Add(s, NewIRI(SOSA+"hasSimpleResult"), o)
+			g.Add(result, NewIRI(RDF+"value"), o)
+		}
+	} else {
+		g.fields(result, Result, obs.Result)
+	}
+	if obs.Scale != "" {
+		g.Add(result, NewIRI(Obs+"scale"), g.identifier(obs.Scale))
+	}
+
+	for _, key := range sortedKeys(obs.Tags) {
+		g.Add(s, NewIRI(Tag+url.PathEscape(key)), NewLiteral(obs.Tags[key], ""))
+	}
+
+	if obs.PhenomenonLocation != nil {
+		g.Add(feature, NewIRI(GeoSPARQL+"hasGeometry"), g.geometry(obs.PhenomenonLocation))
+	}
+	if obs.ObservationLocation != nil {
+		g.Add(s, NewIRI(Obs+"observationLocation"), g.geometry(obs.ObservationLocation))
+	}
+
+	g.Add(s, NewIRI(Obs+"revision"), NewLiteral(strconv.Itoa(obs.Revision), XSD+"integer"))
+	if !obs.ModifiedAt.IsZero() {
+		g.Add(s, NewIRI(Obs+"modifiedAt"), dateTime(obs.ModifiedAt))
+	}
+}
+
+// FeatureType adds the triples describing a feature type and its properties
+// and property types to a graph. Feature types are classes of features of
+// interest, and properties are observable properties of those features.
+// Definitions without an id are skipped.
+func (g *Graph) FeatureType(ft definitions.FeatureType) {
+	if ft.ID == "" {
+		return
+	}
+
+	s := NewIRI(ID(ft.ID))
+	g.Add(s, NewIRI(RDF+"type"), NewIRI(RDFS+"Class"))
+	g.Add(s, NewIRI(RDFS+"subClassOf"), NewIRI(SOSA+"FeatureOfInterest"))
+	g.definition(s, ft.Name, ft.Slug, ft.Description)
+
+	for _, slug := range sortedKeys(ft.Properties) {
+		property := ft.Properties[slug]
+		if property.ID == "" {
+			continue
+		}
+
+		p := NewIRI(ID(property.ID))
+		g.Add(p, NewIRI(RDF+"type"), NewIRI(SOSA+"ObservableProperty"))
+		g.Add(p, NewIRI(SSN+"isPropertyOf"), s)
+		g.definition(p, property.Name, property.Slug, property.Description)
+		if property.Category != "" {
+			g.Add(p, NewIRI(Obs+"category"), NewLiteral(property.Category, ""))
+		}
+
+		for _, typeSlug := range sortedKeys(property.PropertyTypes) {
+			pt := property.PropertyTypes[typeSlug]
+			if pt.ID == "" {
+				continue
+			}
+
+			t := NewIRI(ID(pt.ID))
+			g.Add(t, NewIRI(RDF+"type"), NewIRI(Obs+"PropertyType"))
+			g.Add(t, NewIRI(Obs+"property"), p)
+			g.definition(t, pt.Name, pt.Slug, pt.Description)
+			g.Add(t, NewIRI(Obs+"version"), NewLiteral(strconv.Itoa(pt.Version), XSD+"integer"))
+			if pt.SchemaURL != "" {
+				g.Add(t, NewIRI(Obs+"schema"), NewIRI(pt.SchemaURL))
+			} else if id, ok := pt.Schema["$id"].(string); ok {
+				g.Add(t, NewIRI(Obs+"schema"), NewIRI(id))
+			}
+		}
+	}
+}
+
+// definition adds the name, slug and description of a definition.
+func (g *Graph) definition(s Term, name, slug, description string) {
+	if name != "" {
+		g.Add(s, NewIRI(RDFS+"label"), NewLiteral(name, ""))
+	}
+	if slug != "" {
+		g.Add(s, NewIRI(Obs+"slug"), NewLiteral(slug, ""))
+	}
+	if description != "" {
+		g.Add(s, NewIRI(RDFS+"comment"), NewLiteral(description, ""))
+	}
+}
+
+// referenceable adds the label, description and reference of a referenceable
+// field and returns its IRI.
+func (g *Graph) referenceable(r observations.Referenceable) Term {
+	s := NewIRI(ID(r.ID))
+	if r.Label != "" {
+		g.Add(s, NewIRI(RDFS+"label"), NewLiteral(r.Label, ""))
+	}
+	if r.Description != "" {
+		g.Add(s, NewIRI(RDFS+"comment"), NewLiteral(r.Description, ""))
+	}
+	if r.Reference != "" {
+		g.Add(s, NewIRI(RDFS+"seeAlso"), NewIRI(r.Reference))
+	}
+	return s
+}
+
+// identifier is an IRI when s is a URI or URN, or a literal otherwise.
+func (g *Graph) identifier(s string) Term {
+	if u, err := url.Parse(s); err == nil && u.Scheme != "" {
+		return NewIRI(s)
+	}
+	return NewLiteral(s, "")
+}
+
+// instant adds an instant at t as the predicate of s.
+func (g *Graph) instant(s Term, predicate string, t time.Time) {
+	instant := g.Blank()
+	g.Add(s, NewIRI(predicate), instant)
+	g.Add(instant, NewIRI(RDF+"type"), NewIRI(Time+"Instant"))
+	g.Add(instant, NewIRI(Time+"inXSDDateTimeStamp"), dateTimeStamp(t))
+}
+
+// geometry adds a geometry and returns its blank node.
+func (g *Graph) geometry(geometry *geojson.Geometry) Term {
+	node := g.Blank()
+	data, _ := geometry.MarshalJSON()
+	g.Add(node, NewIRI(RDF+"type"), NewIRI(GeoSPARQL+"Geometry"))
+	g.Add(node, NewIRI(GeoSPARQL+"asGeoJSON"), NewLiteral(string(data), GeoSPARQL+"geoJSONLiteral"))
+	return node
+}
+
+// fields adds each field of a document as a property of s in a namespace.
+func (g *Graph) fields(s Term, namespace string, doc map[string]interface{}) {
+	for _, key := range sortedKeys(doc) {
+		predicate := NewIRI(namespace + url.PathEscape(key))
+		for _, v := range values(doc[key]) {
+			if m, ok := document(v); ok {
+				node := g.Blank()
+				g.Add(s, predicate, node)
+				g.fields(node, namespace, m)
+				continue
+			}
+			if o, ok := g.value(v); ok {
+				g.Add(s, predicate, o)
+			}
+		}
+	}
+}
+
+// value converts a value in a result to a term. Documents and arrays are not
+// single values and are reported as not ok.
+func (g *Graph) value(v interface{}) (Term, bool) {
+	switch v := v.(type) {
+	case string:
+		return NewLiteral(v, ""), true
+	case bool:
+		return NewLiteral(strconv.FormatBool(v), XSD+"boolean"), true
+	case int:
+		return NewLiteral(strconv.Itoa(v), XSD+"integer"), true
+	case int32:
+		return NewLiteral(strconv.FormatInt(int64(v), 10), XSD+"integer"), true
+	case int64:
+		return NewLiteral(strconv.FormatInt(v, 10), XSD+"integer"), true
+	case float64:
+		return NewLiteral(strconv.FormatFloat(v, 'E', -1, 64), XSD+"double"), true
+	case time.Time:
+		return dateTime(v), true
+	case primitive.DateTime:
+		return dateTime(time.Unix(0, int64(v)*int64(time.Millisecond))), true
+	}
+	return Term{}, false
+}
+
+// values lists the values of a field, which are the items of arrays.
+func values(v interface{}) []interface{} {
+	switch v := v.(type) {
+	case primitive.A:
+		return v
+	case []interface{}:
+		return v
+	}
+	return []interface{}{v}
+}
+
+// document converts the documents that may be in results to a map.
+func document(v interface{}) (map[string]interface{}, bool) {
+	switch v := v.(type) {
+	case bson.M:
+		return v, true
+	case map[string]interface{}:
+		return v, true
+	case primitive.D:
+		return v.Map(), true
+	}
+	return nil, false
+}
+
+// dateTime is a literal of a time.
+func dateTime(t time.Time) Term {
+	return NewLiteral(t.UTC().Format(time.RFC3339Nano), XSD+"dateTime")
+}
+
+// dateTimeStamp is a literal of a time for properties that require a time
+// zone.
+func dateTimeStamp(t time.Time) Term {
+	return NewLiteral(t.UTC().Format(time.RFC3339Nano), XSD+"dateTimeStamp")
+}
+
+// sortedKeys lists the keys of a map in order so graphs are written the same
+// way each time.
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]string:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case bson.M:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]interface{}:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]definitions.Property:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]definitions.PropertyType:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,168 @@
+package linkeddata_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	geojson "github.com/paulmach/go.geojson"
+	"github.com/schafer14/obs/internal/definitions"
+	"github.com/schafer14/obs/internal/linkeddata"
+	"github.com/schafer14/obs/internal/observations"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const base = "https://example.com/v1/observations"
+
+func TestObservationsUseSOSATerms(t *testing.T) {
+
+	// Arrange
+	var g linkeddata.Graph
+
+	// Act
+	g.Observation(mkObs(), base)
+
+	// Assert
+	s := linkeddata.NewIRI(base + "/7c1e2d2e-91b5-4b43-9f0a-5d2b7c9a3b11")
+	objects := map[string]linkeddata.Term{}
+	for _, triple := range g.Triples {
+		if triple.Subject == s {
+			objects[triple.Predicate.Value] = triple.Object
+		}
+	}
+	assert.Equal(t, linkeddata.NewIRI("https://example.com/banners-garden"), objects[linkeddata.SOSA+"hasFeatureOfInterest"], "feature of interest mismatch")
+	assert.Equal(t, linkeddata.NewIRI("urn:example:health"), objects[linkeddata.SOSA+"observedProperty"], "observed property mismatch")
+	assert.Equal(t, linkeddata.NewIRI("urn:example:measurement:by-eye"), objects[linkeddata.SOSA+"usedProcedure"], "procedure mismatch")
+	assert.Equal(t, linkeddata.Blank, objects[linkeddata.SOSA+"hasResult"].Kind, "result is not a node")
+	assert.Equal(t, linkeddata.NewLiteral("2020-03-02T00:00:00Z", linkeddata.XSD+"dateTime"), objects[linkeddata.SOSA+"resultTime"], "result time mismatch")
+}
+
+func TestSimpleResults(t *testing.T) {
+
+	// Arrange
+	var g linkeddata.Graph
+	obs := mkObs()
+	obs.Result = map[string]interface{}{"value": int64(5)}
+
+	// Act
+	g.Observation(obs, base)
+
+	// Assert
+	var found bool
+	for _, triple := range g.Triples {
+		if triple.Predicate.Value == linkeddata.SOSA+"hasSimpleResult" {
+			found = true
+			assert.Equal(t, linkeddata.NewLiteral("5", linkeddata.XSD+"integer"), triple.Object, "simple result mismatch")
+		}
+	}
+	assert.True(t, found, "simple result not added")
+}
+
+func TestWritingNTriples(t *testing.T) {
+
+	// Arrange
+	var g linkeddata.Graph
+	g.Observation(mkObs(), base)
+	var buf bytes.Buffer
+
+	// Act
+	err := linkeddata.NTriples.Write(&buf, &g)
+
+	// Assert
+	require.Nil(t, err, "writing n-triples")
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, len(g.Triples), len(lines), "a line is not written for each triple")
+	assert.Contains(t, lines, "<"+base+"/7c1e2d2e-91b5-4b43-9f0a-5d2b7c9a3b11> <http://www.w3.org/ns/sosa/observedProperty> <urn:example:health> .", "observed property not written")
+	assert.Contains(t, buf.String(), `"Banner's \"Garden\""`, "literal not escaped")
+	assert.Contains(t, buf.String(), "<https://linked-data-land.appspot.com/vocab/tag#observed%20by>", "tag not written")
+}
+
+func TestWritingTurtle(t *testing.T) {
+
+	// Arrange
+	var g linkeddata.Graph
+	g.Observation(mkObs(), base)
+	var buf bytes.Buffer
+
+	// Act
+	err := linkeddata.Turtle.Write(&buf, &g)
+
+	// Assert
+	require.Nil(t, err, "writing turtle")
+	assert.Contains(t, buf.String(), "@prefix sosa: <http://www.w3.org/ns/sosa/> .", "prefix not declared")
+	assert.Contains(t, buf.String(), "a sosa:Observation", "type not compacted")
+	assert.Contains(t, buf.String(), "result:wisteria \"5\"^^xsd:integer", "result not written")
+}
+
+func TestWritingJSONLD(t *testing.T) {
+
+	// Arrange
+	var g linkeddata.Graph
+	g.Observation(mkObs(), base)
+	var buf bytes.Buffer
+
+	// Act
+	err := linkeddata.JSONLD.Write(&buf, &g)
+
+	// Assert
+	require.Nil(t, err, "writing json-ld")
+	var doc struct {
+		Context map[string]string        `json:"@context"`
+		Graph   []map[string]interface{} `json:"@graph"`
+	}
+	require.Nil(t, json.Unmarshal(buf.Bytes(), &doc), "decoding json-ld")
+	assert.Equal(t, linkeddata.SOSA, doc.Context["sosa"], "context mismatch")
+	obs := doc.Graph[0]
+	assert.Equal(t, base+"/7c1e2d2e-91b5-4b43-9f0a-5d2b7c9a3b11", obs["@id"], "id mismatch")
+	assert.Equal(t, "sosa:Observation", obs["@type"], "type mismatch")
+	assert.Equal(t, map[string]interface{}{"@id": "urn:example:health"}, obs["sosa:observedProperty"], "observed property mismatch")
+}
+
+func TestDefinitionsAreDescribed(t *testing.T) {
+
+	// Arrange
+	var g linkeddata.Graph
+	people := definitions.Data["people"]
+
+	// Act
+	g.FeatureType(people)
+
+	// Assert
+	var properties int
+	for _, triple := range g.Triples {
+		if triple.Object == linkeddata.NewIRI(linkeddata.SOSA+"ObservableProperty") {
+			properties++
+		}
+	}
+	assert.Equal(t, len(people.Properties), properties, "properties not described")
+	assert.Equal(t, linkeddata.NewIRI("urn:uuid:"+people.ID), g.Triples[0].Subject, "uuid not converted to urn")
+}
+
+func mkObs() observations.Observation {
+	now := time.Date(2020, 3, 2, 0, 0, 0, 0, time.UTC)
+	end := now.Add(time.Hour)
+	return observations.Observation{
+		ID:                 "7c1e2d2e-91b5-4b43-9f0a-5d2b7c9a3b11",
+		PhenomenonTime:     now.Add(-time.Hour),
+		ResultTime:         now,
+		ValidInterval:      observations.Interval{StartTime: now, Duration: time.Hour},
+		PhenomenonLocation: geojson.NewPointGeometry([]float64{153.02, -27.47}),
+		Feature: observations.Referenceable{
+			ID:    "https://example.com/banners-garden",
+			Label: `Banner's "Garden"`,
+		},
+		FeatureType:      observations.Referenceable{ID: "urn:example:garden"},
+		Property:         observations.Referenceable{ID: "urn:example:health", Label: "Health"},
+		PropertyType:     observations.Referenceable{ID: "urn:example:scale-1-5"},
+		Process:          observations.Referenceable{ID: "urn:example:measurement:by-eye"},
+		FeatureID:        "https://example.com/banners-garden",
+		PropertyID:       "urn:example:health",
+		ValidIntervalEnd: &end,
+		Tags:             map[string]string{"observed by": "Banner"},
+		Result:           map[string]interface{}{"wisteria": int64(5), "beds": []interface{}{"north", "south"}},
+		Revision:         1,
+	}
+}
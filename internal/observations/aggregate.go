@@ -0,0 +1,438 @@
+package observations
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/schafer14/obs/internal/units"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Aggregation describes statistics to compute over the numeric values at Field
+// of the observations matching Query. Observations are grouped by feature and
+// property, and then into buckets of their phenomenon time. Bucket is one of
+// hour, day or week, and weeks start on Monday. Times are bucketed in UTC.
+//
+// Functions are the statistics computed for each bucket. They may be count,
+// min, max, mean, sum or a percentile such as p50 or p99.9. The sort order,
+// limit and cursor of the query are ignored. When the query has a unit, values
+// are converted to it before statistics are computed.
+type Aggregation struct {
+	Query     Query
+	Field     string
+	Bucket    string
+	Functions []string
+}
+
+// Series is the statistics of the observations of a property of a feature.
+type Series struct {
+	FeatureID  string   `json:"featureId"`
+	PropertyID string   `json:"propertyId"`
+	Buckets    []Bucket `json:"buckets"`
+}
+
+// Bucket is the statistics of the observations with a phenomenon time from
+// Start until the start of the next bucket. Values are keyed by function.
+type Bucket struct {
+	Start  time.Time          `json:"start"`
+	Values map[string]float64 `json:"values"`
+}
+
+// maxFunctions is the most functions an aggregation may compute.
+const maxFunctions = 16
+
+// accumulators map the functions of an aggregation to mongo accumulators.
+var accumulators = map[string]string{
+	"count": "$sum",
+	"min":   "$min",
+	"max":   "$max",
+	"mean":  "$avg",
+	"sum":   "$sum",
+}
+
+// aggregationPlan is an aggregation converted to a mongo pipeline.
+type aggregationPlan struct {
+	filter      bson.D
+	key         string
+	bucket      string
+	functions   []string
+	percentiles map[string]float64
+	unit        *units.Unit
+	conversions map[string]units.Conversion
+}
+
+// Validate checks that an aggregation can be run. A *ValidationError
+// describing each invalid part of the aggregation is returned if it cannot.
+func (a Aggregation) Validate() error {
+	_, err := buildAggregation(a)
+	return err
+}
+
+// buildAggregation checks an aggregation and converts it to a plan.
+func buildAggregation(a Aggregation) (aggregationPlan, error) {
+	var fieldErrors []FieldError
+
+	p, err := buildQuery(Query{
+		Filters:        a.Query.Filters,
+		Where:          a.Query.Where,
+		ValidAt:        a.Query.ValidAt,
+		ValidDuring:    a.Query.ValidDuring,
+		PhenomenonTime: a.Query.PhenomenonTime,
+		Unit:           a.Query.Unit,
+	})
+	if vError, ok := err.(*ValidationError); ok {
+		fieldErrors = append(fieldErrors, vError.Fields...)
+	}
+
+	ap := aggregationPlan{filter: p.filter, bucket: a.Bucket, percentiles: map[string]float64{}, unit: p.unit}
+
+	fld, err := lookupField(a.Field)
+	switch {
+	case err != nil:
+		fieldErrors = append(fieldErrors, FieldError{Field: "field", Error: err.Error()})
+	case fld.typ != typeAny && fld.typ != typeNumber:
+		fieldErrors = append(fieldErrors, FieldError{Field: "field", Error: fmt.Sprintf("cannot aggregate %q, it is not a number", a.Field)})
+	default:
+		ap.key = fld.key
+	}
+
+	switch a.Bucket {
+	case "hour", "day", "week":
+	default:
+		fieldErrors = append(fieldErrors, FieldError{Field: "bucket", Error: "bucket must be one of hour, day or week"})
+	}
+
+	if len(a.Functions) == 0 || len(a.Functions) > maxFunctions {
+		fieldErrors = append(fieldErrors, FieldError{Field: "functions", Error: fmt.Sprintf("between 1 and %d functions are required", maxFunctions)})
+	}
+
+	seen := map[string]bool{}
+	for i, fn := range a.Functions {
+		if seen[fn] {
+			fieldErrors = append(fieldErrors, FieldError{Field: fmt.Sprintf("functions[%d]", i), Error: fmt.Sprintf("function %q is repeated", fn)})
+			continue
+		}
+		seen[fn] = true
+
+		if _, ok := accumulators[fn]; ok {
+			ap.functions = append(ap.functions, fn)
+			continue
+		}
+
+		q, err := parsePercentile(fn)
+		if err != nil {
+			fieldErrors = append(fieldErrors, FieldError{Field: fmt.Sprintf("functions[%d]", i), Error: err.Error()})
+			continue
+		}
+		ap.functions = append(ap.functions, fn)
+		ap.percentiles[fn] = q
+	}
+
+	if len(fieldErrors) > 0 {
+		return aggregationPlan{}, &ValidationError{Err: "error validating aggregation", Fields: fieldErrors}
+	}
+
+	return ap, nil
+}
+
+// parsePercentile parses a percentile function such as p95 to the fraction
+// of values below the percentile.
+func parsePercentile(fn string) (float64, error) {
+	if !strings.HasPrefix(fn, "p") {
+		return 0, fmt.Errorf("unknown function %q", fn)
+	}
+
+	n, err := strconv.ParseFloat(fn[1:], 64)
+	if err != nil || math.IsNaN(n) || math.IsInf(n, 0) || n < 0 || n > 100 {
+		return 0, fmt.Errorf("percentile %q must be between p0 and p100", fn)
+	}
+
+	return n / 100, nil
+}
+
+// valueCount is the field the groups of an aggregation count the values of
+// their bucket in, so its percentiles can be found. It cannot be the name of
+// a function.
+const valueCount = "valuecount"
+
+// bucketKey identifies a bucket of the series of a property of a feature.
+type bucketKey struct {
+	feature  string
+	property string
+	start    int64
+}
+
+// Aggregate computes statistics over the observations matching an aggregation.
+// Observations without a number at the aggregated field are skipped.
+//
+// Percentiles are found by reading the values of each bucket in order after
+// the other statistics are computed, so buckets of any size are not gathered
+// into a single document. Aggregations may sort and group more data than mongo
+// keeps in memory, so they are allowed to use disk.
+func Aggregate(ctx context.Context, collection *mongo.Collection, a Aggregation) ([]Series, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	p, err := buildAggregation(a)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.unit != nil {
+		conv, err := scales(ctx, collection, plan{filter: p.filter, unit: p.unit})
+		if err != nil {
+			return nil, err
+		}
+		p.conversions = conv.conversions
+	}
+
+	cursor, err := collection.Aggregate(ctx, p.pipeline(), options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return nil, errors.Wrap(err, "aggregating observations")
+	}
+	defer cursor.Close(ctx)
+
+	series := []Series{}
+	buckets := map[bucketKey]Bucket{}
+	counts := map[bucketKey]int{}
+	for cursor.Next(ctx) {
+		var group struct {
+			ID struct {
+				Feature  string
+				Property string
+				Bucket   time.Time
+			} `bson:"_id"`
+			Stats map[string]float64 `bson:",inline"`
+		}
+		if err := cursor.Decode(&group); err != nil {
+			return nil, errors.Wrap(err, "decoding aggregation")
+		}
+
+		if n := len(series); n == 0 || series[n-1].FeatureID != group.ID.Feature || series[n-1].PropertyID != group.ID.Property {
+			series = append(series, Series{FeatureID: group.ID.Feature, PropertyID: group.ID.Property})
+		}
+
+		bucket := Bucket{Start: group.ID.Bucket, Values: map[string]float64{}}
+		for _, fn := range p.functions {
+			if _, ok := p.percentiles[fn]; ok {
+				continue
+			}
+			bucket.Values[fn] = group.Stats[fn]
+		}
+		if len(p.percentiles) > 0 {
+			key := bucketKey{group.ID.Feature, group.ID.Property, group.ID.Bucket.UnixNano()}
+			buckets[key] = bucket
+			counts[key] = int(group.Stats[valueCount])
+		}
+
+		last := &series[len(series)-1]
+		last.Buckets = append(last.Buckets, bucket)
+	}
+
+	if err := cursor.Err(); err != nil {
+		return nil, errors.Wrap(err, "aggregating observations")
+	}
+
+	if len(p.percentiles) > 0 {
+		if err := p.readPercentiles(ctx, collection, buckets, counts); err != nil {
+			return nil, err
+		}
+	}
+
+	return series, nil
+}
+
+// readPercentiles computes the percentiles of buckets from their values read in
+// order. Each percentile interpolates between the values at the closest ranks
+// to it, as percentile does, which are found from the number of values in the
+// bucket.
+func (p aggregationPlan) readPercentiles(ctx context.Context, collection *mongo.Collection, buckets map[bucketKey]Bucket, counts map[bucketKey]int) error {
+	cursor, err := collection.Aggregate(ctx, p.valuesPipeline(), options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return errors.Wrap(err, "reading values of buckets")
+	}
+	defer cursor.Close(ctx)
+
+	var current bucketKey
+	rank := 0
+	for cursor.Next(ctx) {
+		var v struct {
+			ID struct {
+				Feature  string
+				Property string
+				Bucket   time.Time
+			} `bson:"_id"`
+			Value float64 `bson:"value"`
+		}
+		if err := cursor.Decode(&v); err != nil {
+			return errors.Wrap(err, "decoding values of buckets")
+		}
+
+		key := bucketKey{v.ID.Feature, v.ID.Property, v.ID.Bucket.UnixNano()}
+		if key != current {
+			current, rank = key, 0
+		}
+		bucket, ok := buckets[key]
+		if !ok {
+			// The observation was saved after the buckets were read.
+			continue
+		}
+
+		for fn, q := range p.percentiles {
+			at := q * float64(counts[key]-1)
+			lower, upper := int(math.Floor(at)), int(math.Ceil(at))
+			if rank == lower {
+				bucket.Values[fn] = v.Value
+			}
+			if rank == upper {
+				bucket.Values[fn] += (v.Value - bucket.Values[fn]) * (at - float64(lower))
+			}
+		}
+		rank++
+	}
+
+	return errors.Wrap(cursor.Err(), "reading values of buckets")
+}
+
+// pipeline converts an aggregation plan to a mongo aggregation pipeline.
+func (p aggregationPlan) pipeline() mongo.Pipeline {
+	stages, value := p.values()
+
+	group := bson.D{{Key: "_id", Value: p.groupID()}}
+	for _, fn := range p.functions {
+		if _, ok := p.percentiles[fn]; ok {
+			continue
+		}
+		if fn == "count" {
+			group = append(group, bson.E{Key: fn, Value: bson.M{"$sum": 1}})
+			continue
+		}
+		group = append(group, bson.E{Key: fn, Value: bson.M{accumulators[fn]: value}})
+	}
+	if len(p.percentiles) > 0 {
+		group = append(group, bson.E{Key: valueCount, Value: bson.M{"$sum": 1}})
+	}
+
+	return append(stages,
+		bson.D{{Key: "$group", Value: group}},
+		bson.D{{Key: "$sort", Value: bson.D{
+			{Key: "_id.feature", Value: 1},
+			{Key: "_id.property", Value: 1},
+			{Key: "_id.bucket", Value: 1},
+		}}},
+	)
+}
+
+// valuesPipeline converts an aggregation plan to a mongo aggregation pipeline
+// of the values of each bucket, in order.
+func (p aggregationPlan) valuesPipeline() mongo.Pipeline {
+	stages, value := p.values()
+
+	return append(stages,
+		bson.D{{Key: "$project", Value: bson.D{
+			{Key: "_id", Value: p.groupID()},
+			{Key: "value", Value: value},
+		}}},
+		bson.D{{Key: "$sort", Value: bson.D{
+			{Key: "_id.feature", Value: 1},
+			{Key: "_id.property", Value: 1},
+			{Key: "_id.bucket", Value: 1},
+			{Key: "value", Value: 1},
+		}}},
+	)
+}
+
+// values is the stages of a mongo aggregation pipeline that match the
+// observations with a number to aggregate, and the expression of the number.
+// Values are converted to the unit of the plan in a field of their own.
+func (p aggregationPlan) values() (mongo.Pipeline, string) {
+	key := p.key
+	stages := mongo.Pipeline{{{Key: "$match", Value: p.filter}}}
+	if p.unit != nil {
+		key = "convertedvalue"
+		stages = append(stages, bson.D{{Key: "$addFields", Value: bson.M{key: p.convert("$" + p.key)}}})
+	}
+
+	stages = append(stages, bson.D{{Key: "$match", Value: bson.D{{Key: key, Value: bson.M{"$type": "number"}}}}})
+	return stages, "$" + key
+}
+
+// groupID is the mongo expression grouping observations by feature, property
+// and bucket.
+func (p aggregationPlan) groupID() bson.D {
+	return bson.D{
+		{Key: "feature", Value: "$featureid"},
+		{Key: "property", Value: "$propertyid"},
+		{Key: "bucket", Value: bucketStart(p.bucket, "$phenomenontime")},
+	}
+}
+
+// convert is a mongo expression converting a value from the scale of its
+// observation to the unit of the plan. Values without a scale are left as
+// they are, and values that are not numbers or have a scale that was not
+// checked are skipped.
+func (p aggregationPlan) convert(value string) bson.M {
+	scales := make([]string, 0, len(p.conversions))
+	for scale := range p.conversions {
+		scales = append(scales, scale)
+	}
+	sort.Strings(scales)
+
+	branches := bson.A{bson.M{"case": bson.M{"$eq": bson.A{"$scale", ""}}, "then": value}}
+	for _, scale := range scales {
+		c := p.conversions[scale]
+		branches = append(branches, bson.M{
+			"case": bson.M{"$eq": bson.A{"$scale", scale}},
+			"then": bson.M{"$add": bson.A{bson.M{"$multiply": bson.A{value, c.Scale}}, c.Shift}},
+		})
+	}
+
+	numeric := bson.M{"$in": bson.A{bson.M{"$type": value}, bson.A{"double", "int", "long", "decimal"}}}
+	return bson.M{"$cond": bson.A{numeric, bson.M{"$switch": bson.M{"branches": branches, "default": nil}}, nil}}
+}
+
+// bucketStart is a mongo expression for the start of the bucket a time is in.
+func bucketStart(bucket, t string) bson.M {
+	if bucket == "week" {
+		return bson.M{"$dateFromParts": bson.D{
+			{Key: "isoWeekYear", Value: bson.M{"$isoWeekYear": t}},
+			{Key: "isoWeek", Value: bson.M{"$isoWeek": t}},
+		}}
+	}
+
+	parts := bson.D{
+		{Key: "year", Value: bson.M{"$year": t}},
+		{Key: "month", Value: bson.M{"$month": t}},
+		{Key: "day", Value: bson.M{"$dayOfMonth": t}},
+	}
+	if bucket == "hour" {
+		parts = append(parts, bson.E{Key: "hour", Value: bson.M{"$hour": t}})
+	}
+
+	return bson.M{"$dateFromParts": parts}
+}
+
+// percentile computes the q quantile of values by interpolating between the
+// closest ranks. Buckets always have at least one value.
+func percentile(values []float64, q float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	rank := q * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+
+	return sorted[lower] + (sorted[upper]-sorted[lower])*(rank-float64(lower))
+}
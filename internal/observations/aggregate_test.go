@@ -0,0 +1,100 @@
+package observations_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/schafer14/obs/internal/observations"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidAggregation(t *testing.T) {
+
+	// Arrange
+	a := observations.Aggregation{
+		Query: observations.Query{Filters: []observations.Filter{
+			{Path: "propertyId", Op: "=", Matcher: "urn:example:optimism"},
+		}},
+		Field:     "result.score",
+		Bucket:    "day",
+		Functions: []string{"count", "min", "max", "mean", "sum", "p50", "p99.9"},
+	}
+
+	// Act
+	err := a.Validate()
+
+	// Assert
+	assert.Nil(t, err, "valid aggregation rejected")
+}
+
+func TestInvalidAggregationsAreNamed(t *testing.T) {
+
+	// Arrange
+	a := observations.Aggregation{
+		Query: observations.Query{Filters: []observations.Filter{
+			{Path: "propertyId", Op: "~", Matcher: "optimism"},
+		}},
+		Field:     "resultTime",
+		Bucket:    "fortnight",
+		Functions: []string{"count", "median", "p101", "count", "pNaN", "p-Inf"},
+	}
+
+	// Act
+	err := a.Validate()
+
+	// Assert
+	require.Error(t, err, "invalid aggregation accepted")
+	vError, ok := err.(*observations.ValidationError)
+	require.True(t, ok, "error is not a validation error")
+
+	var names []string
+	for _, f := range vError.Fields {
+		names = append(names, f.Field)
+	}
+	assert.Equal(t, []string{"filters[0]", "field", "bucket", "functions[1]", "functions[2]", "functions[3]", "functions[4]", "functions[5]"}, names, "invalid aggregation not named")
+}
+
+func TestAggregatingObservations(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Arrange
+	ctx := context.Background()
+	err := deleteCollection(ctx, coll)
+	require.Nil(t, err, "deleting collection")
+	start := time.Date(2020, 3, 2, 9, 0, 0, 0, time.UTC)
+	obss := mkObss(4)
+	for i := range obss {
+		obss[i].PhenomenonTime = start.Add(time.Duration(i) * 12 * time.Hour)
+		obss[i].Result = map[string]interface{}{"wisteria": int64(i + 1)}
+	}
+
+	err = saveObss(ctx, obss, time.Now(), coll)
+	require.Nil(t, err, "prepping observations")
+
+	// Act
+	days, err := observations.Aggregate(ctx, coll, observations.Aggregation{
+		Field:     "result.wisteria",
+		Bucket:    "day",
+		Functions: []string{"count", "mean", "max", "p50"},
+	})
+	require.Nil(t, err, "aggregating by day")
+	weeks, err := observations.Aggregate(ctx, coll, observations.Aggregation{
+		Field:     "result.wisteria",
+		Bucket:    "week",
+		Functions: []string{"sum", "p0", "p25", "p100"},
+	})
+	require.Nil(t, err, "aggregating by week")
+
+	// Assert
+	require.Equal(t, 1, len(days), "series mismatch")
+	require.Equal(t, 2, len(days[0].Buckets), "daily buckets mismatch")
+	assert.Equal(t, time.Date(2020, 3, 2, 0, 0, 0, 0, time.UTC), days[0].Buckets[0].Start.UTC(), "bucket start invalid")
+	assert.Equal(t, map[string]float64{"count": 2, "mean": 1.5, "max": 2, "p50": 1.5}, days[0].Buckets[0].Values, "bucket values invalid")
+	require.Equal(t, 1, len(weeks[0].Buckets), "weekly buckets mismatch")
+	assert.Equal(t, map[string]float64{"sum": 10, "p0": 1, "p25": 1.75, "p100": 4}, weeks[0].Buckets[0].Values, "weekly values invalid")
+}
@@ -0,0 +1,93 @@
+package observations
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// changeOrder is the order observations are listed in by Changes, which is
+// the order they were saved in.
+var changeOrder = []string{"modifiedAt"}
+
+// Token marks the position of an observation in the order observations are
+// saved in. Each revision of an observation is saved at its modified time, so
+// a token identifies a single revision.
+type Token struct {
+	ModifiedAt time.Time
+	ID         string
+}
+
+// TokenOf finds the token of an observation.
+func TokenOf(obs Observation) Token {
+	return Token{ModifiedAt: obs.ModifiedAt, ID: obs.ID}
+}
+
+// TokenAt is the token of a time, which is before every observation saved
+// after it.
+func TokenAt(t time.Time) Token {
+	return Token{ModifiedAt: t}
+}
+
+// String encodes a token as an opaque url safe string.
+func (t Token) String() string {
+	keys, _ := parseSort(changeOrder)
+	return encodeCursor(t.position(keys))
+}
+
+// position converts a token to a position in the order of changes.
+func (t Token) position(keys []sortKey) position {
+	pos := position{Values: bson.A{t.ModifiedAt, t.ID}}
+	for _, k := range keys {
+		pos.Sort = append(pos.Sort, k.String())
+	}
+	return pos
+}
+
+// ParseToken decodes a token created by Token.String.
+func ParseToken(s string) (Token, error) {
+	keys, _ := parseSort(changeOrder)
+	pos, err := decodeCursor(s)
+	if err != nil || !pos.follows(keys) {
+		return Token{}, errors.New("invalid token")
+	}
+
+	modifiedAt, ok := pos.Values[0].(primitive.DateTime)
+	if !ok {
+		return Token{}, errors.New("invalid token")
+	}
+	id, ok := pos.Values[1].(string)
+	if !ok {
+		return Token{}, errors.New("invalid token")
+	}
+
+	return Token{ModifiedAt: time.Unix(0, int64(modifiedAt)*int64(time.Millisecond)).UTC(), ID: id}, nil
+}
+
+// Changes lists up to limit observations matching a query that were saved
+// after a token, in the order they were saved. Revisions of an observation are
+// listed as they are saved, while the revisions they supersede are not listed
+// again. The sort order, cursor and offset of the query are ignored.
+func Changes(ctx context.Context, collection *mongo.Collection, q Query, after Token, limit int) ([]Observation, error) {
+	page, err := Get(ctx, collection, changesQuery(q, after, limit))
+	if err != nil {
+		return nil, err
+	}
+
+	return page.Observations, nil
+}
+
+// changesQuery is the query for a page of the changes to the observations
+// matching a query after a token.
+func changesQuery(q Query, after Token, limit int) Query {
+	keys, _ := parseSort(changeOrder)
+	q.Sort = changeOrder
+	q.Cursor = encodeCursor(after.position(keys))
+	q.Offset = 0
+	q.Limit = limit
+	return q
+}
@@ -0,0 +1,78 @@
+package observations_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/schafer14/obs/internal/observations"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokensRoundTrip(t *testing.T) {
+
+	// Arrange
+	token := observations.Token{ModifiedAt: time.Date(2020, 3, 2, 10, 0, 0, 0, time.UTC), ID: uuid.New().String()}
+
+	// Act
+	parsed, err := observations.ParseToken(token.String())
+
+	// Assert
+	require.Nil(t, err, "parsing token")
+	assert.Equal(t, token, parsed, "token mismatch")
+}
+
+func TestCursorsAreNotTokens(t *testing.T) {
+
+	// Arrange
+	invalid := []string{"", "not a token", "DgAAAARzAAUAAAAAAA"}
+
+	for _, s := range invalid {
+
+		// Act
+		_, err := observations.ParseToken(s)
+
+		// Assert
+		assert.Error(t, err, "invalid token %q accepted", s)
+	}
+}
+
+func TestListingChanges(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Arrange
+	ctx := context.Background()
+	err := deleteCollection(ctx, coll)
+	require.Nil(t, err, "deleting collection")
+	start := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		require.Nil(t, saveObss(ctx, mkObss(1), start.Add(time.Duration(i)*time.Hour), coll), "prepping observations")
+	}
+
+	prev, err := observations.New(mkObs(), uuid.New().String(), start.Add(30*time.Minute))
+	require.Nil(t, err, "creating observation")
+	require.Nil(t, observations.Save(ctx, coll, prev), "saving observation")
+	next, err := observations.Revise(prev, prev.AsNew(), "banner@example.com", start.Add(3*time.Hour))
+	require.Nil(t, err, "revising observation")
+	require.Nil(t, observations.Supersede(ctx, coll, next), "superseding observation")
+
+	// Act
+	all, err := observations.Changes(ctx, coll, observations.Query{}, observations.TokenAt(start), 10)
+	require.Nil(t, err, "listing changes")
+	rest, err := observations.Changes(ctx, coll, observations.Query{}, observations.TokenOf(all[1]), 10)
+	require.Nil(t, err, "listing changes after token")
+
+	// Assert
+	require.Equal(t, 4, len(all), "changes mismatch")
+	for i := 1; i < len(all); i++ {
+		assert.False(t, all[i].ModifiedAt.Before(all[i-1].ModifiedAt), "changes not listed in the order they were saved")
+	}
+	assert.Equal(t, next.ID, all[3].ID, "revision not listed")
+	assert.Equal(t, 2, all[3].Revision, "superseded revision listed")
+	assert.Equal(t, all[2:], rest, "changes after token mismatch")
+}
@@ -0,0 +1,156 @@
+package observations
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Distinct retrieves one observation for each distinct combination of the
+// values at paths, such as one observation of each feature. The observation
+// with the latest result time represents each combination. Combinations are
+// ordered by the sort order of the query and then by the values at paths.
+// The limit and offset of the query apply to the combinations.
+func Distinct(ctx context.Context, collection *mongo.Collection, q Query, paths []string) ([]Observation, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if len(paths) == 0 {
+		return nil, &ValidationError{Err: "error validating query", Fields: []FieldError{{Field: "paths", Error: "at least one path is required"}}}
+	}
+
+	p, keys, err := buildDistinct(q, paths)
+	if err != nil {
+		return nil, err
+	}
+
+	limit := pageLimit(q.Limit)
+
+	// Observations are only sorted by id to break ties, which is replaced by
+	// the values at the paths when grouping.
+	sort := bson.D{}
+	sorted := map[string]bool{}
+	for _, k := range p.sort {
+		if k.key == "id" {
+			continue
+		}
+		direction := 1
+		if k.desc {
+			direction = -1
+		}
+		sort = append(sort, bson.E{Key: k.key, Value: direction})
+		sorted[k.key] = true
+	}
+	for _, key := range keys {
+		if !sorted[key] {
+			sort = append(sort, bson.E{Key: key, Value: 1})
+		}
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: p.filter}},
+		{{Key: "$sort", Value: bson.D{{Key: "resulttime", Value: -1}, {Key: "id", Value: 1}}}},
+		{{Key: "$group", Value: bson.D{{Key: "_id", Value: group(keys)}, {Key: "doc", Value: bson.M{"$first": "$$ROOT"}}}}},
+		{{Key: "$replaceRoot", Value: bson.D{{Key: "newRoot", Value: "$doc"}}}},
+		{{Key: "$sort", Value: sort}},
+		{{Key: "$skip", Value: q.Offset}},
+		{{Key: "$limit", Value: limit}},
+	}
+
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching distinct observations")
+	}
+
+	obss := []Observation{}
+	if err := cursor.All(ctx, &obss); err != nil {
+		return nil, errors.Wrap(err, "decoding distinct observations")
+	}
+
+	return obss, nil
+}
+
+// Count counts the observations matching a query. When paths are given the
+// distinct combinations of the values at paths are counted instead.
+func Count(ctx context.Context, collection *mongo.Collection, q Query, paths []string) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	p, keys, err := buildDistinct(q, paths)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(keys) == 0 {
+		n, err := collection.CountDocuments(ctx, p.filter)
+		return n, errors.Wrap(err, "counting observations")
+	}
+
+	cursor, err := collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: p.filter}},
+		{{Key: "$group", Value: bson.D{{Key: "_id", Value: group(keys)}}}},
+		{{Key: "$count", Value: "n"}},
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "counting distinct observations")
+	}
+	defer cursor.Close(ctx)
+
+	var count struct {
+		N int64 `bson:"n"`
+	}
+	if cursor.Next(ctx) {
+		if err := cursor.Decode(&count); err != nil {
+			return 0, errors.Wrap(err, "decoding count")
+		}
+	}
+
+	return count.N, errors.Wrap(cursor.Err(), "counting distinct observations")
+}
+
+// buildDistinct checks a query and the paths to group it by.
+func buildDistinct(q Query, paths []string) (plan, []string, error) {
+	p, err := buildQuery(Query{
+		Filters:        q.Filters,
+		Where:          q.Where,
+		ValidAt:        q.ValidAt,
+		ValidDuring:    q.ValidDuring,
+		PhenomenonTime: q.PhenomenonTime,
+		Sort:           q.Sort,
+		Offset:         q.Offset,
+	})
+
+	var fieldErrors []FieldError
+	if vError, ok := err.(*ValidationError); ok {
+		fieldErrors = vError.Fields
+	}
+
+	var keys []string
+	for i, path := range paths {
+		fld, err := lookupField(path)
+		if err != nil || fld.typ == typeGeometry {
+			fieldErrors = append(fieldErrors, FieldError{Field: fmt.Sprintf("paths[%d]", i), Error: fmt.Sprintf("cannot group by %q", path)})
+			continue
+		}
+		keys = append(keys, fld.key)
+	}
+
+	if len(fieldErrors) > 0 {
+		return plan{}, nil, &ValidationError{Err: "error validating query", Fields: fieldErrors}
+	}
+
+	return p, keys, nil
+}
+
+// group is the mongo expression grouping observations by the values at keys.
+func group(keys []string) bson.D {
+	g := bson.D{}
+	for i, key := range keys {
+		g = append(g, bson.E{Key: fmt.Sprintf("k%d", i), Value: "$" + key})
+	}
+	return g
+}
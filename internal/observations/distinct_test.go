@@ -0,0 +1,64 @@
+package observations_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/schafer14/obs/internal/observations"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDistinctNeedsPaths(t *testing.T) {
+
+	// Act
+	_, err := observations.Distinct(context.Background(), nil, observations.Query{}, nil)
+
+	// Assert
+	require.Error(t, err, "distinct observations without paths accepted")
+	_, ok := err.(*observations.ValidationError)
+	assert.True(t, ok, "error is not a validation error")
+}
+
+func TestInvalidDistinctPathsAreNamed(t *testing.T) {
+
+	// Act
+	_, err := observations.Count(context.Background(), nil, observations.Query{Offset: -1}, []string{"featureId", "password", "phenomenonLocation"})
+
+	// Assert
+	require.Error(t, err, "invalid paths accepted")
+	vError, ok := err.(*observations.ValidationError)
+	require.True(t, ok, "error is not a validation error")
+	var names []string
+	for _, f := range vError.Fields {
+		names = append(names, f.Field)
+	}
+	assert.ElementsMatch(t, []string{"offset", "paths[1]", "paths[2]"}, names, "errors not named")
+}
+
+func TestDistinctObservations(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Arrange
+	ctx := context.Background()
+	err := deleteCollection(ctx, coll)
+	require.Nil(t, err, "deleting collection")
+	obss := mkObss(3)
+	obss[2].Property = observations.Referenceable{ID: "urn:example:yield"}
+	err = saveObss(ctx, obss, obss[0].PhenomenonTime, coll)
+	require.Nil(t, err, "prepping observations")
+
+	// Act
+	distinct, err := observations.Distinct(ctx, coll, observations.Query{}, []string{"featureId", "propertyId"})
+	require.Nil(t, err, "getting distinct observations")
+	n, err := observations.Count(ctx, coll, observations.Query{}, []string{"propertyId"})
+	require.Nil(t, err, "counting distinct observations")
+
+	// Assert
+	require.Equal(t, 2, len(distinct), "distinct observations mismatch")
+	assert.Equal(t, "urn:example:health", distinct[0].PropertyID, "distinct observations not ordered")
+	assert.Equal(t, int64(2), n, "count mismatch")
+}
@@ -39,6 +39,7 @@ func init() {
 
 var (
 	ErrorNotFound = errors.New("observation not found")
+	ErrorConflict = errors.New("observation has been modified")
 )
 
 // FieldError is used to indicate an error with a specific request field.
@@ -0,0 +1,509 @@
+package observations
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Filter restricts the observations returned by Get. The value at Path is
+// compared to Matcher with the Op operator.
+//
+// Matchers are strings that are converted to the type of the field being
+// filtered on. Fields inside results do not have a type, so their matchers
+// are numbers or booleans when they can be parsed as one, unless Type says
+// otherwise. Operators that take several values, such as in and between,
+// take them as a comma separated list. The exists operator takes true or
+// false.
+//
+// In JSON the match may also be a number or a boolean, which is read as the
+// string it is written as. The match may be empty, to filter for an empty
+// string, but it must be given.
+type Filter struct {
+	Path    string `json:"path" validate:"required"`
+	Op      string `json:"op" validate:"required"`
+	Matcher string `json:"match" validate:"-"`
+	Type    string `json:"type,omitempty" validate:"omitempty,oneof=string number bool time"`
+
+	// noMatch is set when a filter read from JSON has no match. A filter
+	// made in code always has one, even when it is empty.
+	noMatch bool
+}
+
+// UnmarshalJSON reads a filter from JSON, recording whether it has a match.
+// Unknown fields are rejected.
+func (f *Filter) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		Path  string          `json:"path"`
+		Op    string          `json:"op"`
+		Match json.RawMessage `json:"match"`
+		Type  string          `json:"type"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&raw); err != nil {
+		return err
+	}
+
+	*f = Filter{Path: raw.Path, Op: raw.Op, Type: raw.Type}
+	match := bytes.TrimSpace(raw.Match)
+	switch {
+	case len(match) == 0 || string(match) == "null":
+		f.noMatch = true
+	case match[0] == '"':
+		return json.Unmarshal(match, &f.Matcher)
+	case string(match) == "true" || string(match) == "false":
+		f.Matcher = string(match)
+	default:
+		var n json.Number
+		if err := json.Unmarshal(match, &n); err != nil {
+			return fmt.Errorf("match must be a string, number or boolean")
+		}
+		f.Matcher = n.String()
+	}
+
+	return nil
+}
+
+// UnmarshalJSON reads an expression from JSON. The fields of a filter are
+// read by Filter, so that it records whether the filter has a match.
+func (e *Expression) UnmarshalJSON(b []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return err
+	}
+
+	var branches struct {
+		And []Expression `json:"and"`
+		Or  []Expression `json:"or"`
+		Not *Expression  `json:"not"`
+	}
+	filter := map[string]json.RawMessage{}
+	for k, v := range fields {
+		switch k {
+		case "and", "or", "not":
+		default:
+			filter[k] = v
+		}
+	}
+	if err := json.Unmarshal(b, &branches); err != nil {
+		return err
+	}
+	*e = Expression{And: branches.And, Or: branches.Or, Not: branches.Not}
+
+	if len(filter) == 0 {
+		return nil
+	}
+	fb, err := json.Marshal(filter)
+	if err != nil {
+		return err
+	}
+	e.Filter = &Filter{}
+	return json.Unmarshal(fb, e.Filter)
+}
+
+// Expression is a tree of filters combined with boolean operators. Each node
+// of the tree sets exactly one of And, Or, Not or the fields of a Filter.
+//
+//	{"and": [
+//		{"path": "featureTypeId", "op": "=", "match": "urn:example:garden"},
+//		{"or": [
+//			{"path": "propertyId", "op": "=", "match": "urn:example:health"},
+//			{"path": "propertyId", "op": "=", "match": "urn:example:yield"}
+//		]},
+//		{"not": {"path": "processId", "op": "=", "match": "urn:example:by-eye"}}
+//	]}
+type Expression struct {
+	And     []Expression `json:"and,omitempty" validate:"-"`
+	Or      []Expression `json:"or,omitempty" validate:"-"`
+	Not     *Expression  `json:"not,omitempty" validate:"-"`
+	*Filter `validate:"-"`
+}
+
+const (
+	// MaxExpressionDepth is the deepest an expression may be nested.
+	MaxExpressionDepth = 8
+
+	// MaxExpressionSize is the most filters and operators a query may have.
+	MaxExpressionSize = 100
+)
+
+// node is a parsed expression. Branches combine their children with the
+// and, or or not operator and leaves hold a single condition.
+type node struct {
+	op       string
+	children []node
+	cond     condition
+}
+
+// parseExpression checks an expression is valid and converts it to a node.
+// Errors are named after the position of the invalid node in the expression.
+func parseExpression(e Expression, name string, depth int, size *int) (node, []FieldError) {
+	*size++
+	if depth > MaxExpressionDepth {
+		return node{}, []FieldError{{Field: name, Error: fmt.Sprintf("expressions may be nested at most %d deep", MaxExpressionDepth)}}
+	}
+	if *size > MaxExpressionSize {
+		return node{}, []FieldError{{Field: name, Error: fmt.Sprintf("queries may have at most %d filters and operators", MaxExpressionSize)}}
+	}
+
+	set := 0
+	for _, isSet := range []bool{len(e.And) > 0, len(e.Or) > 0, e.Not != nil, e.Filter != nil} {
+		if isSet {
+			set++
+		}
+	}
+	if set != 1 {
+		return node{}, []FieldError{{Field: name, Error: "expression must have exactly one of and, or, not or a filter"}}
+	}
+
+	switch {
+	case e.Filter != nil:
+		c, err := parseFilter(*e.Filter)
+		if err != nil {
+			return node{}, []FieldError{{Field: name, Error: err.Error()}}
+		}
+		return node{cond: c}, nil
+
+	case e.Not != nil:
+		child, errs := parseExpression(*e.Not, name+".not", depth+1, size)
+		return node{op: "not", children: []node{child}}, errs
+	}
+
+	op, operands := "and", e.And
+	if len(e.Or) > 0 {
+		op, operands = "or", e.Or
+	}
+
+	n := node{op: op}
+	var errs []FieldError
+	for i, operand := range operands {
+		child, childErrs := parseExpression(operand, fmt.Sprintf("%s.%s[%d]", name, op, i), depth+1, size)
+		errs = append(errs, childErrs...)
+		n.children = append(n.children, child)
+	}
+
+	return n, errs
+}
+
+// bson converts a node to a mongo filter.
+func (n node) bson() bson.D {
+	switch n.op {
+	case "":
+		return bson.D{n.cond.bson()}
+	case "not":
+		return bson.D{{Key: "$nor", Value: bson.A{n.children[0].bson()}}}
+	}
+
+	operands := bson.A{}
+	for _, child := range n.children {
+		operands = append(operands, child.bson())
+	}
+
+	return bson.D{{Key: "$" + n.op, Value: operands}}
+}
+
+// valueType is the type of the values of a field.
+type valueType string
+
+const (
+	typeAny    valueType = ""
+	typeString valueType = "string"
+	typeNumber valueType = "number"
+	typeBool   valueType = "bool"
+	typeTime   valueType = "time"
+
+	// typeGeometry fields are GeoJSON geometries that may only be filtered
+	// with the geospatial operators.
+	typeGeometry valueType = "geometry"
+)
+
+// field is a field of an observation that may be filtered or sorted on.
+type field struct {
+	key string
+	typ valueType
+}
+
+// fields are the top level fields that may be filtered or sorted on keyed by
+// their lower cased path.
+var fields = map[string]field{
+	"id":                      {"id", typeString},
+	"featureid":               {"featureid", typeString},
+	"featuretypeid":           {"featuretypeid", typeString},
+	"propertyid":              {"propertyid", typeString},
+	"propertytypeid":          {"propertytypeid", typeString},
+	"processid":               {"processid", typeString},
+	"feature.label":           {"feature.label", typeString},
+	"featuretype.label":       {"featuretype.label", typeString},
+	"property.label":          {"property.label", typeString},
+	"propertytype.label":      {"propertytype.label", typeString},
+	"process.label":           {"process.label", typeString},
+	"scale":                   {"scale", typeString},
+	"phenomenontime":          {"phenomenontime", typeTime},
+	"resulttime":              {"resulttime", typeTime},
+	"validinterval.starttime": {"validinterval.starttime", typeTime},
+	"validinterval.endtime":   {"validintervalend", typeTime},
+	"revision":                {"revision", typeNumber},
+	"modifiedby":              {"modifiedby", typeString},
+	"modifiedat":              {"modifiedat", typeTime},
+	"phenomenonlocation":      {"phenomenonlocation", typeGeometry},
+	"observationlocation":     {"observationlocation", typeGeometry},
+}
+
+// segment is a key inside an observation's result or tags that may be filtered
+// or sorted on. Keys are restricted so that paths cannot address mongo
+// operators or fields outside the result and tags.
+var segment = regexp.MustCompile(`^[\p{L}\p{N} _-]+$`)
+
+// maxResultDepth is the deepest a path may reach into a result.
+const maxResultDepth = 8
+
+// lookupField finds the field at a path. Paths are either one of the top level
+// fields, a dotted path into the result such as result.wisteria, or the name of
+// a tag such as tags.observed by. Top level fields are matched without regard to
+// case while keys in results and tags are case sensitive.
+func lookupField(path string) (field, error) {
+	if fld, ok := fields[strings.ToLower(path)]; ok {
+		return fld, nil
+	}
+
+	parts := strings.Split(path, ".")
+	switch strings.ToLower(parts[0]) {
+	case "result":
+		if len(parts) < 2 || len(parts) > maxResultDepth+1 {
+			return field{}, fmt.Errorf("result paths must have between 1 and %d keys", maxResultDepth)
+		}
+	case "tags":
+		if len(parts) != 2 {
+			return field{}, fmt.Errorf("tag paths must name a single tag")
+		}
+	default:
+		return field{}, fmt.Errorf("cannot query path %q", path)
+	}
+
+	for _, part := range parts[1:] {
+		if !segment.MatchString(part) {
+			return field{}, fmt.Errorf("invalid key %q in path %q, keys may only contain letters, numbers, spaces, _ and -", part, path)
+		}
+	}
+
+	typ := typeAny
+	if len(parts) == 2 && strings.ToLower(parts[0]) == "tags" {
+		typ = typeString
+	}
+
+	return field{key: strings.ToLower(parts[0]) + "." + strings.Join(parts[1:], "."), typ: typ}, nil
+}
+
+// condition is a parsed filter that is ready to be converted to a query.
+type condition struct {
+	key    string
+	op     string
+	values []interface{}
+}
+
+// parseFilter checks a filter is valid and converts its matcher to
+// values of the type of the field being filtered on.
+func parseFilter(f Filter) (condition, error) {
+	if f.noMatch {
+		return condition{}, fmt.Errorf("filter on %q needs a match", f.Path)
+	}
+
+	fld, err := lookupField(f.Path)
+	if err != nil {
+		return condition{}, err
+	}
+
+	if fld.typ == typeGeometry && f.Op != "exists" {
+		if f.Type != "" {
+			return condition{}, fmt.Errorf("cannot match %q as type %q", f.Path, f.Type)
+		}
+		return parseGeoFilter(f, fld)
+	}
+
+	typ := fld.typ
+	if f.Type != "" {
+		if !validType(fld.typ, valueType(f.Type)) {
+			return condition{}, fmt.Errorf("cannot match %q as type %q", f.Path, f.Type)
+		}
+		typ = valueType(f.Type)
+	}
+
+	c := condition{key: fld.key, op: f.Op}
+
+	var matchers []string
+	switch f.Op {
+	case "=", "!=", "<", "<=", ">", ">=":
+		matchers = []string{f.Matcher}
+	case "in", "nin":
+		matchers = splitMatcher(f.Matcher)
+	case "between":
+		matchers = splitMatcher(f.Matcher)
+		if len(matchers) != 2 {
+			return c, fmt.Errorf("between on %q needs two comma separated values", f.Path)
+		}
+	case "exists":
+		exists, err := strconv.ParseBool(f.Matcher)
+		if err != nil {
+			return c, fmt.Errorf("exists on %q needs true or false", f.Path)
+		}
+		c.values = []interface{}{exists}
+		return c, nil
+	default:
+		return c, fmt.Errorf("cannot filter %q with operation %q", f.Path, f.Op)
+	}
+
+	for _, m := range matchers {
+		v, err := parseValue(typ, m)
+		if err != nil {
+			return c, fmt.Errorf("invalid match for %q: %v", f.Path, err)
+		}
+		c.values = append(c.values, v)
+	}
+
+	return c, nil
+}
+
+// validType reports whether a filter may match a field of type fieldType as a
+// value of type typ. Fields in results do not have a type and may be matched
+// as strings, numbers or booleans.
+func validType(fieldType, typ valueType) bool {
+	if fieldType != typeAny {
+		return fieldType == typ
+	}
+
+	return typ == typeString || typ == typeNumber || typ == typeBool
+}
+
+// splitMatcher splits a comma separated matcher into its values.
+func splitMatcher(m string) []string {
+	matchers := strings.Split(m, ",")
+	for i := range matchers {
+		matchers[i] = strings.TrimSpace(matchers[i])
+	}
+	return matchers
+}
+
+// parseValue converts a matcher to a value of the given type. Matchers for
+// fields without a type are numbers or booleans if they can be parsed as one
+// and strings otherwise.
+func parseValue(typ valueType, m string) (interface{}, error) {
+	switch typ {
+	case typeAny:
+		if n, err := strconv.ParseFloat(m, 64); err == nil {
+			return n, nil
+		}
+		if b, err := strconv.ParseBool(m); err == nil {
+			return b, nil
+		}
+		return m, nil
+	case typeNumber:
+		n, err := strconv.ParseFloat(m, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", m)
+		}
+		return n, nil
+	case typeBool:
+		b, err := strconv.ParseBool(m)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not true or false", m)
+		}
+		return b, nil
+	case typeTime:
+		t, err := time.Parse(time.RFC3339Nano, m)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an RFC3339 time", m)
+		}
+		return t, nil
+	default:
+		return m, nil
+	}
+}
+
+// sortKey is a field observations are sorted by.
+type sortKey struct {
+	key  string
+	desc bool
+}
+
+// String formats a sort key in the form it is given in a query.
+func (k sortKey) String() string {
+	if k.desc {
+		return "-" + k.key
+	}
+	return k.key
+}
+
+// maxSortKeys is the most fields observations may be sorted by.
+const maxSortKeys = 4
+
+// parseSort checks the sort order of a query is valid. Each entry is a path
+// that is sorted in ascending order, or in descending order when prefixed with
+// a minus sign. Observations are sorted by result time when no order is given
+// and their id is used to break ties when it is not in the order.
+func parseSort(sort []string) ([]sortKey, []FieldError) {
+	if len(sort) == 0 {
+		return []sortKey{{key: "resulttime"}, {key: "id"}}, nil
+	}
+
+	if len(sort) > maxSortKeys {
+		return nil, []FieldError{{Field: "sort", Error: fmt.Sprintf("observations may be sorted by at most %d paths", maxSortKeys)}}
+	}
+
+	var keys []sortKey
+	var errs []FieldError
+	byID := false
+	for i, s := range sort {
+		desc := strings.HasPrefix(s, "-")
+		fld, err := lookupField(strings.TrimPrefix(s, "-"))
+		if err != nil {
+			errs = append(errs, FieldError{Field: fmt.Sprintf("sort[%d]", i), Error: err.Error()})
+			continue
+		}
+		if fld.typ == typeGeometry {
+			errs = append(errs, FieldError{Field: fmt.Sprintf("sort[%d]", i), Error: fmt.Sprintf("cannot sort by location %q", s)})
+			continue
+		}
+		byID = byID || fld.key == "id"
+		keys = append(keys, sortKey{key: fld.key, desc: desc})
+	}
+
+	if !byID {
+		keys = append(keys, sortKey{key: "id"})
+	}
+	return keys, errs
+}
+
+// operators maps the comparison operators of filters to mongo operators.
+var operators = map[string]string{
+	"!=":     "$ne",
+	"<":      "$lt",
+	"<=":     "$lte",
+	">":      "$gt",
+	">=":     "$gte",
+	"in":     "$in",
+	"nin":    "$nin",
+	"exists": "$exists",
+}
+
+// bson converts a condition to a mongo filter element.
+func (c condition) bson() bson.E {
+	switch c.op {
+	case "=":
+		return bson.E{Key: c.key, Value: c.values[0]}
+	case "in", "nin":
+		return bson.E{Key: c.key, Value: bson.M{operators[c.op]: c.values}}
+	case "between":
+		return bson.E{Key: c.key, Value: bson.M{"$gte": c.values[0], "$lte": c.values[1]}}
+	case "within", "intersects", "near", "bbox":
+		return c.geoBSON()
+	default:
+		return bson.E{Key: c.key, Value: bson.M{operators[c.op]: c.values[0]}}
+	}
+}
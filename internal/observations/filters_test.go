@@ -0,0 +1,337 @@
+package observations_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/schafer14/obs/internal/observations"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidFilters(t *testing.T) {
+
+	// Arrange
+	filters := []observations.Filter{
+		{Path: "featureId", Op: "=", Matcher: "urn:example:garden"},
+		{Path: "propertyId", Op: "!=", Matcher: "urn:example:health"},
+		{Path: "processId", Op: "nin", Matcher: "urn:example:by-eye,urn:example:by-ear"},
+		{Path: "resultTime", Op: ">=", Matcher: "2020-03-01T00:00:00Z"},
+		{Path: "phenomenonTime", Op: "between", Matcher: "2020-03-01T00:00:00Z,2020-04-01T00:00:00+10:00"},
+		{Path: "revision", Op: "<", Matcher: "3"},
+		{Path: "scale", Op: "exists", Matcher: "false"},
+	}
+
+	// Act
+	err := observations.Query{Filters: filters}.Validate()
+
+	// Assert
+	assert.Nil(t, err, "valid filters rejected")
+}
+
+func TestInvalidFiltersAreNamed(t *testing.T) {
+
+	// Arrange
+	filters := []observations.Filter{
+		{Path: "featureId", Op: "=", Matcher: "urn:example:garden"},
+		{Path: "featureId", Op: "~", Matcher: "garden"},
+		{Path: "password", Op: "=", Matcher: "secret"},
+		{Path: "resultTime", Op: ">", Matcher: "yesterday"},
+		{Path: "revision", Op: "between", Matcher: "1"},
+		{Path: "scale", Op: "exists", Matcher: "maybe"},
+	}
+
+	// Act
+	err := observations.Query{Filters: filters}.Validate()
+
+	// Assert
+	require.Error(t, err, "invalid filters accepted")
+	vError, ok := err.(*observations.ValidationError)
+	require.True(t, ok, "error is not a validation error")
+
+	var names []string
+	for _, f := range vError.Fields {
+		names = append(names, f.Field)
+	}
+	assert.Equal(t, []string{"filters[1]", "filters[2]", "filters[3]", "filters[4]", "filters[5]"}, names, "invalid filters not named")
+}
+
+func TestMatchingRevisions(t *testing.T) {
+
+	// Arrange
+	q := observations.Query{Filters: []observations.Filter{
+		{Path: "propertyId", Op: "=", Matcher: "urn:example:health"},
+		{Path: "revision", Op: "=", Matcher: "1"},
+	}}
+	superseded, err := observations.New(mkObs(), "7c1e2d2e-91b5-4b43-9f0a-5d2b7c9a3b11", time.Now())
+	require.Nil(t, err, "creating observation")
+	superseded.Superseded = true
+	changed := mkObs()
+	changed.Property = observations.Referenceable{ID: "urn:example:yield"}
+	other, err := observations.New(changed, "7c1e2d2e-91b5-4b43-9f0a-5d2b7c9a3b11", time.Now())
+	require.Nil(t, err, "creating observation")
+
+	// Act
+	matched, err := q.Matches(superseded)
+	require.Nil(t, err, "matching superseded revision")
+	unmatched, err := q.Matches(other)
+	require.Nil(t, err, "matching other revision")
+	_, invalid := observations.Query{Filters: []observations.Filter{{Path: "password", Op: "=", Matcher: "secret"}}}.Matches(superseded)
+
+	// Assert
+	assert.True(t, matched, "superseded revision not matched")
+	assert.False(t, unmatched, "revision of another property matched")
+	assert.Error(t, invalid, "invalid filter matched")
+}
+
+func TestValidExpression(t *testing.T) {
+
+	// Arrange
+	var where observations.Expression
+	err := json.Unmarshal([]byte(`{"and": [
+		{"path": "featureTypeId", "op": "=", "match": "urn:example:garden"},
+		{"or": [
+			{"path": "propertyId", "op": "=", "match": "urn:example:health"},
+			{"path": "propertyId", "op": "=", "match": "urn:example:yield"}
+		]},
+		{"not": {"path": "processId", "op": "=", "match": "urn:example:by-eye"}}
+	]}`), &where)
+	require.Nil(t, err, "decoding expression")
+
+	// Act
+	err = observations.Query{Where: &where}.Validate()
+
+	// Assert
+	assert.Nil(t, err, "valid expression rejected")
+}
+
+func TestInvalidExpressionsAreNamed(t *testing.T) {
+
+	// Arrange
+	filter := &observations.Filter{Path: "featureId", Op: "=", Matcher: "urn:example:garden"}
+	where := observations.Expression{And: []observations.Expression{
+		{Filter: filter},
+		{Or: []observations.Expression{{Filter: &observations.Filter{Path: "featureId", Op: "~", Matcher: "garden"}}}},
+		{},
+		{Not: &observations.Expression{Filter: filter}, Filter: filter},
+	}}
+
+	// Act
+	err := observations.Query{Where: &where}.Validate()
+
+	// Assert
+	require.Error(t, err, "invalid expression accepted")
+	vError, ok := err.(*observations.ValidationError)
+	require.True(t, ok, "error is not a validation error")
+
+	var names []string
+	for _, f := range vError.Fields {
+		names = append(names, f.Field)
+	}
+	assert.Equal(t, []string{"where.and[1].or[0]", "where.and[2]", "where.and[3]"}, names, "invalid expressions not named")
+}
+
+func TestExpressionLimits(t *testing.T) {
+
+	// Arrange
+	filter := observations.Expression{Filter: &observations.Filter{Path: "featureId", Op: "=", Matcher: "urn:example:garden"}}
+	deep := filter
+	for i := 0; i < observations.MaxExpressionDepth; i++ {
+		deep = observations.Expression{Not: &deep}
+	}
+	wide := observations.Expression{}
+	for i := 0; i < observations.MaxExpressionSize; i++ {
+		wide.Or = append(wide.Or, filter)
+	}
+
+	// Act
+	deepErr := observations.Query{Where: &deep}.Validate()
+	wideErr := observations.Query{Where: &wide}.Validate()
+
+	// Assert
+	assert.Error(t, deepErr, "deep expression accepted")
+	assert.Error(t, wideErr, "large expression accepted")
+}
+
+func TestFilteringInsideResultsAndTags(t *testing.T) {
+
+	// Arrange
+	filters := []observations.Filter{
+		{Path: "result.wisteria", Op: ">", Matcher: "3"},
+		{Path: "result.steps.0.description", Op: "exists", Matcher: "true"},
+		{Path: "result.goal", Op: "=", Matcher: "42", Type: "string"},
+		{Path: "tags.observed by", Op: "=", Matcher: "Banner"},
+	}
+
+	// Act
+	err := observations.Query{Filters: filters}.Validate()
+
+	// Assert
+	assert.Nil(t, err, "valid filters rejected")
+}
+
+func TestMatchingEmptyZeroAndFalseValues(t *testing.T) {
+
+	// Arrange
+	var q observations.Query
+	require.Nil(t, json.Unmarshal([]byte(`{"filters": [
+		{"path": "result.note", "op": "=", "match": ""},
+		{"path": "result.count", "op": "=", "match": 0},
+		{"path": "result.done", "op": "=", "match": false},
+		{"path": "result.count", "op": "=", "match": "0"}
+	], "where": {"path": "result.done", "op": "=", "match": "false"}}`), &q), "decoding query")
+	newObs := mkObs()
+	newObs.Result = map[string]interface{}{"note": "", "count": 0, "done": false}
+	obs, err := observations.New(newObs, "7c1e2d2e-91b5-4b43-9f0a-5d2b7c9a3b11", time.Now())
+	require.Nil(t, err, "creating observation")
+
+	// Act
+	matched, err := q.Matches(obs)
+
+	// Assert
+	require.Nil(t, err, "empty, zero or false matches rejected")
+	assert.True(t, matched, "empty, zero or false values not matched")
+}
+
+func TestFiltersWithoutAMatchAreNamed(t *testing.T) {
+
+	// Arrange
+	var q observations.Query
+	require.Nil(t, json.Unmarshal([]byte(`{
+		"filters": [{"path": "result.note", "op": "=", "match": ""}, {"path": "result.note", "op": "="}],
+		"where": {"and": [{"path": "result.note", "op": "=", "match": null}]}
+	}`), &q), "decoding query")
+
+	// Act
+	err := q.Validate()
+
+	// Assert
+	require.Error(t, err, "filters without a match accepted")
+	vError, ok := err.(*observations.ValidationError)
+	require.True(t, ok, "error is not a validation error")
+
+	var names []string
+	for _, f := range vError.Fields {
+		names = append(names, f.Field)
+	}
+	assert.Equal(t, []string{"filters[1]", "where.and[0]"}, names, "filters without a match not named")
+}
+
+func TestInternalFieldsCannotBeQueried(t *testing.T) {
+
+	// Arrange
+	filters := []observations.Filter{
+		{Path: "superseded", Op: "=", Matcher: "true"},
+		{Path: "_id", Op: "exists", Matcher: "true"},
+		{Path: "result.$where", Op: "=", Matcher: "1"},
+		{Path: "result..wisteria", Op: "=", Matcher: "1"},
+		{Path: "tags.observed.by", Op: "=", Matcher: "Banner"},
+		{Path: "tags.observed by", Op: "<", Matcher: "3", Type: "number"},
+		{Path: "result", Op: "exists", Matcher: "true"},
+	}
+
+	// Act
+	err := observations.Query{Filters: filters}.Validate()
+
+	// Assert
+	require.Error(t, err, "internal fields accepted")
+	vError, ok := err.(*observations.ValidationError)
+	require.True(t, ok, "error is not a validation error")
+	assert.Equal(t, len(filters), len(vError.Fields), "invalid filters not rejected")
+}
+
+func TestSortOrders(t *testing.T) {
+
+	// Arrange
+	valid := []string{"-result.wisteria", "tags.observed by", "phenomenonTime"}
+	invalid := []string{"-superseded", "result.$natural"}
+
+	// Act
+	validErr := observations.Query{Sort: valid}.Validate()
+	invalidErr := observations.Query{Sort: invalid}.Validate()
+
+	// Assert
+	assert.Nil(t, validErr, "valid sort rejected")
+	require.Error(t, invalidErr, "invalid sort accepted")
+	assert.Equal(t, 2, len(invalidErr.(*observations.ValidationError).Fields), "invalid sort paths not named")
+}
+
+func TestGeospatialFilters(t *testing.T) {
+
+	// Arrange
+	filters := []observations.Filter{
+		{Path: "phenomenonLocation", Op: "within", Matcher: `{"type": "Polygon", "coordinates": [[[153, -27], [154, -27], [154, -28], [153, -27]]]}`},
+		{Path: "observationLocation", Op: "intersects", Matcher: `{"type": "LineString", "coordinates": [[153, -27], [154, -28]]}`},
+		{Path: "phenomenonLocation", Op: "near", Matcher: "153.02,-27.47,500"},
+		{Path: "observationLocation", Op: "bbox", Matcher: "153,-28,154,-27"},
+		{Path: "phenomenonLocation", Op: "exists", Matcher: "true"},
+	}
+
+	// Act
+	err := observations.Query{Filters: filters}.Validate()
+
+	// Assert
+	assert.Nil(t, err, "valid geospatial filters rejected")
+}
+
+func TestInvalidGeospatialFiltersAreNamed(t *testing.T) {
+
+	// Arrange
+	filters := []observations.Filter{
+		{Path: "phenomenonLocation", Op: "=", Matcher: "here"},
+		{Path: "phenomenonLocation", Op: "within", Matcher: `{"type": "Point", "coordinates": [153, -27]}`},
+		{Path: "phenomenonLocation", Op: "within", Matcher: `{"type": "Polygon", "coordinates": [[[153, -27], [154, -27], [154, -28], [153, -28]]]}`},
+		{Path: "observationLocation", Op: "intersects", Matcher: "not json"},
+		{Path: "phenomenonLocation", Op: "near", Matcher: "153,-97,500"},
+		{Path: "phenomenonLocation", Op: "bbox", Matcher: "154,-28,153,-27"},
+		{Path: "resultTime", Op: "near", Matcher: "153,-27,500"},
+	}
+
+	// Act
+	err := observations.Query{Filters: filters, Sort: []string{"phenomenonLocation"}}.Validate()
+
+	// Assert
+	require.Error(t, err, "invalid geospatial filters accepted")
+	vError, ok := err.(*observations.ValidationError)
+	require.True(t, ok, "error is not a validation error")
+
+	var names []string
+	for _, f := range vError.Fields {
+		names = append(names, f.Field)
+	}
+	assert.Equal(t, []string{"filters[0]", "filters[1]", "filters[2]", "filters[3]", "filters[4]", "filters[5]", "filters[6]", "sort[0]"}, names, "invalid filters not named")
+}
+
+func TestTemporalQueries(t *testing.T) {
+
+	// Arrange
+	valid := observations.Query{
+		ValidAt:        "2020-03-01T00:00:00Z",
+		ValidDuring:    "2020-03-01T00:00:00Z/..",
+		PhenomenonTime: "/2020-04-01T00:00:00+10:00",
+		Filters: []observations.Filter{
+			{Path: "validInterval.endTime", Op: "exists", Matcher: "true"},
+		},
+		Sort: []string{"-validInterval.endTime"},
+	}
+	invalid := observations.Query{
+		ValidAt:        "yesterday",
+		ValidDuring:    "2020-04-01T00:00:00Z/2020-03-01T00:00:00Z",
+		PhenomenonTime: "2020-03-01T00:00:00Z",
+	}
+
+	// Act
+	validErr := valid.Validate()
+	invalidErr := invalid.Validate()
+
+	// Assert
+	assert.Nil(t, validErr, "valid temporal query rejected")
+	require.Error(t, invalidErr, "invalid temporal query accepted")
+
+	var names []string
+	for _, f := range invalidErr.(*observations.ValidationError).Fields {
+		names = append(names, f.Field)
+	}
+	assert.Equal(t, []string{"validAt", "validDuring", "phenomenonTime"}, names, "invalid periods not named")
+}
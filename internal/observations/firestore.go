@@ -0,0 +1,489 @@
+package observations
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	geojson "github.com/paulmach/go.geojson"
+	"github.com/pkg/errors"
+	"github.com/schafer14/obs/internal/platform/database"
+	"go.mongodb.org/mongo-driver/bson"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Firestore is a repository of observations in a firestore collection.
+//
+// Observations are stored as the documents mongo would store, with their
+// locations as GeoJSON strings as firestore cannot store arrays inside arrays.
+// Queries are converted from the filters sent to mongo, and those firestore
+// cannot run are rejected with a *ValidationError rather than answered
+// differently. Distinct, Count, Latest and Aggregate find the matching
+// observations in firestore and compute their answer in the process like
+// Memory.
+type Firestore struct {
+	client     *firestore.Client
+	collection *firestore.CollectionRef
+}
+
+// NewFirestore creates a repository of the observations in a collection.
+func NewFirestore(client *firestore.Client, collection string) *Firestore {
+	return &Firestore{client: client, collection: client.Collection(collection)}
+}
+
+// toFirestore converts an observation to the document firestore stores for a
+// new revision, which is pending until its event has been published.
+func toFirestore(obs Observation) (map[string]interface{}, error) {
+	raw, err := encode(obs)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc bson.M
+	if err := bson.Unmarshal(raw, &doc); err != nil {
+		return nil, errors.Wrap(err, "encoding observation")
+	}
+	data := firestoreValue(doc).(map[string]interface{})
+
+	for key, g := range map[string]*geojson.Geometry{"phenomenonlocation": obs.PhenomenonLocation, "observationlocation": obs.ObservationLocation} {
+		if g == nil {
+			continue
+		}
+		location, err := json.Marshal(g)
+		if err != nil {
+			return nil, errors.Wrap(err, "encoding location")
+		}
+		data[key] = string(location)
+	}
+	data["pending"] = true
+
+	return data, nil
+}
+
+// fromFirestore converts a stored document to the document mongo would
+// store, so it may be decoded and matched like the documents of Memory.
+func fromFirestore(data map[string]interface{}) (bson.Raw, error) {
+	for _, key := range locations {
+		location, ok := data[key].(string)
+		if !ok {
+			continue
+		}
+		var g geojson.Geometry
+		if err := json.Unmarshal([]byte(location), &g); err != nil {
+			return nil, errors.Wrap(err, "decoding location")
+		}
+		data[key] = &g
+	}
+
+	raw, err := bson.MarshalWithRegistry(database.Registry, data)
+	return bson.Raw(raw), errors.Wrap(err, "decoding observation")
+}
+
+// docID is the id of the document of a revision of an observation.
+func docID(id string, revision int) string {
+	return fmt.Sprintf("%s@%d", url.PathEscape(id), revision)
+}
+
+// Save persists an observation.
+func (f *Firestore) Save(ctx context.Context, obs Observation) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	data, err := toFirestore(obs)
+	if err != nil {
+		return errors.Wrap(err, "saving observation")
+	}
+
+	_, err = f.collection.Doc(docID(obs.ID, obs.Revision)).Create(ctx, data)
+
+	return errors.Wrap(err, "saving observation")
+}
+
+// SaveMany persists a batch of observations. Observations that cannot be
+// saved are returned keyed by their index in the batch.
+func (f *Firestore) SaveMany(ctx context.Context, obss []Observation) (map[int]error, error) {
+	failed := map[int]error{}
+	for i, obs := range obss {
+		if err := f.Save(ctx, obs); err != nil {
+			failed[i] = err
+		}
+	}
+
+	return failed, nil
+}
+
+// Find retrieves the latest revision of an observation.
+func (f *Firestore) Find(ctx context.Context, id string) (Observation, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	docs, err := f.documents(ctx, f.collection.Where("id", "==", id).Where("superseded", "==", false).Limit(1))
+	if err != nil {
+		return Observation{}, errors.Wrap(err, "finding observation")
+	}
+	if len(docs) == 0 {
+		return Observation{}, ErrorNotFound
+	}
+
+	return decode(docs[0])
+}
+
+// Supersede persists a new revision of an observation and marks the revision
+// it replaces as superseded. ErrorConflict is returned if the previous
+// revision has already been superseded.
+func (f *Firestore) Supersede(ctx context.Context, obs Observation) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	data, err := toFirestore(obs)
+	if err != nil {
+		return errors.Wrap(err, "saving revision")
+	}
+
+	prev := f.collection.Doc(docID(obs.ID, obs.Revision-1))
+	err = f.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snap, err := tx.Get(prev)
+		if status.Code(err) == codes.NotFound {
+			return ErrorConflict
+		}
+		if err != nil {
+			return err
+		}
+		if superseded, _ := snap.DataAt("superseded"); superseded == true {
+			return ErrorConflict
+		}
+
+		if err := tx.Update(prev, []firestore.Update{{Path: "superseded", Value: true}}); err != nil {
+			return err
+		}
+		return tx.Create(f.collection.Doc(docID(obs.ID, obs.Revision)), data)
+	})
+	if err == ErrorConflict {
+		return err
+	}
+
+	return errors.Wrap(err, "superseding observation")
+}
+
+// Unpublished lists up to limit revisions of observations whose events have
+// not been published, in the order they were saved. Firestore asks for a
+// composite index of pending and modifiedat the first time it is run.
+func (f *Firestore) Unpublished(ctx context.Context, limit int) ([]Observation, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	docs, err := f.documents(ctx, f.collection.Where("pending", "==", true).OrderBy("modifiedat", firestore.Asc).Limit(limit))
+	if err != nil {
+		return nil, errors.Wrap(err, "finding unpublished observations")
+	}
+
+	obss, err := decodeAll(docs)
+	return obss, errors.Wrap(err, "decoding unpublished observations")
+}
+
+// MarkPublished records that the event of a revision of an observation has
+// been published.
+func (f *Firestore) MarkPublished(ctx context.Context, obs Observation) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := f.collection.Doc(docID(obs.ID, obs.Revision)).Update(ctx, []firestore.Update{{Path: "pending", Value: firestore.Delete}})
+	return errors.Wrap(err, "marking observation published")
+}
+
+// History retrieves every revision of an observation ordered from the first
+// revision to the latest.
+func (f *Firestore) History(ctx context.Context, id string) ([]Observation, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	docs, err := f.documents(ctx, f.collection.Where("id", "==", id))
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching observation history")
+	}
+	sortDocuments(docs, []sortKey{{key: "revision"}})
+
+	revisions, err := decodeAll(docs)
+	if err != nil {
+		return revisions, errors.Wrap(err, "decoding observation history")
+	}
+	if len(revisions) == 0 {
+		return revisions, ErrorNotFound
+	}
+
+	return revisions, nil
+}
+
+// Get retrieves a page of observations.
+func (f *Firestore) Get(ctx context.Context, q Query) (Page, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	limit := pageLimit(q.Limit)
+
+	fp, err := buildFirestoreQuery(q)
+	if err != nil {
+		return Page{}, err
+	}
+	if err := fp.ordered(); err != nil {
+		return Page{}, err
+	}
+
+	// One more observation than the limit is fetched to know if there is
+	// another page.
+	docs, err := f.documents(ctx, fp.sorted(f.collection.Query).Offset(q.Offset).Limit(limit+1))
+	if err != nil {
+		return Page{}, errors.Wrap(err, "fetching observations")
+	}
+
+	var page Page
+	if len(docs) > limit {
+		docs = docs[:limit]
+		page.Next = encodeCursor(fp.position(docs[limit-1]))
+	}
+
+	var conv *converter
+	if fp.unit != nil {
+		conv = newConverter(*fp.unit)
+	}
+
+	for _, doc := range docs {
+		obs, err := decode(doc)
+		if err != nil {
+			return page, errors.Wrap(err, "decoding observations")
+		}
+		if conv != nil {
+			if obs, err = conv.convert(obs); err != nil {
+				return Page{}, err
+			}
+		}
+		page.Observations = append(page.Observations, obs)
+	}
+
+	return page, nil
+}
+
+// Stream calls fn with each observation matching a query in order. When the
+// query has a unit, the scales of the matching observations are checked
+// before fn is first called.
+func (f *Firestore) Stream(ctx context.Context, q Query, fn func(Observation) error) error {
+	fp, err := buildFirestoreQuery(q)
+	if err != nil {
+		return err
+	}
+	if err := fp.ordered(); err != nil {
+		return err
+	}
+
+	var conv *converter
+	if fp.unit != nil {
+		if conv, err = f.scales(ctx, fp); err != nil {
+			return err
+		}
+	}
+
+	query := fp.sorted(f.collection.Query).Offset(q.Offset)
+	if q.Limit > 0 {
+		query = query.Limit(q.Limit)
+	}
+
+	iter := query.Documents(ctx)
+	defer iter.Stop()
+
+	for {
+		snap, err := iter.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "fetching observations")
+		}
+
+		doc, err := fromFirestore(snap.Data())
+		if err != nil {
+			return err
+		}
+		obs, err := decode(doc)
+		if err != nil {
+			return errors.Wrap(err, "decoding observations")
+		}
+		if conv != nil {
+			if obs, err = conv.convert(obs); err != nil {
+				return err
+			}
+		}
+		if err := fn(obs); err != nil {
+			return err
+		}
+	}
+}
+
+// Convertible checks the observations matching a query can be converted to
+// its unit.
+func (f *Firestore) Convertible(ctx context.Context, q Query) error {
+	fp, err := buildFirestoreQuery(q)
+	if err != nil || fp.unit == nil {
+		return err
+	}
+
+	_, err = f.scales(ctx, fp)
+	return err
+}
+
+// scales checks the scales of the observations matching a plan can be
+// converted to its unit.
+func (f *Firestore) scales(ctx context.Context, fp firestorePlan) (*converter, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	docs, err := f.documents(ctx, fp.apply(f.collection.Select("scale")))
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching scales")
+	}
+
+	return checkScales(*fp.unit, distinctScales(docs))
+}
+
+// Changes lists the observations matching a query saved after a token.
+func (f *Firestore) Changes(ctx context.Context, q Query, after Token, limit int) ([]Observation, error) {
+	page, err := f.Get(ctx, changesQuery(q, after, limit))
+	if err != nil {
+		return nil, err
+	}
+
+	return page.Observations, nil
+}
+
+// Distinct retrieves one observation for each combination of the values at
+// paths.
+func (f *Firestore) Distinct(ctx context.Context, q Query, paths []string) ([]Observation, error) {
+	if _, _, err := buildDistinct(q, paths); err != nil {
+		return nil, err
+	}
+
+	m, err := f.load(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.Distinct(ctx, q, paths)
+}
+
+// Count counts the observations, or combinations of values at paths,
+// matching a query.
+func (f *Firestore) Count(ctx context.Context, q Query, paths []string) (int64, error) {
+	if _, _, err := buildDistinct(q, paths); err != nil {
+		return 0, err
+	}
+
+	m, err := f.load(ctx, q)
+	if err != nil {
+		return 0, err
+	}
+
+	return m.Count(ctx, q, paths)
+}
+
+// Latest retrieves the most recent observation of each property of features.
+// Firestore matches at most ten features at a time, so the observations of
+// larger lists of features are fetched ten features at a time.
+func (f *Firestore) Latest(ctx context.Context, features []string, asOf time.Time) ([]Observation, error) {
+	if err := validFeatures(features); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	m := NewMemory()
+	for start := 0; start < len(features); start += maxFirestoreIn {
+		end := start + maxFirestoreIn
+		if end > len(features) {
+			end = len(features)
+		}
+
+		query := f.collection.Where("featureid", "in", features[start:end])
+		if asOf.IsZero() {
+			query = query.Where("superseded", "==", false)
+		}
+
+		docs, err := f.documents(ctx, query)
+		if err != nil {
+			return nil, errors.Wrap(err, "fetching latest observations")
+		}
+		m.docs = append(m.docs, docs...)
+	}
+
+	return m.Latest(ctx, features, asOf)
+}
+
+// Aggregate computes statistics over the observations matching an
+// aggregation.
+func (f *Firestore) Aggregate(ctx context.Context, a Aggregation) ([]Series, error) {
+	if _, err := buildAggregation(a); err != nil {
+		return nil, err
+	}
+
+	m, err := f.load(ctx, Query{
+		Filters:        a.Query.Filters,
+		Where:          a.Query.Where,
+		ValidAt:        a.Query.ValidAt,
+		ValidDuring:    a.Query.ValidDuring,
+		PhenomenonTime: a.Query.PhenomenonTime,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return m.Aggregate(ctx, a)
+}
+
+// load fetches the observations matching the filters of a query into memory,
+// ignoring its sort order and paging.
+func (f *Firestore) load(ctx context.Context, q Query) (*Memory, error) {
+	fp, err := buildFirestoreQuery(Query{
+		Filters:        q.Filters,
+		Where:          q.Where,
+		ValidAt:        q.ValidAt,
+		ValidDuring:    q.ValidDuring,
+		PhenomenonTime: q.PhenomenonTime,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	docs, err := f.documents(ctx, fp.apply(f.collection.Query))
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching observations")
+	}
+
+	return &Memory{docs: docs}, nil
+}
+
+// documents runs a firestore query and converts the documents it finds to
+// the documents mongo would store.
+func (f *Firestore) documents(ctx context.Context, q firestore.Query) ([]bson.Raw, error) {
+	snaps, err := q.Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	docs := make([]bson.Raw, 0, len(snaps))
+	for _, snap := range snaps {
+		doc, err := fromFirestore(snap.Data())
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+
+	return docs, nil
+}
@@ -0,0 +1,279 @@
+package observations
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// maxFirestoreIn is the most values firestore matches with a single in
+// filter.
+const maxFirestoreIn = 10
+
+// firestoreFilter is a filter of a firestore query.
+type firestoreFilter struct {
+	key   string
+	op    string
+	value interface{}
+}
+
+// firestorePlan is a query converted to the filters of a firestore query.
+//
+// Firestore only matches values equal to one or any of a list of values, and
+// values in a range of a single field. Filters that need more than that, such
+// as or, not, !=, exists and the geospatial operators, cannot be converted and
+// are reported as a *ValidationError naming the part of the query that uses
+// them.
+type firestorePlan struct {
+	plan
+	filters []firestoreFilter
+	after   []interface{}
+
+	// rangeKey is the only field matched with a range, and rangeName the part
+	// of the query that matched it.
+	rangeKey, rangeName string
+
+	// inName is the part of the query that matched a field with in.
+	inName string
+}
+
+// unsupportedQuery reports the parts of a query firestore cannot run.
+func unsupportedQuery(errs []FieldError) error {
+	return &ValidationError{Err: "query not supported by firestore", Fields: errs}
+}
+
+// buildFirestoreQuery converts a query to the filters of a firestore query.
+// The filters are converted from the same mongo filters as Mongo uses, one
+// part of the query at a time, so unsupported filters are reported against
+// the part of the query they came from.
+func buildFirestoreQuery(q Query) (firestorePlan, error) {
+	p, err := buildQuery(q)
+	if err != nil {
+		return firestorePlan{}, err
+	}
+
+	fp := firestorePlan{plan: p, filters: []firestoreFilter{{key: "superseded", op: "==", value: false}}}
+
+	var errs []FieldError
+	for i, filter := range q.Filters {
+		c, _ := parseFilter(filter)
+		errs = append(errs, fp.add(fmt.Sprintf("filters[%d]", i), bson.D{c.bson()})...)
+	}
+
+	if q.Where != nil {
+		size := len(q.Filters)
+		where, _ := parseExpression(*q.Where, "where", 1, &size)
+		errs = append(errs, fp.add("where", where.bson())...)
+	}
+
+	periods := []struct {
+		name string
+		q    Query
+	}{
+		{"validAt", Query{ValidAt: q.ValidAt}},
+		{"validDuring", Query{ValidDuring: q.ValidDuring}},
+		{"phenomenonTime", Query{PhenomenonTime: q.PhenomenonTime}},
+	}
+	for _, period := range periods {
+		clauses, _ := temporalClauses(period.q)
+		for _, clause := range clauses {
+			errs = append(errs, fp.add(period.name, clause.(bson.D))...)
+		}
+	}
+
+	if q.Cursor != "" {
+		pos, _ := decodeCursor(q.Cursor)
+		for _, v := range pos.Values {
+			fp.after = append(fp.after, firestoreValue(v))
+		}
+	}
+
+	if len(errs) > 0 {
+		return firestorePlan{}, unsupportedQuery(errs)
+	}
+
+	return fp, nil
+}
+
+// ordered checks firestore can list the observations of a plan in its sort
+// order. A field matched with a range must be the first field sorted by, and
+// results and tags may only be sorted by a field that is filtered on, as
+// firestore leaves out observations without the field being sorted by.
+func (fp firestorePlan) ordered() error {
+	filtered := map[string]bool{}
+	for _, f := range fp.filters {
+		if f.value != nil {
+			filtered[f.key] = true
+		}
+	}
+
+	var errs []FieldError
+	if fp.rangeKey != "" && fp.sort[0].key != fp.rangeKey {
+		errs = append(errs, FieldError{Field: fp.rangeName, Error: fmt.Sprintf("firestore can only match a range of %q when observations are sorted by it first", fp.rangeKey)})
+	}
+	for _, k := range fp.sort {
+		if (strings.HasPrefix(k.key, "result.") || strings.HasPrefix(k.key, "tags.")) && !filtered[k.key] {
+			errs = append(errs, FieldError{Field: "sort", Error: fmt.Sprintf("firestore can only sort by %q when observations are also filtered on it", k.key)})
+		}
+	}
+
+	if len(errs) > 0 {
+		return unsupportedQuery(errs)
+	}
+
+	return nil
+}
+
+// firestoreOperators maps mongo comparison operators to firestore operators.
+var firestoreOperators = map[string]string{
+	"$lt":  "<",
+	"$lte": "<=",
+	"$gt":  ">",
+	"$gte": ">=",
+}
+
+// filterNames maps mongo operators to the names of the filters that use them.
+var filterNames = map[string]string{
+	"$ne":            "!=",
+	"$nin":           "nin",
+	"$exists":        "exists",
+	"$geoWithin":     "within, near or bbox",
+	"$geoIntersects": "intersects",
+}
+
+// add converts a mongo filter from the part of a query called name to
+// firestore filters.
+func (fp *firestorePlan) add(name string, filter bson.D) []FieldError {
+	var errs []FieldError
+	for _, e := range filter {
+		switch e.Key {
+		case "$and", "$or":
+			operands := list(e.Value)
+			if e.Key == "$or" && len(operands) != 1 {
+				errs = append(errs, FieldError{Field: name, Error: "firestore cannot match observations matching any of several filters, use in to match any of several values"})
+				continue
+			}
+			for _, operand := range operands {
+				errs = append(errs, fp.add(name, operand.(bson.D))...)
+			}
+
+		case "$nor":
+			errs = append(errs, FieldError{Field: name, Error: "firestore cannot match observations that do not match a filter"})
+
+		default:
+			ops, ok := e.Value.(bson.M)
+			if !ok {
+				fp.filters = append(fp.filters, firestoreFilter{key: e.Key, op: "==", value: e.Value})
+				continue
+			}
+
+			sorted := make([]string, 0, len(ops))
+			for op := range ops {
+				sorted = append(sorted, op)
+			}
+			sort.Strings(sorted)
+
+			for _, op := range sorted {
+				if err := fp.compare(name, e.Key, op, ops[op]); err != nil {
+					errs = append(errs, *err)
+				}
+			}
+		}
+	}
+
+	return errs
+}
+
+// compare converts a mongo comparison of the field at key to a firestore
+// filter.
+func (fp *firestorePlan) compare(name, key, op string, arg interface{}) *FieldError {
+	if op == "$in" {
+		values := list(arg)
+		switch {
+		case fp.inName != "":
+			return &FieldError{Field: name, Error: fmt.Sprintf("firestore can only match any of several values once per query, %s already does", fp.inName)}
+		case len(values) > maxFirestoreIn:
+			return &FieldError{Field: name, Error: fmt.Sprintf("firestore can only match any of at most %d values", maxFirestoreIn)}
+		}
+		fp.inName = name
+		fp.filters = append(fp.filters, firestoreFilter{key: key, op: "in", value: values})
+		return nil
+	}
+
+	fop, ok := firestoreOperators[op]
+	if !ok {
+		filter, ok := filterNames[op]
+		if !ok {
+			filter = strings.TrimPrefix(op, "$")
+		}
+		return &FieldError{Field: name, Error: fmt.Sprintf("firestore cannot filter %q with %s", key, filter)}
+	}
+
+	if fp.rangeKey != "" && fp.rangeKey != key {
+		return &FieldError{Field: name, Error: fmt.Sprintf("firestore can only match a range of one field, %s already matches a range of %q", fp.rangeName, fp.rangeKey)}
+	}
+	fp.rangeKey, fp.rangeName = key, name
+	fp.filters = append(fp.filters, firestoreFilter{key: key, op: fop, value: arg})
+
+	return nil
+}
+
+// apply adds the filters of a plan to a firestore query.
+func (fp firestorePlan) apply(q firestore.Query) firestore.Query {
+	for _, f := range fp.filters {
+		q = q.WherePath(fieldPath(f.key), f.op, f.value)
+	}
+	return q
+}
+
+// sorted adds the filters, sort order and cursor of a plan to a firestore
+// query.
+func (fp firestorePlan) sorted(q firestore.Query) firestore.Query {
+	q = fp.apply(q)
+	for _, k := range fp.sort {
+		direction := firestore.Asc
+		if k.desc {
+			direction = firestore.Desc
+		}
+		q = q.OrderByPath(fieldPath(k.key), direction)
+	}
+	if fp.after != nil {
+		q = q.StartAfter(fp.after...)
+	}
+	return q
+}
+
+// fieldPath converts a dotted key to a firestore field path. Keys in results
+// and tags may contain characters firestore does not allow in dotted paths.
+func fieldPath(key string) firestore.FieldPath {
+	return firestore.FieldPath(strings.Split(key, "."))
+}
+
+// firestoreValue converts a value of a mongo document to the value firestore
+// stores. Times are stored as timestamps and integers as 64 bit integers.
+func firestoreValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case primitive.M:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[key] = firestoreValue(value)
+		}
+		return m
+	case primitive.A:
+		a := make([]interface{}, len(v))
+		for i, value := range v {
+			a[i] = firestoreValue(value)
+		}
+		return a
+	case primitive.DateTime:
+		return time.Unix(0, int64(v)*int64(time.Millisecond)).UTC()
+	case int32:
+		return int64(v)
+	}
+	return v
+}
@@ -0,0 +1,252 @@
+package observations
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	geojson "github.com/paulmach/go.geojson"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// earthRadius is the radius of the earth in metres used to convert distances
+// to the radians mongo expects. It is the only radius, as postgres and memory
+// compare angles in radians too, so a distance covers the same area whichever
+// database is used.
+const earthRadius = 6378100.0
+
+// locations are the keys of the geometries of an observation.
+var locations = []string{"phenomenonlocation", "observationlocation"}
+
+// parseGeoFilter converts a filter on a location to a condition. Locations
+// may be filtered with the following operators.
+//
+//	within      the location is inside the GeoJSON Polygon or MultiPolygon in the matcher
+//	intersects  the location intersects the GeoJSON geometry in the matcher
+//	near        the location is within a distance of a point given as lng,lat,metres
+//	bbox        the location is inside the box given as minLng,minLat,maxLng,maxLat
+func parseGeoFilter(f Filter, fld field) (condition, error) {
+	c := condition{key: fld.key, op: f.Op}
+
+	switch f.Op {
+	case "within", "intersects":
+		g, err := geojson.UnmarshalGeometry([]byte(f.Matcher))
+		if err != nil {
+			return c, fmt.Errorf("%s on %q needs a GeoJSON geometry", f.Op, f.Path)
+		}
+		if f.Op == "within" && !g.IsPolygon() && !g.IsMultiPolygon() {
+			return c, fmt.Errorf("within on %q needs a Polygon or MultiPolygon", f.Path)
+		}
+		if err := validGeometry(g); err != nil {
+			return c, fmt.Errorf("invalid geometry for %q: %v", f.Path, err)
+		}
+		c.values = []interface{}{g}
+
+	case "near":
+		v, err := parseFloats(f.Matcher, 3)
+		if err != nil {
+			return c, fmt.Errorf("near on %q needs a longitude, latitude and distance in metres", f.Path)
+		}
+		if err := validPosition(v[:2]); err != nil {
+			return c, fmt.Errorf("invalid point for %q: %v", f.Path, err)
+		}
+		if v[2] < 0 {
+			return c, fmt.Errorf("near on %q needs a distance that is not negative", f.Path)
+		}
+		c.values = []interface{}{bson.A{v[0], v[1]}, v[2] / earthRadius}
+
+	case "bbox":
+		v, err := parseFloats(f.Matcher, 4)
+		if err != nil {
+			return c, fmt.Errorf("bbox on %q needs a minimum longitude, minimum latitude, maximum longitude and maximum latitude", f.Path)
+		}
+		minLng, minLat, maxLng, maxLat := v[0], v[1], v[2], v[3]
+		if minLng >= maxLng || minLat >= maxLat {
+			return c, fmt.Errorf("bbox on %q needs minimums less than maximums", f.Path)
+		}
+		g := geojson.NewPolygonGeometry([][][]float64{{
+			{minLng, minLat}, {maxLng, minLat}, {maxLng, maxLat}, {minLng, maxLat}, {minLng, minLat},
+		}})
+		if err := validGeometry(g); err != nil {
+			return c, fmt.Errorf("invalid box for %q: %v", f.Path, err)
+		}
+		c.values = []interface{}{g}
+
+	default:
+		return c, fmt.Errorf("cannot filter %q with operation %q", f.Path, f.Op)
+	}
+
+	return c, nil
+}
+
+// geoBSON converts a condition on a location to a mongo filter element.
+// Distances are matched with $centerSphere rather than $near so that they
+// may be combined with other filters and sorted like any other filter.
+func (c condition) geoBSON() bson.E {
+	switch c.op {
+	case "intersects":
+		return bson.E{Key: c.key, Value: bson.M{"$geoIntersects": bson.M{"$geometry": c.values[0]}}}
+	case "near":
+		return bson.E{Key: c.key, Value: bson.M{"$geoWithin": bson.M{"$centerSphere": bson.A{c.values[0], c.values[1]}}}}
+	default:
+		return bson.E{Key: c.key, Value: bson.M{"$geoWithin": bson.M{"$geometry": c.values[0]}}}
+	}
+}
+
+// parseFloats parses a comma separated list of exactly n numbers.
+func parseFloats(m string, n int) ([]float64, error) {
+	parts := splitMatcher(m)
+	if len(parts) != n {
+		return nil, fmt.Errorf("expected %d numbers", n)
+	}
+
+	v := make([]float64, n)
+	for i, p := range parts {
+		f, err := strconv.ParseFloat(p, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", p)
+		}
+		v[i] = f
+	}
+
+	return v, nil
+}
+
+// validGeometry checks that a geometry can be stored and indexed by mongo.
+// Positions must be a longitude and latitude in degrees and the rings of
+// polygons must be closed.
+func validGeometry(g *geojson.Geometry) error {
+	switch g.Type {
+	case geojson.GeometryPoint:
+		return validPosition(g.Point)
+	case geojson.GeometryMultiPoint:
+		return validPositions(g.MultiPoint, 1)
+	case geojson.GeometryLineString:
+		return validPositions(g.LineString, 2)
+	case geojson.GeometryMultiLineString:
+		for _, line := range g.MultiLineString {
+			if err := validPositions(line, 2); err != nil {
+				return err
+			}
+		}
+		return nil
+	case geojson.GeometryPolygon:
+		return validPolygon(g.Polygon)
+	case geojson.GeometryMultiPolygon:
+		for _, polygon := range g.MultiPolygon {
+			if err := validPolygon(polygon); err != nil {
+				return err
+			}
+		}
+		return nil
+	case geojson.GeometryCollection:
+		for _, child := range g.Geometries {
+			if err := validGeometry(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown geometry type %q", g.Type)
+	}
+}
+
+// validPolygon checks each ring of a polygon is closed.
+func validPolygon(rings [][][]float64) error {
+	if len(rings) == 0 {
+		return fmt.Errorf("polygons need at least one ring")
+	}
+
+	for _, ring := range rings {
+		if err := validPositions(ring, 4); err != nil {
+			return err
+		}
+		first, last := ring[0], ring[len(ring)-1]
+		if first[0] != last[0] || first[1] != last[1] {
+			return fmt.Errorf("polygon rings must end at their first position")
+		}
+	}
+
+	return nil
+}
+
+// validPositions checks there are at least min positions and that each
+// of them is valid.
+func validPositions(positions [][]float64, min int) error {
+	if len(positions) < min {
+		return fmt.Errorf("expected at least %d positions", min)
+	}
+
+	for _, p := range positions {
+		if err := validPosition(p); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validPosition checks a position is a longitude and latitude in degrees.
+func validPosition(p []float64) error {
+	if len(p) < 2 {
+		return fmt.Errorf("positions need a longitude and latitude")
+	}
+	if p[0] < -180 || p[0] > 180 {
+		return fmt.Errorf("longitude %v is not between -180 and 180", p[0])
+	}
+	if p[1] < -90 || p[1] > 90 {
+		return fmt.Errorf("latitude %v is not between -90 and 90", p[1])
+	}
+
+	return nil
+}
+
+// locationErrors checks the locations of a new observation.
+func locationErrors(newObs NewObservation) []FieldError {
+	var errs []FieldError
+	for _, l := range []struct {
+		name string
+		g    *geojson.Geometry
+	}{
+		{"phenomenonLocation", newObs.PhenomenonLocation},
+		{"observationLocation", newObs.ObservationLocation},
+	} {
+		if l.g == nil {
+			continue
+		}
+		if err := validGeometry(l.g); err != nil {
+			errs = append(errs, FieldError{Field: "NewObservation." + l.name, Error: err.Error()})
+		}
+	}
+
+	return errs
+}
+
+// migrateLocations rewrites locations that were stored before geometries
+// were encoded as GeoJSON. Mongo cannot index these locations, so they are
+// rewritten before the location indexes are created.
+func migrateLocations(ctx context.Context, collection *mongo.Collection) error {
+	for _, key := range locations {
+		key := key
+		filter := bson.D{{Key: key + ".multipolygon", Value: bson.M{"$exists": true}}}
+		err := migrate(ctx, collection, filter, func(doc bson.Raw) (bson.D, error) {
+			var obs Observation
+			if err := bson.Unmarshal(doc, &obs); err != nil {
+				return nil, err
+			}
+
+			location := obs.PhenomenonLocation
+			if key == "observationlocation" {
+				location = obs.ObservationLocation
+			}
+			return bson.D{{Key: key, Value: location}}, nil
+		})
+		if err != nil {
+			return errors.Wrapf(err, "migrating %s", key)
+		}
+	}
+
+	return nil
+}
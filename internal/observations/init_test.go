@@ -1,23 +1,32 @@
 package observations_test
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
 	"testing"
 
+	"cloud.google.com/go/firestore"
+	"github.com/jmoiron/sqlx"
+	"github.com/schafer14/obs/internal/observations"
 	"github.com/schafer14/obs/internal/tests"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
 var coll *mongo.Collection
 
-// TestMain runs a database for this package.
+var pg *sqlx.DB
+
+var fs *firestore.Client
+
+// TestMain runs a mongo and a postgres database and the firestore emulator
+// for this package.
 func TestMain(m *testing.M) {
 	t := &testing.T{}
 
 	flag.Parse()
-	var c *tests.Container
+	var c, pc, fc *tests.Container
 	if !testing.Short() {
 		c = tests.SetupDatabase(t)
 		db, err := tests.DatabaseTest(t, c)
@@ -26,12 +35,33 @@ func TestMain(m *testing.M) {
 			os.Exit(1)
 		}
 		coll = db.Collection("observations")
+
+		pc = tests.SetupPostgres(t)
+		pg, err = tests.PostgresTest(t, pc)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if err := observations.MigratePostgres(context.Background(), pg); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		fc = tests.SetupFirestore(t)
+		fs, err = tests.FirestoreTest(t, fc)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
 	}
 
 	result := m.Run()
 
 	if !testing.Short() {
 		tests.TeardownDatabase(t, c)
+		tests.TeardownDatabase(t, pc)
+		fs.Close()
+		tests.TeardownDatabase(t, fc)
 	}
 	os.Exit(result)
 }
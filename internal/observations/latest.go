@@ -0,0 +1,99 @@
+package observations
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// MaxLatestFeatures is the most features the latest observations may be
+// retrieved for at once.
+const MaxLatestFeatures = 100
+
+// Latest retrieves the most recent observation of each property of the given
+// features. Observations are the most recent by phenomenon time, and then by
+// result time. They are ordered by feature, property and property type.
+//
+// When asOf is not zero the observations are those that were known at that
+// time. Observations with a later phenomenon time are skipped, and revisions
+// made after asOf are ignored so the observations are as they were then.
+func Latest(ctx context.Context, collection *mongo.Collection, features []string, asOf time.Time) ([]Observation, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if err := validFeatures(features); err != nil {
+		return nil, err
+	}
+
+	inFeatures := bson.E{Key: "featureid", Value: bson.M{"$in": features}}
+
+	var pipeline mongo.Pipeline
+	if asOf.IsZero() {
+		pipeline = mongo.Pipeline{
+			{{Key: "$match", Value: bson.D{inFeatures, current}}},
+		}
+	} else {
+		// Find the revision of each observation that was current at asOf.
+		// Observations saved before revisions were introduced have no
+		// modification time and are treated as always known.
+		pipeline = mongo.Pipeline{
+			{{Key: "$match", Value: bson.D{inFeatures, {Key: "modifiedat", Value: bson.M{"$not": bson.M{"$gt": asOf}}}}}},
+			{{Key: "$sort", Value: bson.D{{Key: "id", Value: 1}, {Key: "revision", Value: -1}}}},
+			{{Key: "$group", Value: bson.D{{Key: "_id", Value: "$id"}, {Key: "doc", Value: bson.M{"$first": "$$ROOT"}}}}},
+			{{Key: "$replaceRoot", Value: bson.D{{Key: "newRoot", Value: "$doc"}}}},
+			{{Key: "$match", Value: bson.D{{Key: "phenomenontime", Value: bson.M{"$lte": asOf}}}}},
+		}
+	}
+
+	property := bson.D{
+		{Key: "feature", Value: "$featureid"},
+		{Key: "property", Value: "$propertyid"},
+		{Key: "propertyType", Value: "$propertytypeid"},
+	}
+
+	pipeline = append(pipeline,
+		bson.D{{Key: "$sort", Value: bson.D{
+			{Key: "featureid", Value: 1},
+			{Key: "propertyid", Value: 1},
+			{Key: "propertytypeid", Value: 1},
+			{Key: "phenomenontime", Value: -1},
+			{Key: "resulttime", Value: -1},
+			{Key: "id", Value: 1},
+		}}},
+		bson.D{{Key: "$group", Value: bson.D{{Key: "_id", Value: property}, {Key: "doc", Value: bson.M{"$first": "$$ROOT"}}}}},
+		bson.D{{Key: "$replaceRoot", Value: bson.D{{Key: "newRoot", Value: "$doc"}}}},
+		bson.D{{Key: "$sort", Value: bson.D{
+			{Key: "featureid", Value: 1},
+			{Key: "propertyid", Value: 1},
+			{Key: "propertytypeid", Value: 1},
+		}}},
+	)
+
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching latest observations")
+	}
+
+	obss := []Observation{}
+	if err := cursor.All(ctx, &obss); err != nil {
+		return nil, errors.Wrap(err, "decoding latest observations")
+	}
+
+	return obss, nil
+}
+
+// validFeatures checks the number of features the latest observations are
+// retrieved for.
+func validFeatures(features []string) error {
+	if len(features) == 0 || len(features) > MaxLatestFeatures {
+		return &ValidationError{
+			Err:    "error validating latest observations",
+			Fields: []FieldError{{Field: "feature", Error: fmt.Sprintf("between 1 and %d features are required", MaxLatestFeatures)}},
+		}
+	}
+	return nil
+}
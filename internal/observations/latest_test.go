@@ -0,0 +1,75 @@
+package observations_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/schafer14/obs/internal/observations"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatestNeedsFeatures(t *testing.T) {
+
+	// Act
+	_, err := observations.Latest(context.Background(), nil, nil, time.Time{})
+
+	// Assert
+	require.Error(t, err, "latest observations without features accepted")
+	_, ok := err.(*observations.ValidationError)
+	assert.True(t, ok, "error is not a validation error")
+}
+
+func TestGettingLatestObservations(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Arrange
+	ctx := context.Background()
+	err := deleteCollection(ctx, coll)
+	require.Nil(t, err, "deleting collection")
+	start := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	obss := mkObss(4)
+	for i := range obss {
+		obss[i].PhenomenonTime = start.Add(time.Duration(i) * 24 * time.Hour)
+		obss[i].Result = map[string]interface{}{"wisteria": int64(i)}
+	}
+	obss[3].Property = observations.Referenceable{ID: "urn:example:yield"}
+
+	err = saveObss(ctx, obss, start, coll)
+	require.Nil(t, err, "prepping observations")
+
+	// Revise the newest health observation after the fact.
+	prev, err := observations.New(mkObs(), uuid.New().String(), start)
+	require.Nil(t, err, "creating observation")
+	prev.PhenomenonTime = start.Add(2*24*time.Hour + time.Hour)
+	require.Nil(t, observations.Save(ctx, coll, prev), "saving observation")
+	newObs := prev.AsNew()
+	newObs.Result = map[string]interface{}{"wisteria": int64(9)}
+	next, err := observations.Revise(prev, newObs, "banner@example.com", start.Add(10*24*time.Hour))
+	require.Nil(t, err, "revising observation")
+	require.Nil(t, observations.Supersede(ctx, coll, next), "superseding observation")
+
+	feature := []string{mkObs().Feature.ID}
+
+	// Act
+	latest, err := observations.Latest(ctx, coll, feature, time.Time{})
+	require.Nil(t, err, "getting latest observations")
+	before, err := observations.Latest(ctx, coll, feature, start.Add(5*24*time.Hour))
+	require.Nil(t, err, "getting latest observations before revision")
+	earlier, err := observations.Latest(ctx, coll, feature, start.Add(24*time.Hour))
+	require.Nil(t, err, "getting earlier observations")
+
+	// Assert
+	require.Equal(t, 2, len(latest), "latest observations mismatch")
+	assert.Equal(t, "urn:example:health", latest[0].Property.ID, "properties not ordered")
+	assert.Equal(t, 2, latest[0].Revision, "latest revision not used")
+	require.Equal(t, 2, len(before), "observations before revision mismatch")
+	assert.Equal(t, 1, before[0].Revision, "revision made after asOf used")
+	require.Equal(t, 1, len(earlier), "earlier observations mismatch")
+	assert.Equal(t, int64(1), earlier[0].Result["wisteria"], "earlier observation invalid")
+}
@@ -0,0 +1,701 @@
+package observations
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	geojson "github.com/paulmach/go.geojson"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// The functions in this file evaluate the mongo filters and sort orders that
+// queries are converted to against documents held in memory, so that Memory
+// answers queries in the same way as mongo. Only the operators the queries
+// of this package use are supported.
+
+// matches reports whether a document matches a mongo filter.
+func matches(doc bson.Raw, filter interface{}) bool {
+	for _, e := range elements(filter) {
+		switch e.Key {
+		case "$and":
+			for _, f := range list(e.Value) {
+				if !matches(doc, f) {
+					return false
+				}
+			}
+		case "$or":
+			any := false
+			for _, f := range list(e.Value) {
+				if matches(doc, f) {
+					any = true
+					break
+				}
+			}
+			if !any {
+				return false
+			}
+		case "$nor":
+			for _, f := range list(e.Value) {
+				if matches(doc, f) {
+					return false
+				}
+			}
+		default:
+			if !matchField(doc, e.Key, e.Value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// matchField reports whether the value at a key of a document matches a
+// condition, which is either a value the field must equal or a document of
+// operators.
+func matchField(doc bson.Raw, key string, cond interface{}) bool {
+	values, found := lookup(doc, key)
+
+	ops := elements(cond)
+	if len(ops) == 0 || !strings.HasPrefix(ops[0].Key, "$") {
+		return equals(values, found, cond)
+	}
+
+	for _, op := range ops {
+		if !matchOp(values, found, op.Key, op.Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchOp reports whether the values at a key match an operator.
+func matchOp(values []interface{}, found bool, op string, arg interface{}) bool {
+	switch op {
+	case "$eq":
+		return equals(values, found, arg)
+	case "$ne":
+		return !equals(values, found, arg)
+	case "$gt", "$gte", "$lt", "$lte":
+		want := normal(arg)
+		for _, v := range candidates(values) {
+			if rank(v) != rank(want) {
+				continue
+			}
+			c := compare(v, want)
+			if (op == "$gt" && c > 0) || (op == "$gte" && c >= 0) || (op == "$lt" && c < 0) || (op == "$lte" && c <= 0) {
+				return true
+			}
+		}
+		return false
+	case "$in":
+		for _, v := range list(arg) {
+			if equals(values, found, v) {
+				return true
+			}
+		}
+		return false
+	case "$nin":
+		return !matchOp(values, found, "$in", arg)
+	case "$exists":
+		exists, _ := arg.(bool)
+		return found == exists
+	case "$not":
+		for _, e := range elements(arg) {
+			if !matchOp(values, found, e.Key, e.Value) {
+				return true
+			}
+		}
+		return false
+	case "$type":
+		for _, v := range candidates(values) {
+			if _, ok := v.(float64); ok && arg == "number" {
+				return true
+			}
+		}
+		return false
+	case "$geoWithin", "$geoIntersects":
+		return matchGeo(values, op, arg)
+	}
+	return false
+}
+
+// equals reports whether any of the values at a key equal a value. Null
+// matches keys that are missing as well as keys that are null, and values
+// in arrays are compared as well as the array itself.
+func equals(values []interface{}, found bool, arg interface{}) bool {
+	want := normal(arg)
+	if want == nil && !found {
+		return true
+	}
+	for _, v := range candidates(values) {
+		if rank(v) == rank(want) && compare(v, want) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// candidates are the values a condition is compared to, which are the values
+// at a key and the elements of those that are arrays.
+func candidates(values []interface{}) []interface{} {
+	var all []interface{}
+	for _, v := range values {
+		all = append(all, v)
+		if a, ok := v.([]interface{}); ok {
+			all = append(all, a...)
+		}
+	}
+	return all
+}
+
+// lookup finds the values at a dotted key of a document. A key may reach
+// through arrays into the documents they hold, so there may be many values.
+func lookup(doc bson.Raw, key string) ([]interface{}, bool) {
+	return walk(doc, strings.Split(key, "."))
+}
+
+// walk finds the values at a path below a value.
+func walk(v interface{}, path []string) ([]interface{}, bool) {
+	if len(path) == 0 {
+		return []interface{}{v}, true
+	}
+
+	switch v := v.(type) {
+	case bson.Raw:
+		rv, err := v.LookupErr(path[0])
+		if err != nil {
+			return nil, false
+		}
+		return walk(rawValue(rv), path[1:])
+	case []interface{}:
+		if i, err := strconv.Atoi(path[0]); err == nil {
+			if i < 0 || i >= len(v) {
+				return nil, false
+			}
+			return walk(v[i], path[1:])
+		}
+		var values []interface{}
+		found := false
+		for _, elem := range v {
+			if _, ok := elem.(bson.Raw); !ok {
+				continue
+			}
+			if vs, ok := walk(elem, path); ok {
+				values = append(values, vs...)
+				found = true
+			}
+		}
+		return values, found
+	}
+
+	return nil, false
+}
+
+// rawValue converts a bson value to a value that can be compared. Numbers are
+// float64, times are time.Time in UTC, null is nil, documents are bson.Raw and
+// arrays are []interface{}.
+func rawValue(rv bson.RawValue) interface{} {
+	switch rv.Type {
+	case bsontype.Double:
+		return rv.Double()
+	case bsontype.Int32:
+		return float64(rv.Int32())
+	case bsontype.Int64:
+		return float64(rv.Int64())
+	case bsontype.Decimal128:
+		f, _ := strconv.ParseFloat(rv.Decimal128().String(), 64)
+		return f
+	case bsontype.String:
+		return rv.StringValue()
+	case bsontype.Boolean:
+		return rv.Boolean()
+	case bsontype.DateTime:
+		return time.Unix(0, rv.DateTime()*int64(time.Millisecond)).UTC()
+	case bsontype.Null, bsontype.Undefined:
+		return nil
+	case bsontype.EmbeddedDocument:
+		return rv.Document()
+	case bsontype.Array:
+		elems, _ := rv.Array().Values()
+		values := make([]interface{}, len(elems))
+		for i, elem := range elems {
+			values[i] = rawValue(elem)
+		}
+		return values
+	}
+	return rv
+}
+
+// normal converts a value in a filter to a value that can be compared, in
+// the same way it would be stored by mongo.
+func normal(v interface{}) interface{} {
+	t, data, err := bson.MarshalValue(v)
+	if err != nil {
+		return v
+	}
+	return rawValue(bson.RawValue{Type: t, Value: data})
+}
+
+// rank is the position of the type of a value in the order mongo sorts
+// values of different types in. Values are only compared by filters to
+// values of the same rank.
+func rank(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 1
+	case float64:
+		return 2
+	case string:
+		return 3
+	case bson.Raw:
+		return 4
+	case []interface{}:
+		return 5
+	case bool:
+		return 7
+	case time.Time:
+		return 8
+	}
+	return 6
+}
+
+// compare compares two values in the order mongo sorts them in.
+func compare(a, b interface{}) int {
+	if ra, rb := rank(a), rank(b); ra != rb {
+		if ra < rb {
+			return -1
+		}
+		return 1
+	}
+
+	switch a := a.(type) {
+	case float64:
+		b := b.(float64)
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+		return 0
+	case string:
+		return strings.Compare(a, b.(string))
+	case bool:
+		b := b.(bool)
+		switch {
+		case a == b:
+			return 0
+		case !a:
+			return -1
+		}
+		return 1
+	case time.Time:
+		b := b.(time.Time)
+		switch {
+		case a.Before(b):
+			return -1
+		case a.After(b):
+			return 1
+		}
+		return 0
+	case bson.Raw:
+		return bytes.Compare(a, b.(bson.Raw))
+	case []interface{}:
+		b := b.([]interface{})
+		for i := 0; i < len(a) && i < len(b); i++ {
+			if c := compare(a[i], b[i]); c != 0 {
+				return c
+			}
+		}
+		return len(a) - len(b)
+	}
+	return 0
+}
+
+// sortValue is the value a document is sorted by for a sort key. Missing
+// values sort as null, and arrays sort by their smallest element in
+// ascending order and their largest in descending order.
+func sortValue(doc bson.Raw, k sortKey) interface{} {
+	values, _ := lookup(doc, k.key)
+	var best interface{}
+	for i, v := range candidates(values) {
+		if _, ok := v.([]interface{}); ok {
+			continue
+		}
+		c := compare(v, best)
+		if i == 0 || (k.desc && c > 0) || (!k.desc && c < 0) {
+			best = v
+		}
+	}
+	return best
+}
+
+// sortDocuments sorts documents by sort keys. Documents with the same values
+// keep their order.
+func sortDocuments(docs []bson.Raw, keys []sortKey) {
+	sort.SliceStable(docs, func(i, j int) bool {
+		for _, k := range keys {
+			c := compare(sortValue(docs[i], k), sortValue(docs[j], k))
+			if k.desc {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+}
+
+// groupKey is a key identifying the values of a document at keys, so that
+// documents with equal values have the same key.
+func groupKey(doc bson.Raw, keys []string) string {
+	var b strings.Builder
+	for _, key := range keys {
+		values, found := lookup(doc, key)
+		switch {
+		case !found:
+			b.WriteString("missing")
+		case len(values) == 1:
+			v, _ := bson.Marshal(bson.D{{Key: "v", Value: values[0]}})
+			if f, ok := values[0].(float64); ok {
+				v = []byte(strconv.FormatFloat(f, 'g', -1, 64))
+			}
+			b.WriteString(strconv.Itoa(rank(values[0])))
+			b.Write(v)
+		default:
+			v, _ := bson.Marshal(bson.D{{Key: "v", Value: values}})
+			b.Write(v)
+		}
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+// elements lists the elements of a filter document.
+func elements(v interface{}) []bson.E {
+	switch v := v.(type) {
+	case bson.D:
+		return v
+	case bson.M:
+		return sortedElements(v)
+	case map[string]interface{}:
+		return sortedElements(v)
+	}
+	return nil
+}
+
+// sortedElements lists the elements of a map in the order of their keys, so
+// filters are evaluated in the same order each time.
+func sortedElements(m map[string]interface{}) []bson.E {
+	d := make([]bson.E, 0, len(m))
+	for k, v := range m {
+		d = append(d, bson.E{Key: k, Value: v})
+	}
+	sort.Slice(d, func(i, j int) bool { return d[i].Key < d[j].Key })
+	return d
+}
+
+// list lists the values of an array in a filter.
+func list(v interface{}) []interface{} {
+	switch v := v.(type) {
+	case bson.A:
+		return v
+	case []interface{}:
+		return v
+	case []string:
+		values := make([]interface{}, len(v))
+		for i, s := range v {
+			values[i] = s
+		}
+		return values
+	}
+	return nil
+}
+
+// matchGeo reports whether the geometry at a key matches a geospatial
+// operator. Shapes are compared on a plane of longitudes and latitudes, while
+// mongo compares them on a sphere, so results differ for shapes with edges
+// long enough for the curve of the earth to matter.
+func matchGeo(values []interface{}, op string, arg interface{}) bool {
+	if len(values) != 1 {
+		return false
+	}
+	doc, ok := values[0].(bson.Raw)
+	if !ok {
+		return false
+	}
+	data, err := bson.MarshalExtJSON(doc, false, false)
+	if err != nil {
+		return false
+	}
+	g, err := geojson.UnmarshalGeometry(data)
+	if err != nil {
+		return false
+	}
+
+	for _, e := range elements(arg) {
+		switch e.Key {
+		case "$geometry":
+			other, ok := e.Value.(*geojson.Geometry)
+			if !ok {
+				return false
+			}
+			if op == "$geoIntersects" {
+				return geoIntersects(g, other)
+			}
+			return geoWithin(g, other)
+		case "$centerSphere":
+			args := list(e.Value)
+			if len(args) != 2 {
+				return false
+			}
+			center, _ := normal(args[0]).([]interface{})
+			radius, _ := normal(args[1]).(float64)
+			if len(center) != 2 {
+				return false
+			}
+			lng, _ := center[0].(float64)
+			lat, _ := center[1].(float64)
+			for _, p := range points(g) {
+				if distance(p, []float64{lng, lat}) > radius {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// points lists every position of a geometry.
+func points(g *geojson.Geometry) [][]float64 {
+	switch g.Type {
+	case geojson.GeometryPoint:
+		return [][]float64{g.Point}
+	case geojson.GeometryMultiPoint:
+		return g.MultiPoint
+	case geojson.GeometryLineString:
+		return g.LineString
+	case geojson.GeometryMultiLineString:
+		var ps [][]float64
+		for _, line := range g.MultiLineString {
+			ps = append(ps, line...)
+		}
+		return ps
+	case geojson.GeometryPolygon:
+		var ps [][]float64
+		for _, ring := range g.Polygon {
+			ps = append(ps, ring...)
+		}
+		return ps
+	case geojson.GeometryMultiPolygon:
+		var ps [][]float64
+		for _, polygon := range g.MultiPolygon {
+			for _, ring := range polygon {
+				ps = append(ps, ring...)
+			}
+		}
+		return ps
+	case geojson.GeometryCollection:
+		var ps [][]float64
+		for _, child := range g.Geometries {
+			ps = append(ps, points(child)...)
+		}
+		return ps
+	}
+	return nil
+}
+
+// segments lists the edges of the lines and polygon rings of a geometry.
+func segments(g *geojson.Geometry) [][2][]float64 {
+	var lines [][][]float64
+	switch g.Type {
+	case geojson.GeometryLineString:
+		lines = [][][]float64{g.LineString}
+	case geojson.GeometryMultiLineString:
+		lines = g.MultiLineString
+	case geojson.GeometryPolygon:
+		lines = g.Polygon
+	case geojson.GeometryMultiPolygon:
+		for _, polygon := range g.MultiPolygon {
+			lines = append(lines, polygon...)
+		}
+	case geojson.GeometryCollection:
+		var segs [][2][]float64
+		for _, child := range g.Geometries {
+			segs = append(segs, segments(child)...)
+		}
+		return segs
+	}
+
+	var segs [][2][]float64
+	for _, line := range lines {
+		for i := 1; i < len(line); i++ {
+			segs = append(segs, [2][]float64{line[i-1], line[i]})
+		}
+	}
+	return segs
+}
+
+// polygons lists the polygons of a geometry.
+func polygons(g *geojson.Geometry) [][][][]float64 {
+	switch g.Type {
+	case geojson.GeometryPolygon:
+		return [][][][]float64{g.Polygon}
+	case geojson.GeometryMultiPolygon:
+		return g.MultiPolygon
+	case geojson.GeometryCollection:
+		var ps [][][][]float64
+		for _, child := range g.Geometries {
+			ps = append(ps, polygons(child)...)
+		}
+		return ps
+	}
+	return nil
+}
+
+// geoWithin reports whether a geometry is inside a polygon or multipolygon.
+// Every position must be inside and no edge may cross the boundary.
+func geoWithin(g, container *geojson.Geometry) bool {
+	ps := polygons(container)
+	for _, p := range points(g) {
+		if !insideAny(p, ps) {
+			return false
+		}
+	}
+	for _, s := range segments(g) {
+		for _, edge := range segments(container) {
+			if crosses(s, edge) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// geoIntersects reports whether two geometries share any point.
+func geoIntersects(a, b *geojson.Geometry) bool {
+	for _, pair := range [][2]*geojson.Geometry{{a, b}, {b, a}} {
+		ps := polygons(pair[1])
+		for _, p := range points(pair[0]) {
+			if insideAny(p, ps) {
+				return true
+			}
+			for _, q := range points(pair[1]) {
+				if p[0] == q[0] && p[1] == q[1] {
+					return true
+				}
+			}
+			for _, s := range segments(pair[1]) {
+				if onSegment(p, s) {
+					return true
+				}
+			}
+		}
+	}
+
+	for _, s := range segments(a) {
+		for _, t := range segments(b) {
+			if touches(s, t) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// insideAny reports whether a position is inside any of some polygons.
+func insideAny(p []float64, ps [][][][]float64) bool {
+	for _, polygon := range ps {
+		if inside(p, polygon) {
+			return true
+		}
+	}
+	return false
+}
+
+// inside reports whether a position is inside a polygon, which is inside its
+// first ring and not inside any of its holes. Positions on the boundary are
+// inside.
+func inside(p []float64, polygon [][][]float64) bool {
+	if len(polygon) == 0 || !inRing(p, polygon[0]) {
+		return false
+	}
+	for _, hole := range polygon[1:] {
+		if inRing(p, hole) && !onRing(p, hole) {
+			return false
+		}
+	}
+	return true
+}
+
+// inRing reports whether a position is inside or on a closed ring.
+func inRing(p []float64, ring [][]float64) bool {
+	if onRing(p, ring) {
+		return true
+	}
+	in := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if (a[1] > p[1]) != (b[1] > p[1]) && p[0] < (b[0]-a[0])*(p[1]-a[1])/(b[1]-a[1])+a[0] {
+			in = !in
+		}
+	}
+	return in
+}
+
+// onRing reports whether a position is on the edge of a ring.
+func onRing(p []float64, ring [][]float64) bool {
+	for i := 1; i < len(ring); i++ {
+		if onSegment(p, [2][]float64{ring[i-1], ring[i]}) {
+			return true
+		}
+	}
+	return false
+}
+
+// orientation is positive when c is to the left of the line from a to b,
+// negative when it is to the right and zero when the three are in line.
+func orientation(a, b, c []float64) float64 {
+	return (b[0]-a[0])*(c[1]-a[1]) - (b[1]-a[1])*(c[0]-a[0])
+}
+
+// onSegment reports whether a position is on a segment.
+func onSegment(p []float64, s [2][]float64) bool {
+	a, b := s[0], s[1]
+	if orientation(a, b, p) != 0 {
+		return false
+	}
+	return math.Min(a[0], b[0]) <= p[0] && p[0] <= math.Max(a[0], b[0]) &&
+		math.Min(a[1], b[1]) <= p[1] && p[1] <= math.Max(a[1], b[1])
+}
+
+// crosses reports whether two segments cross each other at a point inside
+// both of them.
+func crosses(s, t [2][]float64) bool {
+	d1 := orientation(t[0], t[1], s[0])
+	d2 := orientation(t[0], t[1], s[1])
+	d3 := orientation(s[0], s[1], t[0])
+	d4 := orientation(s[0], s[1], t[1])
+	return ((d1 > 0 && d2 < 0) || (d1 < 0 && d2 > 0)) && ((d3 > 0 && d4 < 0) || (d3 < 0 && d4 > 0))
+}
+
+// touches reports whether two segments share any point.
+func touches(s, t [2][]float64) bool {
+	return crosses(s, t) || onSegment(s[0], t) || onSegment(s[1], t) || onSegment(t[0], s) || onSegment(t[1], s)
+}
+
+// distance is the angle in radians between two positions on a sphere.
+func distance(a, b []float64) float64 {
+	lat1, lat2 := a[1]*math.Pi/180, b[1]*math.Pi/180
+	dLat := lat2 - lat1
+	dLng := (b[0] - a[0]) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * math.Asin(math.Min(1, math.Sqrt(h)))
+}
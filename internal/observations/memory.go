@@ -0,0 +1,558 @@
+package observations
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/schafer14/obs/internal/platform/database"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Memory is a repository of observations held in the process. Observations
+// are kept as the documents mongo would store and queries are evaluated
+// against them with the filters sent to mongo, so Memory answers queries in
+// the same way as Mongo. Observations are lost when the process stops.
+type Memory struct {
+	mu   sync.RWMutex
+	docs []bson.Raw
+}
+
+// NewMemory creates an empty repository of observations.
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+// encode converts an observation to the document mongo would store.
+func encode(obs Observation) (bson.Raw, error) {
+	data, err := bson.MarshalWithRegistry(database.Registry, obs)
+	return bson.Raw(data), errors.Wrap(err, "encoding observation")
+}
+
+// decode converts a stored document to an observation. Each call returns a
+// new observation, so changes to it do not change the stored document.
+func decode(doc bson.Raw) (Observation, error) {
+	var obs Observation
+	err := bson.UnmarshalWithRegistry(database.Registry, doc, &obs)
+	return obs, errors.Wrap(err, "decoding observation")
+}
+
+// Save persists an observation.
+func (m *Memory) Save(ctx context.Context, obs Observation) error {
+	doc, err := encode(obs)
+	if err != nil {
+		return errors.Wrap(err, "saving observation")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.docs = append(m.docs, doc)
+	return nil
+}
+
+// SaveMany persists a batch of observations. Observations that cannot be
+// saved are returned keyed by their index in the batch.
+func (m *Memory) SaveMany(ctx context.Context, obss []Observation) (map[int]error, error) {
+	failed := map[int]error{}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, obs := range obss {
+		doc, err := encode(obs)
+		if err != nil {
+			failed[i] = errors.Wrap(err, "saving observation")
+			continue
+		}
+		m.docs = append(m.docs, doc)
+	}
+
+	return failed, nil
+}
+
+// Find retrieves the latest revision of an observation.
+func (m *Memory) Find(ctx context.Context, id string) (Observation, error) {
+	docs := m.match(bson.D{{Key: "id", Value: id}, current})
+	if len(docs) == 0 {
+		return Observation{}, ErrorNotFound
+	}
+
+	return decode(docs[0])
+}
+
+// Supersede persists a new revision of an observation and marks the revision
+// it replaces as superseded. ErrorConflict is returned if the previous
+// revision has already been superseded.
+func (m *Memory) Supersede(ctx context.Context, obs Observation) error {
+	doc, err := encode(obs)
+	if err != nil {
+		return errors.Wrap(err, "saving revision")
+	}
+
+	var revision interface{} = obs.Revision - 1
+	if obs.Revision == 1 {
+		revision = bson.M{"$in": bson.A{nil, 0}}
+	}
+	prev := bson.D{{Key: "id", Value: obs.ID}, {Key: "revision", Value: revision}, current}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, d := range m.docs {
+		if !matches(d, prev) {
+			continue
+		}
+
+		superseded, err := decode(d)
+		if err != nil {
+			return errors.Wrap(err, "superseding observation")
+		}
+		superseded.Superseded = true
+		if m.docs[i], err = encode(superseded); err != nil {
+			return errors.Wrap(err, "superseding observation")
+		}
+
+		m.docs = append(m.docs, doc)
+		return nil
+	}
+
+	return ErrorConflict
+}
+
+// History retrieves every revision of an observation ordered from the first
+// revision to the latest.
+func (m *Memory) History(ctx context.Context, id string) ([]Observation, error) {
+	docs := m.match(bson.D{{Key: "id", Value: id}})
+	sortDocuments(docs, []sortKey{{key: "revision"}})
+
+	revisions, err := decodeAll(docs)
+	if err != nil {
+		return revisions, errors.Wrap(err, "decoding observation history")
+	}
+	if len(revisions) == 0 {
+		return revisions, ErrorNotFound
+	}
+
+	return revisions, nil
+}
+
+// Get retrieves a page of observations.
+func (m *Memory) Get(ctx context.Context, q Query) (Page, error) {
+	limit := pageLimit(q.Limit)
+
+	p, err := buildQuery(q)
+	if err != nil {
+		return Page{}, err
+	}
+
+	docs := skip(m.sorted(p), q.Offset)
+
+	var page Page
+	if len(docs) > limit {
+		docs = docs[:limit]
+		page.Next = encodeCursor(p.position(docs[limit-1]))
+	}
+
+	var conv *converter
+	if p.unit != nil {
+		conv = newConverter(*p.unit)
+	}
+
+	for _, doc := range docs {
+		obs, err := decode(doc)
+		if err != nil {
+			return page, errors.Wrap(err, "decoding observations")
+		}
+		if conv != nil {
+			if obs, err = conv.convert(obs); err != nil {
+				return Page{}, err
+			}
+		}
+		page.Observations = append(page.Observations, obs)
+	}
+
+	return page, nil
+}
+
+// Stream calls fn with each observation matching a query in order. The
+// observations are found before fn is first called, so fn may use the
+// repository.
+func (m *Memory) Stream(ctx context.Context, q Query, fn func(Observation) error) error {
+	p, err := buildQuery(q)
+	if err != nil {
+		return err
+	}
+
+	docs := skip(m.sorted(p), q.Offset)
+	if q.Limit > 0 && len(docs) > q.Limit {
+		docs = docs[:q.Limit]
+	}
+
+	var conv *converter
+	if p.unit != nil {
+		if conv, err = checkScales(*p.unit, distinctScales(docs)); err != nil {
+			return err
+		}
+	}
+
+	for _, doc := range docs {
+		if err := ctx.Err(); err != nil {
+			return errors.Wrap(err, "fetching observations")
+		}
+
+		obs, err := decode(doc)
+		if err != nil {
+			return errors.Wrap(err, "decoding observations")
+		}
+		if conv != nil {
+			if obs, err = conv.convert(obs); err != nil {
+				return err
+			}
+		}
+		if err := fn(obs); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Convertible checks the observations matching a query can be converted to
+// its unit.
+func (m *Memory) Convertible(ctx context.Context, q Query) error {
+	p, err := buildQuery(q)
+	if err != nil || p.unit == nil {
+		return err
+	}
+
+	_, err = checkScales(*p.unit, distinctScales(m.match(p.filter)))
+	return err
+}
+
+// Changes lists the observations matching a query saved after a token.
+func (m *Memory) Changes(ctx context.Context, q Query, after Token, limit int) ([]Observation, error) {
+	page, err := m.Get(ctx, changesQuery(q, after, limit))
+	if err != nil {
+		return nil, err
+	}
+
+	return page.Observations, nil
+}
+
+// Distinct retrieves one observation for each combination of the values at
+// paths.
+func (m *Memory) Distinct(ctx context.Context, q Query, paths []string) ([]Observation, error) {
+	if len(paths) == 0 {
+		return nil, &ValidationError{Err: "error validating query", Fields: []FieldError{{Field: "paths", Error: "at least one path is required"}}}
+	}
+
+	p, keys, err := buildDistinct(q, paths)
+	if err != nil {
+		return nil, err
+	}
+
+	limit := pageLimit(q.Limit)
+
+	docs := m.match(p.filter)
+	sortDocuments(docs, []sortKey{{key: "resulttime", desc: true}, {key: "id"}})
+	docs = first(docs, keys)
+
+	// Groups are sorted by the sort order of the query, with the values at
+	// the paths in place of id.
+	var order []sortKey
+	sorted := map[string]bool{}
+	for _, k := range p.sort {
+		if k.key == "id" {
+			continue
+		}
+		order = append(order, k)
+		sorted[k.key] = true
+	}
+	for _, key := range keys {
+		if !sorted[key] {
+			order = append(order, sortKey{key: key})
+		}
+	}
+	sortDocuments(docs, order)
+
+	docs = skip(docs, q.Offset)
+	if len(docs) > limit {
+		docs = docs[:limit]
+	}
+
+	obss, err := decodeAll(docs)
+	return obss, errors.Wrap(err, "decoding distinct observations")
+}
+
+// Count counts the observations, or combinations of values at paths,
+// matching a query.
+func (m *Memory) Count(ctx context.Context, q Query, paths []string) (int64, error) {
+	p, keys, err := buildDistinct(q, paths)
+	if err != nil {
+		return 0, err
+	}
+
+	docs := m.match(p.filter)
+	if len(keys) > 0 {
+		docs = first(docs, keys)
+	}
+
+	return int64(len(docs)), nil
+}
+
+// Latest retrieves the most recent observation of each property of features.
+func (m *Memory) Latest(ctx context.Context, features []string, asOf time.Time) ([]Observation, error) {
+	if err := validFeatures(features); err != nil {
+		return nil, err
+	}
+
+	inFeatures := bson.E{Key: "featureid", Value: bson.M{"$in": features}}
+
+	var docs []bson.Raw
+	if asOf.IsZero() {
+		docs = m.match(bson.D{inFeatures, current})
+	} else {
+		docs = m.match(bson.D{inFeatures, {Key: "modifiedat", Value: bson.M{"$not": bson.M{"$gt": asOf}}}})
+		sortDocuments(docs, []sortKey{{key: "id"}, {key: "revision", desc: true}})
+		var known []bson.Raw
+		for _, doc := range first(docs, []string{"id"}) {
+			if matches(doc, bson.D{{Key: "phenomenontime", Value: bson.M{"$lte": asOf}}}) {
+				known = append(known, doc)
+			}
+		}
+		docs = known
+	}
+
+	property := []sortKey{{key: "featureid"}, {key: "propertyid"}, {key: "propertytypeid"}}
+	sortDocuments(docs, append(property,
+		sortKey{key: "phenomenontime", desc: true},
+		sortKey{key: "resulttime", desc: true},
+		sortKey{key: "id"},
+	))
+	docs = first(docs, []string{"featureid", "propertyid", "propertytypeid"})
+
+	obss, err := decodeAll(docs)
+	return obss, errors.Wrap(err, "decoding latest observations")
+}
+
+// Aggregate computes statistics over the observations matching an
+// aggregation.
+func (m *Memory) Aggregate(ctx context.Context, a Aggregation) ([]Series, error) {
+	p, err := buildAggregation(a)
+	if err != nil {
+		return nil, err
+	}
+
+	docs := m.match(p.filter)
+	if p.unit != nil {
+		conv, err := checkScales(*p.unit, distinctScales(docs))
+		if err != nil {
+			return nil, err
+		}
+		p.conversions = conv.conversions
+	}
+
+	type group struct {
+		feature, property string
+		start             time.Time
+		values            []float64
+	}
+	groups := map[string]*group{}
+	for _, doc := range docs {
+		value, ok := p.value(doc)
+		if !ok {
+			continue
+		}
+
+		obs, err := decode(doc)
+		if err != nil {
+			return nil, errors.Wrap(err, "decoding observations")
+		}
+		start := p.start(obs.PhenomenonTime)
+
+		id := groupKey(doc, []string{"featureid", "propertyid"}) + start.String()
+		g, ok := groups[id]
+		if !ok {
+			g = &group{feature: obs.FeatureID, property: obs.PropertyID, start: start}
+			groups[id] = g
+		}
+		g.values = append(g.values, value)
+	}
+
+	sorted := make([]*group, 0, len(groups))
+	for _, g := range groups {
+		sorted = append(sorted, g)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.feature != b.feature {
+			return a.feature < b.feature
+		}
+		if a.property != b.property {
+			return a.property < b.property
+		}
+		return a.start.Before(b.start)
+	})
+
+	series := []Series{}
+	for _, g := range sorted {
+		if n := len(series); n == 0 || series[n-1].FeatureID != g.feature || series[n-1].PropertyID != g.property {
+			series = append(series, Series{FeatureID: g.feature, PropertyID: g.property})
+		}
+
+		bucket := Bucket{Start: g.start, Values: map[string]float64{}}
+		for _, fn := range p.functions {
+			if q, ok := p.percentiles[fn]; ok {
+				bucket.Values[fn] = percentile(g.values, q)
+				continue
+			}
+			bucket.Values[fn] = statistic(fn, g.values)
+		}
+
+		last := &series[len(series)-1]
+		last.Buckets = append(last.Buckets, bucket)
+	}
+
+	return series, nil
+}
+
+// value finds the number an observation contributes to an aggregation,
+// converted to the unit of the plan. It returns false if the observation
+// does not have a number at the aggregated field, or has a scale without a
+// conversion.
+func (p aggregationPlan) value(doc bson.Raw) (float64, bool) {
+	values, _ := lookup(doc, p.key)
+	if len(values) != 1 {
+		return 0, false
+	}
+	v, ok := values[0].(float64)
+	if !ok || p.unit == nil {
+		return v, ok
+	}
+
+	scale, _ := lookup(doc, "scale")
+	if len(scale) != 1 || scale[0] == "" {
+		return v, true
+	}
+	s, _ := scale[0].(string)
+	c, ok := p.conversions[s]
+	return v*c.Scale + c.Shift, ok
+}
+
+// start finds the start of the bucket of the plan a time is in.
+func (p aggregationPlan) start(t time.Time) time.Time {
+	t = t.UTC()
+	y, m, d := t.Date()
+	switch p.bucket {
+	case "hour":
+		return time.Date(y, m, d, t.Hour(), 0, 0, 0, time.UTC)
+	case "week":
+		weekday := int(t.Weekday()+6) % 7
+		return time.Date(y, m, d-weekday, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// statistic computes a function of an aggregation other than a percentile.
+func statistic(fn string, values []float64) float64 {
+	var sum float64
+	min, max := values[0], values[0]
+	for _, v := range values {
+		sum += v
+		if v < min {
+			min = v
+		}
+		if v > max {
+			max = v
+		}
+	}
+
+	switch fn {
+	case "count":
+		return float64(len(values))
+	case "min":
+		return min
+	case "max":
+		return max
+	case "mean":
+		return sum / float64(len(values))
+	}
+	return sum
+}
+
+// match finds the documents matching a filter, in the order they were saved.
+func (m *Memory) match(filter interface{}) []bson.Raw {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var docs []bson.Raw
+	for _, doc := range m.docs {
+		if matches(doc, filter) {
+			docs = append(docs, doc)
+		}
+	}
+	return docs
+}
+
+// sorted finds the documents matching a plan in its sort order.
+func (m *Memory) sorted(p plan) []bson.Raw {
+	docs := m.match(p.filter)
+	sortDocuments(docs, p.sort)
+	return docs
+}
+
+// skip drops the first n documents.
+func skip(docs []bson.Raw, n int) []bson.Raw {
+	if n >= len(docs) {
+		return nil
+	}
+	return docs[n:]
+}
+
+// first keeps the first document with each combination of the values at
+// keys, in the order the documents are in.
+func first(docs []bson.Raw, keys []string) []bson.Raw {
+	seen := map[string]bool{}
+	var firsts []bson.Raw
+	for _, doc := range docs {
+		id := groupKey(doc, keys)
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		firsts = append(firsts, doc)
+	}
+	return firsts
+}
+
+// distinctScales lists the scales of documents.
+func distinctScales(docs []bson.Raw) []interface{} {
+	seen := map[string]bool{}
+	var scales []interface{}
+	for _, doc := range docs {
+		values, _ := lookup(doc, "scale")
+		for _, v := range values {
+			if s, ok := v.(string); ok && !seen[s] {
+				seen[s] = true
+				scales = append(scales, s)
+			}
+		}
+	}
+	return scales
+}
+
+// decodeAll converts stored documents to observations.
+func decodeAll(docs []bson.Raw) ([]Observation, error) {
+	obss := []Observation{}
+	for _, doc := range docs {
+		obs, err := decode(doc)
+		if err != nil {
+			return obss, err
+		}
+		obss = append(obss, obs)
+	}
+	return obss, nil
+}
@@ -60,11 +60,74 @@ type Observation struct {
 	PropertyTypeID string `json:"-"`
 	ProcessID      string `json:"-"`
 
+	// ValidIntervalEnd is the end of the valid interval, or nil when the
+	// observation is valid indefinitely.
+	ValidIntervalEnd *time.Time `json:"-"`
+
 	Tags    map[string]string `json:"tags,omitempty"`
 	Context []string          `json:"context,omitempty"`
 
 	Result bson.M `json:"result"`
 	Scale  string `json:"scale,omitempty"`
+
+	// Revision data about the observation
+	Revision   int       `json:"revision"`
+	ModifiedBy string    `json:"modifiedBy,omitempty"`
+	ModifiedAt time.Time `json:"modifiedAt"`
+	Changes    []string  `json:"changes,omitempty"`
+	Superseded bool      `json:"-"`
+}
+
+// AsNew returns the fields of an observation that may be amended as a
+// NewObservation. Amending the result and passing it to Revise creates
+// the next revision of the observation. The result, tags, context and
+// locations are copies, so amending them leaves the observation unchanged.
+func (o Observation) AsNew() NewObservation {
+	var tags map[string]string
+	if o.Tags != nil {
+		tags = make(map[string]string, len(o.Tags))
+		for k, v := range o.Tags {
+			tags[k] = v
+		}
+	}
+
+	var result bson.M
+	if o.Result != nil {
+		result = make(bson.M, len(o.Result))
+		for k, v := range o.Result {
+			result[k] = v
+		}
+	}
+
+	return NewObservation{
+		PhenomenonTime:      o.PhenomenonTime,
+		ResultTime:          o.ResultTime,
+		ValidInterval:       o.ValidInterval,
+		PhenomenonLocation:  copyGeometry(o.PhenomenonLocation),
+		ObservationLocation: copyGeometry(o.ObservationLocation),
+
+		Feature:      o.Feature,
+		FeatureType:  o.FeatureType,
+		Property:     o.Property,
+		PropertyType: o.PropertyType,
+		Process:      o.Process,
+
+		Tags:    tags,
+		Context: append([]string(nil), o.Context...),
+
+		Result: result,
+		Scale:  o.Scale,
+	}
+}
+
+// copyGeometry returns a copy of a geometry, so decoding into the copy leaves
+// the geometry unchanged.
+func copyGeometry(g *geojson.Geometry) *geojson.Geometry {
+	if g == nil {
+		return nil
+	}
+	c := *g
+	return &c
 }
 
 // Referenceable field is a field that can be looked up with an ID and additionally has a human
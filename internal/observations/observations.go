@@ -1,12 +1,16 @@
 package observations
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"strings"
 	"time"
 
 	"github.com/pkg/errors"
+	"github.com/schafer14/obs/internal/units"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -38,16 +42,23 @@ func New(newObs NewObservation, id string, now time.Time) (Observation, error) {
 		return Observation{}, validationError(err)
 	}
 
+	scale, scaleErrs := canonicalScale(newObs.Scale)
+	if errs := append(append(intervalErrors(newObs), locationErrors(newObs)...), scaleErrs...); len(errs) > 0 {
+		return Observation{}, &ValidationError{Err: "error validating observation", Fields: errs}
+	}
+
+	validInterval := Interval{
+		StartTime: startTime,
+		Duration:  newObs.ValidInterval.Duration,
+	}
+
 	return Observation{
 
 		ID: id,
 
-		PhenomenonTime: phenomenonTime,
-		ResultTime:     resultTime,
-		ValidInterval: Interval{
-			StartTime: startTime,
-			Duration:  newObs.ValidInterval.Duration,
-		},
+		PhenomenonTime:      phenomenonTime,
+		ResultTime:          resultTime,
+		ValidInterval:       validInterval,
 		PhenomenonLocation:  newObs.PhenomenonLocation,
 		ObservationLocation: newObs.ObservationLocation,
 
@@ -63,21 +74,129 @@ func New(newObs NewObservation, id string, now time.Time) (Observation, error) {
 		PropertyTypeID: newObs.PropertyType.ID,
 		ProcessID:      newObs.Process.ID,
 
+		ValidIntervalEnd: intervalEnd(validInterval),
+
 		Context: newObs.Context,
 		Tags:    newObs.Tags,
 
-		Scale:  newObs.Scale,
+		Scale:  scale,
 		Result: newObs.Result,
+
+		Revision:   1,
+		ModifiedAt: now,
 	}, nil
 }
 
+// Revise creates the next revision of an Observation from a NewObservation. The
+// revision keeps the identity of the previous revision and records who made the
+// change, when it was made and which fields were changed. Times that are not
+// provided are carried over from the previous revision. The scale is only
+// checked when it is changed, so observations stored with scales that are not
+// UCUM units can still be revised.
+func Revise(prev Observation, newObs NewObservation, by string, now time.Time) (Observation, error) {
+	if newObs.PhenomenonTime.IsZero() {
+		newObs.PhenomenonTime = prev.PhenomenonTime
+	}
+
+	if newObs.ResultTime.IsZero() {
+		newObs.ResultTime = prev.ResultTime
+	}
+
+	if newObs.ValidInterval.StartTime.IsZero() {
+		newObs.ValidInterval.StartTime = prev.ValidInterval.StartTime
+	}
+
+	keepScale := newObs.Scale == prev.Scale
+	if keepScale {
+		newObs.Scale = ""
+	}
+
+	obs, err := New(newObs, prev.ID, now)
+	if err != nil {
+		return Observation{}, err
+	}
+
+	if keepScale {
+		obs.Scale = prev.Scale
+	}
+	obs.Revision = prev.Revision + 1
+	obs.ModifiedBy = by
+	obs.Changes = changes(prev, obs)
+
+	return obs, nil
+}
+
+// changes lists the json names of the fields that differ between two revisions
+// of an observation.
+func changes(prev, next Observation) []string {
+	fields := []struct {
+		name       string
+		prev, next interface{}
+	}{
+		{"phenomenonTime", prev.PhenomenonTime.UTC(), next.PhenomenonTime.UTC()},
+		{"resultTime", prev.ResultTime.UTC(), next.ResultTime.UTC()},
+		{"validInterval", prev.ValidInterval.StartTime.UTC(), next.ValidInterval.StartTime.UTC()},
+		{"validInterval", prev.ValidInterval.Duration, next.ValidInterval.Duration},
+		{"phenomenonLocation", prev.PhenomenonLocation, next.PhenomenonLocation},
+		{"observationLocation", prev.ObservationLocation, next.ObservationLocation},
+		{"feature", prev.Feature, next.Feature},
+		{"featureType", prev.FeatureType, next.FeatureType},
+		{"property", prev.Property, next.Property},
+		{"propertyType", prev.PropertyType, next.PropertyType},
+		{"process", prev.Process, next.Process},
+		{"tags", prev.Tags, next.Tags},
+		{"context", prev.Context, next.Context},
+		{"result", normalize(prev.Result), normalize(next.Result)},
+		{"scale", prev.Scale, next.Scale},
+	}
+
+	var changed []string
+	for _, f := range fields {
+		if len(changed) > 0 && changed[len(changed)-1] == f.name {
+			continue
+		}
+
+		a, errA := json.Marshal(f.prev)
+		b, errB := json.Marshal(f.next)
+		if errA != nil || errB != nil || !bytes.Equal(a, b) {
+			changed = append(changed, f.name)
+		}
+	}
+
+	return changed
+}
+
+// normalize round trips a result through bson so results read from the
+// database and results read from a request have the same nested types.
+func normalize(result bson.M) bson.M {
+	data, err := bson.Marshal(result)
+	if err != nil {
+		return result
+	}
+
+	var m bson.M
+	if err := bson.Unmarshal(data, &m); err != nil {
+		return result
+	}
+
+	return m
+}
+
+// document is a revision of an observation as it is stored. Pending marks a
+// revision whose event has not been published, so the event is recorded in
+// the same write as the revision, see Unpublished.
+type document struct {
+	Observation `bson:",inline"`
+	Pending     bool `bson:"pending,omitempty"`
+}
+
 // Save persists an Observation to the database. It expects that the observation
 // has been initiated with New and is not a Observation literal.
 func Save(ctx context.Context, collection *mongo.Collection, obs Observation) error {
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	_, err := collection.InsertOne(ctx, obs)
+	_, err := collection.InsertOne(ctx, document{obs, true})
 
 	if err != nil {
 		return errors.Wrap(err, "saving observation")
@@ -86,58 +205,663 @@ func Save(ctx context.Context, collection *mongo.Collection, obs Observation) er
 	return nil
 }
 
+// SaveMany persists a batch of Observations to the database in a single request.
+// Observations that cannot be saved do not stop the rest of the batch from being
+// saved. Their errors are returned keyed by their index in the batch.
+func SaveMany(ctx context.Context, collection *mongo.Collection, obss []Observation) (map[int]error, error) {
+	failed := map[int]error{}
+	if len(obss) == 0 {
+		return failed, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	docs := make([]interface{}, len(obss))
+	for i, obs := range obss {
+		docs[i] = document{obs, true}
+	}
+
+	_, err := collection.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	if err != nil {
+		bwErr, ok := err.(mongo.BulkWriteException)
+		if !ok || bwErr.WriteConcernError != nil {
+			return nil, errors.Wrap(err, "saving observations")
+		}
+		for _, wErr := range bwErr.WriteErrors {
+			failed[wErr.Index] = errors.Wrap(wErr, "saving observation")
+		}
+	}
+
+	return failed, nil
+}
+
 // Find retrieves a single observation from the database based on the observation id.
 func Find(ctx context.Context, collection *mongo.Collection, id string) (Observation, error) {
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
+	// The latest revision is current before the revision it replaces is
+	// marked as superseded, see Supersede.
 	var obs Observation
-	err := collection.FindOne(ctx, bson.D{{"id", id}}).Decode(&obs)
+	opts := options.FindOne().SetSort(bson.D{{Key: "revision", Value: -1}})
+	err := collection.FindOne(ctx, bson.D{{Key: "id", Value: id}, current}, opts).Decode(&obs)
 	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return obs, ErrorNotFound
+		}
 		return obs, errors.Wrap(err, "finding observation")
 	}
 
 	return obs, nil
 }
 
-type Filter struct {
-	Path    string `json:"path" validate:"required"`
-	Op      string `json:"op" validate:"required"`
-	Matcher string `json:"match" validate:"required"`
+// Supersede persists a new revision of an observation that was created with
+// Revise. The revision it replaces is kept but marked as superseded, so only
+// the latest revision is returned by Find and Get. ErrorConflict is returned
+// if the previous revision has already been superseded.
+//
+// The new revision is saved before the earlier revisions are marked as
+// superseded, so the observation can always be found. Revisions are unique
+// for each observation, so only one revision replaces another. Earlier
+// revisions left current by a failure are marked as superseded by the next
+// revision.
+func Supersede(ctx context.Context, collection *mongo.Collection, obs Observation) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if _, err := collection.InsertOne(ctx, document{obs, true}); err != nil {
+		if duplicate(err) {
+			return ErrorConflict
+		}
+		return errors.Wrap(err, "saving revision")
+	}
+
+	earlier := bson.D{{Key: "id", Value: obs.ID}, {Key: "revision", Value: bson.M{"$ne": obs.Revision}}, current}
+	res, err := collection.UpdateMany(ctx, earlier, bson.M{"$set": bson.M{"superseded": true}})
+	if err == nil && res.MatchedCount > 0 {
+		return nil
+	}
+	if err == nil {
+		err = ErrorConflict
+	} else {
+		err = errors.Wrap(err, "superseding observation")
+	}
+
+	// Remove the new revision so the previous revision is still current.
+	revision := bson.D{{Key: "id", Value: obs.ID}, {Key: "revision", Value: obs.Revision}}
+	if _, delErr := collection.DeleteOne(ctx, revision); delErr != nil {
+		return errors.Wrapf(err, "removing revision after failure: %v", delErr)
+	}
+
+	return err
+}
+
+// duplicate reports whether an insert failed because of a unique index.
+func duplicate(err error) bool {
+	if we, ok := err.(mongo.WriteException); ok {
+		for _, e := range we.WriteErrors {
+			if e.Code == 11000 {
+				return true
+			}
+		}
+	}
+	return false
 }
 
-// Get retrieves a list of observations from the databse.
-func Get(ctx context.Context, collection *mongo.Collection, filters ...Filter) ([]Observation, error) {
+// pending matches the revisions whose events have not been published.
+var pending = bson.D{{Key: "pending", Value: true}}
+
+// Unpublished lists up to limit revisions of observations whose events have
+// not been published, in the order they were saved. Superseded revisions are
+// listed too, so an event is published for every revision.
+func Unpublished(ctx context.Context, collection *mongo.Collection, limit int) ([]Observation, error) {
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	mongoFilter := []bson.E{}
-	for _, filter := range filters {
-		mongoFilter = append(mongoFilter, buildFilter(filter))
+	opts := options.Find().
+		SetSort(bson.D{{Key: "modifiedat", Value: 1}, {Key: "_id", Value: 1}}).
+		SetLimit(int64(limit))
+	cursor, err := collection.Find(ctx, pending, opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "finding unpublished observations")
 	}
+	defer cursor.Close(ctx)
+
+	obss := []Observation{}
+	if err := cursor.All(ctx, &obss); err != nil {
+		return nil, errors.Wrap(err, "decoding unpublished observations")
+	}
+
+	return obss, nil
+}
 
-	var observations []Observation
-	opts := options.Find().SetSort(bson.D{{"resultTime", 1}})
-	cursor, err := collection.Find(ctx, mongoFilter, opts)
+// MarkPublished records that the event of a revision of an observation has
+// been published, so it is no longer listed by Unpublished.
+func MarkPublished(ctx context.Context, collection *mongo.Collection, obs Observation) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	revision := bson.D{{Key: "id", Value: obs.ID}, {Key: "revision", Value: obs.Revision}}
+	_, err := collection.UpdateOne(ctx, revision, bson.M{"$unset": bson.M{"pending": ""}})
+
+	return errors.Wrap(err, "marking observation published")
+}
+
+// History retrieves every revision of an observation ordered from the first
+// revision to the latest.
+func History(ctx context.Context, collection *mongo.Collection, id string) ([]Observation, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var revisions []Observation
+	opts := options.Find().SetSort(bson.D{{Key: "revision", Value: 1}})
+	cursor, err := collection.Find(ctx, bson.D{{Key: "id", Value: id}}, opts)
 	if err != nil {
-		return observations, errors.Wrap(err, "fetching observations")
+		return revisions, errors.Wrap(err, "fetching observation history")
+	}
+
+	if err = cursor.All(ctx, &revisions); err != nil {
+		return revisions, errors.Wrap(err, "decoding observation history")
 	}
 
-	if err = cursor.All(ctx, &observations); err != nil {
-		return observations, errors.Wrap(err, "decoding observations")
+	if len(revisions) == 0 {
+		return revisions, ErrorNotFound
 	}
 
-	return observations, nil
+	return revisions, nil
 }
 
-func buildFilter(f Filter) bson.E {
-	switch f.Op {
-	case "=":
-		return bson.E{Key: strings.ToLower(f.Path), Value: f.Matcher}
-	case "in":
-		return bson.E{Key: strings.ToLower(f.Path), Value: bson.M{"$in": strings.Split(f.Matcher, ",")}}
+// current matches only the latest revision of an observation.
+var current = bson.E{Key: "superseded", Value: bson.M{"$ne": true}}
+
+const (
+	// DefaultLimit is the number of observations in a page when no limit is given.
+	DefaultLimit = 100
+
+	// MaxLimit is the largest number of observations in a page.
+	MaxLimit = 1000
+)
+
+// Query describes which observations to retrieve. Observations must match all
+// of the Filters and the Where expression. They are listed in the order given
+// by Sort, a page at a time. Cursor is the Next value of the previous page, or
+// empty for the first page.
+//
+// ValidAt is an RFC3339 time the observations must be valid at. ValidDuring
+// and PhenomenonTime are periods in the form start/end, where either time may
+// be left empty. Observations must be valid at some point during ValidDuring
+// and have a phenomenon time inside PhenomenonTime.
+//
+// Offset skips that many observations before the first one is returned. It is
+// provided for clients that page by position, cursors should be preferred as
+// skipped observations must still be read by the database.
+//
+// Unit is a UCUM code the numeric results of observations are converted to.
+// Every observation with a scale must have a scale compatible with Unit, and
+// observations without a scale are returned unchanged.
+type Query struct {
+	Filters        []Filter
+	Where          *Expression
+	ValidAt        string
+	ValidDuring    string
+	PhenomenonTime string
+	Sort           []string
+	Limit          int
+	Offset         int
+	Cursor         string
+	Unit           string
+}
+
+// Page is a page of observations. Next is the cursor for the following page
+// and is empty on the last page.
+type Page struct {
+	Observations []Observation
+	Next         string
+}
+
+// Get retrieves a page of observations from the databse.
+func Get(ctx context.Context, collection *mongo.Collection, q Query) (Page, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	limit := pageLimit(q.Limit)
+
+	p, err := buildQuery(q)
+	if err != nil {
+		return Page{}, err
+	}
+
+	var conv *converter
+	if p.unit != nil {
+		conv = newConverter(*p.unit)
+	}
+
+	// One more observation than the limit is fetched to know if there is
+	// another page.
+	var page Page
+	opts := options.Find().SetSort(p.sortBSON()).SetLimit(int64(limit + 1)).SetSkip(int64(q.Offset))
+	cursor, err := collection.Find(ctx, p.filter, opts)
+	if err != nil {
+		return page, errors.Wrap(err, "fetching observations")
+	}
+	defer cursor.Close(ctx)
+
+	var last bson.Raw
+	for cursor.Next(ctx) {
+		if len(page.Observations) == limit {
+			page.Next = encodeCursor(p.position(last))
+			break
+		}
+
+		var obs Observation
+		if err := cursor.Decode(&obs); err != nil {
+			return page, errors.Wrap(err, "decoding observations")
+		}
+		if conv != nil {
+			if obs, err = conv.convert(obs); err != nil {
+				return Page{}, err
+			}
+		}
+		page.Observations = append(page.Observations, obs)
+		last = append(last[:0], cursor.Current...)
+	}
+
+	if err := cursor.Err(); err != nil {
+		return page, errors.Wrap(err, "fetching observations")
+	}
+
+	return page, nil
+}
+
+// pageLimit is the number of observations in a page of a query with a limit.
+func pageLimit(limit int) int {
+	if limit <= 0 {
+		return DefaultLimit
+	}
+	if limit > MaxLimit {
+		return MaxLimit
+	}
+	return limit
+}
+
+// Stream calls fn with each observation matching a query in order. Unlike Get,
+// observations are not fetched a page at a time. Every matching observation
+// is streamed, or only the first q.Limit observations when a limit is given.
+// Streaming stops at the first error returned by fn. When the query has a
+// unit, the scales of the matching observations are checked before fn is
+// first called, so an incompatible scale is reported before anything is
+// streamed.
+func Stream(ctx context.Context, collection *mongo.Collection, q Query, fn func(Observation) error) error {
+	p, err := buildQuery(q)
+	if err != nil {
+		return err
+	}
+
+	var conv *converter
+	if p.unit != nil {
+		if conv, err = scales(ctx, collection, p); err != nil {
+			return err
+		}
+	}
+
+	opts := options.Find().SetSort(p.sortBSON()).SetBatchSize(500).SetSkip(int64(q.Offset))
+	if q.Limit > 0 {
+		opts.SetLimit(int64(q.Limit))
+	}
+
+	cursor, err := collection.Find(ctx, p.filter, opts)
+	if err != nil {
+		return errors.Wrap(err, "fetching observations")
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var obs Observation
+		if err := cursor.Decode(&obs); err != nil {
+			return errors.Wrap(err, "decoding observations")
+		}
+		if conv != nil {
+			if obs, err = conv.convert(obs); err != nil {
+				return err
+			}
+		}
+		if err := fn(obs); err != nil {
+			return err
+		}
+	}
+
+	return errors.Wrap(cursor.Err(), "fetching observations")
+}
+
+// Validate checks that a query can be run. A *ValidationError describing
+// each invalid part of the query is returned if it cannot.
+func (q Query) Validate() error {
+	_, err := buildQuery(q)
+	return err
+}
+
+// plan is a query converted to a mongo filter and sort order, and the unit
+// results are converted to if one was given.
+type plan struct {
+	filter bson.D
+	sort   []sortKey
+	unit   *units.Unit
+}
+
+// Matches reports whether a revision of an observation matches a query,
+// whether or not it is the latest revision. The query is evaluated as Memory
+// evaluates it, so it has the same meaning as when searching for
+// observations.
+func (q Query) Matches(obs Observation) (bool, error) {
+	p, err := planQuery(q, bson.A{})
+	if err != nil {
+		return false, err
+	}
+
+	doc, err := encode(obs)
+	if err != nil {
+		return false, err
+	}
+
+	return matches(doc, p.filter), nil
+}
+
+// buildQuery converts a query to a mongo filter of the latest revisions of
+// observations and sort order.
+func buildQuery(q Query) (plan, error) {
+	return planQuery(q, bson.A{bson.D{current}})
+}
+
+// planQuery converts a query to a mongo filter and sort order. The filter
+// matches the clauses given as well as the query.
+func planQuery(q Query, clauses bson.A) (plan, error) {
+	// Clauses are combined with $and so filters on the same path do not
+	// replace each other.
+
+	var fieldErrors []FieldError
+	for i, filter := range q.Filters {
+		c, err := parseFilter(filter)
+		if err != nil {
+			fieldErrors = append(fieldErrors, FieldError{Field: fmt.Sprintf("filters[%d]", i), Error: err.Error()})
+			continue
+		}
+		clauses = append(clauses, bson.D{c.bson()})
+	}
+
+	if q.Where != nil {
+		size := len(q.Filters)
+		where, errs := parseExpression(*q.Where, "where", 1, &size)
+		fieldErrors = append(fieldErrors, errs...)
+		if len(errs) == 0 {
+			clauses = append(clauses, where.bson())
+		}
+	}
+
+	times, errs := temporalClauses(q)
+	fieldErrors = append(fieldErrors, errs...)
+	clauses = append(clauses, times...)
+
+	keys, errs := parseSort(q.Sort)
+	fieldErrors = append(fieldErrors, errs...)
+
+	if q.Offset < 0 {
+		fieldErrors = append(fieldErrors, FieldError{Field: "offset", Error: "offset must not be negative"})
+	}
+
+	if q.Cursor != "" {
+		pos, err := decodeCursor(q.Cursor)
+		if err != nil || !pos.follows(keys) {
+			fieldErrors = append(fieldErrors, FieldError{Field: "cursor", Error: "invalid cursor"})
+		} else {
+			clauses = append(clauses, after(keys, pos.Values))
+		}
+	}
+
+	var unit *units.Unit
+	if q.Unit != "" {
+		u, err := units.Parse(q.Unit)
+		if err != nil {
+			fieldErrors = append(fieldErrors, FieldError{Field: "unit", Error: err.Error()})
+		} else {
+			unit = &u
+		}
+	}
+
+	if len(fieldErrors) > 0 {
+		return plan{}, &ValidationError{Err: "error validating query", Fields: fieldErrors}
+	}
+
+	return plan{filter: bson.D{{Key: "$and", Value: clauses}}, sort: keys, unit: unit}, nil
+}
+
+// sortBSON converts the sort order of a plan to a mongo sort document.
+func (p plan) sortBSON() bson.D {
+	sort := bson.D{}
+	for _, k := range p.sort {
+		direction := 1
+		if k.desc {
+			direction = -1
+		}
+		sort = append(sort, bson.E{Key: k.key, Value: direction})
+	}
+	return sort
+}
+
+// position finds the position of a raw observation in the sort order of a plan.
+func (p plan) position(raw bson.Raw) position {
+	pos := position{Values: bson.A{}}
+	for _, k := range p.sort {
+		pos.Sort = append(pos.Sort, k.String())
+
+		var v interface{}
+		if rv, err := raw.LookupErr(strings.Split(k.key, ".")...); err == nil {
+			rv.Unmarshal(&v)
+		}
+		pos.Values = append(pos.Values, v)
+	}
+	return pos
+}
+
+// after matches the observations that are listed after the observation with
+// the given values for each sort key.
+func after(keys []sortKey, values bson.A) bson.D {
+	branches := bson.A{}
+	for i, k := range keys {
+		next, ok := beyond(k, values[i])
+		if !ok {
+			continue
+		}
+
+		branch := bson.A{}
+		for j := 0; j < i; j++ {
+			branch = append(branch, bson.D{{Key: keys[j].key, Value: values[j]}})
+		}
+		branches = append(branches, bson.D{{Key: "$and", Value: append(branch, next)}})
+	}
+
+	return bson.D{{Key: "$or", Value: branches}}
+}
+
+// beyond matches the values of a sort key that are listed after v. Missing and
+// null values are listed before all other values. It returns false if no value
+// is listed after v.
+func beyond(k sortKey, v interface{}) (bson.D, bool) {
+	switch {
+	case v == nil && k.desc:
+		return nil, false
+	case v == nil:
+		return bson.D{{Key: k.key, Value: bson.M{"$ne": nil}}}, true
+	case k.desc:
+		return bson.D{{Key: "$or", Value: bson.A{
+			bson.D{{Key: k.key, Value: bson.M{"$lt": v}}},
+			bson.D{{Key: k.key, Value: nil}},
+		}}}, true
 	default:
-		fmt.Printf("Cannot filter with operation %v\n", f.Op)
-		return bson.E{}
+		return bson.D{{Key: k.key, Value: bson.M{"$gt": v}}}, true
+	}
+}
+
+// position is the position of an observation in a listing of observations. It
+// holds the sort order of the listing and the observation's value for each
+// sort key.
+type position struct {
+	Sort   []string `bson:"s"`
+	Values bson.A   `bson:"v"`
+}
+
+// follows reports whether a position is in a listing with the given sort order.
+func (p position) follows(keys []sortKey) bool {
+	if len(p.Sort) != len(keys) || len(p.Values) != len(keys) {
+		return false
+	}
+
+	for i, k := range keys {
+		if p.Sort[i] != k.String() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// encodeCursor encodes a position as an opaque url safe cursor.
+func encodeCursor(p position) string {
+	data, _ := bson.Marshal(p)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor decodes a cursor created by encodeCursor.
+func decodeCursor(c string) (position, error) {
+	var p position
+
+	data, err := base64.RawURLEncoding.DecodeString(c)
+	if err != nil {
+		return p, errors.Wrap(err, "decoding cursor")
+	}
+
+	if err := bson.Unmarshal(data, &p); err != nil {
+		return p, errors.Wrap(err, "decoding cursor")
+	}
+
+	return p, nil
+}
+
+// migrateBatch is the number of documents rewritten by each write of a
+// migration.
+const migrateBatch = 1000
+
+// migrate sets fields of each document matching a filter to the fields
+// returned by set for the document. The documents are written back in
+// batches, so a migration makes one round trip for each batch rather than for
+// each document.
+func migrate(ctx context.Context, collection *mongo.Collection, filter bson.D, set func(bson.Raw) (bson.D, error)) error {
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		return errors.Wrap(err, "finding documents to migrate")
+	}
+	defer cursor.Close(ctx)
+
+	write := func(models []mongo.WriteModel) error {
+		if len(models) == 0 {
+			return nil
+		}
+		_, err := collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+		return errors.Wrap(err, "writing migrated documents")
 	}
+
+	var models []mongo.WriteModel
+	for cursor.Next(ctx) {
+		fields, err := set(cursor.Current)
+		if err != nil {
+			return errors.Wrap(err, "decoding document to migrate")
+		}
+
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.D{{Key: "_id", Value: cursor.Current.Lookup("_id")}}).
+			SetUpdate(bson.D{{Key: "$set", Value: fields}}))
+		if len(models) == migrateBatch {
+			if err := write(models); err != nil {
+				return err
+			}
+			models = nil
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return errors.Wrap(err, "finding documents to migrate")
+	}
+
+	return write(models)
+}
+
+// migrateRevisionIndex drops the index of revisions created before revisions
+// were unique, so it can be created again as a unique index.
+func migrateRevisionIndex(ctx context.Context, collection *mongo.Collection) error {
+	cursor, err := collection.Indexes().List(ctx)
+	if err != nil {
+		return errors.Wrap(err, "listing observation indexes")
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var index struct {
+			Name   string `bson:"name"`
+			Unique bool   `bson:"unique"`
+		}
+		if err := cursor.Decode(&index); err != nil {
+			return errors.Wrap(err, "decoding observation indexes")
+		}
+		if index.Name == "id_1_revision_1" && !index.Unique {
+			_, err := collection.Indexes().DropOne(ctx, index.Name)
+			return errors.Wrap(err, "dropping revision index")
+		}
+	}
+
+	return errors.Wrap(cursor.Err(), "listing observation indexes")
+}
+
+// EnsureIndexes creates the indexes used to query observations. Observations
+// stored before the indexes existed are migrated first. The migrations take as
+// long as the collection needs and are only bound by ctx, while the indexes
+// must be created within 30 seconds.
+func EnsureIndexes(ctx context.Context, collection *mongo.Collection) error {
+	if err := migrateLocations(ctx, collection); err != nil {
+		return err
+	}
+
+	if err := migrateIntervals(ctx, collection); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	if err := migrateRevisionIndex(ctx, collection); err != nil {
+		return err
+	}
+
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "id", Value: 1}, {Key: "revision", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "resulttime", Value: 1}, {Key: "id", Value: 1}}},
+		{Keys: bson.D{{Key: "phenomenontime", Value: 1}, {Key: "id", Value: 1}}},
+		{Keys: bson.D{{Key: "modifiedat", Value: 1}, {Key: "id", Value: 1}}},
+		{Keys: bson.D{
+			{Key: "featureid", Value: 1},
+			{Key: "propertyid", Value: 1},
+			{Key: "propertytypeid", Value: 1},
+			{Key: "phenomenontime", Value: -1},
+		}},
+		{Keys: bson.D{{Key: "validinterval.starttime", Value: 1}, {Key: "validintervalend", Value: 1}}},
+		{Keys: bson.D{{Key: "phenomenonlocation", Value: "2dsphere"}}},
+		{Keys: bson.D{{Key: "observationlocation", Value: "2dsphere"}}},
+		{
+			Keys:    bson.D{{Key: "modifiedat", Value: 1}, {Key: "_id", Value: 1}},
+			Options: options.Index().SetPartialFilterExpression(pending),
+		},
+	})
+	if err != nil {
+		return errors.Wrap(err, "creating observation indexes")
+	}
+
+	return nil
 }
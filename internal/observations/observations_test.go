@@ -12,6 +12,8 @@ import (
 	"github.com/schafer14/obs/internal/observations"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
@@ -106,6 +108,133 @@ func TestObservationWithGeoJson(t *testing.T) {
 	assert.Equal(t, newObs.ObservationLocation, obs.ObservationLocation, "process label invalid")
 }
 
+func TestInvalidLocationsAreRejected(t *testing.T) {
+
+	// Arrange
+	newObs := mkObs()
+	newObs.PhenomenonLocation = geojson.NewPointGeometry([]float64{200, 2})
+	newObs.ObservationLocation = geojson.NewPolygonGeometry([][][]float64{{{1, 1}, {2, 1}, {2, 2}, {1, 2}}})
+
+	// Act
+	_, err := observations.New(newObs, uuid.New().String(), time.Now())
+
+	// Assert
+	require.Error(t, err, "invalid locations accepted")
+	vError, ok := err.(*observations.ValidationError)
+	require.True(t, ok, "error is not a validation error")
+	assert.Equal(t, 2, len(vError.Fields), "invalid locations not named")
+}
+
+func TestScalesAreUCUMUnits(t *testing.T) {
+
+	// Arrange
+	canonical := mkObs()
+	canonical.Scale = "m+2"
+	invalid := mkObs()
+	invalid.Scale = "centimetre"
+
+	// Act
+	obs, err := observations.New(canonical, uuid.New().String(), time.Now())
+	_, invalidErr := observations.New(invalid, uuid.New().String(), time.Now())
+
+	// Assert
+	require.Nil(t, err, "creating observation")
+	assert.Equal(t, "m2", obs.Scale, "scale not canonical")
+	vError, ok := invalidErr.(*observations.ValidationError)
+	require.True(t, ok, "invalid scale accepted")
+	assert.Equal(t, "scale", vError.Fields[0].Field, "invalid scale not named")
+}
+
+func TestRevisingAnObservationWithALegacyScale(t *testing.T) {
+
+	// Arrange
+	now := time.Now()
+	prev, err := observations.New(mkObs(), uuid.New().String(), now.Add(-time.Hour))
+	require.Nil(t, err, "creating observation")
+	prev.Scale = "out of five"
+	patched := prev.AsNew()
+	patched.Result = map[string]interface{}{"wisteria": int64(2)}
+	rescaled := prev.AsNew()
+	rescaled.Scale = "out of ten"
+
+	// Act
+	obs, err := observations.Revise(prev, patched, "banner@example.com", now)
+	_, rescaledErr := observations.Revise(prev, rescaled, "banner@example.com", now)
+
+	// Assert
+	require.Nil(t, err, "revising observation with a legacy scale")
+	assert.Equal(t, "out of five", obs.Scale, "legacy scale not kept")
+	assert.Equal(t, []string{"result"}, obs.Changes, "changes mismatch")
+	_, ok := rescaledErr.(*observations.ValidationError)
+	assert.True(t, ok, "invalid scale accepted")
+}
+
+func TestValidIntervalEndIsStored(t *testing.T) {
+
+	// Arrange
+	start := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	bounded := mkObs()
+	bounded.ValidInterval = observations.Interval{StartTime: start, Duration: 24 * time.Hour}
+	unbounded := mkObs()
+	unbounded.ValidInterval = observations.Interval{StartTime: start}
+	negative := mkObs()
+	negative.ValidInterval = observations.Interval{StartTime: start, Duration: -time.Hour}
+
+	// Act
+	boundedObs, boundedErr := observations.New(bounded, uuid.New().String(), time.Now())
+	unboundedObs, unboundedErr := observations.New(unbounded, uuid.New().String(), time.Now())
+	_, negativeErr := observations.New(negative, uuid.New().String(), time.Now())
+
+	// Assert
+	require.Nil(t, boundedErr, "creating bounded observation")
+	require.Nil(t, unboundedErr, "creating unbounded observation")
+	require.NotNil(t, boundedObs.ValidIntervalEnd, "end time not stored")
+	assert.Equal(t, start.Add(24*time.Hour), *boundedObs.ValidIntervalEnd, "end time invalid")
+	assert.Nil(t, unboundedObs.ValidIntervalEnd, "end time stored for unbounded interval")
+	assert.Error(t, negativeErr, "negative duration accepted")
+}
+
+func TestRevisingAnObservation(t *testing.T) {
+
+	// Arrange
+	now := time.Now()
+	prev, err := observations.New(mkObs(), uuid.New().String(), now.Add(-time.Hour))
+	require.Nil(t, err, "creating observation")
+	newObs := prev.AsNew()
+	newObs.Result = map[string]interface{}{"wisteria": int64(2)}
+	newObs.Scale = "cm"
+
+	// Act
+	obs, err := observations.Revise(prev, newObs, "banner@example.com", now)
+
+	// Assert
+	require.Nil(t, err, "revising observation")
+
+	assert.Equal(t, prev.ID, obs.ID, "revision id changed")
+	assert.Equal(t, 2, obs.Revision, "revision not incremented")
+	assert.Equal(t, "banner@example.com", obs.ModifiedBy, "revision author not recorded")
+	assert.Equal(t, now, obs.ModifiedAt, "revision time not recorded")
+	assert.Equal(t, prev.PhenomenonTime, obs.PhenomenonTime, "phenomenon time not carried over")
+	assert.Equal(t, []string{"result", "scale"}, obs.Changes, "invalid changes")
+}
+
+func TestRevisingWithInvalidObservation(t *testing.T) {
+
+	// Arrange
+	prev, err := observations.New(mkObs(), uuid.New().String(), time.Now())
+	require.Nil(t, err, "creating observation")
+	newObs := prev.AsNew()
+	newObs.Feature = observations.Referenceable{}
+
+	// Act
+	_, err = observations.Revise(prev, newObs, "", time.Now())
+
+	// Assert
+	require.Error(t, err, "no error for invalid revision")
+	_, ok := err.(*observations.ValidationError)
+	assert.True(t, ok, "error is not a validation error")
+}
+
 func TestSavingAnObservation(t *testing.T) {
 
 	if testing.Short() {
@@ -131,6 +260,33 @@ func TestSavingAnObservation(t *testing.T) {
 	assert.WithinDuration(t, newObs.ResultTime, obs.ResultTime, time.Millisecond, "observation result time not saved correctly")
 }
 
+func TestSavingManyObservations(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Arrange
+	ctx := context.Background()
+	now := time.Now()
+	var obss []observations.Observation
+	for _, newObs := range mkObss(3) {
+		obs, err := observations.New(newObs, uuid.New().String(), now)
+		require.Nil(t, err, "creating observation")
+		obss = append(obss, obs)
+	}
+
+	// Act
+	failed, err := observations.SaveMany(ctx, coll, obss)
+
+	// Assert
+	require.Nil(t, err, "saving observations")
+	assert.Equal(t, 0, len(failed), "observations failed to save")
+	for _, obs := range obss {
+		assert.Equal(t, obs.ID, fetchObs(t, ctx, coll, obs.ID).ID, "observation not saved")
+	}
+}
+
 func TestGettingObservations(t *testing.T) {
 
 	if testing.Short() {
@@ -156,16 +312,14 @@ func TestGettingObservations(t *testing.T) {
 	require.Nil(t, err, "prepping observations")
 
 	// Act
-	newObss, err := observations.Get(
-		ctx,
-		coll,
-		observations.Filter{Path: "featureId", Op: "=", Matcher: uuids[0]},
-		observations.Filter{Path: "propertyId", Op: "=", Matcher: uuids[1]},
-	)
+	page, err := observations.Get(ctx, coll, observations.Query{Filters: []observations.Filter{
+		{Path: "featureId", Op: "=", Matcher: uuids[0]},
+		{Path: "propertyId", Op: "=", Matcher: uuids[1]},
+	}})
 
 	// Assert
 	require.Nil(t, err, "getting observations")
-	assert.Equal(t, 2, len(newObss), "observation length mismatch")
+	assert.Equal(t, 2, len(page.Observations), "observation length mismatch")
 }
 
 func TestGettingObservationsWithInFilter(t *testing.T) {
@@ -192,17 +346,422 @@ func TestGettingObservationsWithInFilter(t *testing.T) {
 	require.Nil(t, err, "prepping observations")
 
 	// Act
-	newObss, err := observations.Get(
-		ctx,
-		coll,
-		observations.Filter{Path: "featureId", Op: "in", Matcher: strings.Join([]string{
+	page, err := observations.Get(ctx, coll, observations.Query{Filters: []observations.Filter{
+		{Path: "featureId", Op: "in", Matcher: strings.Join([]string{
 			uuids[0], uuids[1],
 		}, ",")},
-	)
+	}})
 
 	// Assert
 	require.Nil(t, err, "getting observations")
-	assert.Equal(t, 3, len(newObss), "observation length mismatch")
+	assert.Equal(t, 3, len(page.Observations), "observation length mismatch")
+}
+
+func TestGettingObservationsWithRangeFilter(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Arrage
+	ctx := context.Background()
+	err := deleteCollection(ctx, coll)
+	require.Nil(t, err, "deleting collection")
+	obss := mkObss(4)
+	start := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	for i := range obss {
+		obss[i].ResultTime = start.Add(time.Duration(i) * 24 * time.Hour)
+	}
+
+	err = saveObss(ctx, obss, time.Now(), coll)
+	require.Nil(t, err, "prepping observations")
+
+	// Act
+	page, err := observations.Get(ctx, coll, observations.Query{Filters: []observations.Filter{
+		{Path: "resultTime", Op: ">", Matcher: "2020-03-01T00:00:00Z"},
+		{Path: "resultTime", Op: "<=", Matcher: "2020-03-03T00:00:00Z"},
+	}})
+
+	// Assert
+	require.Nil(t, err, "getting observations")
+	assert.Equal(t, 2, len(page.Observations), "observation length mismatch")
+}
+
+func TestGettingObservationsInsideABoundary(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Arrage
+	ctx := context.Background()
+	err := deleteCollection(ctx, coll)
+	require.Nil(t, err, "deleting collection")
+	obss := mkObss(3)
+	obss[0].PhenomenonLocation = geojson.NewPointGeometry([]float64{153.02, -27.47})
+	obss[1].PhenomenonLocation = geojson.NewPointGeometry([]float64{153.03, -27.48})
+	obss[2].PhenomenonLocation = geojson.NewPointGeometry([]float64{151.21, -33.87})
+
+	err = saveObss(ctx, obss, time.Now(), coll)
+	require.Nil(t, err, "prepping observations")
+
+	// Act
+	within, err := observations.Get(ctx, coll, observations.Query{Filters: []observations.Filter{
+		{Path: "phenomenonLocation", Op: "within", Matcher: `{"type": "Polygon", "coordinates": [[[153, -27], [154, -27], [154, -28], [153, -28], [153, -27]]]}`},
+	}})
+	require.Nil(t, err, "getting observations within boundary")
+	near, err := observations.Get(ctx, coll, observations.Query{Filters: []observations.Filter{
+		{Path: "phenomenonLocation", Op: "near", Matcher: "153.02,-27.47,500"},
+	}})
+	require.Nil(t, err, "getting observations near point")
+	box, err := observations.Get(ctx, coll, observations.Query{Filters: []observations.Filter{
+		{Path: "phenomenonLocation", Op: "bbox", Matcher: "150,-35,152,-33"},
+	}})
+	require.Nil(t, err, "getting observations inside box")
+
+	// Assert
+	assert.Equal(t, 2, len(within.Observations), "observations within boundary mismatch")
+	assert.Equal(t, 1, len(near.Observations), "observations near point mismatch")
+	assert.Equal(t, 1, len(box.Observations), "observations inside box mismatch")
+}
+
+func TestGettingObservationsValidAtATime(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Arrage
+	ctx := context.Background()
+	err := deleteCollection(ctx, coll)
+	require.Nil(t, err, "deleting collection")
+	start := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	obss := mkObss(3)
+	obss[0].ValidInterval = observations.Interval{StartTime: start, Duration: 24 * time.Hour}
+	obss[1].ValidInterval = observations.Interval{StartTime: start.Add(48 * time.Hour), Duration: 24 * time.Hour}
+	obss[2].ValidInterval = observations.Interval{StartTime: start.Add(12 * time.Hour)}
+	for i := range obss {
+		obss[i].PhenomenonTime = start.Add(time.Duration(i) * time.Hour)
+	}
+
+	err = saveObss(ctx, obss, time.Now(), coll)
+	require.Nil(t, err, "prepping observations")
+
+	// Act
+	at, err := observations.Get(ctx, coll, observations.Query{ValidAt: "2020-03-01T18:00:00Z"})
+	require.Nil(t, err, "getting observations valid at a time")
+	during, err := observations.Get(ctx, coll, observations.Query{ValidDuring: "2020-03-02T12:00:00Z/2020-03-03T12:00:00Z"})
+	require.Nil(t, err, "getting observations valid during a period")
+	phenomenon, err := observations.Get(ctx, coll, observations.Query{PhenomenonTime: "2020-03-01T01:00:00Z/.."})
+	require.Nil(t, err, "getting observations by phenomenon time")
+
+	// Assert
+	assert.Equal(t, 2, len(at.Observations), "observations valid at a time mismatch")
+	assert.Equal(t, 2, len(during.Observations), "observations valid during a period mismatch")
+	assert.Equal(t, 2, len(phenomenon.Observations), "observations by phenomenon time mismatch")
+}
+
+func TestGettingObservationsWithExpression(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Arrage
+	ctx := context.Background()
+	err := deleteCollection(ctx, coll)
+	require.Nil(t, err, "deleting collection")
+	uuids := ids(3)
+	obss := mkObss(4)
+	obss[0].Property.ID = uuids[0]
+	obss[1].Property.ID = uuids[1]
+	obss[2].Property.ID = uuids[1]
+	obss[2].Process.ID = uuids[2]
+	obss[3].Property.ID = uuids[2]
+
+	err = saveObss(ctx, obss, time.Now(), coll)
+	require.Nil(t, err, "prepping observations")
+
+	// Act
+	where := observations.Expression{And: []observations.Expression{
+		{Or: []observations.Expression{
+			{Filter: &observations.Filter{Path: "propertyId", Op: "=", Matcher: uuids[0]}},
+			{Filter: &observations.Filter{Path: "propertyId", Op: "=", Matcher: uuids[1]}},
+		}},
+		{Not: &observations.Expression{Filter: &observations.Filter{Path: "processId", Op: "=", Matcher: uuids[2]}}},
+	}}
+	page, err := observations.Get(ctx, coll, observations.Query{Where: &where})
+
+	// Assert
+	require.Nil(t, err, "getting observations")
+	assert.Equal(t, 2, len(page.Observations), "observation length mismatch")
+}
+
+func TestPagingThroughObservations(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Arrage
+	ctx := context.Background()
+	err := deleteCollection(ctx, coll)
+	require.Nil(t, err, "deleting collection")
+	err = saveObss(ctx, mkObss(5), time.Now(), coll)
+	require.Nil(t, err, "prepping observations")
+
+	// Act
+	q := observations.Query{Limit: 2}
+	var pages []observations.Page
+	for {
+		page, err := observations.Get(ctx, coll, q)
+		require.Nil(t, err, "getting observations")
+		pages = append(pages, page)
+		if page.Next == "" {
+			break
+		}
+		q.Cursor = page.Next
+	}
+
+	// Assert
+	require.Equal(t, 3, len(pages), "page count mismatch")
+	seen := map[string]bool{}
+	for _, page := range pages {
+		for _, obs := range page.Observations {
+			assert.False(t, seen[obs.ID], "observation listed twice")
+			seen[obs.ID] = true
+		}
+	}
+	assert.Equal(t, 5, len(seen), "observation count mismatch")
+}
+
+func TestSortingOnResults(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Arrage
+	ctx := context.Background()
+	err := deleteCollection(ctx, coll)
+	require.Nil(t, err, "deleting collection")
+	obss := mkObss(5)
+	for i := range obss {
+		obss[i].Result = map[string]interface{}{"wisteria": int64(i % 3)}
+		obss[i].Tags = map[string]string{"observed by": "Banner"}
+	}
+	delete(obss[4].Result, "wisteria")
+
+	err = saveObss(ctx, obss, time.Now(), coll)
+	require.Nil(t, err, "prepping observations")
+
+	// Act
+	q := observations.Query{
+		Filters: []observations.Filter{{Path: "tags.observed by", Op: "=", Matcher: "Banner"}},
+		Sort:    []string{"-result.wisteria"},
+		Limit:   2,
+	}
+	var wisteria []interface{}
+	for {
+		page, err := observations.Get(ctx, coll, q)
+		require.Nil(t, err, "getting observations")
+		for _, obs := range page.Observations {
+			wisteria = append(wisteria, obs.Result["wisteria"])
+		}
+		if page.Next == "" {
+			break
+		}
+		q.Cursor = page.Next
+	}
+
+	// Assert
+	assert.Equal(t, []interface{}{int64(2), int64(1), int64(1), int64(0), nil}, wisteria, "observations not sorted")
+}
+
+func TestStreamingObservations(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Arrange
+	ctx := context.Background()
+	err := deleteCollection(ctx, coll)
+	require.Nil(t, err, "deleting collection")
+	err = saveObss(ctx, mkObss(observations.DefaultLimit+5), time.Now(), coll)
+	require.Nil(t, err, "prepping observations")
+
+	// Act
+	var all, limited int
+	err = observations.Stream(ctx, coll, observations.Query{}, func(observations.Observation) error {
+		all++
+		return nil
+	})
+	require.Nil(t, err, "streaming observations")
+	err = observations.Stream(ctx, coll, observations.Query{Limit: 3}, func(observations.Observation) error {
+		limited++
+		return nil
+	})
+	require.Nil(t, err, "streaming limited observations")
+
+	// Assert
+	assert.Equal(t, observations.DefaultLimit+5, all, "not every observation streamed")
+	assert.Equal(t, 3, limited, "limit not applied")
+}
+
+func TestGettingObservationsInAUnit(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Arrange
+	ctx := context.Background()
+	err := deleteCollection(ctx, coll)
+	require.Nil(t, err, "deleting collection")
+	millimetres := mkObs()
+	millimetres.Scale = "mm"
+	millimetres.Result = map[string]interface{}{"wisteria": int64(1500), "heights": []interface{}{250.0}}
+	celsius := mkObs()
+	celsius.Scale = "Cel"
+	err = saveObss(ctx, []observations.NewObservation{millimetres, celsius}, time.Now(), coll)
+	require.Nil(t, err, "prepping observations")
+	lengths := []observations.Filter{{Path: "scale", Op: "=", Matcher: "mm"}}
+
+	// Act
+	page, err := observations.Get(ctx, coll, observations.Query{Filters: lengths, Unit: "m"})
+	require.Nil(t, err, "getting observations in metres")
+	_, incompatibleErr := observations.Get(ctx, coll, observations.Query{Unit: "m"})
+	streamErr := observations.Stream(ctx, coll, observations.Query{Unit: "m"}, func(observations.Observation) error {
+		t.Error("observation streamed before scales were checked")
+		return nil
+	})
+
+	// Assert
+	require.Equal(t, 1, len(page.Observations), "observations mismatch")
+	assert.Equal(t, "m", page.Observations[0].Scale, "scale not converted")
+	assert.Equal(t, 1.5, page.Observations[0].Result["wisteria"], "result not converted")
+	assert.Equal(t, primitive.A{0.25}, page.Observations[0].Result["heights"], "nested result not converted")
+	_, ok := incompatibleErr.(*observations.ValidationError)
+	assert.True(t, ok, "incompatible scale not rejected")
+	_, ok = streamErr.(*observations.ValidationError)
+	assert.True(t, ok, "incompatible scale not rejected when streaming")
+}
+
+func TestGettingWithInvalidCursor(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Act
+	_, err := observations.Get(context.Background(), coll, observations.Query{Cursor: "not a cursor"})
+
+	// Assert
+	_, ok := err.(*observations.ValidationError)
+	assert.True(t, ok, "invalid cursor not rejected")
+}
+
+func TestSupersedingAnObservation(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Arrange
+	ctx := context.Background()
+	now := time.Now()
+	require.Nil(t, observations.EnsureIndexes(ctx, coll), "creating indexes")
+	prev, err := observations.New(mkObs(), uuid.New().String(), now)
+	require.Nil(t, err, "creating observation")
+	err = observations.Save(ctx, coll, prev)
+	require.Nil(t, err, "saving observation")
+	newObs := prev.AsNew()
+	newObs.Result = map[string]interface{}{"wisteria": int64(1)}
+	next, err := observations.Revise(prev, newObs, "banner@example.com", now)
+	require.Nil(t, err, "revising observation")
+
+	// Act
+	err = observations.Supersede(ctx, coll, next)
+
+	// Assert
+	require.Nil(t, err, "superseding observation")
+	obs := fetchObs(t, ctx, coll, prev.ID)
+	assert.Equal(t, 2, obs.Revision, "latest revision not returned")
+
+	history, err := observations.History(ctx, coll, prev.ID)
+	require.Nil(t, err, "fetching history")
+	require.Equal(t, 2, len(history), "history length mismatch")
+	assert.Equal(t, 1, history[0].Revision, "first revision missing")
+	assert.Equal(t, "banner@example.com", history[1].ModifiedBy, "revision author not saved")
+
+	err = observations.Supersede(ctx, coll, next)
+	assert.Equal(t, observations.ErrorConflict, err, "superseded a stale revision")
+}
+
+func TestSupersedingSupersedesEveryEarlierRevision(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Arrange
+	ctx := context.Background()
+	now := time.Now()
+	require.Nil(t, observations.EnsureIndexes(ctx, coll), "creating indexes")
+	first, err := observations.New(mkObs(), uuid.New().String(), now)
+	require.Nil(t, err, "creating observation")
+	require.Nil(t, observations.Save(ctx, coll, first), "saving observation")
+
+	// A failure after saving the second revision leaves the first current.
+	second, err := observations.Revise(first, first.AsNew(), "banner@example.com", now)
+	require.Nil(t, err, "revising observation")
+	require.Nil(t, observations.Save(ctx, coll, second), "saving revision")
+	third, err := observations.Revise(second, second.AsNew(), "banner@example.com", now)
+	require.Nil(t, err, "revising observation")
+
+	// Act
+	found := fetchObs(t, ctx, coll, first.ID)
+	err = observations.Supersede(ctx, coll, third)
+
+	// Assert
+	assert.Equal(t, 2, found.Revision, "latest revision not found while earlier revision is current")
+	require.Nil(t, err, "superseding observation")
+	n, err := coll.CountDocuments(ctx, bson.D{{Key: "id", Value: first.ID}, {Key: "superseded", Value: bson.M{"$ne": true}}})
+	require.Nil(t, err, "counting current revisions")
+	assert.Equal(t, int64(1), n, "earlier revisions still current")
+	assert.Equal(t, 3, fetchObs(t, ctx, coll, first.ID).Revision, "latest revision not returned")
+}
+
+func TestMigratingIntervalsInBatches(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Arrange
+	ctx := context.Background()
+	start := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	newObs := mkObs()
+	newObs.Feature.ID = "https://example.com/" + uuid.New().String()
+	newObs.ValidInterval = observations.Interval{StartTime: start, Duration: time.Hour}
+	newObss := make([]observations.NewObservation, 1001)
+	for i := range newObss {
+		newObss[i] = newObs
+	}
+	require.Nil(t, saveObss(ctx, newObss, time.Now(), coll), "prepping observations")
+	feature := bson.D{{Key: "featureid", Value: newObs.Feature.ID}}
+	_, err := coll.UpdateMany(ctx, feature, bson.D{{Key: "$unset", Value: bson.D{{Key: "validintervalend", Value: ""}}}})
+	require.Nil(t, err, "removing end times")
+
+	// Act
+	err = observations.EnsureIndexes(ctx, coll)
+
+	// Assert
+	require.Nil(t, err, "creating indexes")
+	n, err := coll.CountDocuments(ctx, append(feature, bson.E{Key: "validintervalend", Value: start.Add(time.Hour)}))
+	require.Nil(t, err, "counting migrated observations")
+	assert.Equal(t, int64(1001), n, "end times not migrated")
 }
 
 // ===========================================
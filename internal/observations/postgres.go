@@ -0,0 +1,878 @@
+package observations
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	geojson "github.com/paulmach/go.geojson"
+	"github.com/pkg/errors"
+	"github.com/schafer14/obs/internal/platform/postgres"
+	"github.com/schafer14/obs/internal/units"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// postgresMigrations create and update the tables observations are stored
+// in. Each revision of an observation is a row, and locations are indexed as
+// geometries in longitudes and latitudes.
+var postgresMigrations = []postgres.Migration{
+	{Version: 1, SQL: `
+		CREATE EXTENSION IF NOT EXISTS postgis;
+
+		CREATE TABLE observations (
+			pk                   bigserial PRIMARY KEY,
+			id                   text COLLATE "C" NOT NULL,
+			revision             integer NOT NULL,
+			superseded           boolean NOT NULL DEFAULT false,
+
+			phenomenon_time      timestamptz NOT NULL,
+			result_time          timestamptz NOT NULL,
+			valid_start          timestamptz NOT NULL,
+			valid_duration       bigint NOT NULL,
+			valid_end            timestamptz,
+			phenomenon_location  geometry(Geometry, 4326),
+			observation_location geometry(Geometry, 4326),
+
+			feature              jsonb NOT NULL,
+			feature_type         jsonb NOT NULL,
+			property             jsonb NOT NULL,
+			property_type        jsonb NOT NULL,
+			process              jsonb NOT NULL,
+			feature_id           text COLLATE "C" NOT NULL,
+			feature_type_id      text COLLATE "C" NOT NULL,
+			property_id          text COLLATE "C" NOT NULL,
+			property_type_id     text COLLATE "C" NOT NULL,
+			process_id           text COLLATE "C" NOT NULL,
+
+			tags                 jsonb NOT NULL,
+			context              jsonb NOT NULL,
+			result               jsonb NOT NULL,
+			scale                text COLLATE "C" NOT NULL,
+
+			modified_by          text COLLATE "C" NOT NULL,
+			modified_at          timestamptz NOT NULL,
+			changes              jsonb NOT NULL,
+
+			UNIQUE (id, revision)
+		);
+
+		CREATE INDEX ON observations (result_time, id);
+		CREATE INDEX ON observations (phenomenon_time, id);
+		CREATE INDEX ON observations (modified_at, id);
+		CREATE INDEX ON observations (feature_id, property_id, property_type_id, phenomenon_time DESC);
+		CREATE INDEX ON observations (valid_start, valid_end);
+		CREATE INDEX ON observations USING gist (phenomenon_location);
+		CREATE INDEX ON observations USING gist (observation_location);
+		CREATE INDEX ON observations USING gin (result jsonb_path_ops);
+		CREATE INDEX ON observations USING gin (tags jsonb_path_ops);
+	`},
+	{Version: 2, SQL: `
+		ALTER TABLE observations ADD COLUMN pending boolean NOT NULL DEFAULT false;
+
+		CREATE INDEX ON observations (pk) WHERE pending;
+	`},
+}
+
+// MigratePostgres creates or updates the tables observations are stored in.
+func MigratePostgres(ctx context.Context, db *sqlx.DB) error {
+	return postgres.Migrate(ctx, db, "observations", postgresMigrations)
+}
+
+// Postgres is a repository of observations in a postgres database with the
+// PostGIS extension. Results and tags are stored as JSONB and locations as
+// PostGIS geometries. Queries are converted to the same mongo filters as
+// Mongo uses and then to SQL, so Postgres answers queries in the same way.
+//
+// Times are stored to the millisecond, as mongo stores them. Whole numbers
+// in results are read as int64 and other numbers as float64, as JSON does not
+// record the type of numbers.
+type Postgres struct {
+	db *sqlx.DB
+}
+
+// NewPostgres creates a repository of the observations in a postgres
+// database. The database must have been migrated with MigratePostgres.
+func NewPostgres(db *sqlx.DB) *Postgres {
+	return &Postgres{db: db}
+}
+
+// selectObservation lists the columns of a row that are read into a record.
+const selectObservation = `SELECT id, revision, superseded,
+	phenomenon_time, result_time, valid_start, valid_duration, valid_end,
+	ST_AsGeoJSON(phenomenon_location, 15) AS phenomenon_location,
+	ST_AsGeoJSON(observation_location, 15) AS observation_location,
+	feature, feature_type, property, property_type, process,
+	feature_id, feature_type_id, property_id, property_type_id, process_id,
+	tags, context, result, scale, modified_by, modified_at, changes`
+
+// insertObservation inserts a record.
+const insertObservation = `INSERT INTO observations (id, revision, superseded, pending,
+	phenomenon_time, result_time, valid_start, valid_duration, valid_end,
+	phenomenon_location, observation_location,
+	feature, feature_type, property, property_type, process,
+	feature_id, feature_type_id, property_id, property_type_id, process_id,
+	tags, context, result, scale, modified_by, modified_at, changes)
+VALUES (:id, :revision, :superseded, :pending,
+	:phenomenon_time, :result_time, :valid_start, :valid_duration, :valid_end,
+	ST_SetSRID(ST_GeomFromGeoJSON(CAST(:phenomenon_location AS text)), 4326),
+	ST_SetSRID(ST_GeomFromGeoJSON(CAST(:observation_location AS text)), 4326),
+	:feature, :feature_type, :property, :property_type, :process,
+	:feature_id, :feature_type_id, :property_id, :property_type_id, :process_id,
+	:tags, :context, :result, :scale, :modified_by, :modified_at, :changes)`
+
+// record is an observation as it is stored in a row. JSON columns are sent
+// as text, as binary values cannot be stored in JSONB columns.
+type record struct {
+	ID         string `db:"id"`
+	Revision   int    `db:"revision"`
+	Superseded bool   `db:"superseded"`
+	Pending    bool   `db:"pending"`
+
+	PhenomenonTime      time.Time  `db:"phenomenon_time"`
+	ResultTime          time.Time  `db:"result_time"`
+	ValidStart          time.Time  `db:"valid_start"`
+	ValidDuration       int64      `db:"valid_duration"`
+	ValidEnd            *time.Time `db:"valid_end"`
+	PhenomenonLocation  *string    `db:"phenomenon_location"`
+	ObservationLocation *string    `db:"observation_location"`
+
+	Feature        string `db:"feature"`
+	FeatureType    string `db:"feature_type"`
+	Property       string `db:"property"`
+	PropertyType   string `db:"property_type"`
+	Process        string `db:"process"`
+	FeatureID      string `db:"feature_id"`
+	FeatureTypeID  string `db:"feature_type_id"`
+	PropertyID     string `db:"property_id"`
+	PropertyTypeID string `db:"property_type_id"`
+	ProcessID      string `db:"process_id"`
+
+	Tags    string `db:"tags"`
+	Context string `db:"context"`
+	Result  string `db:"result"`
+	Scale   string `db:"scale"`
+
+	ModifiedBy string    `db:"modified_by"`
+	ModifiedAt time.Time `db:"modified_at"`
+	Changes    string    `db:"changes"`
+}
+
+// newRecord converts an observation to the record of a new row, whose event
+// has not been published.
+func newRecord(obs Observation) (record, error) {
+	r := record{
+		ID:         obs.ID,
+		Revision:   obs.Revision,
+		Superseded: obs.Superseded,
+		Pending:    true,
+
+		PhenomenonTime: storedTime(obs.PhenomenonTime),
+		ResultTime:     storedTime(obs.ResultTime),
+		ValidStart:     storedTime(obs.ValidInterval.StartTime),
+		ValidDuration:  int64(obs.ValidInterval.Duration),
+
+		FeatureID:      obs.FeatureID,
+		FeatureTypeID:  obs.FeatureTypeID,
+		PropertyID:     obs.PropertyID,
+		PropertyTypeID: obs.PropertyTypeID,
+		ProcessID:      obs.ProcessID,
+
+		Scale:      obs.Scale,
+		ModifiedBy: obs.ModifiedBy,
+		ModifiedAt: storedTime(obs.ModifiedAt),
+	}
+
+	if obs.ValidIntervalEnd != nil {
+		end := storedTime(*obs.ValidIntervalEnd)
+		r.ValidEnd = &end
+	}
+
+	for _, l := range []struct {
+		g  *geojson.Geometry
+		to **string
+	}{
+		{obs.PhenomenonLocation, &r.PhenomenonLocation},
+		{obs.ObservationLocation, &r.ObservationLocation},
+	} {
+		if l.g == nil {
+			continue
+		}
+		data, err := json.Marshal(l.g)
+		if err != nil {
+			return r, errors.Wrap(err, "encoding location")
+		}
+		s := string(data)
+		*l.to = &s
+	}
+
+	for _, f := range []struct {
+		v  interface{}
+		to *string
+	}{
+		{obs.Feature, &r.Feature},
+		{obs.FeatureType, &r.FeatureType},
+		{obs.Property, &r.Property},
+		{obs.PropertyType, &r.PropertyType},
+		{obs.Process, &r.Process},
+		{obs.Tags, &r.Tags},
+		{obs.Context, &r.Context},
+		{obs.Result, &r.Result},
+		{obs.Changes, &r.Changes},
+	} {
+		data, err := json.Marshal(f.v)
+		if err != nil {
+			return r, errors.Wrap(err, "encoding observation")
+		}
+		*f.to = string(data)
+	}
+
+	return r, nil
+}
+
+// storedTime is a time as it is stored, in UTC to the millisecond.
+func storedTime(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Millisecond)
+}
+
+// observation converts a record to an observation.
+func (r record) observation() (Observation, error) {
+	obs := Observation{
+		ID:         r.ID,
+		Revision:   r.Revision,
+		Superseded: r.Superseded,
+
+		PhenomenonTime: r.PhenomenonTime.UTC(),
+		ResultTime:     r.ResultTime.UTC(),
+		ValidInterval:  Interval{StartTime: r.ValidStart.UTC(), Duration: time.Duration(r.ValidDuration)},
+
+		FeatureID:      r.FeatureID,
+		FeatureTypeID:  r.FeatureTypeID,
+		PropertyID:     r.PropertyID,
+		PropertyTypeID: r.PropertyTypeID,
+		ProcessID:      r.ProcessID,
+
+		Scale:      r.Scale,
+		ModifiedBy: r.ModifiedBy,
+		ModifiedAt: r.ModifiedAt.UTC(),
+	}
+
+	if r.ValidEnd != nil {
+		end := r.ValidEnd.UTC()
+		obs.ValidIntervalEnd = &end
+	}
+
+	var err error
+	if r.PhenomenonLocation != nil {
+		if obs.PhenomenonLocation, err = geojson.UnmarshalGeometry([]byte(*r.PhenomenonLocation)); err != nil {
+			return obs, errors.Wrap(err, "decoding location")
+		}
+	}
+	if r.ObservationLocation != nil {
+		if obs.ObservationLocation, err = geojson.UnmarshalGeometry([]byte(*r.ObservationLocation)); err != nil {
+			return obs, errors.Wrap(err, "decoding location")
+		}
+	}
+
+	for _, f := range []struct {
+		data string
+		to   interface{}
+	}{
+		{r.Feature, &obs.Feature},
+		{r.FeatureType, &obs.FeatureType},
+		{r.Property, &obs.Property},
+		{r.PropertyType, &obs.PropertyType},
+		{r.Process, &obs.Process},
+		{r.Tags, &obs.Tags},
+		{r.Context, &obs.Context},
+		{r.Changes, &obs.Changes},
+	} {
+		if err := json.Unmarshal([]byte(f.data), f.to); err != nil {
+			return obs, errors.Wrap(err, "decoding observation")
+		}
+	}
+
+	if obs.Result, err = decodeResult(r.Result); err != nil {
+		return obs, errors.Wrap(err, "decoding result")
+	}
+
+	return obs, nil
+}
+
+// decodeResult decodes a result stored as JSON into the types mongo decodes
+// results into, so that results are the same whichever repository they are
+// read from. Documents are bson.M and arrays are bson.A.
+func decodeResult(data string) (bson.M, error) {
+	dec := json.NewDecoder(strings.NewReader(data))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	result, _ := resultValue(v).(bson.M)
+	return result, nil
+}
+
+// resultValue converts a value decoded from JSON to the type mongo decodes it
+// into.
+func resultValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := bson.M{}
+		for k, value := range v {
+			m[k] = resultValue(value)
+		}
+		return m
+	case []interface{}:
+		a := bson.A{}
+		for _, value := range v {
+			a = append(a, resultValue(value))
+		}
+		return a
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	}
+	return v
+}
+
+// query runs a query and converts the rows it returns to observations.
+func (p *Postgres) query(ctx context.Context, query string, args ...interface{}) ([]Observation, error) {
+	var records []record
+	if err := p.db.SelectContext(ctx, &records, query, args...); err != nil {
+		return nil, err
+	}
+
+	obss := []Observation{}
+	for _, r := range records {
+		obs, err := r.observation()
+		if err != nil {
+			return obss, err
+		}
+		obss = append(obss, obs)
+	}
+	return obss, nil
+}
+
+// Save persists an observation.
+func (p *Postgres) Save(ctx context.Context, obs Observation) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	r, err := newRecord(obs)
+	if err != nil {
+		return errors.Wrap(err, "saving observation")
+	}
+
+	_, err = p.db.NamedExecContext(ctx, insertObservation, r)
+	return errors.Wrap(err, "saving observation")
+}
+
+// SaveMany persists a batch of observations in a single transaction.
+// Observations that cannot be saved do not stop the rest of the batch from
+// being saved. Their errors are returned keyed by their index in the batch.
+func (p *Postgres) SaveMany(ctx context.Context, obss []Observation) (map[int]error, error) {
+	failed := map[int]error{}
+	if len(obss) == 0 {
+		return failed, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	tx, err := p.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "saving observations")
+	}
+	defer tx.Rollback()
+
+	for i, obs := range obss {
+		r, err := newRecord(obs)
+		if err != nil {
+			failed[i] = errors.Wrap(err, "saving observation")
+			continue
+		}
+
+		// Each observation is saved inside a savepoint so a failure only
+		// undoes that observation.
+		if _, err := tx.ExecContext(ctx, "SAVEPOINT observation"); err != nil {
+			return nil, errors.Wrap(err, "saving observations")
+		}
+		if _, err := tx.NamedExecContext(ctx, insertObservation, r); err != nil {
+			failed[i] = errors.Wrap(err, "saving observation")
+			if _, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT observation"); err != nil {
+				return nil, errors.Wrap(err, "saving observations")
+			}
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, "RELEASE SAVEPOINT observation"); err != nil {
+			return nil, errors.Wrap(err, "saving observations")
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrap(err, "saving observations")
+	}
+
+	return failed, nil
+}
+
+// Find retrieves the latest revision of an observation.
+func (p *Postgres) Find(ctx context.Context, id string) (Observation, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	obss, err := p.query(ctx, selectObservation+` FROM observations WHERE id = $1 AND NOT superseded`, id)
+	if err != nil {
+		return Observation{}, errors.Wrap(err, "finding observation")
+	}
+	if len(obss) == 0 {
+		return Observation{}, ErrorNotFound
+	}
+
+	return obss[0], nil
+}
+
+// Supersede persists a new revision of an observation and marks the revision
+// it replaces as superseded in a single transaction. ErrorConflict is
+// returned if the previous revision has already been superseded.
+func (p *Postgres) Supersede(ctx context.Context, obs Observation) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	r, err := newRecord(obs)
+	if err != nil {
+		return errors.Wrap(err, "saving revision")
+	}
+
+	tx, err := p.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "superseding observation")
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `UPDATE observations SET superseded = true WHERE id = $1 AND revision = $2 AND NOT superseded`, obs.ID, obs.Revision-1)
+	if err != nil {
+		return errors.Wrap(err, "superseding observation")
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "superseding observation")
+	}
+	if n == 0 {
+		return ErrorConflict
+	}
+
+	if _, err := tx.NamedExecContext(ctx, insertObservation, r); err != nil {
+		return errors.Wrap(err, "saving revision")
+	}
+
+	return errors.Wrap(tx.Commit(), "superseding observation")
+}
+
+// Unpublished lists up to limit revisions of observations whose events have
+// not been published, in the order they were saved. Rows are saved with their
+// event pending, so the event is recorded in the same write as the revision.
+func (p *Postgres) Unpublished(ctx context.Context, limit int) ([]Observation, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	obss, err := p.query(ctx, selectObservation+` FROM observations WHERE pending ORDER BY pk LIMIT $1`, limit)
+	return obss, errors.Wrap(err, "finding unpublished observations")
+}
+
+// MarkPublished records that the event of a revision of an observation has
+// been published.
+func (p *Postgres) MarkPublished(ctx context.Context, obs Observation) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := p.db.ExecContext(ctx, `UPDATE observations SET pending = false WHERE id = $1 AND revision = $2`, obs.ID, obs.Revision)
+	return errors.Wrap(err, "marking observation published")
+}
+
+// History retrieves every revision of an observation ordered from the first
+// revision to the latest.
+func (p *Postgres) History(ctx context.Context, id string) ([]Observation, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	revisions, err := p.query(ctx, selectObservation+` FROM observations WHERE id = $1 ORDER BY revision`, id)
+	if err != nil {
+		return revisions, errors.Wrap(err, "fetching observation history")
+	}
+	if len(revisions) == 0 {
+		return revisions, ErrorNotFound
+	}
+
+	return revisions, nil
+}
+
+// Get retrieves a page of observations.
+func (p *Postgres) Get(ctx context.Context, q Query) (Page, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	limit := pageLimit(q.Limit)
+
+	pl, err := buildQuery(q)
+	if err != nil {
+		return Page{}, err
+	}
+
+	// One more observation than the limit is fetched to know if there is
+	// another page.
+	var s sqlQuery
+	query := fmt.Sprintf("%s FROM observations WHERE %s ORDER BY %s LIMIT %d OFFSET %d",
+		selectObservation, s.where(pl.filter), s.orderBy(pl.sort), limit+1, q.Offset)
+	obss, err := p.query(ctx, query, s.args...)
+	if err != nil {
+		return Page{}, errors.Wrap(err, "fetching observations")
+	}
+
+	var page Page
+	if len(obss) > limit {
+		obss = obss[:limit]
+		last, err := encode(obss[limit-1])
+		if err != nil {
+			return Page{}, err
+		}
+		page.Next = encodeCursor(pl.position(last))
+	}
+
+	var conv *converter
+	if pl.unit != nil {
+		conv = newConverter(*pl.unit)
+	}
+
+	for _, obs := range obss {
+		if conv != nil {
+			if obs, err = conv.convert(obs); err != nil {
+				return Page{}, err
+			}
+		}
+		page.Observations = append(page.Observations, obs)
+	}
+
+	return page, nil
+}
+
+// Stream calls fn with each observation matching a query in order. When the
+// query has a unit, the scales of the matching observations are checked
+// before fn is first called.
+func (p *Postgres) Stream(ctx context.Context, q Query, fn func(Observation) error) error {
+	pl, err := buildQuery(q)
+	if err != nil {
+		return err
+	}
+
+	var conv *converter
+	if pl.unit != nil {
+		if conv, err = p.scales(ctx, pl); err != nil {
+			return err
+		}
+	}
+
+	var s sqlQuery
+	query := fmt.Sprintf("%s FROM observations WHERE %s ORDER BY %s OFFSET %d",
+		selectObservation, s.where(pl.filter), s.orderBy(pl.sort), q.Offset)
+	if q.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", q.Limit)
+	}
+
+	rows, err := p.db.QueryxContext(ctx, query, s.args...)
+	if err != nil {
+		return errors.Wrap(err, "fetching observations")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r record
+		if err := rows.StructScan(&r); err != nil {
+			return errors.Wrap(err, "decoding observations")
+		}
+		obs, err := r.observation()
+		if err != nil {
+			return errors.Wrap(err, "decoding observations")
+		}
+		if conv != nil {
+			if obs, err = conv.convert(obs); err != nil {
+				return err
+			}
+		}
+		if err := fn(obs); err != nil {
+			return err
+		}
+	}
+
+	return errors.Wrap(rows.Err(), "fetching observations")
+}
+
+// Convertible checks the observations matching a query can be converted to
+// its unit.
+func (p *Postgres) Convertible(ctx context.Context, q Query) error {
+	pl, err := buildQuery(q)
+	if err != nil || pl.unit == nil {
+		return err
+	}
+
+	_, err = p.scales(ctx, pl)
+	return err
+}
+
+// scales checks that the scale of every observation matching a plan can be
+// converted to the unit of the plan, and returns a converter with the
+// conversion from each scale.
+func (p *Postgres) scales(ctx context.Context, pl plan) (*converter, error) {
+	var s sqlQuery
+	var found []string
+	if err := p.db.SelectContext(ctx, &found, "SELECT DISTINCT scale FROM observations WHERE "+s.where(pl.filter), s.args...); err != nil {
+		return nil, errors.Wrap(err, "fetching scales")
+	}
+
+	values := make([]interface{}, len(found))
+	for i, scale := range found {
+		values[i] = scale
+	}
+
+	return checkScales(*pl.unit, values)
+}
+
+// Changes lists the observations matching a query saved after a token.
+func (p *Postgres) Changes(ctx context.Context, q Query, after Token, limit int) ([]Observation, error) {
+	page, err := p.Get(ctx, changesQuery(q, after, limit))
+	if err != nil {
+		return nil, err
+	}
+
+	return page.Observations, nil
+}
+
+// Distinct retrieves one observation for each combination of the values at
+// paths.
+func (p *Postgres) Distinct(ctx context.Context, q Query, paths []string) ([]Observation, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if len(paths) == 0 {
+		return nil, &ValidationError{Err: "error validating query", Fields: []FieldError{{Field: "paths", Error: "at least one path is required"}}}
+	}
+
+	pl, keys, err := buildDistinct(q, paths)
+	if err != nil {
+		return nil, err
+	}
+
+	var s sqlQuery
+	groups := make([]string, len(keys))
+	for i, key := range keys {
+		groups[i] = s.value(key)
+	}
+
+	// Groups are sorted by the sort order of the query, with the values at
+	// the paths in place of id.
+	var order []sortKey
+	sorted := map[string]bool{}
+	for _, k := range pl.sort {
+		if k.key == "id" {
+			continue
+		}
+		order = append(order, k)
+		sorted[k.key] = true
+	}
+	for _, key := range keys {
+		if !sorted[key] {
+			order = append(order, sortKey{key: key})
+		}
+	}
+
+	group := strings.Join(groups, ", ")
+	query := fmt.Sprintf(`%s FROM (
+		SELECT DISTINCT ON (%s) * FROM observations WHERE %s ORDER BY %s, result_time DESC, id
+	) AS observations ORDER BY %s LIMIT %d OFFSET %d`,
+		selectObservation, group, s.where(pl.filter), group, s.orderBy(order), pageLimit(q.Limit), q.Offset)
+
+	obss, err := p.query(ctx, query, s.args...)
+	return obss, errors.Wrap(err, "fetching distinct observations")
+}
+
+// Count counts the observations, or combinations of values at paths,
+// matching a query.
+func (p *Postgres) Count(ctx context.Context, q Query, paths []string) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	pl, keys, err := buildDistinct(q, paths)
+	if err != nil {
+		return 0, err
+	}
+
+	var s sqlQuery
+	where := s.where(pl.filter)
+	query := "SELECT count(*) FROM observations WHERE " + where
+	if len(keys) > 0 {
+		groups := make([]string, len(keys))
+		for i, key := range keys {
+			groups[i] = s.value(key)
+		}
+		query = fmt.Sprintf("SELECT count(*) FROM (SELECT DISTINCT %s FROM observations WHERE %s) AS groups",
+			strings.Join(groups, ", "), where)
+	}
+
+	var n int64
+	err = p.db.GetContext(ctx, &n, query, s.args...)
+	return n, errors.Wrap(err, "counting observations")
+}
+
+// Latest retrieves the most recent observation of each property of features.
+func (p *Postgres) Latest(ctx context.Context, features []string, asOf time.Time) ([]Observation, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if err := validFeatures(features); err != nil {
+		return nil, err
+	}
+
+	inFeatures := bson.E{Key: "featureid", Value: bson.M{"$in": features}}
+
+	var s sqlQuery
+	var from string
+	if asOf.IsZero() {
+		from = "observations WHERE " + s.where(bson.D{inFeatures, current})
+	} else {
+		// Find the revision of each observation that was current at asOf.
+		from = fmt.Sprintf(`(
+			SELECT DISTINCT ON (id) * FROM observations WHERE %s ORDER BY id, revision DESC
+		) AS observations WHERE %s`,
+			s.where(bson.D{inFeatures, {Key: "modifiedat", Value: bson.M{"$not": bson.M{"$gt": asOf}}}}),
+			s.where(bson.D{{Key: "phenomenontime", Value: bson.M{"$lte": asOf}}}))
+	}
+
+	query := fmt.Sprintf(`%s FROM (
+		SELECT DISTINCT ON (feature_id, property_id, property_type_id) * FROM %s
+		ORDER BY feature_id, property_id, property_type_id, phenomenon_time DESC, result_time DESC, id
+	) AS observations ORDER BY feature_id, property_id, property_type_id`, selectObservation, from)
+
+	obss, err := p.query(ctx, query, s.args...)
+	return obss, errors.Wrap(err, "fetching latest observations")
+}
+
+// Aggregate computes statistics over the observations matching an
+// aggregation.
+func (p *Postgres) Aggregate(ctx context.Context, a Aggregation) ([]Series, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	ap, err := buildAggregation(a)
+	if err != nil {
+		return nil, err
+	}
+
+	if ap.unit != nil {
+		conv, err := p.scales(ctx, plan{filter: ap.filter, unit: ap.unit})
+		if err != nil {
+			return nil, err
+		}
+		ap.conversions = conv.conversions
+	}
+
+	var s sqlQuery
+	value := s.number(ap.key)
+	if ap.unit != nil {
+		value = s.convert(value, ap.conversions)
+	}
+
+	stats := make([]string, len(ap.functions))
+	for i, fn := range ap.functions {
+		if q, ok := ap.percentiles[fn]; ok {
+			stats[i] = fmt.Sprintf("percentile_cont(%s::float8) WITHIN GROUP (ORDER BY value)", s.arg(q))
+			continue
+		}
+		stats[i] = fmt.Sprintf(aggregates[fn], "value")
+	}
+
+	query := fmt.Sprintf(`SELECT feature_id, property_id, bucket, %s FROM (
+		SELECT feature_id, property_id,
+			date_trunc(%s::text, phenomenon_time AT TIME ZONE 'UTC') AT TIME ZONE 'UTC' AS bucket,
+			%s AS value
+		FROM observations WHERE %s
+	) AS observations
+	WHERE value IS NOT NULL
+	GROUP BY feature_id, property_id, bucket
+	ORDER BY feature_id, property_id, bucket`,
+		strings.Join(stats, ", "), s.arg(ap.bucket), value, s.where(ap.filter))
+
+	rows, err := p.db.QueryContext(ctx, query, s.args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "aggregating observations")
+	}
+	defer rows.Close()
+
+	series := []Series{}
+	for rows.Next() {
+		var feature, property string
+		var start time.Time
+		values := make([]sql.NullFloat64, len(ap.functions))
+		dest := []interface{}{&feature, &property, &start}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, errors.Wrap(err, "decoding aggregation")
+		}
+
+		if n := len(series); n == 0 || series[n-1].FeatureID != feature || series[n-1].PropertyID != property {
+			series = append(series, Series{FeatureID: feature, PropertyID: property})
+		}
+
+		bucket := Bucket{Start: start.UTC(), Values: map[string]float64{}}
+		for i, fn := range ap.functions {
+			bucket.Values[fn] = values[i].Float64
+		}
+
+		last := &series[len(series)-1]
+		last.Buckets = append(last.Buckets, bucket)
+	}
+
+	return series, errors.Wrap(rows.Err(), "aggregating observations")
+}
+
+// aggregates map the functions of an aggregation other than percentiles to
+// SQL aggregate functions.
+var aggregates = map[string]string{
+	"count": "count(%s)::float8",
+	"min":   "min(%s)",
+	"max":   "max(%s)",
+	"mean":  "avg(%s)",
+	"sum":   "sum(%s)",
+}
+
+// convert is a SQL expression converting a number from the scale of its
+// observation with the conversions of an aggregation. Numbers without a
+// scale are left as they are, and numbers with a scale that was not checked
+// are skipped.
+func (q *sqlQuery) convert(value string, conversions map[string]units.Conversion) string {
+	scales := make([]string, 0, len(conversions))
+	for scale := range conversions {
+		scales = append(scales, scale)
+	}
+	sort.Strings(scales)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "CASE scale WHEN '' THEN %s", value)
+	for _, scale := range scales {
+		c := conversions[scale]
+		fmt.Fprintf(&b, " WHEN %s::text THEN %s * %s::float8 + %s::float8", q.arg(scale), value, q.arg(c.Scale), q.arg(c.Shift))
+	}
+	b.WriteString(" END")
+	return b.String()
+}
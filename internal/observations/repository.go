@@ -0,0 +1,123 @@
+package observations
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Repository stores observations and answers queries about them. Mongo
+// stores observations in a mongo collection, Postgres stores them in a
+// postgres database, Firestore stores them in a firestore collection, and
+// Memory stores them in the process so observations can be used without a
+// database.
+//
+// Every implementation validates queries in the same way and returns the
+// same errors, except that Firestore also rejects the queries firestore
+// cannot run. The package functions of the same name describe each method.
+type Repository interface {
+	Save(ctx context.Context, obs Observation) error
+	SaveMany(ctx context.Context, obss []Observation) (map[int]error, error)
+	Find(ctx context.Context, id string) (Observation, error)
+	Supersede(ctx context.Context, obs Observation) error
+	History(ctx context.Context, id string) ([]Observation, error)
+
+	Get(ctx context.Context, q Query) (Page, error)
+	Stream(ctx context.Context, q Query, fn func(Observation) error) error
+	Convertible(ctx context.Context, q Query) error
+	Changes(ctx context.Context, q Query, after Token, limit int) ([]Observation, error)
+	Distinct(ctx context.Context, q Query, paths []string) ([]Observation, error)
+	Count(ctx context.Context, q Query, paths []string) (int64, error)
+	Latest(ctx context.Context, features []string, asOf time.Time) ([]Observation, error)
+	Aggregate(ctx context.Context, a Aggregation) ([]Series, error)
+}
+
+// Mongo is a repository of observations in a mongo collection.
+type Mongo struct {
+	collection *mongo.Collection
+}
+
+// NewMongo creates a repository of the observations in a collection.
+func NewMongo(collection *mongo.Collection) *Mongo {
+	return &Mongo{collection: collection}
+}
+
+// Save persists an observation.
+func (m *Mongo) Save(ctx context.Context, obs Observation) error {
+	return Save(ctx, m.collection, obs)
+}
+
+// SaveMany persists a batch of observations.
+func (m *Mongo) SaveMany(ctx context.Context, obss []Observation) (map[int]error, error) {
+	return SaveMany(ctx, m.collection, obss)
+}
+
+// Find retrieves the latest revision of an observation.
+func (m *Mongo) Find(ctx context.Context, id string) (Observation, error) {
+	return Find(ctx, m.collection, id)
+}
+
+// Supersede persists a new revision of an observation.
+func (m *Mongo) Supersede(ctx context.Context, obs Observation) error {
+	return Supersede(ctx, m.collection, obs)
+}
+
+// History retrieves every revision of an observation.
+func (m *Mongo) History(ctx context.Context, id string) ([]Observation, error) {
+	return History(ctx, m.collection, id)
+}
+
+// Get retrieves a page of observations.
+func (m *Mongo) Get(ctx context.Context, q Query) (Page, error) {
+	return Get(ctx, m.collection, q)
+}
+
+// Stream calls fn with each observation matching a query.
+func (m *Mongo) Stream(ctx context.Context, q Query, fn func(Observation) error) error {
+	return Stream(ctx, m.collection, q, fn)
+}
+
+// Convertible checks the observations matching a query can be converted to
+// its unit.
+func (m *Mongo) Convertible(ctx context.Context, q Query) error {
+	return Convertible(ctx, m.collection, q)
+}
+
+// Changes lists the observations matching a query saved after a token.
+func (m *Mongo) Changes(ctx context.Context, q Query, after Token, limit int) ([]Observation, error) {
+	return Changes(ctx, m.collection, q, after, limit)
+}
+
+// Distinct retrieves one observation for each combination of the values at
+// paths.
+func (m *Mongo) Distinct(ctx context.Context, q Query, paths []string) ([]Observation, error) {
+	return Distinct(ctx, m.collection, q, paths)
+}
+
+// Count counts the observations, or combinations of values at paths,
+// matching a query.
+func (m *Mongo) Count(ctx context.Context, q Query, paths []string) (int64, error) {
+	return Count(ctx, m.collection, q, paths)
+}
+
+// Latest retrieves the most recent observation of each property of features.
+func (m *Mongo) Latest(ctx context.Context, features []string, asOf time.Time) ([]Observation, error) {
+	return Latest(ctx, m.collection, features, asOf)
+}
+
+// Aggregate computes statistics over the observations matching an
+// aggregation.
+func (m *Mongo) Aggregate(ctx context.Context, a Aggregation) ([]Series, error) {
+	return Aggregate(ctx, m.collection, a)
+}
+
+// Unpublished lists revisions whose events have not been published.
+func (m *Mongo) Unpublished(ctx context.Context, limit int) ([]Observation, error) {
+	return Unpublished(ctx, m.collection, limit)
+}
+
+// MarkPublished records that the event of a revision has been published.
+func (m *Mongo) MarkPublished(ctx context.Context, obs Observation) error {
+	return MarkPublished(ctx, m.collection, obs)
+}
@@ -0,0 +1,758 @@
+package observations_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/google/uuid"
+	geojson "github.com/paulmach/go.geojson"
+	"github.com/pkg/errors"
+	"github.com/schafer14/obs/internal/observations"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+func TestMemoryFiltersObservations(t *testing.T) {
+
+	// Act and Assert
+	filterObservations(t, observations.NewMemory())
+}
+
+func TestPostgresFiltersObservations(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Act and Assert
+	filterObservations(t, postgresRepository(t))
+}
+
+func filterObservations(t *testing.T, repo observations.Repository) {
+
+	// Arrange
+	ctx := context.Background()
+	uuids := ids(3)
+	obss := mkObss(5)
+	for i := range obss {
+		obss[i].Result = map[string]interface{}{"wisteria": int64(i)}
+	}
+	obss[0].Property.ID = uuids[0]
+	obss[1].Property.ID = uuids[1]
+	obss[2].Property.ID = uuids[1]
+	obss[2].Process.ID = uuids[2]
+	obss[3].Property.ID = uuids[2]
+	obss[4].Tags = map[string]string{"observed by": "Banner"}
+
+	err := saveTo(ctx, repo, obss, time.Now())
+	require.Nil(t, err, "prepping observations")
+
+	where := observations.Expression{And: []observations.Expression{
+		{Or: []observations.Expression{
+			{Filter: &observations.Filter{Path: "propertyId", Op: "=", Matcher: uuids[0]}},
+			{Filter: &observations.Filter{Path: "propertyId", Op: "=", Matcher: uuids[1]}},
+		}},
+		{Not: &observations.Expression{Filter: &observations.Filter{Path: "processId", Op: "=", Matcher: uuids[2]}}},
+	}}
+
+	// Act
+	in, err := repo.Get(ctx, observations.Query{Filters: []observations.Filter{
+		{Path: "propertyId", Op: "in", Matcher: uuids[0] + "," + uuids[1]},
+	}})
+	require.Nil(t, err, "getting observations with in filter")
+	between, err := repo.Get(ctx, observations.Query{Filters: []observations.Filter{
+		{Path: "result.wisteria", Op: "between", Matcher: "1,3"},
+	}})
+	require.Nil(t, err, "getting observations with range filter")
+	tagged, err := repo.Get(ctx, observations.Query{Filters: []observations.Filter{
+		{Path: "tags.observed by", Op: "exists", Matcher: "true"},
+	}})
+	require.Nil(t, err, "getting observations with tag")
+	expression, err := repo.Get(ctx, observations.Query{Where: &where})
+	require.Nil(t, err, "getting observations with expression")
+
+	// Assert
+	assert.Equal(t, 3, len(in.Observations), "observations with in filter mismatch")
+	assert.Equal(t, 3, len(between.Observations), "observations with range filter mismatch")
+	assert.Equal(t, 1, len(tagged.Observations), "observations with tag mismatch")
+	assert.Equal(t, 2, len(expression.Observations), "observations with expression mismatch")
+}
+
+func TestFirestoreFiltersObservations(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Arrange
+	ctx := context.Background()
+	repo := firestoreRepository()
+	uuids := ids(2)
+	obss := mkObss(4)
+	for i := range obss {
+		obss[i].Result = map[string]interface{}{"wisteria": int64(i)}
+	}
+	obss[0].Property.ID = uuids[0]
+	obss[1].Property.ID = uuids[1]
+	obss[2].Property.ID = uuids[1]
+	obss[3].Tags = map[string]string{"observed by": "Banner"}
+
+	err := saveTo(ctx, repo, obss, time.Now())
+	require.Nil(t, err, "prepping observations")
+
+	// Act
+	in, err := repo.Get(ctx, observations.Query{Filters: []observations.Filter{
+		{Path: "propertyId", Op: "in", Matcher: uuids[0] + "," + uuids[1]},
+	}})
+	require.Nil(t, err, "getting observations with in filter")
+	between, err := repo.Get(ctx, observations.Query{
+		Filters: []observations.Filter{{Path: "result.wisteria", Op: "between", Matcher: "1,3"}},
+		Sort:    []string{"-result.wisteria"},
+	})
+	require.Nil(t, err, "getting observations with range filter")
+	tagged, err := repo.Get(ctx, observations.Query{Filters: []observations.Filter{
+		{Path: "tags.observed by", Op: "=", Matcher: "Banner"},
+	}})
+	require.Nil(t, err, "getting observations with tag")
+
+	// Assert
+	assert.Equal(t, 3, len(in.Observations), "observations with in filter mismatch")
+	require.Equal(t, 3, len(between.Observations), "observations with range filter mismatch")
+	assert.Equal(t, int64(3), between.Observations[0].Result["wisteria"], "observations not sorted")
+	assert.Equal(t, 1, len(tagged.Observations), "observations with tag mismatch")
+}
+
+func TestFirestoreRejectsUnsupportedQueries(t *testing.T) {
+
+	// Arrange
+	ctx := context.Background()
+	client, err := firestore.NewClient(ctx, "observations",
+		option.WithEndpoint("localhost:8080"),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithInsecure()),
+	)
+	require.Nil(t, err, "creating client")
+	defer client.Close()
+	repo := observations.NewFirestore(client, "observations")
+
+	queries := map[string]observations.Query{
+		"not equal": {Filters: []observations.Filter{{Path: "propertyId", Op: "!=", Matcher: "urn:example:health"}}},
+		"or": {Where: &observations.Expression{Or: []observations.Expression{
+			{Filter: &observations.Filter{Path: "propertyId", Op: "=", Matcher: "urn:example:health"}},
+			{Filter: &observations.Filter{Path: "processId", Op: "=", Matcher: "urn:example:by-eye"}},
+		}}},
+		"within":   {Filters: []observations.Filter{{Path: "phenomenonLocation", Op: "bbox", Matcher: "150,-35,152,-33"}}},
+		"valid at": {ValidAt: "2020-03-01T18:00:00Z"},
+		"two ranges": {Filters: []observations.Filter{
+			{Path: "result.wisteria", Op: ">", Matcher: "1"},
+			{Path: "revision", Op: "<", Matcher: "3"},
+		}},
+		"range not sorted first": {Filters: []observations.Filter{{Path: "result.wisteria", Op: ">", Matcher: "1"}}},
+		"sort by result":         {Sort: []string{"result.wisteria"}},
+	}
+
+	for name, q := range queries {
+
+		// Act
+		_, err := repo.Get(ctx, q)
+
+		// Assert
+		vError, ok := err.(*observations.ValidationError)
+		require.True(t, ok, "%s query not rejected", name)
+		assert.Equal(t, "query not supported by firestore", vError.Err, "%s query rejected for another reason", name)
+	}
+}
+
+func TestMemoryFindsObservationsInsideABoundary(t *testing.T) {
+
+	// Act and Assert
+	findObservationsInsideABoundary(t, observations.NewMemory())
+}
+
+func TestPostgresFindsObservationsInsideABoundary(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Act and Assert
+	findObservationsInsideABoundary(t, postgresRepository(t))
+}
+
+func findObservationsInsideABoundary(t *testing.T, repo observations.Repository) {
+
+	// Arrange
+	ctx := context.Background()
+	obss := mkObss(3)
+	obss[0].PhenomenonLocation = geojson.NewPointGeometry([]float64{153.02, -27.47})
+	obss[1].PhenomenonLocation = geojson.NewPointGeometry([]float64{153.03, -27.48})
+	obss[2].PhenomenonLocation = geojson.NewPointGeometry([]float64{151.21, -33.87})
+
+	err := saveTo(ctx, repo, obss, time.Now())
+	require.Nil(t, err, "prepping observations")
+
+	// Act
+	within, err := repo.Get(ctx, observations.Query{Filters: []observations.Filter{
+		{Path: "phenomenonLocation", Op: "within", Matcher: `{"type": "Polygon", "coordinates": [[[153, -27], [154, -27], [154, -28], [153, -28], [153, -27]]]}`},
+	}})
+	require.Nil(t, err, "getting observations within boundary")
+	near, err := repo.Get(ctx, observations.Query{Filters: []observations.Filter{
+		{Path: "phenomenonLocation", Op: "near", Matcher: "153.02,-27.47,500"},
+	}})
+	require.Nil(t, err, "getting observations near point")
+	box, err := repo.Get(ctx, observations.Query{Filters: []observations.Filter{
+		{Path: "phenomenonLocation", Op: "bbox", Matcher: "150,-35,152,-33"},
+	}})
+	require.Nil(t, err, "getting observations inside box")
+	line, err := repo.Get(ctx, observations.Query{Filters: []observations.Filter{
+		{Path: "phenomenonLocation", Op: "intersects", Matcher: `{"type": "LineString", "coordinates": [[153.02, -27.47], [153.04, -27.47]]}`},
+	}})
+	require.Nil(t, err, "getting observations intersecting line")
+
+	// Assert
+	assert.Equal(t, 2, len(within.Observations), "observations within boundary mismatch")
+	assert.Equal(t, 1, len(near.Observations), "observations near point mismatch")
+	assert.Equal(t, 1, len(box.Observations), "observations inside box mismatch")
+	assert.Equal(t, 1, len(line.Observations), "observations intersecting line mismatch")
+}
+
+func TestMemoryFindsObservationsValidAtATime(t *testing.T) {
+
+	// Act and Assert
+	findObservationsValidAtATime(t, observations.NewMemory())
+}
+
+func TestPostgresFindsObservationsValidAtATime(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Act and Assert
+	findObservationsValidAtATime(t, postgresRepository(t))
+}
+
+func findObservationsValidAtATime(t *testing.T, repo observations.Repository) {
+
+	// Arrange
+	ctx := context.Background()
+	start := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	obss := mkObss(3)
+	obss[0].ValidInterval = observations.Interval{StartTime: start, Duration: 24 * time.Hour}
+	obss[1].ValidInterval = observations.Interval{StartTime: start.Add(48 * time.Hour), Duration: 24 * time.Hour}
+	obss[2].ValidInterval = observations.Interval{StartTime: start.Add(12 * time.Hour)}
+	for i := range obss {
+		obss[i].PhenomenonTime = start.Add(time.Duration(i) * time.Hour)
+	}
+
+	err := saveTo(ctx, repo, obss, time.Now())
+	require.Nil(t, err, "prepping observations")
+
+	// Act
+	at, err := repo.Get(ctx, observations.Query{ValidAt: "2020-03-01T18:00:00Z"})
+	require.Nil(t, err, "getting observations valid at a time")
+	during, err := repo.Get(ctx, observations.Query{ValidDuring: "2020-03-02T12:00:00Z/2020-03-03T12:00:00Z"})
+	require.Nil(t, err, "getting observations valid during a period")
+	phenomenon, err := repo.Get(ctx, observations.Query{PhenomenonTime: "2020-03-01T01:00:00Z/.."})
+	require.Nil(t, err, "getting observations by phenomenon time")
+
+	// Assert
+	assert.Equal(t, 2, len(at.Observations), "observations valid at a time mismatch")
+	assert.Equal(t, 2, len(during.Observations), "observations valid during a period mismatch")
+	assert.Equal(t, 2, len(phenomenon.Observations), "observations by phenomenon time mismatch")
+}
+
+func TestMemorySortsAndPagesObservations(t *testing.T) {
+
+	// Act and Assert
+	sortAndPageObservations(t, observations.NewMemory())
+}
+
+func TestPostgresSortsAndPagesObservations(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Act and Assert
+	sortAndPageObservations(t, postgresRepository(t))
+}
+
+func sortAndPageObservations(t *testing.T, repo observations.Repository) {
+
+	// Arrange
+	ctx := context.Background()
+	obss := mkObss(5)
+	for i := range obss {
+		obss[i].Result = map[string]interface{}{"wisteria": int64(i % 3)}
+	}
+	delete(obss[4].Result, "wisteria")
+
+	err := saveTo(ctx, repo, obss, time.Now())
+	require.Nil(t, err, "prepping observations")
+
+	// Act
+	q := observations.Query{Sort: []string{"-result.wisteria"}, Limit: 2}
+	var wisteria []interface{}
+	pages := 0
+	for {
+		page, err := repo.Get(ctx, q)
+		require.Nil(t, err, "getting observations")
+		pages++
+		for _, obs := range page.Observations {
+			wisteria = append(wisteria, obs.Result["wisteria"])
+		}
+		if page.Next == "" {
+			break
+		}
+		q.Cursor = page.Next
+	}
+	offset, err := repo.Get(ctx, observations.Query{Sort: []string{"result.wisteria"}, Offset: 1, Limit: 1})
+	require.Nil(t, err, "getting observations with offset")
+	byID, err := repo.Get(ctx, observations.Query{Sort: []string{"-id"}})
+	require.Nil(t, err, "getting observations by id")
+
+	// Assert
+	assert.Equal(t, 3, pages, "page count mismatch")
+	assert.Equal(t, []interface{}{int64(2), int64(1), int64(0), int64(0), nil}, wisteria, "observations not sorted")
+	require.Equal(t, 1, len(offset.Observations), "observations with offset mismatch")
+	assert.Equal(t, int64(0), offset.Observations[0].Result["wisteria"], "offset not skipped")
+	require.Equal(t, 5, len(byID.Observations), "observations by id mismatch")
+	for i := 1; i < len(byID.Observations); i++ {
+		assert.True(t, byID.Observations[i-1].ID > byID.Observations[i].ID, "observations not sorted by descending id")
+	}
+}
+
+func TestMemorySupersedesObservations(t *testing.T) {
+
+	// Act and Assert
+	supersedeObservations(t, observations.NewMemory())
+}
+
+func TestPostgresSupersedesObservations(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Act and Assert
+	supersedeObservations(t, postgresRepository(t))
+}
+
+func TestFirestoreSupersedesObservations(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Act and Assert
+	supersedeObservations(t, firestoreRepository())
+}
+
+func supersedeObservations(t *testing.T, repo observations.Repository) {
+
+	// Arrange
+	ctx := context.Background()
+	now := time.Now()
+	prev, err := observations.New(mkObs(), uuid.New().String(), now)
+	require.Nil(t, err, "creating observation")
+	require.Nil(t, repo.Save(ctx, prev), "saving observation")
+	newObs := prev.AsNew()
+	newObs.Result = map[string]interface{}{"wisteria": int64(1)}
+	next, err := observations.Revise(prev, newObs, "banner@example.com", now)
+	require.Nil(t, err, "revising observation")
+
+	// Act
+	err = repo.Supersede(ctx, next)
+
+	// Assert
+	require.Nil(t, err, "superseding observation")
+	obs, err := repo.Find(ctx, prev.ID)
+	require.Nil(t, err, "fetching observation")
+	assert.Equal(t, 2, obs.Revision, "latest revision not returned")
+
+	history, err := repo.History(ctx, prev.ID)
+	require.Nil(t, err, "fetching history")
+	require.Equal(t, 2, len(history), "history length mismatch")
+	assert.Equal(t, 1, history[0].Revision, "first revision missing")
+
+	page, err := repo.Get(ctx, observations.Query{})
+	require.Nil(t, err, "getting observations")
+	assert.Equal(t, 1, len(page.Observations), "superseded revision listed")
+
+	err = repo.Supersede(ctx, next)
+	assert.Equal(t, observations.ErrorConflict, err, "superseded a stale revision")
+	_, err = repo.Find(ctx, uuid.New().String())
+	assert.Equal(t, observations.ErrorNotFound, err, "found a missing observation")
+}
+
+func TestMemoryConvertsUnits(t *testing.T) {
+
+	// Act and Assert
+	convertUnits(t, observations.NewMemory())
+}
+
+func TestPostgresConvertsUnits(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Act and Assert
+	convertUnits(t, postgresRepository(t))
+}
+
+func TestFirestoreConvertsUnits(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Act and Assert
+	convertUnits(t, firestoreRepository())
+}
+
+func convertUnits(t *testing.T, repo observations.Repository) {
+
+	// Arrange
+	ctx := context.Background()
+	millimetres := mkObs()
+	millimetres.Scale = "mm"
+	millimetres.Result = map[string]interface{}{"wisteria": int64(1500), "heights": []interface{}{250.0}}
+	celsius := mkObs()
+	celsius.Scale = "Cel"
+	err := saveTo(ctx, repo, []observations.NewObservation{millimetres, celsius}, time.Now())
+	require.Nil(t, err, "prepping observations")
+	lengths := []observations.Filter{{Path: "scale", Op: "=", Matcher: "mm"}}
+
+	// Act
+	page, err := repo.Get(ctx, observations.Query{Filters: lengths, Unit: "m"})
+	require.Nil(t, err, "getting observations in metres")
+	series, err := repo.Aggregate(ctx, observations.Aggregation{
+		Query:     observations.Query{Filters: lengths, Unit: "m"},
+		Field:     "result.wisteria",
+		Bucket:    "day",
+		Functions: []string{"max"},
+	})
+	require.Nil(t, err, "aggregating observations in metres")
+	streamErr := repo.Stream(ctx, observations.Query{Unit: "m"}, func(observations.Observation) error {
+		t.Error("observation streamed before scales were checked")
+		return nil
+	})
+
+	// Assert
+	require.Equal(t, 1, len(page.Observations), "observations mismatch")
+	assert.Equal(t, "m", page.Observations[0].Scale, "scale not converted")
+	assert.Equal(t, 1.5, page.Observations[0].Result["wisteria"], "result not converted")
+	assert.Equal(t, primitive.A{0.25}, page.Observations[0].Result["heights"], "nested result not converted")
+	require.Equal(t, 1, len(series), "series mismatch")
+	assert.InDelta(t, 1.5, series[0].Buckets[0].Values["max"], 1e-9, "aggregate not converted")
+	_, ok := streamErr.(*observations.ValidationError)
+	assert.True(t, ok, "incompatible scale not rejected when streaming")
+	_, ok = repo.Convertible(ctx, observations.Query{Unit: "m"}).(*observations.ValidationError)
+	assert.True(t, ok, "incompatible scale not rejected")
+}
+
+func TestMemoryAggregatesObservations(t *testing.T) {
+
+	// Act and Assert
+	aggregateObservations(t, observations.NewMemory())
+}
+
+func TestPostgresAggregatesObservations(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Act and Assert
+	aggregateObservations(t, postgresRepository(t))
+}
+
+func TestFirestoreAggregatesObservations(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Act and Assert
+	aggregateObservations(t, firestoreRepository())
+}
+
+func aggregateObservations(t *testing.T, repo observations.Repository) {
+
+	// Arrange
+	ctx := context.Background()
+	start := time.Date(2020, 3, 2, 9, 0, 0, 0, time.UTC)
+	obss := mkObss(4)
+	for i := range obss {
+		obss[i].PhenomenonTime = start.Add(time.Duration(i) * 12 * time.Hour)
+		obss[i].Result = map[string]interface{}{"wisteria": int64(i + 1)}
+	}
+
+	err := saveTo(ctx, repo, obss, time.Now())
+	require.Nil(t, err, "prepping observations")
+
+	// Act
+	days, err := repo.Aggregate(ctx, observations.Aggregation{
+		Field:     "result.wisteria",
+		Bucket:    "day",
+		Functions: []string{"count", "mean", "max", "p50"},
+	})
+	require.Nil(t, err, "aggregating by day")
+	weeks, err := repo.Aggregate(ctx, observations.Aggregation{
+		Field:     "result.wisteria",
+		Bucket:    "week",
+		Functions: []string{"sum"},
+	})
+	require.Nil(t, err, "aggregating by week")
+
+	// Assert
+	require.Equal(t, 1, len(days), "series mismatch")
+	require.Equal(t, 2, len(days[0].Buckets), "daily buckets mismatch")
+	assert.Equal(t, time.Date(2020, 3, 2, 0, 0, 0, 0, time.UTC), days[0].Buckets[0].Start, "bucket start invalid")
+	assert.Equal(t, map[string]float64{"count": 2, "mean": 1.5, "max": 2, "p50": 1.5}, days[0].Buckets[0].Values, "bucket values invalid")
+	require.Equal(t, 1, len(weeks[0].Buckets), "weekly buckets mismatch")
+	assert.Equal(t, time.Date(2020, 3, 2, 0, 0, 0, 0, time.UTC), weeks[0].Buckets[0].Start, "week does not start on monday")
+	assert.Equal(t, 10.0, weeks[0].Buckets[0].Values["sum"], "weekly sum invalid")
+}
+
+func TestMemoryFindsDistinctAndLatestObservations(t *testing.T) {
+
+	// Act and Assert
+	findDistinctAndLatestObservations(t, observations.NewMemory())
+}
+
+func TestPostgresFindsDistinctAndLatestObservations(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Act and Assert
+	findDistinctAndLatestObservations(t, postgresRepository(t))
+}
+
+func TestFirestoreFindsDistinctAndLatestObservations(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Act and Assert
+	findDistinctAndLatestObservations(t, firestoreRepository())
+}
+
+func findDistinctAndLatestObservations(t *testing.T, repo observations.Repository) {
+
+	// Arrange
+	ctx := context.Background()
+	start := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	obss := mkObss(4)
+	for i := range obss {
+		obss[i].PhenomenonTime = start.Add(time.Duration(i) * 24 * time.Hour)
+		obss[i].Result = map[string]interface{}{"wisteria": int64(i)}
+	}
+	obss[3].Property = observations.Referenceable{ID: "urn:example:yield"}
+
+	err := saveTo(ctx, repo, obss, start)
+	require.Nil(t, err, "prepping observations")
+
+	prev, err := observations.New(mkObs(), uuid.New().String(), start)
+	require.Nil(t, err, "creating observation")
+	prev.PhenomenonTime = start.Add(2*24*time.Hour + time.Hour)
+	require.Nil(t, repo.Save(ctx, prev), "saving observation")
+	newObs := prev.AsNew()
+	newObs.Result = map[string]interface{}{"wisteria": int64(9)}
+	next, err := observations.Revise(prev, newObs, "banner@example.com", start.Add(10*24*time.Hour))
+	require.Nil(t, err, "revising observation")
+	require.Nil(t, repo.Supersede(ctx, next), "superseding observation")
+
+	feature := []string{mkObs().Feature.ID}
+
+	// Act
+	distinct, err := repo.Distinct(ctx, observations.Query{}, []string{"featureId", "propertyId"})
+	require.Nil(t, err, "getting distinct observations")
+	n, err := repo.Count(ctx, observations.Query{}, []string{"propertyId"})
+	require.Nil(t, err, "counting distinct observations")
+	total, err := repo.Count(ctx, observations.Query{}, nil)
+	require.Nil(t, err, "counting observations")
+	latest, err := repo.Latest(ctx, feature, time.Time{})
+	require.Nil(t, err, "getting latest observations")
+	before, err := repo.Latest(ctx, feature, start.Add(5*24*time.Hour))
+	require.Nil(t, err, "getting latest observations before revision")
+	earlier, err := repo.Latest(ctx, feature, start.Add(24*time.Hour))
+	require.Nil(t, err, "getting earlier observations")
+
+	// Assert
+	require.Equal(t, 2, len(distinct), "distinct observations mismatch")
+	assert.Equal(t, "urn:example:health", distinct[0].PropertyID, "distinct observations not ordered")
+	assert.Equal(t, int64(2), n, "distinct count mismatch")
+	assert.Equal(t, int64(5), total, "count mismatch")
+	require.Equal(t, 2, len(latest), "latest observations mismatch")
+	assert.Equal(t, "urn:example:health", latest[0].Property.ID, "properties not ordered")
+	assert.Equal(t, 2, latest[0].Revision, "latest revision not used")
+	require.Equal(t, 2, len(before), "observations before revision mismatch")
+	assert.Equal(t, 1, before[0].Revision, "revision made after asOf used")
+	require.Equal(t, 1, len(earlier), "earlier observations mismatch")
+	assert.Equal(t, int64(1), earlier[0].Result["wisteria"], "earlier observation invalid")
+}
+
+func TestMemoryListsChanges(t *testing.T) {
+
+	// Act and Assert
+	listChanges(t, observations.NewMemory())
+}
+
+func TestPostgresListsChanges(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Act and Assert
+	listChanges(t, postgresRepository(t))
+}
+
+func TestFirestoreListsChanges(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Act and Assert
+	listChanges(t, firestoreRepository())
+}
+
+func listChanges(t *testing.T, repo observations.Repository) {
+
+	// Arrange
+	ctx := context.Background()
+	start := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		require.Nil(t, saveTo(ctx, repo, mkObss(1), start.Add(time.Duration(i)*time.Hour)), "prepping observations")
+	}
+
+	prev, err := observations.New(mkObs(), uuid.New().String(), start.Add(30*time.Minute))
+	require.Nil(t, err, "creating observation")
+	require.Nil(t, repo.Save(ctx, prev), "saving observation")
+	next, err := observations.Revise(prev, prev.AsNew(), "banner@example.com", start.Add(3*time.Hour))
+	require.Nil(t, err, "revising observation")
+	require.Nil(t, repo.Supersede(ctx, next), "superseding observation")
+
+	// Act
+	all, err := repo.Changes(ctx, observations.Query{}, observations.TokenAt(start), 10)
+	require.Nil(t, err, "listing changes")
+	rest, err := repo.Changes(ctx, observations.Query{}, observations.TokenOf(all[1]), 10)
+	require.Nil(t, err, "listing changes after token")
+
+	// Assert
+	require.Equal(t, 4, len(all), "changes mismatch")
+	for i := 1; i < len(all); i++ {
+		assert.False(t, all[i].ModifiedAt.Before(all[i-1].ModifiedAt), "changes not listed in the order they were saved")
+	}
+	assert.Equal(t, next.ID, all[3].ID, "revision not listed")
+	assert.Equal(t, 2, all[3].Revision, "superseded revision listed")
+	assert.Equal(t, all[2:], rest, "changes after token mismatch")
+}
+
+func TestMongoListsUnpublishedObservations(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Arrange
+	require.Nil(t, coll.Drop(context.Background()), "deleting collection")
+
+	// Act and Assert
+	listUnpublished(t, observations.NewMongo(coll))
+}
+
+func TestPostgresListsUnpublishedObservations(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Act and Assert
+	listUnpublished(t, postgresRepository(t))
+}
+
+func TestFirestoreListsUnpublishedObservations(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Act and Assert
+	listUnpublished(t, firestoreRepository())
+}
+
+// publishing is a repository that keeps the events of observations, see
+// events.Source.
+type publishing interface {
+	observations.Repository
+	Unpublished(ctx context.Context, limit int) ([]observations.Observation, error)
+	MarkPublished(ctx context.Context, obs observations.Observation) error
+}
+
+func listUnpublished(t *testing.T, repo publishing) {
+
+	// Arrange
+	ctx := context.Background()
+	start := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	prev, err := observations.New(mkObs(), uuid.New().String(), start)
+	require.Nil(t, err, "creating observation")
+	require.Nil(t, repo.Save(ctx, prev), "saving observation")
+	next, err := observations.Revise(prev, prev.AsNew(), "banner@example.com", start.Add(time.Hour))
+	require.Nil(t, err, "revising observation")
+	require.Nil(t, repo.Supersede(ctx, next), "superseding observation")
+
+	// Act
+	all, err := repo.Unpublished(ctx, 10)
+	require.Nil(t, err, "listing unpublished observations")
+	require.Nil(t, repo.MarkPublished(ctx, prev), "marking observation published")
+	rest, err := repo.Unpublished(ctx, 10)
+	require.Nil(t, err, "listing unpublished observations")
+
+	// Assert
+	require.Equal(t, 2, len(all), "unpublished revisions mismatch")
+	assert.Equal(t, []int{1, 2}, []int{all[0].Revision, all[1].Revision}, "revisions not listed in the order they were saved")
+	require.Equal(t, 1, len(rest), "published revision listed")
+	assert.Equal(t, 2, rest[0].Revision, "unpublished revision mismatch")
+}
+
+// postgresRepository empties the postgres observations table and returns a
+// repository of it.
+func postgresRepository(t *testing.T) *observations.Postgres {
+	_, err := pg.Exec("TRUNCATE observations")
+	require.Nil(t, err, "emptying table")
+
+	return observations.NewPostgres(pg)
+}
+
+// firestoreRepository returns a repository of a new firestore collection.
+func firestoreRepository() *observations.Firestore {
+	return observations.NewFirestore(fs, "observations-"+uuid.New().String())
+}
+
+// saveTo saves a list of new observations to a repository.
+func saveTo(ctx context.Context, repo observations.Repository, newObservations []observations.NewObservation, now time.Time) error {
+	for _, obs := range newObservations {
+		newObs, err := observations.New(obs, uuid.New().String(), now)
+		if err != nil {
+			return errors.Wrap(err, "creating observation")
+		}
+		if err := repo.Save(ctx, newObs); err != nil {
+			return errors.Wrap(err, "saving observation")
+		}
+	}
+
+	return nil
+}
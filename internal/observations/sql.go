@@ -0,0 +1,418 @@
+package observations
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	geojson "github.com/paulmach/go.geojson"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// The functions in this file convert the mongo filters and sort orders that
+// queries are converted to into SQL for the observations table, so that
+// Postgres answers queries in the same way as mongo. Only the operators the
+// queries of this package use are supported, and unknown operators match
+// nothing.
+
+// column is the SQL expression a top level key of an observation is stored
+// in, and the type of its values.
+type column struct {
+	expr string
+	typ  valueType
+}
+
+// columns map the keys of observations to their columns. Text columns sort
+// by byte like mongo does. Labels are stored inside their referenceable and
+// are empty when they are not set.
+var columns = map[string]column{
+	"id":                      {"id", typeString},
+	"featureid":               {"feature_id", typeString},
+	"featuretypeid":           {"feature_type_id", typeString},
+	"propertyid":              {"property_id", typeString},
+	"propertytypeid":          {"property_type_id", typeString},
+	"processid":               {"process_id", typeString},
+	"feature.label":           {`COALESCE(feature->>'label', '') COLLATE "C"`, typeString},
+	"featuretype.label":       {`COALESCE(feature_type->>'label', '') COLLATE "C"`, typeString},
+	"property.label":          {`COALESCE(property->>'label', '') COLLATE "C"`, typeString},
+	"propertytype.label":      {`COALESCE(property_type->>'label', '') COLLATE "C"`, typeString},
+	"process.label":           {`COALESCE(process->>'label', '') COLLATE "C"`, typeString},
+	"scale":                   {"scale", typeString},
+	"phenomenontime":          {"phenomenon_time", typeTime},
+	"resulttime":              {"result_time", typeTime},
+	"validinterval.starttime": {"valid_start", typeTime},
+	"validintervalend":        {"valid_end", typeTime},
+	"revision":                {"revision", typeNumber},
+	"modifiedby":              {"modified_by", typeString},
+	"modifiedat":              {"modified_at", typeTime},
+	"superseded":              {"superseded", typeBool},
+	"phenomenonlocation":      {"phenomenon_location", typeGeometry},
+	"observationlocation":     {"observation_location", typeGeometry},
+}
+
+// casts are the SQL types the values of each type are sent as.
+var casts = map[valueType]string{
+	typeString: "text",
+	typeNumber: "float8",
+	typeBool:   "boolean",
+	typeTime:   "timestamptz",
+}
+
+// sqlQuery collects the arguments of a SQL statement as it is built.
+type sqlQuery struct {
+	args []interface{}
+}
+
+// arg adds an argument to the statement and returns its placeholder.
+func (q *sqlQuery) arg(v interface{}) string {
+	q.args = append(q.args, v)
+	return "$" + strconv.Itoa(len(q.args))
+}
+
+// where converts a mongo filter to a SQL condition.
+func (q *sqlQuery) where(filter interface{}) string {
+	var conds []string
+	for _, e := range elements(filter) {
+		switch e.Key {
+		case "$and":
+			conds = append(conds, q.join(e.Value, " AND ", "TRUE"))
+		case "$or":
+			conds = append(conds, q.join(e.Value, " OR ", "FALSE"))
+		case "$nor":
+			conds = append(conds, "NOT "+q.join(e.Value, " OR ", "FALSE"))
+		default:
+			conds = append(conds, q.field(e.Key, e.Value))
+		}
+	}
+
+	if len(conds) == 0 {
+		return "TRUE"
+	}
+	return "(" + strings.Join(conds, " AND ") + ")"
+}
+
+// join converts a list of mongo filters to SQL conditions joined by an
+// operator, or to empty when the list is empty.
+func (q *sqlQuery) join(filters interface{}, op, empty string) string {
+	var conds []string
+	for _, f := range list(filters) {
+		conds = append(conds, q.where(f))
+	}
+
+	if len(conds) == 0 {
+		return empty
+	}
+	return "(" + strings.Join(conds, op) + ")"
+}
+
+// field converts the condition on a key of a mongo filter, which is either a
+// value the field must equal or a document of operators.
+func (q *sqlQuery) field(key string, cond interface{}) string {
+	ops := elements(cond)
+	if len(ops) == 0 || !strings.HasPrefix(ops[0].Key, "$") {
+		return q.op(key, "$eq", cond)
+	}
+
+	var conds []string
+	for _, op := range ops {
+		conds = append(conds, q.op(key, op.Key, op.Value))
+	}
+	return "(" + strings.Join(conds, " AND ") + ")"
+}
+
+// op converts an operator on a key. Keys inside results and tags are
+// matched with JSON paths and all other keys with their columns.
+func (q *sqlQuery) op(key, op string, arg interface{}) string {
+	switch op {
+	case "$ne":
+		return "NOT " + q.op(key, "$eq", arg)
+	case "$nin":
+		return "NOT " + q.op(key, "$in", arg)
+	case "$not":
+		return "NOT " + q.field(key, arg)
+	}
+
+	if c, ok := columns[key]; ok {
+		return q.columnOp(c, op, arg)
+	}
+
+	parts := strings.Split(key, ".")
+	if len(parts) < 2 || (parts[0] != "result" && parts[0] != "tags") {
+		return "FALSE"
+	}
+	return q.documentOp(parts[0], parts[1:], op, arg)
+}
+
+// columnOp converts an operator on a column. Values are only compared to
+// columns of the same type, and every column exists, as mongo stores each
+// field of an observation even when it is empty.
+func (q *sqlQuery) columnOp(c column, op string, arg interface{}) string {
+	switch op {
+	case "$eq":
+		v := normal(arg)
+		if v == nil {
+			return fmt.Sprintf("(%s IS NULL)", c.expr)
+		}
+		if !ofType(v, c.typ) {
+			return "FALSE"
+		}
+		return fmt.Sprintf("((%s = %s::%s) IS TRUE)", c.expr, q.arg(v), casts[c.typ])
+	case "$gt", "$gte", "$lt", "$lte":
+		v := normal(arg)
+		if !ofType(v, c.typ) {
+			return "FALSE"
+		}
+		return fmt.Sprintf("((%s %s %s::%s) IS TRUE)", c.expr, comparisons[op], q.arg(v), casts[c.typ])
+	case "$in":
+		var conds []string
+		for _, v := range list(arg) {
+			conds = append(conds, q.columnOp(c, "$eq", v))
+		}
+		if len(conds) == 0 {
+			return "FALSE"
+		}
+		return "(" + strings.Join(conds, " OR ") + ")"
+	case "$exists":
+		if exists, _ := arg.(bool); exists {
+			return "TRUE"
+		}
+		return "FALSE"
+	case "$type":
+		if arg == "number" && c.typ == typeNumber {
+			return "TRUE"
+		}
+		return "FALSE"
+	case "$geoWithin", "$geoIntersects":
+		if c.typ != typeGeometry {
+			return "FALSE"
+		}
+		return q.geoOp(c.expr, op, arg)
+	}
+	return "FALSE"
+}
+
+// comparisons map mongo comparison operators to SQL and JSON path operators.
+var comparisons = map[string]string{
+	"$gt":  ">",
+	"$gte": ">=",
+	"$lt":  "<",
+	"$lte": "<=",
+}
+
+// ofType reports whether a normal value can be compared to a column of a type.
+func ofType(v interface{}, typ valueType) bool {
+	switch v.(type) {
+	case string:
+		return typ == typeString
+	case float64:
+		return typ == typeNumber
+	case bool:
+		return typ == typeBool
+	case time.Time:
+		return typ == typeTime
+	}
+	return false
+}
+
+// documentOp converts an operator on a path inside the result or tags
+// column. Paths are matched with lax JSON paths, which reach into the
+// documents in arrays and match the elements of arrays like mongo does.
+func (q *sqlQuery) documentOp(col string, path []string, op string, arg interface{}) string {
+	matches := func(cond string) string {
+		return fmt.Sprintf("(%s @? %s::jsonpath)", col, q.arg(jsonPath(path, cond)))
+	}
+
+	switch op {
+	case "$eq":
+		return q.documentOp(col, path, "$in", bson.A{arg})
+	case "$gt", "$gte", "$lt", "$lte":
+		lit, ok := literal(normal(arg))
+		if !ok || lit == "null" {
+			return "FALSE"
+		}
+		return matches(fmt.Sprintf("@ %s %s", comparisons[op], lit))
+	case "$in":
+		var conds, equal []string
+		for _, v := range list(arg) {
+			lit, ok := literal(normal(v))
+			switch {
+			case !ok:
+			case lit == "null":
+				conds = append(conds, "NOT "+matches(""))
+				equal = append(equal, "@ == null")
+			default:
+				equal = append(equal, "@ == "+lit)
+			}
+		}
+		if len(equal) > 0 {
+			conds = append(conds, matches(strings.Join(equal, " || ")))
+		}
+		if len(conds) == 0 {
+			return "FALSE"
+		}
+		return "(" + strings.Join(conds, " OR ") + ")"
+	case "$exists":
+		if e, _ := arg.(bool); e {
+			return matches("")
+		}
+		return "NOT " + matches("")
+	case "$type":
+		if arg == "number" {
+			return matches(`@.type() == "number"`)
+		}
+	}
+	return "FALSE"
+}
+
+// jsonPath builds a lax JSON path to the keys of a path, with a filter
+// condition when cond is not empty. Keys may only hold letters, numbers,
+// spaces, _ and -, so they do not need escaping.
+func jsonPath(path []string, cond string) string {
+	var b strings.Builder
+	b.WriteString("$")
+	for _, key := range path {
+		b.WriteString(`."` + key + `"`)
+	}
+	if cond != "" {
+		b.WriteString(" ? (" + cond + ")")
+	}
+	return b.String()
+}
+
+// literal formats a normal value as a JSON path literal. It returns false
+// for values that cannot be stored in JSON, which no value in a result or
+// tag is equal to.
+func literal(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case nil:
+		return "null", true
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return "", false
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	case string:
+		var b bytes.Buffer
+		enc := json.NewEncoder(&b)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(v); err != nil {
+			return "", false
+		}
+		return strings.TrimSpace(b.String()), true
+	}
+	return "", false
+}
+
+// geoOp converts a geospatial operator on a location column. Shapes are
+// compared on a plane of longitudes and latitudes like Memory compares them,
+// while distances are measured on a sphere like mongo measures them.
+func (q *sqlQuery) geoOp(col, op string, arg interface{}) string {
+	for _, e := range elements(arg) {
+		switch e.Key {
+		case "$geometry":
+			g, ok := e.Value.(*geojson.Geometry)
+			if !ok {
+				return "FALSE"
+			}
+			data, err := json.Marshal(g)
+			if err != nil {
+				return "FALSE"
+			}
+			shape := fmt.Sprintf("ST_SetSRID(ST_GeomFromGeoJSON(%s::text), 4326)", q.arg(string(data)))
+			if op == "$geoIntersects" {
+				return fmt.Sprintf("(ST_Intersects(%s, %s) IS TRUE)", col, shape)
+			}
+			return fmt.Sprintf("(ST_CoveredBy(%s, %s) IS TRUE)", col, shape)
+		case "$centerSphere":
+			args := list(e.Value)
+			if len(args) != 2 {
+				return "FALSE"
+			}
+			center, _ := normal(args[0]).([]interface{})
+			radius, _ := normal(args[1]).(float64)
+			if len(center) != 2 {
+				return "FALSE"
+			}
+			lng, _ := center[0].(float64)
+			lat, _ := center[1].(float64)
+
+			// Every position of the location must be inside the circle. The
+			// angle to each position is compared to the radius in radians,
+			// as it is in mongo, rather than converted back to a distance on
+			// the sphere PostGIS measures on, whose radius is not earthRadius.
+			lngArg, latArg := q.arg(lng), q.arg(lat)
+			return fmt.Sprintf(`(%s IS NOT NULL AND NOT EXISTS (
+				SELECT 1 FROM ST_DumpPoints(%s) AS p
+				WHERE 2 * asin(least(1, sqrt(
+					power(sin(radians(ST_Y(p.geom) - %s::float8) / 2), 2) +
+					cos(radians(%s::float8)) * cos(radians(ST_Y(p.geom))) * power(sin(radians(ST_X(p.geom) - %s::float8) / 2), 2)
+				))) > %s::float8
+			))`, col, col, latArg, latArg, lngArg, q.arg(radius))
+		}
+	}
+	return "FALSE"
+}
+
+// orderBy converts sort keys to a SQL sort order in the order mongo sorts
+// values in. Missing and null values sort first.
+func (q *sqlQuery) orderBy(keys []sortKey) string {
+	var order []string
+	for _, k := range keys {
+		direction := " ASC NULLS FIRST"
+		if k.desc {
+			direction = " DESC NULLS LAST"
+		}
+		for _, expr := range q.sortExprs(k.key) {
+			order = append(order, expr+direction)
+		}
+	}
+	return strings.Join(order, ", ")
+}
+
+// sortExprs are the SQL expressions values at a key are sorted by. Values in
+// results and tags are sorted by the rank of their type and then by value.
+func (q *sqlQuery) sortExprs(key string) []string {
+	if c, ok := columns[key]; ok {
+		return []string{c.expr}
+	}
+
+	v := q.value(key)
+	return []string{
+		fmt.Sprintf(`CASE jsonb_typeof(%s) WHEN 'number' THEN 2 WHEN 'string' THEN 3 WHEN 'object' THEN 4 WHEN 'array' THEN 5 WHEN 'boolean' THEN 7 ELSE 1 END`, v),
+		fmt.Sprintf(`CASE WHEN jsonb_typeof(%s) = 'number' THEN (%s #>> '{}')::float8 END`, v, v),
+		fmt.Sprintf(`CASE WHEN jsonb_typeof(%s) = 'string' THEN %s #>> '{}' END COLLATE "C"`, v, v),
+		v,
+	}
+}
+
+// value is the SQL expression for the value at a key, which is a jsonb
+// value for keys inside results and tags.
+func (q *sqlQuery) value(key string) string {
+	if c, ok := columns[key]; ok {
+		return c.expr
+	}
+
+	parts := strings.Split(key, ".")
+	return fmt.Sprintf("(%s #> %s::text[])", parts[0], q.arg(pq.Array(parts[1:])))
+}
+
+// number is the SQL expression for the number at a key, which is null when
+// the value at the key is not a number.
+func (q *sqlQuery) number(key string) string {
+	if c, ok := columns[key]; ok {
+		if c.typ != typeNumber {
+			return "NULL::float8"
+		}
+		return c.expr + "::float8"
+	}
+
+	v := q.value(key)
+	return fmt.Sprintf(`CASE WHEN jsonb_typeof(%s) = 'number' THEN (%s #>> '{}')::float8 END`, v, v)
+}
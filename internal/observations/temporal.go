@@ -0,0 +1,153 @@
+package observations
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// period is a span of time given in a query. A zero start or end leaves the
+// period unbounded on that side. Periods include their start and exclude their
+// end.
+type period struct {
+	start, end time.Time
+}
+
+// parsePeriod parses a period in the ISO 8601 interval form start/end, where
+// both times are RFC3339 times. Either side may be empty or .. to leave the
+// period open on that side.
+func parsePeriod(s string) (period, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 {
+		return period{}, fmt.Errorf("%q is not a period in the form start/end", s)
+	}
+
+	var p period
+	times := []*time.Time{&p.start, &p.end}
+	for i, part := range parts {
+		part = strings.TrimSpace(part)
+		if part == "" || part == ".." {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339Nano, part)
+		if err != nil {
+			return period{}, fmt.Errorf("%q is not an RFC3339 time", part)
+		}
+		*times[i] = t
+	}
+
+	if !p.start.IsZero() && !p.end.IsZero() && !p.start.Before(p.end) {
+		return period{}, fmt.Errorf("period %q must start before it ends", s)
+	}
+
+	return p, nil
+}
+
+// intervalEnd is the time an interval stops being valid, or nil when the
+// interval has no duration and is valid indefinitely.
+func intervalEnd(i Interval) *time.Time {
+	if i.Duration == 0 {
+		return nil
+	}
+
+	end := i.StartTime.Add(i.Duration)
+	return &end
+}
+
+// intervalErrors checks the valid interval of a new observation.
+func intervalErrors(newObs NewObservation) []FieldError {
+	if newObs.ValidInterval.Duration < 0 {
+		return []FieldError{{Field: "NewObservation.validInterval.duration", Error: "duration must not be negative"}}
+	}
+
+	return nil
+}
+
+// temporalClauses converts the time periods of a query to mongo filters. The
+// valid interval of an observation includes its start time and excludes its
+// end time, and observations without an end time are valid indefinitely.
+func temporalClauses(q Query) (bson.A, []FieldError) {
+	var clauses bson.A
+	var errs []FieldError
+
+	if q.ValidAt != "" {
+		t, err := time.Parse(time.RFC3339Nano, q.ValidAt)
+		if err != nil {
+			errs = append(errs, FieldError{Field: "validAt", Error: fmt.Sprintf("%q is not an RFC3339 time", q.ValidAt)})
+		} else {
+			clauses = append(clauses, overlaps(period{start: t, end: t.Add(time.Nanosecond)}))
+		}
+	}
+
+	if q.ValidDuring != "" {
+		p, err := parsePeriod(q.ValidDuring)
+		if err != nil {
+			errs = append(errs, FieldError{Field: "validDuring", Error: err.Error()})
+		} else {
+			clauses = append(clauses, overlaps(p))
+		}
+	}
+
+	if q.PhenomenonTime != "" {
+		p, err := parsePeriod(q.PhenomenonTime)
+		if err != nil {
+			errs = append(errs, FieldError{Field: "phenomenonTime", Error: err.Error()})
+		} else {
+			clauses = append(clauses, within("phenomenontime", p))
+		}
+	}
+
+	return clauses, errs
+}
+
+// overlaps matches observations whose valid interval overlaps a period.
+func overlaps(p period) bson.D {
+	d := bson.D{}
+	if !p.end.IsZero() {
+		d = append(d, bson.E{Key: "validinterval.starttime", Value: bson.M{"$lt": p.end}})
+	}
+	if !p.start.IsZero() {
+		d = append(d, bson.E{Key: "$or", Value: bson.A{
+			bson.D{{Key: "validintervalend", Value: nil}},
+			bson.D{{Key: "validintervalend", Value: bson.M{"$gt": p.start}}},
+		}})
+	}
+
+	return d
+}
+
+// within matches observations with a time at key inside a period.
+func within(key string, p period) bson.D {
+	m := bson.M{}
+	if !p.start.IsZero() {
+		m["$gte"] = p.start
+	}
+	if !p.end.IsZero() {
+		m["$lt"] = p.end
+	}
+	if len(m) == 0 {
+		return bson.D{}
+	}
+
+	return bson.D{{Key: key, Value: m}}
+}
+
+// migrateIntervals stores the end time of the valid interval of observations
+// that were saved before end times were stored.
+func migrateIntervals(ctx context.Context, collection *mongo.Collection) error {
+	filter := bson.D{{Key: "validintervalend", Value: bson.M{"$exists": false}}}
+	err := migrate(ctx, collection, filter, func(doc bson.Raw) (bson.D, error) {
+		var obs Observation
+		if err := bson.Unmarshal(doc, &obs); err != nil {
+			return nil, err
+		}
+		return bson.D{{Key: "validintervalend", Value: intervalEnd(obs.ValidInterval)}}, nil
+	})
+
+	return errors.Wrap(err, "migrating intervals")
+}
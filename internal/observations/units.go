@@ -0,0 +1,163 @@
+package observations
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/schafer14/obs/internal/units"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// canonicalScale checks the scale of an observation is a UCUM unit and
+// returns its canonical code. Observations without a scale have no unit.
+func canonicalScale(scale string) (string, []FieldError) {
+	if scale == "" {
+		return "", nil
+	}
+
+	u, err := units.Parse(scale)
+	if err != nil {
+		return "", []FieldError{{Field: "scale", Error: err.Error()}}
+	}
+
+	return u.String(), nil
+}
+
+// converter converts the numeric results of observations to a unit. The
+// conversion from each scale is worked out once.
+type converter struct {
+	to          units.Unit
+	conversions map[string]units.Conversion
+}
+
+// newConverter creates a converter to a unit.
+func newConverter(to units.Unit) *converter {
+	return &converter{to: to, conversions: map[string]units.Conversion{}}
+}
+
+// conversion finds the conversion from a scale to the unit of the converter.
+// A *ValidationError is returned when the scale cannot be converted.
+func (c *converter) conversion(scale string) (units.Conversion, error) {
+	if conv, ok := c.conversions[scale]; ok {
+		return conv, nil
+	}
+
+	from, err := units.Parse(scale)
+	if err != nil {
+		return units.Conversion{}, unitError(fmt.Sprintf("scale %q is not a UCUM unit and cannot be converted to %s", scale, c.to))
+	}
+	conv, err := units.Converter(from, c.to)
+	if err != nil {
+		return units.Conversion{}, unitError(fmt.Sprintf("scale %s cannot be converted to %s", from, c.to))
+	}
+
+	c.conversions[scale] = conv
+	return conv, nil
+}
+
+// unitError is a validation error of the unit of a query.
+func unitError(msg string) error {
+	return &ValidationError{Err: "error converting observations", Fields: []FieldError{{Field: "unit", Error: msg}}}
+}
+
+// convert converts the numbers in the result of an observation to the unit
+// of the converter. Observations without a scale are not converted, as the
+// unit of their results is not known.
+func (c *converter) convert(obs Observation) (Observation, error) {
+	if obs.Scale == "" {
+		return obs, nil
+	}
+
+	conv, err := c.conversion(obs.Scale)
+	if err != nil {
+		return obs, err
+	}
+
+	obs.Result = convertValue(obs.Result, conv).(bson.M)
+	obs.Scale = c.to.String()
+	return obs, nil
+}
+
+// convertValue converts the numbers in a result value. Attachment references
+// are not measurements, so the numbers in them are not converted.
+func convertValue(v interface{}, conv units.Conversion) interface{} {
+	switch v := v.(type) {
+	case int:
+		return conv.Apply(float64(v))
+	case int32:
+		return conv.Apply(float64(v))
+	case int64:
+		return conv.Apply(float64(v))
+	case float64:
+		return conv.Apply(v)
+	case bson.M:
+		if _, ok := v["attachment"]; ok {
+			return v
+		}
+		converted := bson.M{}
+		for k, value := range v {
+			converted[k] = convertValue(value, conv)
+		}
+		return converted
+	case map[string]interface{}:
+		return map[string]interface{}(convertValue(bson.M(v), conv).(bson.M))
+	case primitive.D:
+		return convertValue(v.Map(), conv)
+	case primitive.A:
+		converted := primitive.A{}
+		for _, value := range v {
+			converted = append(converted, convertValue(value, conv))
+		}
+		return converted
+	case []interface{}:
+		return []interface{}(convertValue(primitive.A(v), conv).(primitive.A))
+	}
+	return v
+}
+
+// scales checks that the scale of every observation matching a plan can be
+// converted to the unit of the plan, and returns a converter with the
+// conversion from each scale.
+func scales(ctx context.Context, collection *mongo.Collection, p plan) (*converter, error) {
+	values, err := collection.Distinct(ctx, "scale", p.filter)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching scales")
+	}
+
+	return checkScales(*p.unit, values)
+}
+
+// checkScales checks that each of the distinct scales of some observations
+// can be converted to a unit, and returns a converter with the conversion
+// from each scale.
+func checkScales(to units.Unit, values []interface{}) (*converter, error) {
+	c := newConverter(to)
+	for _, v := range values {
+		scale, ok := v.(string)
+		if !ok || scale == "" {
+			continue
+		}
+		if _, err := c.conversion(scale); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// Convertible checks that the numeric results of every observation matching
+// a query can be converted to the unit of the query. A *ValidationError is
+// returned if the query is invalid or an observation has an incompatible
+// scale. Queries without a unit are always convertible.
+func Convertible(ctx context.Context, collection *mongo.Collection, q Query) error {
+	p, err := buildQuery(q)
+	if err != nil || p.unit == nil {
+		return err
+	}
+
+	_, err = scales(ctx, collection, p)
+	return err
+}
@@ -0,0 +1,473 @@
+package omxml
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/schafer14/obs/internal/observations"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Options control how documents are decoded. FeatureType and PropertyType
+// are the ids of the feature and property type of observations that do not
+// have featureType and propertyType parameters. Limit is the most
+// observations a document may have, or unlimited when it is zero.
+type Options struct {
+	FeatureType  string
+	PropertyType string
+	Limit        int
+}
+
+// Item is an observation read from a document. Errors describe each element
+// of the observation that could not be read, and are named by the path to
+// the element such as OM_Observation[0]/om:result.
+type Item struct {
+	Observation observations.NewObservation
+	Errors      []observations.FieldError
+}
+
+// Decode reads every om:OM_Observation element in a document. Observations
+// may be the root of the document or be nested in other elements, such as
+// the observationData of a sos:GetObservationResponse. An error is only
+// returned when the document cannot be read, errors in observations are
+// reported in their items.
+func Decode(r io.Reader, opts Options) ([]Item, error) {
+	d := xml.NewDecoder(r)
+
+	var items []Item
+	for {
+		token, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "reading document")
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Space != OM || start.Name.Local != "OM_Observation" {
+			continue
+		}
+
+		if opts.Limit > 0 && len(items) == opts.Limit {
+			return nil, ErrTooManyObservations
+		}
+
+		var e element
+		if err := d.DecodeElement(&e, &start); err != nil {
+			return nil, errors.Wrap(err, "reading document")
+		}
+		items = append(items, decodeObservation(e, fmt.Sprintf("OM_Observation[%d]", len(items)), opts))
+	}
+
+	if len(items) == 0 {
+		return nil, ErrNoObservations
+	}
+
+	return items, nil
+}
+
+// observationReader collects the fields of an observation and the errors in
+// its elements.
+type observationReader struct {
+	obs      observations.NewObservation
+	errs     []observations.FieldError
+	instants map[string]time.Time
+}
+
+// fail records an error in the element at path.
+func (o *observationReader) fail(path, format string, args ...interface{}) {
+	o.errs = append(o.errs, observations.FieldError{Field: path, Error: fmt.Sprintf(format, args...)})
+}
+
+// decodeObservation reads an om:OM_Observation element.
+func decodeObservation(e element, path string, opts Options) Item {
+	o := &observationReader{instants: map[string]time.Time{}}
+
+	// The result time is read last so it may refer to the phenomenon time
+	// wherever it is in the observation.
+	var resultTime *element
+	seen := map[string]bool{}
+	for i := range e.Children {
+		child := e.Children[i]
+		childPath := path + "/" + qname(child.XMLName)
+
+		if child.XMLName.Space == OM && child.XMLName.Local != "parameter" {
+			if seen[child.XMLName.Local] {
+				o.fail(childPath, "%s may only be given once", qname(child.XMLName))
+				continue
+			}
+			seen[child.XMLName.Local] = true
+		}
+
+		switch {
+		case child.is(GML, "description"), child.is(GML, "identifier"), child.is(GML, "name"), child.is(OM, "type"):
+			// Descriptive elements are not stored.
+		case child.is(OM, "phenomenonTime"):
+			if t, ok := o.instant(child, childPath); ok {
+				o.obs.PhenomenonTime = t
+			}
+		case child.is(OM, "resultTime"):
+			resultTime = &e.Children[i]
+		case child.is(OM, "validTime"):
+			o.validTime(child, childPath)
+		case child.is(OM, "procedure"):
+			o.obs.Process = o.reference(child, childPath)
+		case child.is(OM, "observedProperty"):
+			o.obs.Property = o.reference(child, childPath)
+		case child.is(OM, "featureOfInterest"):
+			o.obs.Feature = o.reference(child, childPath)
+		case child.is(OM, "parameter"):
+			o.parameter(child, childPath)
+		case child.is(OM, "result"):
+			o.result(child, childPath)
+		default:
+			o.fail(childPath, "element %s is not supported", qname(child.XMLName))
+		}
+	}
+
+	if resultTime != nil {
+		childPath := path + "/om:resultTime"
+		if t, ok := o.instant(*resultTime, childPath); ok {
+			o.obs.ResultTime = t
+		}
+	}
+
+	for _, name := range []string{"phenomenonTime", "procedure", "observedProperty", "featureOfInterest", "result"} {
+		if !seen[name] {
+			o.fail(path+"/om:"+name, "om:%s is required", name)
+		}
+	}
+
+	if o.obs.FeatureType.ID == "" {
+		o.obs.FeatureType.ID = opts.FeatureType
+	}
+	if o.obs.FeatureType.ID == "" {
+		o.fail(path+"/om:parameter", "a %s parameter is required", FeatureTypeParameter)
+	}
+	if o.obs.PropertyType.ID == "" {
+		o.obs.PropertyType.ID = opts.PropertyType
+	}
+	if o.obs.PropertyType.ID == "" {
+		o.fail(path+"/om:parameter", "a %s parameter is required", PropertyTypeParameter)
+	}
+
+	return Item{Observation: o.obs, Errors: o.errs}
+}
+
+// instant reads a time property that is a gml:TimeInstant or a reference to
+// one by its gml:id.
+func (o *observationReader) instant(e element, path string) (time.Time, bool) {
+	if href := e.attr(XLink, "href"); href != "" {
+		t, ok := o.instants[strings.TrimPrefix(href, "#")]
+		if !ok || !strings.HasPrefix(href, "#") {
+			o.fail(path, "%q does not refer to a gml:TimeInstant in the observation", href)
+		}
+		return t, ok
+	}
+
+	if len(e.Children) != 1 {
+		o.fail(path, "a single gml:TimeInstant is required")
+		return time.Time{}, false
+	}
+
+	instant := e.Children[0]
+	instantPath := path + "/" + qname(instant.XMLName)
+	if instant.is(GML, "TimePeriod") {
+		o.fail(instantPath, "gml:TimePeriod is not supported, phenomenon and result times must be instants")
+		return time.Time{}, false
+	}
+	if !instant.is(GML, "TimeInstant") {
+		o.fail(instantPath, "element %s is not supported", qname(instant.XMLName))
+		return time.Time{}, false
+	}
+
+	var position *element
+	for i, child := range instant.Children {
+		if !child.is(GML, "timePosition") {
+			o.fail(instantPath+"/"+qname(child.XMLName), "element %s is not supported", qname(child.XMLName))
+			continue
+		}
+		position = &instant.Children[i]
+	}
+	if position == nil {
+		o.fail(instantPath, "gml:timePosition is required")
+		return time.Time{}, false
+	}
+
+	t, ok := o.position(*position, instantPath+"/gml:timePosition")
+	if ok {
+		if id := instant.attr(GML, "id"); id != "" {
+			o.instants[id] = t
+		}
+	}
+	return t, ok
+}
+
+// position reads a gml:timePosition, gml:beginPosition or gml:endPosition.
+func (o *observationReader) position(e element, path string) (time.Time, bool) {
+	if p := e.attr("", "indeterminatePosition"); p != "" {
+		o.fail(path, "indeterminate position %q is not supported", p)
+		return time.Time{}, false
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, e.text())
+	if err != nil {
+		o.fail(path, "%q is not an RFC3339 time", e.text())
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// validTime reads an om:validTime, which is a gml:TimePeriod.
+func (o *observationReader) validTime(e element, path string) {
+	if len(e.Children) != 1 || !e.Children[0].is(GML, "TimePeriod") {
+		o.fail(path, "a single gml:TimePeriod is required")
+		return
+	}
+
+	period := e.Children[0]
+	periodPath := path + "/gml:TimePeriod"
+	var start, end time.Time
+	var hasStart, hasEnd, open bool
+	for _, child := range period.Children {
+		childPath := periodPath + "/" + qname(child.XMLName)
+		switch {
+		case child.is(GML, "beginPosition"):
+			start, hasStart = o.position(child, childPath)
+		case child.is(GML, "endPosition") && child.attr("", "indeterminatePosition") == "unknown":
+			// Observations valid indefinitely have no end.
+			open, hasEnd = true, true
+		case child.is(GML, "endPosition"):
+			end, hasEnd = o.position(child, childPath)
+		default:
+			o.fail(childPath, "element %s is not supported", qname(child.XMLName))
+		}
+	}
+
+	if !hasStart || !hasEnd {
+		o.fail(periodPath, "gml:beginPosition and gml:endPosition are required")
+		return
+	}
+	if open {
+		o.obs.ValidInterval = observations.Interval{StartTime: start}
+		return
+	}
+	if !start.Before(end) {
+		o.fail(periodPath, "the period must begin before it ends")
+		return
+	}
+
+	o.obs.ValidInterval = observations.Interval{StartTime: start, Duration: end.Sub(start)}
+}
+
+// reference reads the procedure, observed property or feature of interest of
+// an observation, which must be given by xlink:href.
+func (o *observationReader) reference(e element, path string) observations.Referenceable {
+	if len(e.Children) > 0 {
+		o.fail(path+"/"+qname(e.Children[0].XMLName), "inline %s is not supported, %s must be given by xlink:href", qname(e.Children[0].XMLName), qname(e.XMLName))
+		return observations.Referenceable{}
+	}
+
+	href := e.attr(XLink, "href")
+	if href == "" {
+		o.fail(path, "xlink:href is required")
+	}
+
+	return observations.Referenceable{ID: href, Label: e.attr(XLink, "title")}
+}
+
+// parameter reads an om:parameter, which is an om:NamedValue.
+func (o *observationReader) parameter(e element, path string) {
+	if len(e.Children) != 1 || !e.Children[0].is(OM, "NamedValue") {
+		o.fail(path, "a single om:NamedValue is required")
+		return
+	}
+
+	var name, value, title string
+	var hasName, hasValue bool
+	namedValue := e.Children[0]
+	for _, child := range namedValue.Children {
+		childPath := path + "/om:NamedValue/" + qname(child.XMLName)
+		switch {
+		case child.is(OM, "name"):
+			name, hasName = child.attr(XLink, "href"), true
+			if name == "" {
+				name = child.text()
+			}
+		case child.is(OM, "value"):
+			if len(child.Children) > 0 {
+				o.fail(childPath, "parameter values must be text or given by xlink:href")
+				continue
+			}
+			value, title, hasValue = child.attr(XLink, "href"), child.attr(XLink, "title"), true
+			if value == "" {
+				value = child.text()
+			}
+		default:
+			o.fail(childPath, "element %s is not supported", qname(child.XMLName))
+		}
+	}
+
+	if !hasName || !hasValue || name == "" {
+		o.fail(path+"/om:NamedValue", "om:name and om:value are required")
+		return
+	}
+
+	switch name {
+	case FeatureTypeParameter:
+		o.obs.FeatureType = observations.Referenceable{ID: value, Label: title}
+	case PropertyTypeParameter:
+		o.obs.PropertyType = observations.Referenceable{ID: value, Label: title}
+	default:
+		if o.obs.Tags == nil {
+			o.obs.Tags = map[string]string{}
+		}
+		o.obs.Tags[name] = value
+	}
+}
+
+// result reads an om:result by its xsi:type.
+func (o *observationReader) result(e element, path string) {
+	switch typ := e.xsiType(); typ {
+	case "MeasureType":
+		v, err := strconv.ParseFloat(e.text(), 64)
+		if err != nil {
+			o.fail(path, "%q is not a number", e.text())
+			return
+		}
+		o.obs.Result = bson.M{"value": v}
+		o.obs.Scale = e.attr("", "uom")
+
+	case "double", "float", "decimal":
+		v, err := strconv.ParseFloat(e.text(), 64)
+		if err != nil {
+			o.fail(path, "%q is not a number", e.text())
+			return
+		}
+		o.obs.Result = bson.M{"value": v}
+
+	case "integer", "int", "long", "Count", "CountType":
+		v, err := strconv.ParseInt(e.text(), 10, 64)
+		if err != nil {
+			o.fail(path, "%q is not an integer", e.text())
+			return
+		}
+		o.obs.Result = bson.M{"value": v}
+
+	case "boolean":
+		v, err := strconv.ParseBool(e.text())
+		if err != nil {
+			o.fail(path, "%q is not a boolean", e.text())
+			return
+		}
+		o.obs.Result = bson.M{"value": v}
+
+	case "dateTime":
+		v, err := time.Parse(time.RFC3339Nano, e.text())
+		if err != nil {
+			o.fail(path, "%q is not an RFC3339 time", e.text())
+			return
+		}
+		o.obs.Result = bson.M{"value": v}
+
+	case "string", "":
+		if len(e.Children) > 0 {
+			if typ == "" && len(e.Children) == 1 && e.Children[0].is(SWE, "DataRecord") {
+				o.obs.Result = o.record(e.Children[0], path+"/swe:DataRecord")
+				return
+			}
+			o.fail(path, "results without an xsi:type must be text or a swe:DataRecord")
+			return
+		}
+		o.obs.Result = bson.M{"value": e.text()}
+
+	case "ReferenceType":
+		href := e.attr(XLink, "href")
+		if href == "" {
+			o.fail(path, "xlink:href is required")
+			return
+		}
+		o.obs.Result = bson.M{"value": href}
+
+	case "DataRecordPropertyType":
+		if len(e.Children) != 1 || !e.Children[0].is(SWE, "DataRecord") {
+			o.fail(path, "a single swe:DataRecord is required")
+			return
+		}
+		o.obs.Result = o.record(e.Children[0], path+"/swe:DataRecord")
+
+	default:
+		o.fail(path, "result type %s is not supported", e.attr(XSI, "type"))
+	}
+}
+
+// record reads a swe:DataRecord to a result with a field for each field of
+// the record.
+func (o *observationReader) record(e element, path string) bson.M {
+	result := bson.M{}
+	for i, field := range e.Children {
+		fieldPath := fmt.Sprintf("%s/swe:field[%d]", path, i)
+		if !field.is(SWE, "field") {
+			o.fail(fieldPath, "element %s is not supported", qname(field.XMLName))
+			continue
+		}
+
+		name := field.attr("", "name")
+		if name == "" || len(field.Children) != 1 {
+			o.fail(fieldPath, "fields must have a name and a single component")
+			continue
+		}
+
+		component := field.Children[0]
+		componentPath := fieldPath + "/" + qname(component.XMLName)
+		if component.is(SWE, "DataRecord") {
+			result[name] = o.record(component, componentPath)
+			continue
+		}
+
+		var value *element
+		for j, child := range component.Children {
+			switch {
+			case child.is(SWE, "value"):
+				value = &component.Children[j]
+			case child.is(SWE, "uom") && o.obs.Scale == "":
+				// Observations have a single scale, which is the unit of
+				// the first quantity that has one.
+				o.obs.Scale = child.attr("", "code")
+			}
+		}
+		if value == nil {
+			o.fail(componentPath, "swe:value is required")
+			continue
+		}
+
+		var err error
+		switch {
+		case component.is(SWE, "Quantity"):
+			result[name], err = strconv.ParseFloat(value.text(), 64)
+		case component.is(SWE, "Count"):
+			result[name], err = strconv.ParseInt(value.text(), 10, 64)
+		case component.is(SWE, "Boolean"):
+			result[name], err = strconv.ParseBool(value.text())
+		case component.is(SWE, "Text"), component.is(SWE, "Category"):
+			result[name] = value.text()
+		case component.is(SWE, "Time"):
+			result[name], err = time.Parse(time.RFC3339Nano, value.text())
+		default:
+			o.fail(componentPath, "element %s is not supported", qname(component.XMLName))
+			continue
+		}
+		if err != nil {
+			o.fail(componentPath+"/swe:value", "%q is not a valid %s", value.text(), qname(component.XMLName))
+			delete(result, name)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,352 @@
+package omxml
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/schafer14/obs/internal/observations"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// unknownCodeSpace is the code space of gml:identifier elements, which are
+// the ids of observations.
+const unknownCodeSpace = "http://www.opengis.net/def/nil/OGC/0/unknown"
+
+// Marshal writes an observation as an om:OM_Observation document.
+func Marshal(obs observations.Observation) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+
+	root := observation(obs, "o1")
+	root.Attrs = append(namespaces(), root.Attrs...)
+	if err := root.write(enc); err != nil {
+		return nil, errors.Wrap(err, "encoding observation")
+	}
+	if err := enc.Flush(); err != nil {
+		return nil, errors.Wrap(err, "encoding observation")
+	}
+	buf.WriteString("\n")
+
+	return buf.Bytes(), nil
+}
+
+// Encoder writes observations as the observationData of a
+// sos:GetObservationResponse, one at a time. Close must be called after the
+// last observation to complete the document.
+type Encoder struct {
+	w            io.Writer
+	enc          *xml.Encoder
+	observations int
+	started      bool
+}
+
+// NewEncoder creates an encoder that writes a sos:GetObservationResponse.
+func NewEncoder(w io.Writer) *Encoder {
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return &Encoder{w: w, enc: enc}
+}
+
+// response is the start of the document written by an encoder.
+var response = xml.StartElement{Name: xml.Name{Local: "sos:GetObservationResponse"}, Attr: namespaces()}
+
+// start writes the start of the document.
+func (e *Encoder) start() error {
+	if e.started {
+		return nil
+	}
+	e.started = true
+
+	if _, err := io.WriteString(e.w, xml.Header); err != nil {
+		return errors.Wrap(err, "writing response")
+	}
+	return errors.Wrap(e.enc.EncodeToken(response), "writing response")
+}
+
+// Encode writes an observation.
+func (e *Encoder) Encode(obs observations.Observation) error {
+	if err := e.start(); err != nil {
+		return err
+	}
+
+	e.observations++
+	data := element{
+		XMLName:  xml.Name{Local: "sos:observationData"},
+		Children: []element{observation(obs, fmt.Sprintf("o%d", e.observations))},
+	}
+	if err := data.write(e.enc); err != nil {
+		return errors.Wrap(err, "writing observation")
+	}
+
+	return errors.Wrap(e.enc.Flush(), "writing observation")
+}
+
+// Close ends the sos:GetObservationResponse.
+func (e *Encoder) Close() error {
+	if err := e.start(); err != nil {
+		return err
+	}
+
+	if err := e.enc.EncodeToken(response.End()); err != nil {
+		return errors.Wrap(err, "writing response")
+	}
+	if err := e.enc.Flush(); err != nil {
+		return errors.Wrap(err, "writing response")
+	}
+
+	_, err := io.WriteString(e.w, "\n")
+	return errors.Wrap(err, "writing response")
+}
+
+// namespaces declares the prefixes of every namespace in written documents.
+func namespaces() []xml.Attr {
+	spaces := make([]string, 0, len(prefixes))
+	for space := range prefixes {
+		spaces = append(spaces, space)
+	}
+	sort.Slice(spaces, func(i, j int) bool { return prefixes[spaces[i]] < prefixes[spaces[j]] })
+
+	attrs := make([]xml.Attr, len(spaces))
+	for i, space := range spaces {
+		attrs[i] = xml.Attr{Name: xml.Name{Local: "xmlns:" + prefixes[space]}, Value: space}
+	}
+	return attrs
+}
+
+// write encodes an element built for writing, whose names include their
+// prefixes.
+func (e element) write(enc *xml.Encoder) error {
+	start := xml.StartElement{Name: e.XMLName, Attr: e.Attrs}
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+	if e.Text != "" {
+		if err := enc.EncodeToken(xml.CharData(e.Text)); err != nil {
+			return err
+		}
+	}
+	for _, child := range e.Children {
+		if err := child.write(enc); err != nil {
+			return err
+		}
+	}
+	return enc.EncodeToken(start.End())
+}
+
+// node creates an element to write.
+func node(name string, attrs ...string) element {
+	e := element{XMLName: xml.Name{Local: name}}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		e.Attrs = append(e.Attrs, xml.Attr{Name: xml.Name{Local: attrs[i]}, Value: attrs[i+1]})
+	}
+	return e
+}
+
+// withText sets the text of an element.
+func (e element) withText(text string) element {
+	e.Text = text
+	return e
+}
+
+// with adds children to an element.
+func (e element) with(children ...element) element {
+	e.Children = append(e.Children, children...)
+	return e
+}
+
+// observation builds the om:OM_Observation of an observation. The gml:ids
+// of the observation and its times start with id, which must be unique in
+// the document.
+func observation(obs observations.Observation, id string) element {
+	result, typ := resultElement(obs)
+
+	o := node("om:OM_Observation", "gml:id", id).with(
+		node("gml:identifier", "codeSpace", unknownCodeSpace).withText(obs.ID),
+		node("om:type", "xlink:href", observationType+typ),
+		node("om:phenomenonTime").with(timeInstant(id+"-phenomenon-time", obs.PhenomenonTime)),
+	)
+
+	if obs.ResultTime.Equal(obs.PhenomenonTime) {
+		o = o.with(node("om:resultTime", "xlink:href", "#"+id+"-phenomenon-time"))
+	} else {
+		o = o.with(node("om:resultTime").with(timeInstant(id+"-result-time", obs.ResultTime)))
+	}
+
+	end := node("gml:endPosition", "indeterminatePosition", "unknown")
+	if obs.ValidInterval.Duration > 0 {
+		end = node("gml:endPosition").withText(timePosition(obs.ValidInterval.StartTime.Add(obs.ValidInterval.Duration)))
+	}
+	o = o.with(node("om:validTime").with(
+		node("gml:TimePeriod", "gml:id", id+"-valid-time").with(
+			node("gml:beginPosition").withText(timePosition(obs.ValidInterval.StartTime)),
+			end,
+		),
+	))
+
+	o = o.with(
+		reference("om:procedure", obs.Process),
+		parameter(FeatureTypeParameter, obs.FeatureType),
+		parameter(PropertyTypeParameter, obs.PropertyType),
+	)
+
+	tags := make([]string, 0, len(obs.Tags))
+	for tag := range obs.Tags {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	for _, tag := range tags {
+		o = o.with(node("om:parameter").with(node("om:NamedValue").with(
+			node("om:name", "xlink:href", tag),
+			node("om:value", "xsi:type", "xs:string").withText(obs.Tags[tag]),
+		)))
+	}
+
+	return o.with(
+		reference("om:observedProperty", obs.Property),
+		reference("om:featureOfInterest", obs.Feature),
+		result,
+	)
+}
+
+// timeInstant builds a gml:TimeInstant.
+func timeInstant(id string, t time.Time) element {
+	return node("gml:TimeInstant", "gml:id", id).with(node("gml:timePosition").withText(timePosition(t)))
+}
+
+// timePosition formats the time of a gml:timePosition.
+func timePosition(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// reference builds an element that refers to a feature, property or process.
+func reference(name string, r observations.Referenceable) element {
+	e := node(name, "xlink:href", r.ID)
+	if r.Label != "" {
+		e.Attrs = append(e.Attrs, xml.Attr{Name: xml.Name{Local: "xlink:title"}, Value: r.Label})
+	}
+	return e
+}
+
+// parameter builds an om:parameter that refers to a feature or property type.
+func parameter(name string, r observations.Referenceable) element {
+	return node("om:parameter").with(node("om:NamedValue").with(
+		node("om:name", "xlink:href", name),
+		reference("om:value", r),
+	))
+}
+
+// resultElement builds the om:result of an observation and finds the type of
+// the observation. Results with only a value field are written as a single
+// value, and other results as a swe:DataRecord.
+func resultElement(obs observations.Observation) (element, string) {
+	if v, ok := obs.Result["value"]; ok && len(obs.Result) == 1 {
+		if obs.Scale != "" {
+			if n, ok := number(v); ok {
+				return node("om:result", "xsi:type", "gml:MeasureType", "uom", obs.Scale).withText(n), "OM_Measurement"
+			}
+		}
+
+		switch v := v.(type) {
+		case bool:
+			return node("om:result", "xsi:type", "xs:boolean").withText(strconv.FormatBool(v)), "OM_TruthObservation"
+		case string:
+			return node("om:result", "xsi:type", "xs:string").withText(v), "OM_TextObservation"
+		case int, int32, int64:
+			n, _ := number(v)
+			return node("om:result", "xsi:type", "xs:integer").withText(n), "OM_CountObservation"
+		case float64:
+			n, _ := number(v)
+			return node("om:result", "xsi:type", "xs:double").withText(n), "OM_Observation"
+		case time.Time, primitive.DateTime:
+			return node("om:result", "xsi:type", "xs:dateTime").withText(timePosition(toTime(v))), "OM_TemporalObservation"
+		}
+	}
+
+	return node("om:result").with(record(obs.Result, obs.Scale)), "OM_ComplexObservation"
+}
+
+// record builds a swe:DataRecord with a field for each field of a document.
+// Quantities have the scale of the observation as their unit.
+func record(doc map[string]interface{}, scale string) element {
+	keys := make([]string, 0, len(doc))
+	for key := range doc {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	r := node("swe:DataRecord")
+	for _, key := range keys {
+		r = r.with(node("swe:field", "name", key).with(component(doc[key], scale)))
+	}
+	return r
+}
+
+// component builds the swe component of a field of a result.
+func component(v interface{}, scale string) element {
+	switch v := v.(type) {
+	case bool:
+		return node("swe:Boolean").with(node("swe:value").withText(strconv.FormatBool(v)))
+	case string:
+		return node("swe:Text").with(node("swe:value").withText(v))
+	case int, int32, int64:
+		n, _ := number(v)
+		return node("swe:Count").with(node("swe:value").withText(n))
+	case float64:
+		n, _ := number(v)
+		q := node("swe:Quantity")
+		if scale != "" {
+			q = q.with(node("swe:uom", "code", scale))
+		}
+		return q.with(node("swe:value").withText(n))
+	case time.Time, primitive.DateTime:
+		return node("swe:Time").with(node("swe:value").withText(timePosition(toTime(v))))
+	case bson.M:
+		return record(v, scale)
+	case map[string]interface{}:
+		return record(v, scale)
+	case primitive.D:
+		return record(v.Map(), scale)
+	}
+
+	// Arrays and other values are not SWE components, so they are written
+	// as JSON text.
+	data, err := json.Marshal(v)
+	if err != nil {
+		data = []byte(fmt.Sprint(v))
+	}
+	return node("swe:Text").with(node("swe:value").withText(string(data)))
+}
+
+// number formats a numeric value of a result.
+func number(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case int:
+		return strconv.Itoa(v), true
+	case int32:
+		return strconv.FormatInt(int64(v), 10), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), true
+	}
+	return "", false
+}
+
+// toTime converts the times that may be in results.
+func toTime(v interface{}) time.Time {
+	if dt, ok := v.(primitive.DateTime); ok {
+		return time.Unix(0, int64(dt)*int64(time.Millisecond))
+	}
+	return v.(time.Time)
+}
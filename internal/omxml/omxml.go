@@ -0,0 +1,121 @@
+// Package omxml reads and writes observations as OGC Observations and
+// Measurements XML (OMXML 2.0).
+//
+// An om:OM_Observation maps onto an observation as follows.
+//
+//	om:phenomenonTime    a gml:TimeInstant, the phenomenon time
+//	om:resultTime        a gml:TimeInstant or a reference to the phenomenon time
+//	om:validTime         a gml:TimePeriod, the valid interval
+//	om:procedure         the process
+//	om:observedProperty  the property
+//	om:featureOfInterest the feature
+//	om:parameter         tags, or the feature and property type when named
+//	                     featureType or propertyType
+//	om:result            the result, see below
+//
+// Features, properties and processes are given by xlink:href, which is their
+// id, and xlink:title, which is their label. Measures, numbers, booleans,
+// strings and references are results with a value field, and the unit of a
+// measure is the scale. swe:DataRecord results have a field for each field of
+// the record.
+package omxml
+
+import (
+	"encoding/xml"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Namespaces of the elements and attributes of OMXML documents.
+const (
+	OM    = "http://www.opengis.net/om/2.0"
+	GML   = "http://www.opengis.net/gml/3.2"
+	SWE   = "http://www.opengis.net/swe/2.0"
+	SOS   = "http://www.opengis.net/sos/2.0"
+	XLink = "http://www.w3.org/1999/xlink"
+	XSI   = "http://www.w3.org/2001/XMLSchema-instance"
+	XS    = "http://www.w3.org/2001/XMLSchema"
+)
+
+// MediaType is the media type of OMXML documents.
+const MediaType = "application/xml"
+
+// Parameter names that give the feature type and property type of an
+// observation rather than a tag.
+const (
+	FeatureTypeParameter  = "featureType"
+	PropertyTypeParameter = "propertyType"
+)
+
+// observationType is the namespace of OM observation types.
+const observationType = "http://www.opengis.net/def/observationType/OGC-OM/2.0/"
+
+var (
+	// ErrNoObservations is returned when a document has no om:OM_Observation
+	// elements.
+	ErrNoObservations = errors.New("document has no om:OM_Observation elements")
+
+	// ErrTooManyObservations is returned when a document has more
+	// observations than the limit.
+	ErrTooManyObservations = errors.New("document has too many observations")
+)
+
+// element is an XML element with its attributes, children and text.
+type element struct {
+	XMLName  xml.Name
+	Attrs    []xml.Attr `xml:",any,attr"`
+	Children []element  `xml:",any"`
+	Text     string     `xml:",chardata"`
+}
+
+// attr finds the value of an attribute.
+func (e element) attr(space, local string) string {
+	for _, a := range e.Attrs {
+		if a.Name.Space == space && a.Name.Local == local {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// is reports whether an element has a name.
+func (e element) is(space, local string) bool {
+	return e.XMLName.Space == space && e.XMLName.Local == local
+}
+
+// text is the text of an element without surrounding space.
+func (e element) text() string {
+	return strings.TrimSpace(e.Text)
+}
+
+// xsiType is the local name of the xsi:type of an element. Types are QNames
+// whose prefixes are declared in the document, so only the local name is
+// compared.
+func (e element) xsiType() string {
+	t := e.attr(XSI, "type")
+	if i := strings.LastIndex(t, ":"); i > -1 {
+		t = t[i+1:]
+	}
+	return t
+}
+
+// prefixes are the prefixes used for namespaces in element paths and written
+// documents.
+var prefixes = map[string]string{
+	OM:    "om",
+	GML:   "gml",
+	SWE:   "swe",
+	SOS:   "sos",
+	XLink: "xlink",
+	XSI:   "xsi",
+	XS:    "xs",
+}
+
+// qname is the prefixed name of an element used in errors.
+func qname(n xml.Name) string {
+	if prefix, ok := prefixes[n.Space]; ok {
+		return prefix + ":" + n.Local
+	}
+	return n.Local
+}
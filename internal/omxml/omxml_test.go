@@ -0,0 +1,185 @@
+package omxml_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/schafer14/obs/internal/observations"
+	"github.com/schafer14/obs/internal/omxml"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const measurement = `<?xml version="1.0" encoding="UTF-8"?>
+<om:OM_Observation gml:id="obs1"
+    xmlns:om="http://www.opengis.net/om/2.0"
+    xmlns:gml="http://www.opengis.net/gml/3.2"
+    xmlns:xlink="http://www.w3.org/1999/xlink"
+    xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">
+  <gml:description>Water level at the weir</gml:description>
+  <om:type xlink:href="http://www.opengis.net/def/observationType/OGC-OM/2.0/OM_Measurement"/>
+  <om:phenomenonTime>
+    <gml:TimeInstant gml:id="t1">
+      <gml:timePosition>2020-03-02T10:00:00Z</gml:timePosition>
+    </gml:TimeInstant>
+  </om:phenomenonTime>
+  <om:resultTime xlink:href="#t1"/>
+  <om:procedure xlink:href="urn:example:gauge:7"/>
+  <om:parameter>
+    <om:NamedValue>
+      <om:name xlink:href="featureType"/>
+      <om:value xlink:href="urn:example:weir"/>
+    </om:NamedValue>
+  </om:parameter>
+  <om:parameter>
+    <om:NamedValue>
+      <om:name xlink:href="agency"/>
+      <om:value>Riverside Council</om:value>
+    </om:NamedValue>
+  </om:parameter>
+  <om:observedProperty xlink:href="urn:example:water-level" xlink:title="Water level"/>
+  <om:featureOfInterest xlink:href="https://example.com/weirs/12" xlink:title="Weir 12"/>
+  <om:result xsi:type="gml:MeasureType" uom="m">1.42</om:result>
+</om:OM_Observation>`
+
+func TestDecodingMeasurements(t *testing.T) {
+
+	// Arrange
+	opts := omxml.Options{PropertyType: "urn:example:metres"}
+
+	// Act
+	items, err := omxml.Decode(strings.NewReader(measurement), opts)
+
+	// Assert
+	require.Nil(t, err, "decoding document")
+	require.Len(t, items, 1, "observation count mismatch")
+	assert.Empty(t, items[0].Errors, "unexpected errors")
+	obs := items[0].Observation
+	phenomenonTime := time.Date(2020, 3, 2, 10, 0, 0, 0, time.UTC)
+	assert.True(t, phenomenonTime.Equal(obs.PhenomenonTime), "phenomenon time mismatch")
+	assert.True(t, phenomenonTime.Equal(obs.ResultTime), "result time reference not followed")
+	assert.Equal(t, observations.Referenceable{ID: "https://example.com/weirs/12", Label: "Weir 12"}, obs.Feature, "feature mismatch")
+	assert.Equal(t, "urn:example:weir", obs.FeatureType.ID, "feature type parameter not used")
+	assert.Equal(t, "urn:example:metres", obs.PropertyType.ID, "default property type not used")
+	assert.Equal(t, map[string]string{"agency": "Riverside Council"}, obs.Tags, "tags mismatch")
+	assert.Equal(t, bson.M{"value": 1.42}, obs.Result, "result mismatch")
+	assert.Equal(t, "m", obs.Scale, "unit of measure not used as scale")
+}
+
+func TestUnsupportedElementsAreReported(t *testing.T) {
+
+	// Arrange
+	doc := strings.Replace(measurement, `<om:result xsi:type="gml:MeasureType" uom="m">1.42</om:result>`, `
+  <om:resultQuality/>
+  <om:result xsi:type="gml:GeometryPropertyType"/>`, 1)
+	doc = strings.Replace(doc, `<om:resultTime xlink:href="#t1"/>`, `<om:resultTime xlink:href="#t2"/>`, 1)
+
+	// Act
+	items, err := omxml.Decode(strings.NewReader(doc), omxml.Options{})
+
+	// Assert
+	require.Nil(t, err, "decoding document")
+	errs := map[string]string{}
+	for _, e := range items[0].Errors {
+		errs[e.Field] = e.Error
+	}
+	assert.Equal(t, "element om:resultQuality is not supported", errs["OM_Observation[0]/om:resultQuality"], "unsupported element not reported")
+	assert.Equal(t, "result type gml:GeometryPropertyType is not supported", errs["OM_Observation[0]/om:result"], "unsupported result not reported")
+	assert.Contains(t, errs["OM_Observation[0]/om:resultTime"], `"#t2"`, "missing time reference not reported")
+	assert.Equal(t, "a propertyType parameter is required", errs["OM_Observation[0]/om:parameter"], "missing property type not reported")
+}
+
+func TestDocumentsMustHaveObservations(t *testing.T) {
+
+	// Arrange
+	doc := `<sos:GetObservationResponse xmlns:sos="http://www.opengis.net/sos/2.0"/>`
+
+	// Act
+	_, err := omxml.Decode(strings.NewReader(doc), omxml.Options{})
+
+	// Assert
+	assert.Equal(t, omxml.ErrNoObservations, err, "empty document accepted")
+}
+
+func TestDocumentsAreLimited(t *testing.T) {
+
+	// Arrange
+	var buf bytes.Buffer
+	enc := omxml.NewEncoder(&buf)
+	for i := 0; i < 3; i++ {
+		require.Nil(t, enc.Encode(mkObs(t)), "encoding observation")
+	}
+	require.Nil(t, enc.Close(), "closing encoder")
+
+	// Act
+	_, err := omxml.Decode(&buf, omxml.Options{Limit: 2})
+
+	// Assert
+	assert.Equal(t, omxml.ErrTooManyObservations, err, "limit not enforced")
+}
+
+func TestRoundTrip(t *testing.T) {
+	tt := []struct {
+		name   string
+		result bson.M
+		scale  string
+	}{
+		{"measure", bson.M{"value": 1.42}, "m"},
+		{"count", bson.M{"value": int64(4)}, ""},
+		{"truth", bson.M{"value": true}, ""},
+		{"text", bson.M{"value": "dry"}, ""},
+		{"complex", bson.M{"depth": 1.5, "clear": false, "visitor": bson.M{"species": "heron", "count": int64(2)}}, "m"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+
+			// Arrange
+			obs := mkObs(t)
+			obs.Result = tc.result
+			obs.Scale = tc.scale
+
+			// Act
+			data, err := omxml.Marshal(obs)
+			require.Nil(t, err, "marshalling observation")
+			items, err := omxml.Decode(bytes.NewReader(data), omxml.Options{})
+
+			// Assert
+			require.Nil(t, err, "decoding observation")
+			require.Len(t, items, 1, "observation count mismatch")
+			require.Empty(t, items[0].Errors, "errors decoding %s", data)
+			got := items[0].Observation
+			assert.Equal(t, obs.Result, got.Result, "result mismatch")
+			assert.Equal(t, obs.Scale, got.Scale, "scale mismatch")
+			assert.Equal(t, obs.Feature, got.Feature, "feature mismatch")
+			assert.Equal(t, obs.PropertyType, got.PropertyType, "property type mismatch")
+			assert.Equal(t, obs.Tags, got.Tags, "tags mismatch")
+			assert.True(t, obs.PhenomenonTime.Equal(got.PhenomenonTime), "phenomenon time mismatch")
+			assert.True(t, obs.ResultTime.Equal(got.ResultTime), "result time mismatch")
+			assert.True(t, obs.ValidInterval.StartTime.Equal(got.ValidInterval.StartTime), "valid interval mismatch")
+			assert.Equal(t, obs.ValidInterval.Duration, got.ValidInterval.Duration, "valid interval mismatch")
+		})
+	}
+}
+
+func mkObs(t *testing.T) observations.Observation {
+	now := time.Date(2020, 3, 2, 10, 0, 0, 0, time.UTC)
+	obs, err := observations.New(observations.NewObservation{
+		PhenomenonTime: now.Add(-time.Hour),
+		ResultTime:     now,
+		ValidInterval:  observations.Interval{StartTime: now, Duration: 24 * time.Hour},
+		Feature:        observations.Referenceable{ID: "https://example.com/weirs/12", Label: "Weir 12"},
+		FeatureType:    observations.Referenceable{ID: "urn:example:weir"},
+		Property:       observations.Referenceable{ID: "urn:example:water-level", Label: "Water level"},
+		PropertyType:   observations.Referenceable{ID: "urn:example:metres", Label: "Metres"},
+		Process:        observations.Referenceable{ID: "urn:example:gauge:7"},
+		Tags:           map[string]string{"agency": "Riverside Council"},
+		Result:         bson.M{"value": 1.42},
+		Scale:          "m",
+	}, "7c1e2d2e-91b5-4b43-9f0a-5d2b7c9a3b11", now)
+	require.Nil(t, err, "creating observation")
+	return obs
+}
@@ -0,0 +1,85 @@
+package people
+
+import (
+	"context"
+	"net/url"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Firestore is a repository of people in a firestore collection.
+type Firestore struct {
+	collection *firestore.CollectionRef
+}
+
+// NewFirestore creates a repository of the people in a collection.
+func NewFirestore(client *firestore.Client, collection string) *Firestore {
+	return &Firestore{collection: client.Collection(collection)}
+}
+
+// document is a person as stored in firestore. SavedAt is set by firestore
+// so people can be listed in the order they were saved.
+type document struct {
+	ID      string    `firestore:"id"`
+	Name    string    `firestore:"name"`
+	Email   string    `firestore:"email"`
+	SavedAt time.Time `firestore:"savedat,serverTimestamp"`
+}
+
+// Save persists a person.
+func (f *Firestore) Save(ctx context.Context, person Person) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	doc := document{ID: person.ID, Name: person.Name, Email: person.Email}
+	_, err := f.collection.Doc(url.PathEscape(person.ID)).Create(ctx, doc)
+
+	return errors.Wrap(err, "saving person")
+}
+
+// Find retrieves a person by id.
+func (f *Firestore) Find(ctx context.Context, id string) (Person, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	snap, err := f.collection.Doc(url.PathEscape(id)).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return Person{}, ErrorNotFound
+	}
+	if err != nil {
+		return Person{}, errors.Wrap(err, "finding person")
+	}
+
+	var doc document
+	if err := snap.DataTo(&doc); err != nil {
+		return Person{}, errors.Wrap(err, "decoding person")
+	}
+
+	return Person{ID: doc.ID, Name: doc.Name, Email: doc.Email}, nil
+}
+
+// Get retrieves every person in the order they were saved.
+func (f *Firestore) Get(ctx context.Context) ([]Person, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	snaps, err := f.collection.OrderBy("savedat", firestore.Asc).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching people")
+	}
+
+	people := []Person{}
+	for _, snap := range snaps {
+		var doc document
+		if err := snap.DataTo(&doc); err != nil {
+			return nil, errors.Wrap(err, "decoding people")
+		}
+		people = append(people, Person{ID: doc.ID, Name: doc.Name, Email: doc.Email})
+	}
+
+	return people, nil
+}
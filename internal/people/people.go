@@ -13,6 +13,9 @@ import (
 // validate holds the settings and caches for validating request struct values.
 var validate = validator.New()
 
+// ErrorNotFound is returned when a person does not exist.
+var ErrorNotFound = errors.New("person not found")
+
 // New initializes a new person so it is ready to persist.
 func New(newPerson NewPerson, id string) (Person, error) {
 
@@ -50,6 +53,9 @@ func Find(ctx context.Context, collection *mongo.Collection, id string) (Person,
 	var person Person
 	err := collection.FindOne(ctx, bson.D{{"id", id}}).Decode(&person)
 	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return person, ErrorNotFound
+		}
 		return person, errors.Wrap(err, "finding person")
 	}
 
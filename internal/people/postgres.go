@@ -0,0 +1,75 @@
+package people
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/schafer14/obs/internal/platform/postgres"
+)
+
+// postgresMigrations create and update the tables people are stored in.
+var postgresMigrations = []postgres.Migration{
+	{Version: 1, SQL: `
+		CREATE TABLE people (
+			pk    bigserial PRIMARY KEY,
+			id    text NOT NULL UNIQUE,
+			name  text NOT NULL,
+			email text NOT NULL
+		)`},
+}
+
+// MigratePostgres creates or updates the tables people are stored in.
+func MigratePostgres(ctx context.Context, db *sqlx.DB) error {
+	return postgres.Migrate(ctx, db, "people", postgresMigrations)
+}
+
+// Postgres is a repository of people in a postgres database.
+type Postgres struct {
+	db *sqlx.DB
+}
+
+// NewPostgres creates a repository of the people in a postgres database.
+func NewPostgres(db *sqlx.DB) *Postgres {
+	return &Postgres{db: db}
+}
+
+// Save persists a person.
+func (p *Postgres) Save(ctx context.Context, person Person) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := p.db.ExecContext(ctx, `INSERT INTO people (id, name, email) VALUES ($1, $2, $3)`, person.ID, person.Name, person.Email)
+
+	return errors.Wrap(err, "saving person")
+}
+
+// Find retrieves a person by id.
+func (p *Postgres) Find(ctx context.Context, id string) (Person, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var person Person
+	err := p.db.GetContext(ctx, &person, `SELECT id, name, email FROM people WHERE id = $1`, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return person, ErrorNotFound
+		}
+		return person, errors.Wrap(err, "finding person")
+	}
+
+	return person, nil
+}
+
+// Get retrieves every person in the order they were saved.
+func (p *Postgres) Get(ctx context.Context) ([]Person, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	people := []Person{}
+	err := p.db.SelectContext(ctx, &people, `SELECT id, name, email FROM people ORDER BY pk`)
+
+	return people, errors.Wrap(err, "fetching people")
+}
@@ -0,0 +1,86 @@
+package people
+
+import (
+	"context"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Repository stores people. Mongo stores people in a mongo collection,
+// Postgres stores them in a postgres database, Firestore stores them in a
+// firestore collection, and Memory stores them in the process so people can
+// be used without a database.
+type Repository interface {
+	Save(ctx context.Context, person Person) error
+	Find(ctx context.Context, id string) (Person, error)
+	Get(ctx context.Context) ([]Person, error)
+}
+
+// Mongo is a repository of people in a mongo collection.
+type Mongo struct {
+	collection *mongo.Collection
+}
+
+// NewMongo creates a repository of the people in a collection.
+func NewMongo(collection *mongo.Collection) *Mongo {
+	return &Mongo{collection: collection}
+}
+
+// Save persists a person.
+func (m *Mongo) Save(ctx context.Context, person Person) error {
+	return Save(ctx, m.collection, person)
+}
+
+// Find retrieves a person by id.
+func (m *Mongo) Find(ctx context.Context, id string) (Person, error) {
+	return Find(ctx, m.collection, id)
+}
+
+// Get retrieves every person.
+func (m *Mongo) Get(ctx context.Context) ([]Person, error) {
+	return Get(ctx, m.collection)
+}
+
+// Memory is a repository of people held in the process. People are lost
+// when the process stops.
+type Memory struct {
+	mu     sync.RWMutex
+	people []Person
+}
+
+// NewMemory creates an empty repository of people.
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+// Save persists a person.
+func (m *Memory) Save(ctx context.Context, person Person) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.people = append(m.people, person)
+	return nil
+}
+
+// Find retrieves a person by id.
+func (m *Memory) Find(ctx context.Context, id string) (Person, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, person := range m.people {
+		if person.ID == id {
+			return person, nil
+		}
+	}
+
+	return Person{}, ErrorNotFound
+}
+
+// Get retrieves every person in the order they were saved.
+func (m *Memory) Get(ctx context.Context) ([]Person, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return append([]Person(nil), m.people...), nil
+}
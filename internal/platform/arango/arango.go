@@ -0,0 +1,61 @@
+package arango
+
+import (
+	"context"
+	"time"
+
+	driver "github.com/arangodb/go-driver"
+	"github.com/arangodb/go-driver/http"
+	"github.com/pkg/errors"
+)
+
+// Open connects to a database on an arango server, creating the database
+// when it does not exist. The server is not authenticated with when username
+// is empty.
+func Open(ctx context.Context, url, database, username, password string) (driver.Database, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	conn, err := http.NewConnection(http.ConnectionConfig{Endpoints: []string{url}})
+	if err != nil {
+		return nil, errors.Wrap(err, "connecting to arango")
+	}
+
+	config := driver.ClientConfig{Connection: conn}
+	if username != "" {
+		config.Authentication = driver.BasicAuthentication(username, password)
+	}
+	client, err := driver.NewClient(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "connecting to arango")
+	}
+
+	exists, err := client.DatabaseExists(ctx, database)
+	if err != nil {
+		return nil, errors.Wrap(err, "connecting to arango")
+	}
+	// Another instance may create the database first, which is a conflict.
+	if !exists {
+		db, err := client.CreateDatabase(ctx, database, nil)
+		if err == nil {
+			return db, nil
+		}
+		if !driver.IsConflict(err) {
+			return nil, errors.Wrap(err, "creating arango database")
+		}
+	}
+
+	db, err := client.Database(ctx, database)
+
+	return db, errors.Wrap(err, "opening arango database")
+}
+
+// Check makes sure the arango database is responding.
+func Check(ctx context.Context, db driver.Database) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	_, err := db.Info(ctx)
+
+	return errors.Wrap(err, "pinging arango")
+}
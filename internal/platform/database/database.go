@@ -2,22 +2,205 @@ package database
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"strconv"
 	"time"
 
 	"github.com/pkg/errors"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
 )
 
-// Open opens a connection to a mongo database
-func Open(ctx context.Context, connectionString string, database string) (*mongo.Database, error) {
-	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+// Config is how to connect to a mongo database. Options left empty are taken
+// from the URI, or else the defaults of the driver.
+type Config struct {
+	URI  string
+	Name string
+
+	// TLSCAFile is a PEM file of the certificate authorities trusted to
+	// sign the certificate of the server, and TLSCertFile is a PEM file of
+	// the certificate of the client and its private key. Either turns on TLS.
+	TLSCAFile   string
+	TLSCertFile string
+
+	// AuthSource is the database the credentials in the URI are checked
+	// against.
+	AuthSource string
+
+	ReplicaSet string
+
+	// ReadPreference is one of primary, primaryPreferred, secondary,
+	// secondaryPreferred or nearest.
+	ReadPreference string
+
+	// WriteConcern is majority or the number of members that acknowledge
+	// writes.
+	WriteConcern string
+
+	MaxPoolSize uint64
+	MinPoolSize uint64
+
+	// The database is pinged up to ConnectAttempts times before Open gives
+	// up, waiting ConnectBackoff after the first failure and twice as long
+	// after each failure after that.
+	ConnectAttempts int
+	ConnectBackoff  time.Duration
+}
+
+// Open opens a connection to a mongo database, and waits until the database
+// responds. The client of the database must be closed when it is no longer
+// used, see Close.
+func Open(ctx context.Context, cfg Config) (*mongo.Database, error) {
+	opts, err := clientOptions(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "configuring database")
+	}
+
+	client, err := mongo.NewClient(opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "configuring database")
+	}
+
+	connectCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
+	if err := client.Connect(connectCtx); err != nil {
+		return nil, errors.Wrap(err, "connecting to database")
+	}
+
+	attempts, backoff := cfg.ConnectAttempts, cfg.ConnectBackoff
+	if attempts < 1 {
+		attempts = 1
+	}
+	for attempt := 1; ; attempt++ {
+		if err = ping(ctx, client); err == nil {
+			return client.Database(cfg.Name), nil
+		}
+		if attempt >= attempts || ctx.Err() != nil {
+			break
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+		}
+		backoff *= 2
+	}
+
+	Close(ctx, client)
+	return nil, errors.Wrap(err, "connecting to database")
+}
+
+// clientOptions returns the options of the driver for a configuration.
+func clientOptions(cfg Config) (*options.ClientOptions, error) {
+	opts := options.Client().ApplyURI(cfg.URI).SetRegistry(Registry)
+	if err := opts.Validate(); err != nil {
+		return nil, errors.Wrap(err, "parsing uri")
+	}
+
+	if cfg.TLSCAFile != "" || cfg.TLSCertFile != "" {
+		config, err := tlsConfig(cfg.TLSCAFile, cfg.TLSCertFile)
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(config)
+	}
+
+	if cfg.AuthSource != "" {
+		if opts.Auth == nil {
+			return nil, errors.New("an auth source needs credentials in the uri")
+		}
+		opts.Auth.AuthSource = cfg.AuthSource
+	}
+
+	if cfg.ReplicaSet != "" {
+		opts.SetReplicaSet(cfg.ReplicaSet)
+	}
+
+	if cfg.ReadPreference != "" {
+		mode, err := readpref.ModeFromString(cfg.ReadPreference)
+		if err != nil {
+			return nil, errors.Errorf("unknown read preference %q", cfg.ReadPreference)
+		}
+		pref, err := readpref.New(mode)
+		if err != nil {
+			return nil, errors.Wrap(err, "configuring read preference")
+		}
+		opts.SetReadPreference(pref)
+	}
 
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://localhost:27017"))
+	if cfg.WriteConcern != "" {
+		wc, err := writeConcern(cfg.WriteConcern)
+		if err != nil {
+			return nil, err
+		}
+		opts.SetWriteConcern(wc)
+	}
 
-	return client.Database(database), errors.Wrap(err, "connecting to database")
+	if cfg.MaxPoolSize > 0 {
+		opts.SetMaxPoolSize(cfg.MaxPoolSize)
+	}
+	if cfg.MinPoolSize > 0 {
+		opts.SetMinPoolSize(cfg.MinPoolSize)
+	}
+
+	return opts, nil
+}
+
+// tlsConfig reads the certificate authorities and client certificate of a
+// TLS connection from PEM files. Either file may be empty.
+func tlsConfig(caFile, certFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading tls ca file")
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates in tls ca file %s", caFile)
+		}
+	}
+
+	if certFile != "" {
+		pem, err := ioutil.ReadFile(certFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading tls cert file")
+		}
+		cert, err := tls.X509KeyPair(pem, pem)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing tls cert file")
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// writeConcern parses a write concern of majority or a number of members.
+func writeConcern(s string) (*writeconcern.WriteConcern, error) {
+	if s == "majority" {
+		return writeconcern.New(writeconcern.WMajority()), nil
+	}
+
+	w, err := strconv.Atoi(s)
+	if err != nil || w < 0 {
+		return nil, errors.Errorf("write concern %q must be majority or a number of members", s)
+	}
+
+	return writeconcern.New(writeconcern.W(w)), nil
+}
+
+// ping checks the database responds to the read preference of the client.
+func ping(ctx context.Context, client *mongo.Client) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	return client.Ping(ctx, nil)
 }
 
 // Check makes sure the db connection is responding.
@@ -29,3 +212,14 @@ func Check(ctx context.Context, client *mongo.Client) error {
 
 	return errors.Wrap(err, "pinging database")
 }
+
+// Close disconnects a client from the database, waiting for operations in
+// progress to finish.
+func Close(ctx context.Context, client *mongo.Client) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	err := client.Disconnect(ctx)
+
+	return errors.Wrap(err, "disconnecting from database")
+}
@@ -0,0 +1,64 @@
+package database_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/schafer14/obs/internal/platform/database"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInvalidConnectionsAreRejected(t *testing.T) {
+
+	// Arrange
+	dir, err := ioutil.TempDir("", "database")
+	require.Nil(t, err, "creating directory")
+	defer os.RemoveAll(dir)
+	notPEM := filepath.Join(dir, "ca.pem")
+	require.Nil(t, ioutil.WriteFile(notPEM, []byte("wisteria"), 0600), "writing ca file")
+
+	configs := map[string]database.Config{
+		"uri":             {URI: "postgres://localhost:5432"},
+		"read preference": {URI: "mongodb://localhost:27017", ReadPreference: "furthest"},
+		"write concern":   {URI: "mongodb://localhost:27017", WriteConcern: "most"},
+		"auth source":     {URI: "mongodb://localhost:27017", AuthSource: "admin"},
+		"missing ca file": {URI: "mongodb://localhost:27017", TLSCAFile: filepath.Join(dir, "missing.pem")},
+		"ca file":         {URI: "mongodb://localhost:27017", TLSCAFile: notPEM},
+		"cert file":       {URI: "mongodb://localhost:27017", TLSCertFile: notPEM},
+	}
+
+	for name, cfg := range configs {
+
+		// Act
+		_, err := database.Open(context.Background(), cfg)
+
+		// Assert
+		assert.Error(t, err, "%s accepted", name)
+	}
+}
+
+func TestOpeningGivesUpWhenTheDatabaseIsUnavailable(t *testing.T) {
+
+	// Arrange
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	cfg := database.Config{
+		URI:             "mongodb://127.0.0.1:1/?serverSelectionTimeoutMS=50",
+		Name:            "observations",
+		ConnectAttempts: 3,
+		ConnectBackoff:  10 * time.Millisecond,
+	}
+
+	// Act
+	start := time.Now()
+	_, err := database.Open(ctx, cfg)
+
+	// Assert
+	assert.Error(t, err, "unavailable database opened")
+	assert.True(t, time.Since(start) < 400*time.Millisecond, "gave up after %v", time.Since(start))
+}
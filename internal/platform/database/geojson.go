@@ -0,0 +1,88 @@
+package database
+
+import (
+	"encoding/json"
+	"reflect"
+
+	geojson "github.com/paulmach/go.geojson"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+)
+
+// Registry holds the codecs used to convert values to and from mongo
+// documents. It extends the default codecs so that GeoJSON geometries are
+// stored as GeoJSON, which mongo can index and query.
+var Registry = bson.NewRegistryBuilder().
+	RegisterTypeEncoder(tGeometry, bsoncodec.ValueEncoderFunc(encodeGeometry)).
+	RegisterTypeDecoder(tGeometry, bsoncodec.ValueDecoderFunc(decodeGeometry)).
+	Build()
+
+var tGeometry = reflect.TypeOf(geojson.Geometry{})
+
+// encodeGeometry writes a geometry as a GeoJSON document.
+func encodeGeometry(_ bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+	if !val.IsValid() || val.Type() != tGeometry {
+		return bsoncodec.ValueEncoderError{Name: "encodeGeometry", Types: []reflect.Type{tGeometry}, Received: val}
+	}
+
+	data, err := json.Marshal(val.Interface())
+	if err != nil {
+		return errors.Wrap(err, "encoding geometry")
+	}
+
+	var doc bson.D
+	if err := bson.UnmarshalExtJSON(data, false, &doc); err != nil {
+		return errors.Wrap(err, "encoding geometry")
+	}
+
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		return errors.Wrap(err, "encoding geometry")
+	}
+
+	return bsonrw.Copier{}.CopyDocumentFromBytes(vw, raw)
+}
+
+// decodeGeometry reads a GeoJSON document into a geometry. Geometries that
+// were stored before they were encoded as GeoJSON are read as well.
+func decodeGeometry(_ bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+	if !val.CanSet() || val.Type() != tGeometry {
+		return bsoncodec.ValueDecoderError{Name: "decodeGeometry", Types: []reflect.Type{tGeometry}, Received: val}
+	}
+
+	raw, err := bsonrw.Copier{}.CopyDocumentToBytes(vr)
+	if err != nil {
+		return errors.Wrap(err, "decoding geometry")
+	}
+
+	// Previously geometries were stored with a key for each field of the
+	// geometry struct, such as multipolygon, which GeoJSON does not have.
+	if _, err := bson.Raw(raw).LookupErr("multipolygon"); err == nil {
+		var g geojson.Geometry
+		if err := bson.Unmarshal(raw, &g); err != nil {
+			return errors.Wrap(err, "decoding geometry")
+		}
+		val.Set(reflect.ValueOf(g))
+		return nil
+	}
+
+	var m bson.M
+	if err := bson.Unmarshal(raw, &m); err != nil {
+		return errors.Wrap(err, "decoding geometry")
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return errors.Wrap(err, "decoding geometry")
+	}
+
+	g, err := geojson.UnmarshalGeometry(data)
+	if err != nil {
+		return errors.Wrap(err, "decoding geometry")
+	}
+	val.Set(reflect.ValueOf(*g))
+
+	return nil
+}
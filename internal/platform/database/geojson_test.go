@@ -0,0 +1,64 @@
+package database_test
+
+import (
+	"testing"
+
+	geojson "github.com/paulmach/go.geojson"
+	"github.com/schafer14/obs/internal/platform/database"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type located struct {
+	Location *geojson.Geometry
+}
+
+func TestGeometriesAreStoredAsGeoJSON(t *testing.T) {
+
+	// Arrange
+	doc := located{Location: geojson.NewPointGeometry([]float64{153.02, -27.47})}
+
+	// Act
+	raw, err := bson.MarshalWithRegistry(database.Registry, doc)
+	require.Nil(t, err, "encoding geometry")
+	var decoded located
+	err = bson.UnmarshalWithRegistry(database.Registry, raw, &decoded)
+	require.Nil(t, err, "decoding geometry")
+
+	// Assert
+	location := bson.Raw(raw).Lookup("location")
+	assert.Equal(t, "Point", location.Document().Lookup("type").StringValue(), "geometry type not stored")
+	assert.Equal(t, bson.TypeArray, location.Document().Lookup("coordinates").Type, "coordinates not stored")
+	assert.Equal(t, doc.Location.Point, decoded.Location.Point, "geometry not decoded")
+}
+
+func TestLegacyGeometriesCanBeRead(t *testing.T) {
+
+	// Arrange
+	legacy, err := bson.Marshal(located{Location: geojson.NewPointGeometry([]float64{1, 2})})
+	require.Nil(t, err, "encoding legacy geometry")
+
+	// Act
+	var decoded located
+	err = bson.UnmarshalWithRegistry(database.Registry, legacy, &decoded)
+
+	// Assert
+	require.Nil(t, err, "decoding legacy geometry")
+	assert.Equal(t, []float64{1, 2}, decoded.Location.Point, "legacy geometry not decoded")
+}
+
+func TestMissingGeometriesAreNil(t *testing.T) {
+
+	// Arrange
+	raw, err := bson.MarshalWithRegistry(database.Registry, located{})
+	require.Nil(t, err, "encoding missing geometry")
+
+	// Act
+	var decoded located
+	err = bson.UnmarshalWithRegistry(database.Registry, raw, &decoded)
+
+	// Assert
+	require.Nil(t, err, "decoding missing geometry")
+	assert.Nil(t, decoded.Location, "missing geometry not nil")
+}
@@ -0,0 +1,33 @@
+package firestore
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/pkg/errors"
+	"google.golang.org/api/iterator"
+)
+
+// Open creates a firestore client for a Google Cloud project. The client
+// connects to the emulator at FIRESTORE_EMULATOR_HOST when it is set. The
+// context is kept to refresh credentials, so it should last as long as the
+// client.
+func Open(ctx context.Context, project string) (*firestore.Client, error) {
+	client, err := firestore.NewClient(ctx, project)
+
+	return client, errors.Wrap(err, "connecting to firestore")
+}
+
+// Check makes sure firestore is responding by listing a collection.
+func Check(ctx context.Context, client *firestore.Client) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	_, err := client.Collections(ctx).Next()
+	if err == iterator.Done {
+		return nil
+	}
+
+	return errors.Wrap(err, "listing firestore collections")
+}
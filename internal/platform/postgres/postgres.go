@@ -0,0 +1,99 @@
+package postgres
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+
+	// Register the postgres driver with database/sql.
+	_ "github.com/lib/pq"
+)
+
+// Open opens a pool of connections to a postgres database.
+func Open(ctx context.Context, connectionString string) (*sqlx.DB, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	db, err := sqlx.ConnectContext(ctx, "postgres", connectionString)
+
+	return db, errors.Wrap(err, "connecting to database")
+}
+
+// Check makes sure the db connection is responding.
+func Check(ctx context.Context, db *sqlx.DB) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	err := db.PingContext(ctx)
+
+	return errors.Wrap(err, "pinging database")
+}
+
+// Migration is a versioned change to the tables of a schema. Migrations are
+// never edited once released, a new version is added instead.
+type Migration struct {
+	Version int
+	SQL     string
+}
+
+// Migrate applies the migrations of a schema that have not yet been applied,
+// in order of their version. Each migration is applied in a transaction along
+// with the record that it was applied, which is kept in schema_migrations.
+// Instances migrating at the same time wait for each other.
+func Migrate(ctx context.Context, db *sqlx.DB, schema string, migrations []Migration) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			schema     text NOT NULL,
+			version    integer NOT NULL,
+			applied_at timestamptz NOT NULL DEFAULT now(),
+			PRIMARY KEY (schema, version)
+		)`)
+	if err != nil {
+		return errors.Wrap(err, "creating schema_migrations")
+	}
+
+	sorted := append([]Migration(nil), migrations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+
+	for _, m := range sorted {
+		if err := apply(ctx, db, schema, m); err != nil {
+			return errors.Wrapf(err, "applying %s migration %d", schema, m.Version)
+		}
+	}
+
+	return nil
+}
+
+// apply applies a migration unless it has already been applied.
+func apply(ctx context.Context, db *sqlx.DB, schema string, m Migration) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext('schema_migrations'))`); err != nil {
+		return err
+	}
+
+	var applied bool
+	err = tx.GetContext(ctx, &applied, `SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE schema = $1 AND version = $2)`, schema, m.Version)
+	if err != nil || applied {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, m.SQL); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (schema, version) VALUES ($1, $2)`, schema, m.Version); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
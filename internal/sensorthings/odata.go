@@ -0,0 +1,450 @@
+package sensorthings
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/schafer14/obs/internal/observations"
+)
+
+// Options are the OData query options of a request that control which
+// entities are returned and how they are represented.
+type Options struct {
+	Filter  string
+	OrderBy string
+	Select  []string
+	Expand  []Expand
+	Top     int
+	Skip    int
+	Count   bool
+
+	// values are the query parameters the options were read from, which are
+	// used to link to the next page of a collection.
+	values url.Values
+}
+
+// Expand is a navigation property to include in each entity, with the options
+// that apply to the entities it navigates to.
+type Expand struct {
+	Property string
+	Options  Options
+}
+
+// ParseOptions reads the query options of a request. Options that are not
+// given take their default values.
+func ParseOptions(values url.Values) (Options, error) {
+	raw := map[string]string{}
+	for key := range values {
+		if strings.HasPrefix(key, "$") {
+			raw[key] = values.Get(key)
+		}
+	}
+
+	opts, errs := parseOptions(raw, "")
+	if len(errs) > 0 {
+		return Options{}, &observations.ValidationError{Err: "error validating query options", Fields: errs}
+	}
+	opts.values = values
+
+	return opts, nil
+}
+
+// parseOptions reads query options given as a map from option to value. The
+// names of errors are prefixed with prefix so errors in nested options can
+// be found.
+func parseOptions(raw map[string]string, prefix string) (Options, []observations.FieldError) {
+	opts := Options{Top: observations.DefaultLimit}
+	var errs []observations.FieldError
+
+	for key, value := range raw {
+		name := prefix + key
+		switch key {
+		case "$filter":
+			opts.Filter = value
+		case "$orderby":
+			opts.OrderBy = value
+		case "$select":
+			for _, property := range strings.Split(value, ",") {
+				if property = strings.TrimSpace(property); property != "" {
+					opts.Select = append(opts.Select, property)
+				}
+			}
+		case "$top":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 || n > observations.MaxLimit {
+				errs = append(errs, observations.FieldError{Field: name, Error: fmt.Sprintf("$top must be a number between 0 and %d", observations.MaxLimit)})
+				continue
+			}
+			opts.Top = n
+		case "$skip":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				errs = append(errs, observations.FieldError{Field: name, Error: "$skip must be a number that is not negative"})
+				continue
+			}
+			opts.Skip = n
+		case "$count":
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				errs = append(errs, observations.FieldError{Field: name, Error: "$count must be true or false"})
+				continue
+			}
+			opts.Count = b
+		case "$expand":
+			expands, expandErrs := parseExpand(value, name)
+			errs = append(errs, expandErrs...)
+			opts.Expand = expands
+		default:
+			errs = append(errs, observations.FieldError{Field: name, Error: fmt.Sprintf("query option %s is not supported", key)})
+		}
+	}
+
+	return opts, errs
+}
+
+// parseExpand parses the value of an $expand option. Each navigation property
+// is separated by a comma and may have nested options in parentheses that
+// are separated by semicolons, such as Datastreams($top=5;$expand=Sensor).
+// A path such as Datastream/Thing expands Datastream and then Thing.
+func parseExpand(value, name string) ([]Expand, []observations.FieldError) {
+	var expands []Expand
+	var errs []observations.FieldError
+
+	for _, item := range splitTopLevel(value, ',') {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		path, nested := item, ""
+		if i := strings.Index(item, "("); i > -1 {
+			if !strings.HasSuffix(item, ")") {
+				errs = append(errs, observations.FieldError{Field: name, Error: fmt.Sprintf("unbalanced parentheses in %q", item)})
+				continue
+			}
+			path, nested = item[:i], item[i+1:len(item)-1]
+		}
+
+		raw := map[string]string{}
+		for _, option := range splitTopLevel(nested, ';') {
+			if option = strings.TrimSpace(option); option == "" {
+				continue
+			}
+			kv := strings.SplitN(option, "=", 2)
+			if len(kv) != 2 {
+				errs = append(errs, observations.FieldError{Field: name, Error: fmt.Sprintf("invalid option %q", option)})
+				continue
+			}
+			raw[strings.TrimSpace(kv[0])] = kv[1]
+		}
+
+		properties := strings.Split(path, "/")
+		last := len(properties) - 1
+		opts, nestedErrs := parseOptions(raw, name+"("+properties[last]+")")
+		errs = append(errs, nestedErrs...)
+
+		expand := Expand{Property: properties[last], Options: opts}
+		for i := last - 1; i >= 0; i-- {
+			outer, _ := parseOptions(nil, "")
+			outer.Expand = []Expand{expand}
+			expand = Expand{Property: properties[i], Options: outer}
+		}
+		expands = append(expands, expand)
+	}
+
+	return expands, errs
+}
+
+// splitTopLevel splits s at each sep that is not inside parentheses or quotes.
+func splitTopLevel(s string, sep rune) []string {
+	var parts []string
+	depth, quoted, start := 0, false, 0
+	for i, r := range s {
+		switch {
+		case r == '\'':
+			quoted = !quoted
+		case quoted:
+		case r == '(':
+			depth++
+		case r == ')':
+			depth--
+		case r == sep && depth == 0:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(parts, s[start:])
+}
+
+// literalKind is the type of a literal in a filter.
+type literalKind int
+
+const (
+	literalString literalKind = iota
+	literalNumber
+	literalBool
+	literalTime
+	literalNull
+)
+
+// literal is a value in a filter.
+type literal struct {
+	kind literalKind
+	text string
+}
+
+// filterNode is a parsed $filter expression. Logical nodes combine their args
+// and comparison nodes compare the property at path to a literal.
+type filterNode struct {
+	op   string
+	args []filterNode
+	path string
+	lit  literal
+}
+
+// comparisons are the OData comparison operators and the filter operators
+// they map to.
+var comparisons = map[string]string{
+	"eq": "=",
+	"ne": "!=",
+	"gt": ">",
+	"ge": ">=",
+	"lt": "<",
+	"le": "<=",
+}
+
+// flipped are the comparison operators to use when a literal is compared to
+// a property instead of a property to a literal.
+var flipped = map[string]string{
+	"eq": "eq",
+	"ne": "ne",
+	"gt": "lt",
+	"ge": "le",
+	"lt": "gt",
+	"le": "ge",
+}
+
+// token is a token of a $filter expression.
+type token struct {
+	text   string
+	quoted bool
+}
+
+// tokenize splits a $filter expression into tokens. Quoted strings are single
+// tokens with two single quotes standing for one.
+func tokenize(s string) ([]token, error) {
+	var tokens []token
+	runes := []rune(s)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')' || r == ',':
+			tokens = append(tokens, token{text: string(r)})
+			i++
+		case r == '\'':
+			var b strings.Builder
+			i++
+			for {
+				if i >= len(runes) {
+					return nil, fmt.Errorf("unterminated string")
+				}
+				if runes[i] == '\'' {
+					if i+1 < len(runes) && runes[i+1] == '\'' {
+						b.WriteRune('\'')
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				b.WriteRune(runes[i])
+				i++
+			}
+			tokens = append(tokens, token{text: b.String(), quoted: true})
+		default:
+			start := i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && !strings.ContainsRune("(),'", runes[i]) {
+				i++
+			}
+			tokens = append(tokens, token{text: string(runes[start:i])})
+		}
+	}
+
+	return tokens, nil
+}
+
+// filterParser is a recursive descent parser of $filter expressions.
+//
+//	or         = and { "or" and }
+//	and        = not { "and" not }
+//	not        = "not" not | comparison
+//	comparison = operand [ ("eq" | "ne" | "gt" | "ge" | "lt" | "le") operand ]
+//	operand    = "(" or ")" | literal | path
+type filterParser struct {
+	tokens []token
+	pos    int
+}
+
+// parseFilter parses a $filter expression.
+func parseFilter(s string) (filterNode, error) {
+	tokens, err := tokenize(s)
+	if err != nil {
+		return filterNode{}, err
+	}
+
+	p := &filterParser{tokens: tokens}
+	n, err := p.or()
+	if err != nil {
+		return filterNode{}, err
+	}
+	if p.pos < len(p.tokens) {
+		return filterNode{}, fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+
+	return n, nil
+}
+
+// peek returns the next token if it is not quoted.
+func (p *filterParser) peek() string {
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].quoted {
+		return ""
+	}
+	return p.tokens[p.pos].text
+}
+
+func (p *filterParser) or() (filterNode, error) {
+	return p.logical("or", p.and)
+}
+
+func (p *filterParser) and() (filterNode, error) {
+	return p.logical("and", p.not)
+}
+
+// logical parses operands separated by op.
+func (p *filterParser) logical(op string, operand func() (filterNode, error)) (filterNode, error) {
+	first, err := operand()
+	if err != nil {
+		return filterNode{}, err
+	}
+
+	n := filterNode{op: op, args: []filterNode{first}}
+	for p.peek() == op {
+		p.pos++
+		next, err := operand()
+		if err != nil {
+			return filterNode{}, err
+		}
+		n.args = append(n.args, next)
+	}
+
+	if len(n.args) == 1 {
+		return first, nil
+	}
+	return n, nil
+}
+
+func (p *filterParser) not() (filterNode, error) {
+	if p.peek() != "not" {
+		return p.comparison()
+	}
+
+	p.pos++
+	arg, err := p.not()
+	if err != nil {
+		return filterNode{}, err
+	}
+	return filterNode{op: "not", args: []filterNode{arg}}, nil
+}
+
+func (p *filterParser) comparison() (filterNode, error) {
+	left, err := p.operand()
+	if err != nil {
+		return filterNode{}, err
+	}
+
+	op := p.peek()
+	if _, ok := comparisons[op]; !ok {
+		if left.op == "path" || left.op == "literal" {
+			return filterNode{}, fmt.Errorf("expected a comparison after %q", left.path+left.lit.text)
+		}
+		return left, nil
+	}
+	p.pos++
+
+	right, err := p.operand()
+	if err != nil {
+		return filterNode{}, err
+	}
+
+	switch {
+	case left.op == "path" && right.op == "literal":
+		return filterNode{op: op, path: left.path, lit: right.lit}, nil
+	case left.op == "literal" && right.op == "path":
+		return filterNode{op: flipped[op], path: right.path, lit: left.lit}, nil
+	default:
+		return filterNode{}, fmt.Errorf("%s must compare a property to a value", op)
+	}
+}
+
+// operand parses a parenthesised expression, a literal or a property path.
+// Operands that are literals or paths have the op literal or path until they
+// are part of a comparison.
+func (p *filterParser) operand() (filterNode, error) {
+	if p.pos >= len(p.tokens) {
+		return filterNode{}, fmt.Errorf("unexpected end of filter")
+	}
+
+	t := p.tokens[p.pos]
+	p.pos++
+
+	if t.quoted {
+		return filterNode{op: "literal", lit: literal{kind: literalString, text: t.text}}, nil
+	}
+
+	if t.text == "(" {
+		n, err := p.or()
+		if err != nil {
+			return filterNode{}, err
+		}
+		if p.peek() != ")" {
+			return filterNode{}, fmt.Errorf("expected )")
+		}
+		p.pos++
+		return n, nil
+	}
+
+	if p.peek() == "(" {
+		return filterNode{}, fmt.Errorf("function %s is not supported", t.text)
+	}
+
+	switch t.text {
+	case "null":
+		return filterNode{op: "literal", lit: literal{kind: literalNull}}, nil
+	case "true", "false":
+		return filterNode{op: "literal", lit: literal{kind: literalBool, text: t.text}}, nil
+	case ")", ",":
+		return filterNode{}, fmt.Errorf("unexpected %q", t.text)
+	}
+
+	if _, err := strconv.ParseFloat(t.text, 64); err == nil {
+		return filterNode{op: "literal", lit: literal{kind: literalNumber, text: t.text}}, nil
+	}
+	if ts, err := time.Parse(time.RFC3339Nano, t.text); err == nil {
+		return filterNode{op: "literal", lit: literal{kind: literalTime, text: ts.Format(time.RFC3339Nano)}}, nil
+	}
+
+	for _, r := range t.text {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '/' && r != '_' && r != '@' && r != '.' {
+			return filterNode{}, fmt.Errorf("unexpected %q", t.text)
+		}
+	}
+
+	return filterNode{op: "path", path: t.text}, nil
+}
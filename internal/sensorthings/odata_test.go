@@ -0,0 +1,150 @@
+package sensorthings_test
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"github.com/schafer14/obs/internal/observations"
+	"github.com/schafer14/obs/internal/sensorthings"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsingQueryOptions(t *testing.T) {
+
+	// Arrange
+	values := url.Values{
+		"$filter":  {"result gt 3"},
+		"$orderby": {"phenomenonTime desc"},
+		"$select":  {"result, phenomenonTime"},
+		"$top":     {"10"},
+		"$skip":    {"20"},
+		"$count":   {"true"},
+		"$expand":  {"Datastream($select=name;$expand=Thing,Sensor),FeatureOfInterest"},
+	}
+
+	// Act
+	opts, err := sensorthings.ParseOptions(values)
+
+	// Assert
+	require.Nil(t, err, "parsing options")
+	assert.Equal(t, "result gt 3", opts.Filter, "filter mismatch")
+	assert.Equal(t, "phenomenonTime desc", opts.OrderBy, "order mismatch")
+	assert.Equal(t, []string{"result", "phenomenonTime"}, opts.Select, "select mismatch")
+	assert.Equal(t, 10, opts.Top, "top mismatch")
+	assert.Equal(t, 20, opts.Skip, "skip mismatch")
+	assert.True(t, opts.Count, "count not set")
+	require.Equal(t, 2, len(opts.Expand), "expand mismatch")
+	assert.Equal(t, "Datastream", opts.Expand[0].Property, "expanded property mismatch")
+	assert.Equal(t, []string{"name"}, opts.Expand[0].Options.Select, "nested select mismatch")
+	assert.Equal(t, 2, len(opts.Expand[0].Options.Expand), "nested expand mismatch")
+	assert.Equal(t, observations.DefaultLimit, opts.Expand[1].Options.Top, "nested top not defaulted")
+}
+
+func TestExpandPaths(t *testing.T) {
+
+	// Act
+	opts, err := sensorthings.ParseOptions(url.Values{"$expand": {"Datastream/Thing($top=1)"}})
+
+	// Assert
+	require.Nil(t, err, "parsing options")
+	require.Equal(t, 1, len(opts.Expand), "expand mismatch")
+	assert.Equal(t, "Datastream", opts.Expand[0].Property, "outer property mismatch")
+	require.Equal(t, 1, len(opts.Expand[0].Options.Expand), "nested expand mismatch")
+	assert.Equal(t, "Thing", opts.Expand[0].Options.Expand[0].Property, "inner property mismatch")
+	assert.Equal(t, 1, opts.Expand[0].Options.Expand[0].Options.Top, "inner options mismatch")
+}
+
+func TestInvalidQueryOptionsAreNamed(t *testing.T) {
+
+	// Arrange
+	values := url.Values{
+		"$top":      {"-1"},
+		"$skip":     {"many"},
+		"$count":    {"maybe"},
+		"$search":   {"garden"},
+		"$expand":   {"Datastream($top=lots)"},
+		"unrelated": {"ignored"},
+	}
+
+	// Act
+	_, err := sensorthings.ParseOptions(values)
+
+	// Assert
+	require.Error(t, err, "invalid options accepted")
+	vError, ok := err.(*observations.ValidationError)
+	require.True(t, ok, "error is not a validation error")
+	var names []string
+	for _, f := range vError.Fields {
+		names = append(names, f.Field)
+	}
+	assert.ElementsMatch(t, []string{"$top", "$skip", "$count", "$search", "$expand(Datastream)$top"}, names, "errors not named")
+}
+
+func TestInvalidFiltersAreRejected(t *testing.T) {
+
+	filters := []string{
+		"result gt",
+		"result gt 3 and",
+		"(result gt 3",
+		"result",
+		"substringof('a', name) eq true",
+		"result eq 'unterminated",
+		"result gt phenomenonTime",
+		"password eq 'secret'",
+		"phenomenonTime gt 'yesterday'",
+		"Datastream/id gt 'a'",
+		"parameters/a/b eq 'c'",
+	}
+
+	for _, filter := range filters {
+		t.Run(filter, func(t *testing.T) {
+
+			// Arrange
+			opts, err := sensorthings.ParseOptions(url.Values{"$filter": {filter}})
+			require.Nil(t, err, "parsing options")
+
+			// Act
+			_, err = sensorthings.Read(context.Background(), nil, base, "Observations", opts)
+
+			// Assert
+			require.Error(t, err, "invalid filter accepted")
+			vError, ok := err.(*observations.ValidationError)
+			require.True(t, ok, "error is not a validation error")
+			assert.Equal(t, "$filter", vError.Fields[0].Field, "error not named")
+		})
+	}
+}
+
+func TestInvalidOrderingsAreRejected(t *testing.T) {
+
+	// Arrange
+	opts, err := sensorthings.ParseOptions(url.Values{"$orderby": {"resultTime sideways"}})
+	require.Nil(t, err, "parsing options")
+
+	// Act
+	_, err = sensorthings.Read(context.Background(), nil, base, "Observations", opts)
+
+	// Assert
+	require.Error(t, err, "invalid ordering accepted")
+	vError, ok := err.(*observations.ValidationError)
+	require.True(t, ok, "error is not a validation error")
+	assert.Equal(t, "$orderby", vError.Fields[0].Field, "error not named")
+}
+
+func TestExpandingUnknownPropertiesIsRejected(t *testing.T) {
+
+	// Arrange
+	opts, err := sensorthings.ParseOptions(url.Values{"$expand": {"Datastreams($expand=Owner)"}})
+	require.Nil(t, err, "parsing options")
+
+	// Act
+	_, err = sensorthings.Read(context.Background(), nil, base, "Things", opts)
+
+	// Assert
+	require.Error(t, err, "unknown navigation property accepted")
+	vError, ok := err.(*observations.ValidationError)
+	require.True(t, ok, "error is not a validation error")
+	assert.Equal(t, "$expand(Datastreams)", vError.Fields[0].Field, "error not named")
+}
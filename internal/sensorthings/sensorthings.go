@@ -0,0 +1,458 @@
+// Package sensorthings exposes observations through the OGC SensorThings API
+// v1.1 so that SensorThings clients can read and write them.
+//
+// Observations are the only entities that are stored. The other entities are
+// views of the fields of observations.
+//
+//	Things             the feature of observations
+//	FeaturesOfInterest the feature of observations, located at their phenomenon location
+//	ObservedProperties the property of observations
+//	Sensors            the process of observations
+//	Datastreams        the observations of a property of a feature by a process
+//
+// A Things, FeaturesOfInterest, ObservedProperties or Sensors entity has the id
+// of its feature, property or process. A Datastream has an opaque id made from
+// the ids of its feature, feature type, property, property type and process.
+package sensorthings
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/schafer14/obs/internal/observations"
+)
+
+var (
+	// ErrorNotFound is returned when a resource path does not refer to any
+	// entities.
+	ErrorNotFound = errors.New("entity not found")
+
+	// ErrorNotSupported is returned for requests that are valid SensorThings
+	// requests but that cannot be mapped onto observations.
+	ErrorNotSupported = errors.New("not supported by this service")
+
+	// ErrorReadOnly is returned when creating or updating entities that are
+	// views of observations rather than stored entities.
+	ErrorReadOnly = errors.New("entity set is read only")
+)
+
+// observationType is the SensorThings observation type of every datastream.
+const observationType = "http://www.opengis.net/def/observationType/OGC-OM/2.0/OM_Observation"
+
+// entitySet describes how the entities of a SensorThings entity set are made
+// from observations.
+type entitySet struct {
+	name string
+
+	// keys are the paths of the observation fields that identify an entity.
+	keys []string
+
+	// properties map the properties of an entity that may be filtered and
+	// ordered on to observation paths.
+	properties map[string]string
+
+	// toOne are navigation properties to a single entity, which is made from
+	// the same observation. toMany are navigation properties to the entities
+	// that share the keys of this entity.
+	toOne  map[string]string
+	toMany map[string]string
+
+	id     func(obs observations.Observation) string
+	render func(obs observations.Observation) map[string]interface{}
+}
+
+// sets are the supported entity sets by name.
+var sets = map[string]*entitySet{}
+
+// setNames are the names of the supported entity sets in the order they are
+// listed at the service root.
+var setNames = []string{"Things", "Datastreams", "ObservedProperties", "Sensors", "FeaturesOfInterest", "Observations"}
+
+func init() {
+	sets["Things"] = &entitySet{
+		name:       "Things",
+		keys:       []string{"featureId"},
+		properties: map[string]string{"id": "featureId", "name": "feature.label"},
+		toMany:     map[string]string{"Datastreams": "Datastreams"},
+		id:         func(obs observations.Observation) string { return obs.FeatureID },
+		render: func(obs observations.Observation) map[string]interface{} {
+			return map[string]interface{}{
+				"name":        labelOrID(obs.Feature),
+				"description": obs.Feature.Description,
+				"properties": map[string]interface{}{
+					"featureTypeId": obs.FeatureTypeID,
+					"reference":     obs.Feature.Reference,
+				},
+			}
+		},
+	}
+
+	sets["FeaturesOfInterest"] = &entitySet{
+		name:       "FeaturesOfInterest",
+		keys:       []string{"featureId"},
+		properties: map[string]string{"id": "featureId", "name": "feature.label"},
+		toMany:     map[string]string{"Observations": "Observations"},
+		id:         func(obs observations.Observation) string { return obs.FeatureID },
+		render: func(obs observations.Observation) map[string]interface{} {
+			return map[string]interface{}{
+				"name":         labelOrID(obs.Feature),
+				"description":  obs.Feature.Description,
+				"encodingType": "application/geo+json",
+				"feature":      obs.PhenomenonLocation,
+			}
+		},
+	}
+
+	sets["ObservedProperties"] = &entitySet{
+		name:       "ObservedProperties",
+		keys:       []string{"propertyId"},
+		properties: map[string]string{"id": "propertyId", "name": "property.label"},
+		toMany:     map[string]string{"Datastreams": "Datastreams"},
+		id:         func(obs observations.Observation) string { return obs.PropertyID },
+		render: func(obs observations.Observation) map[string]interface{} {
+			definition := obs.Property.Reference
+			if definition == "" {
+				definition = obs.PropertyID
+			}
+			return map[string]interface{}{
+				"name":        labelOrID(obs.Property),
+				"definition":  definition,
+				"description": obs.Property.Description,
+				"properties": map[string]interface{}{
+					"propertyTypeId": obs.PropertyTypeID,
+				},
+			}
+		},
+	}
+
+	sets["Sensors"] = &entitySet{
+		name:       "Sensors",
+		keys:       []string{"processId"},
+		properties: map[string]string{"id": "processId", "name": "process.label"},
+		toMany:     map[string]string{"Datastreams": "Datastreams"},
+		id:         func(obs observations.Observation) string { return obs.ProcessID },
+		render: func(obs observations.Observation) map[string]interface{} {
+			metadata := obs.Process.Reference
+			if metadata == "" {
+				metadata = obs.ProcessID
+			}
+			return map[string]interface{}{
+				"name":         labelOrID(obs.Process),
+				"description":  obs.Process.Description,
+				"encodingType": "text/html",
+				"metadata":     metadata,
+			}
+		},
+	}
+
+	sets["Datastreams"] = &entitySet{
+		name: "Datastreams",
+		keys: []string{"featureId", "featureTypeId", "propertyId", "propertyTypeId", "processId"},
+		properties: map[string]string{
+			"name":                     "property.label",
+			"unitOfMeasurement/symbol": "scale",
+		},
+		toOne: map[string]string{
+			"Thing":            "Things",
+			"Sensor":           "Sensors",
+			"ObservedProperty": "ObservedProperties",
+		},
+		toMany: map[string]string{"Observations": "Observations"},
+		id:     datastreamID,
+		render: func(obs observations.Observation) map[string]interface{} {
+			return map[string]interface{}{
+				"name":        fmt.Sprintf("%s of %s", labelOrID(obs.Property), labelOrID(obs.Feature)),
+				"description": fmt.Sprintf("%s of %s by %s", labelOrID(obs.Property), labelOrID(obs.Feature), labelOrID(obs.Process)),
+				"unitOfMeasurement": map[string]interface{}{
+					"name":       obs.Scale,
+					"symbol":     obs.Scale,
+					"definition": "",
+				},
+				"observationType": observationType,
+				"properties": map[string]interface{}{
+					"featureTypeId":  obs.FeatureTypeID,
+					"propertyTypeId": obs.PropertyTypeID,
+				},
+			}
+		},
+	}
+
+	sets["Observations"] = &entitySet{
+		name: "Observations",
+		keys: []string{"id"},
+		properties: map[string]string{
+			"id":             "id",
+			"phenomenonTime": "phenomenonTime",
+			"resultTime":     "resultTime",
+		},
+		toOne: map[string]string{
+			"Datastream":        "Datastreams",
+			"FeatureOfInterest": "FeaturesOfInterest",
+		},
+		id: func(obs observations.Observation) string { return obs.ID },
+		render: func(obs observations.Observation) map[string]interface{} {
+			entity := map[string]interface{}{
+				"phenomenonTime": obs.PhenomenonTime.UTC().Format(time.RFC3339Nano),
+				"resultTime":     obs.ResultTime.UTC().Format(time.RFC3339Nano),
+				"result":         result(obs),
+				"parameters":     obs.Tags,
+			}
+			if obs.ValidIntervalEnd != nil {
+				entity["validTime"] = obs.ValidInterval.StartTime.UTC().Format(time.RFC3339Nano) + "/" + obs.ValidIntervalEnd.UTC().Format(time.RFC3339Nano)
+			}
+			return entity
+		},
+	}
+}
+
+// labelOrID names a referenceable field by its label, or its id when it does
+// not have a label.
+func labelOrID(r observations.Referenceable) string {
+	if r.Label != "" {
+		return r.Label
+	}
+	return r.ID
+}
+
+// result is the SensorThings result of an observation. Results that only have
+// a value field are represented by that value, for example a result of
+// {"value": 5} is the result 5.
+func result(obs observations.Observation) interface{} {
+	if v, ok := obs.Result["value"]; ok && len(obs.Result) == 1 {
+		return v
+	}
+	return obs.Result
+}
+
+// datastream is the fields of an observation that identify its datastream.
+type datastream struct {
+	FeatureID      string
+	FeatureTypeID  string
+	PropertyID     string
+	PropertyTypeID string
+	ProcessID      string
+}
+
+// datastreamID is the id of the datastream of an observation.
+func datastreamID(obs observations.Observation) string {
+	data, _ := json.Marshal([]string{obs.FeatureID, obs.FeatureTypeID, obs.PropertyID, obs.PropertyTypeID, obs.ProcessID})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// parseDatastreamID reads the fields that identify a datastream from its id.
+func parseDatastreamID(id string) (datastream, error) {
+	data, err := base64.RawURLEncoding.DecodeString(id)
+	if err != nil {
+		return datastream{}, fmt.Errorf("invalid datastream id %q", id)
+	}
+
+	var ids []string
+	if err := json.Unmarshal(data, &ids); err != nil || len(ids) != 5 {
+		return datastream{}, fmt.Errorf("invalid datastream id %q", id)
+	}
+
+	return datastream{ids[0], ids[1], ids[2], ids[3], ids[4]}, nil
+}
+
+// keyFilters are the filters that match the observations of an entity.
+func (s *entitySet) keyFilters(id string) ([]observations.Filter, error) {
+	values := []string{id}
+	if s.name == "Datastreams" {
+		ds, err := parseDatastreamID(id)
+		if err != nil {
+			return nil, err
+		}
+		values = []string{ds.FeatureID, ds.FeatureTypeID, ds.PropertyID, ds.PropertyTypeID, ds.ProcessID}
+	}
+
+	filters := make([]observations.Filter, len(s.keys))
+	for i, key := range s.keys {
+		filters[i] = observations.Filter{Path: key, Op: "=", Matcher: values[i], Type: "string"}
+	}
+
+	return filters, nil
+}
+
+// navigate follows the navigation properties to a single entity at the start
+// of a property path, such as Datastream/Thing/name. Entities reached this way
+// are made from the same observation so their properties can be compared as
+// properties of the observation. The entity set reached and the rest of the
+// path are returned.
+func (s *entitySet) navigate(path string) (*entitySet, string) {
+	parts := strings.Split(path, "/")
+	if target, ok := s.toOne[parts[0]]; ok && len(parts) > 1 {
+		return sets[target].navigate(strings.Join(parts[1:], "/"))
+	}
+	if path == "@iot.id" {
+		path = "id"
+	}
+	return s, path
+}
+
+// property finds the observation path of a property of an entity.
+func (s *entitySet) property(path string) (string, error) {
+	set, path := s.navigate(path)
+	parts := strings.Split(path, "/")
+
+	if set.name == "Observations" {
+		switch {
+		case path == "result":
+			return "result.value", nil
+		case strings.HasPrefix(path, "result/"):
+			return "result." + strings.Join(parts[1:], "."), nil
+		case strings.HasPrefix(path, "parameters/") && len(parts) == 2:
+			return "tags." + parts[1], nil
+		}
+	}
+
+	if p, ok := set.properties[path]; ok {
+		return p, nil
+	}
+
+	return "", fmt.Errorf("cannot filter or order %s by %s", set.name, path)
+}
+
+// compileFilter converts a $filter expression to an observation expression.
+func (s *entitySet) compileFilter(filter string) (*observations.Expression, error) {
+	if strings.TrimSpace(filter) == "" {
+		return nil, nil
+	}
+
+	n, err := parseFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := s.compile(n)
+	if err != nil {
+		return nil, err
+	}
+
+	return &e, nil
+}
+
+// compile converts a parsed $filter expression to an observation expression.
+func (s *entitySet) compile(n filterNode) (observations.Expression, error) {
+	switch n.op {
+	case "and", "or":
+		var args []observations.Expression
+		for _, arg := range n.args {
+			e, err := s.compile(arg)
+			if err != nil {
+				return observations.Expression{}, err
+			}
+			args = append(args, e)
+		}
+		if n.op == "and" {
+			return observations.Expression{And: args}, nil
+		}
+		return observations.Expression{Or: args}, nil
+
+	case "not":
+		e, err := s.compile(n.args[0])
+		if err != nil {
+			return observations.Expression{}, err
+		}
+		return observations.Expression{Not: &e}, nil
+	}
+
+	// Datastreams are identified by several fields so comparing their id
+	// compares each of the fields.
+	if set, property := s.navigate(n.path); property == "id" && len(set.keys) > 1 {
+		if n.lit.kind != literalString || (n.op != "eq" && n.op != "ne") {
+			return observations.Expression{}, fmt.Errorf("%s ids may only be compared with eq or ne to a string", set.name)
+		}
+		filters, err := set.keyFilters(n.lit.text)
+		if err != nil {
+			return observations.Expression{}, err
+		}
+		var and []observations.Expression
+		for i := range filters {
+			and = append(and, observations.Expression{Filter: &filters[i]})
+		}
+		e := observations.Expression{And: and}
+		if n.op == "ne" {
+			return observations.Expression{Not: &e}, nil
+		}
+		return e, nil
+	}
+
+	path, err := s.property(n.path)
+	if err != nil {
+		return observations.Expression{}, err
+	}
+
+	f := observations.Filter{Path: path, Op: comparisons[n.op], Matcher: n.lit.text}
+	untyped := strings.HasPrefix(path, "result.") || strings.HasPrefix(path, "tags.")
+
+	switch n.lit.kind {
+	case literalNull:
+		switch n.op {
+		case "eq":
+			f.Op, f.Matcher = "exists", "false"
+		case "ne":
+			f.Op, f.Matcher = "exists", "true"
+		default:
+			return observations.Expression{}, fmt.Errorf("null may only be compared with eq or ne")
+		}
+	case literalString:
+		if untyped {
+			f.Type = "string"
+		}
+	case literalNumber:
+		if untyped {
+			f.Type = "number"
+		}
+	case literalBool:
+		if untyped {
+			f.Type = "bool"
+		}
+	case literalTime:
+		if untyped {
+			return observations.Expression{}, fmt.Errorf("cannot compare %s to a time", n.path)
+		}
+	}
+
+	// Check the filter now so errors name the property in the $filter
+	// rather than the observation path it maps to.
+	if err := (observations.Query{Filters: []observations.Filter{f}}).Validate(); err != nil {
+		return observations.Expression{}, fmt.Errorf("cannot compare %s to %q", n.path, n.lit.text)
+	}
+
+	return observations.Expression{Filter: &f}, nil
+}
+
+// compileOrderBy converts an $orderby option to the sort order of a query.
+func (s *entitySet) compileOrderBy(orderBy string) ([]string, error) {
+	var sort []string
+	for _, item := range strings.Split(orderBy, ",") {
+		fields := strings.Fields(item)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 2 || (len(fields) == 2 && fields[1] != "asc" && fields[1] != "desc") {
+			return nil, fmt.Errorf("invalid ordering %q", strings.TrimSpace(item))
+		}
+
+		// Datastreams are ordered by the fields of their id when no other
+		// order is given.
+		if set, property := s.navigate(fields[0]); property == "id" && len(set.keys) > 1 {
+			continue
+		}
+
+		path, err := s.property(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) == 2 && fields[1] == "desc" {
+			path = "-" + path
+		}
+		sort = append(sort, path)
+	}
+
+	return sort, nil
+}
@@ -0,0 +1,112 @@
+package sensorthings_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/schafer14/obs/internal/observations"
+	"github.com/schafer14/obs/internal/sensorthings"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const base = "http://example.com/v1.1"
+
+func TestParsingResourcePaths(t *testing.T) {
+
+	// Act
+	segments, err := sensorthings.ParsePath("Things('https://example.com/banners-garden')/Datastreams('it''s')/Observations")
+
+	// Assert
+	require.Nil(t, err, "parsing path")
+	assert.Equal(t, []sensorthings.Segment{
+		{Name: "Things", ID: "https://example.com/banners-garden", HasID: true},
+		{Name: "Datastreams", ID: "it's", HasID: true},
+		{Name: "Observations"},
+	}, segments, "segments mismatch")
+}
+
+func TestInvalidResourcePathsAreRejected(t *testing.T) {
+
+	paths := []string{
+		"Things('a'",
+		"Things(a)",
+		"Things('a')//Datastreams",
+	}
+
+	for _, path := range paths {
+		t.Run(path, func(t *testing.T) {
+
+			// Act
+			_, err := sensorthings.ParsePath(path)
+
+			// Assert
+			require.Error(t, err, "invalid path accepted")
+			_, ok := err.(*observations.ValidationError)
+			assert.True(t, ok, "error is not a validation error")
+		})
+	}
+}
+
+func TestUnknownResourcesAreNotFound(t *testing.T) {
+
+	paths := []string{
+		"Locations",
+		"Things('a')/Owners",
+		"Datastreams('not a datastream')",
+	}
+
+	for _, path := range paths {
+		t.Run(path, func(t *testing.T) {
+
+			// Act
+			_, err := sensorthings.Read(context.Background(), nil, base, path, sensorthings.Options{})
+
+			// Assert
+			assert.Equal(t, sensorthings.ErrorNotFound, err, "unknown resource found")
+		})
+	}
+}
+
+func TestRootListsEntitySets(t *testing.T) {
+
+	// Act
+	root := sensorthings.Root(base)
+
+	// Assert
+	sets, ok := root["value"].([]map[string]string)
+	require.True(t, ok, "entity sets not listed")
+	assert.Equal(t, 6, len(sets), "entity sets mismatch")
+	assert.Equal(t, base+"/Things", sets[0]["url"], "entity set url mismatch")
+}
+
+func TestViewsAreReadOnly(t *testing.T) {
+
+	for _, path := range []string{"Things", "Sensors", "ObservedProperties", "FeaturesOfInterest"} {
+		t.Run(path, func(t *testing.T) {
+
+			// Act
+			_, err := sensorthings.Create(context.Background(), nil, base, path, []byte(`{"name": "Banner's Garden"}`), "banner@example.com", time.Now())
+
+			// Assert
+			assert.Equal(t, sensorthings.ErrorReadOnly, err, "view was created")
+		})
+	}
+}
+
+func TestObservationsNeedADatastream(t *testing.T) {
+
+	// Act
+	_, err := sensorthings.Create(context.Background(), nil, base, "Observations", []byte(`{"result": 5, "validTime": "yesterday"}`), "banner@example.com", time.Now())
+
+	// Assert
+	require.Error(t, err, "observation without datastream accepted")
+	vError, ok := err.(*observations.ValidationError)
+	require.True(t, ok, "error is not a validation error")
+	var names []string
+	for _, f := range vError.Fields {
+		names = append(names, f.Field)
+	}
+	assert.ElementsMatch(t, []string{"Datastream", "validTime"}, names, "errors not named")
+}
@@ -0,0 +1,762 @@
+package sensorthings
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	geojson "github.com/paulmach/go.geojson"
+	"github.com/pkg/errors"
+	"github.com/schafer14/obs/internal/observations"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// conformance are the conformance classes of the SensorThings API the service
+// implements.
+var conformance = []string{
+	"http://www.opengis.net/spec/iot_sensing/1.1/req/datamodel",
+	"http://www.opengis.net/spec/iot_sensing/1.1/req/resource-path/resource-path-to-entities",
+	"http://www.opengis.net/spec/iot_sensing/1.1/req/request-data",
+	"http://www.opengis.net/spec/iot_sensing/1.1/req/create-update-delete/create-entity",
+	"http://www.opengis.net/spec/iot_sensing/1.1/req/create-update-delete/update-entity",
+}
+
+// Root describes the entity sets of the service, whose root is at base.
+func Root(base string) map[string]interface{} {
+	var value []map[string]string
+	for _, name := range setNames {
+		value = append(value, map[string]string{"name": name, "url": base + "/" + name})
+	}
+
+	return map[string]interface{}{
+		"value":          value,
+		"serverSettings": map[string]interface{}{"conformance": conformance},
+	}
+}
+
+// Segment is a segment of a resource path such as Things('a'). ID is set when
+// the segment identifies a single entity.
+type Segment struct {
+	Name  string
+	ID    string
+	HasID bool
+}
+
+// ParsePath parses a resource path relative to the service root, such as
+// Things('a')/Datastreams. Ids are quoted with single quotes, with two single
+// quotes standing for one.
+func ParsePath(path string) ([]Segment, error) {
+	var segments []Segment
+	for _, part := range splitTopLevel(strings.Trim(path, "/"), '/') {
+		if part == "" {
+			return nil, pathError("resource paths must not have empty segments")
+		}
+
+		i := strings.Index(part, "(")
+		if i == -1 {
+			segments = append(segments, Segment{Name: part})
+			continue
+		}
+		if !strings.HasSuffix(part, ")") {
+			return nil, pathError(fmt.Sprintf("unbalanced parentheses in %q", part))
+		}
+
+		key := part[i+1 : len(part)-1]
+		if len(key) >= 2 && strings.HasPrefix(key, "'") && strings.HasSuffix(key, "'") {
+			key = strings.Replace(key[1:len(key)-1], "''", "'", -1)
+		} else if _, err := strconv.ParseInt(key, 10, 64); err != nil {
+			return nil, pathError(fmt.Sprintf("invalid id %q, ids must be quoted", key))
+		}
+
+		segments = append(segments, Segment{Name: part[:i], ID: key, HasID: true})
+	}
+
+	return segments, nil
+}
+
+// pathError is the error for a resource path that cannot be parsed.
+func pathError(msg string) error {
+	return &observations.ValidationError{Err: "error parsing resource path", Fields: []observations.FieldError{{Field: "path", Error: msg}}}
+}
+
+// target is the entities a resource path refers to. They are the entities of
+// set made from the observations matching filters. When single is set the
+// path refers to a single entity.
+//
+// id is the id of the single entity when it was given in the path. parent and
+// parentID are the entity the path navigated from to reach a collection, which
+// new entities in the collection are linked to.
+type target struct {
+	set      *entitySet
+	filters  []observations.Filter
+	single   bool
+	id       string
+	parent   *entitySet
+	parentID string
+}
+
+// resolve finds the entities a resource path refers to.
+func resolve(path string) (target, error) {
+	segments, err := ParsePath(path)
+	if err != nil {
+		return target{}, err
+	}
+	if len(segments) == 0 {
+		return target{}, ErrorNotFound
+	}
+
+	set, ok := sets[segments[0].Name]
+	if !ok {
+		return target{}, ErrorNotFound
+	}
+
+	t := target{set: set}
+	if err := t.identify(segments[0]); err != nil {
+		return target{}, err
+	}
+
+	for _, seg := range segments[1:] {
+		if !t.single {
+			return target{}, pathError(fmt.Sprintf("%s must follow a single entity", seg.Name))
+		}
+
+		if name, ok := t.set.toOne[seg.Name]; ok && !seg.HasID {
+			t = target{set: sets[name], filters: t.filters, single: true}
+			continue
+		}
+
+		if name, ok := t.set.toMany[seg.Name]; ok {
+			t = target{set: sets[name], filters: t.filters, parent: t.set, parentID: t.id}
+			if err := t.identify(seg); err != nil {
+				return target{}, err
+			}
+			continue
+		}
+
+		// Properties and their raw values are valid paths but are not
+		// provided.
+		if _, err := t.set.property(seg.Name); err == nil || seg.Name == "$value" {
+			return target{}, ErrorNotSupported
+		}
+
+		return target{}, ErrorNotFound
+	}
+
+	return t, nil
+}
+
+// identify restricts a target to the entity identified by a segment.
+func (t *target) identify(seg Segment) error {
+	if !seg.HasID {
+		return nil
+	}
+
+	filters, err := t.set.keyFilters(seg.ID)
+	if err != nil {
+		return ErrorNotFound
+	}
+
+	t.filters = append(append([]observations.Filter(nil), t.filters...), filters...)
+	t.single = true
+	t.id = seg.ID
+
+	return nil
+}
+
+// Read retrieves the entity or collection of entities at a resource path,
+// represented as they are in SensorThings responses. Links in the response
+// are relative to base, the url of the service root.
+func Read(ctx context.Context, repo observations.Repository, base, path string, opts Options) (map[string]interface{}, error) {
+	t, err := resolve(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if errs := checkExpand(t.set, opts.Expand, "$expand"); len(errs) > 0 {
+		return nil, &observations.ValidationError{Err: "error validating query options", Fields: errs}
+	}
+
+	if t.single {
+		obss, _, err := list(ctx, repo, t.set, observations.Query{Filters: t.filters}, 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(obss) == 0 {
+			return nil, ErrorNotFound
+		}
+		return render(ctx, repo, base, t.set, obss[0], opts)
+	}
+
+	return readCollection(ctx, repo, base, base+"/"+strings.Trim(path, "/"), t.set, t.filters, opts)
+}
+
+// readCollection retrieves a page of the entities of a set that are made from
+// observations matching filters. Link is the url of the collection.
+func readCollection(ctx context.Context, repo observations.Repository, base, link string, set *entitySet, filters []observations.Filter, opts Options) (map[string]interface{}, error) {
+	q, err := query(set, filters, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	obss, more, err := list(ctx, repo, set, q, opts.Top)
+	if err != nil {
+		return nil, err
+	}
+
+	value := []map[string]interface{}{}
+	for _, obs := range obss {
+		entity, err := render(ctx, repo, base, set, obs, opts)
+		if err != nil {
+			return nil, err
+		}
+		value = append(value, entity)
+	}
+
+	res := map[string]interface{}{"value": value}
+
+	if opts.Count {
+		paths := set.keys
+		if set.name == "Observations" {
+			paths = nil
+		}
+		n, err := repo.Count(ctx, q, paths)
+		if err != nil {
+			return nil, err
+		}
+		res["@iot.count"] = n
+	}
+
+	if more {
+		res["@iot.nextLink"] = nextLink(link, opts)
+	}
+
+	return res, nil
+}
+
+// query converts the options of a request for a collection to a query of the
+// observations the entities are made from.
+func query(set *entitySet, filters []observations.Filter, opts Options) (observations.Query, error) {
+	var errs []observations.FieldError
+
+	where, err := set.compileFilter(opts.Filter)
+	if err != nil {
+		errs = append(errs, observations.FieldError{Field: "$filter", Error: err.Error()})
+	}
+
+	sort, err := set.compileOrderBy(opts.OrderBy)
+	if err != nil {
+		errs = append(errs, observations.FieldError{Field: "$orderby", Error: err.Error()})
+	}
+
+	if len(errs) > 0 {
+		return observations.Query{}, &observations.ValidationError{Err: "error validating query options", Fields: errs}
+	}
+
+	return observations.Query{Filters: filters, Where: where, Sort: sort, Offset: opts.Skip}, nil
+}
+
+// list fetches up to top entities of a set as the observations they are made
+// from. More reports whether there are entities after those returned.
+func list(ctx context.Context, repo observations.Repository, set *entitySet, q observations.Query, top int) ([]observations.Observation, bool, error) {
+	if top == 0 {
+		return nil, false, nil
+	}
+
+	if set.name == "Observations" {
+		q.Limit = top
+		page, err := repo.Get(ctx, q)
+		return page.Observations, page.Next != "", err
+	}
+
+	// One more entity than requested is fetched to know if there are more.
+	q.Limit = top + 1
+	obss, err := repo.Distinct(ctx, q, set.keys)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(obss) > top {
+		return obss[:top], true, nil
+	}
+
+	return obss, false, nil
+}
+
+// nextLink links to the page of a collection after the page requested with
+// opts.
+func nextLink(link string, opts Options) string {
+	values := url.Values{}
+	for key, v := range opts.values {
+		values[key] = v
+	}
+	if opts.Filter != "" {
+		values.Set("$filter", opts.Filter)
+	}
+	if opts.OrderBy != "" {
+		values.Set("$orderby", opts.OrderBy)
+	}
+	values.Set("$top", strconv.Itoa(opts.Top))
+	values.Set("$skip", strconv.Itoa(opts.Skip+opts.Top))
+
+	return link + "?" + values.Encode()
+}
+
+// selfLink is the url of an entity.
+func selfLink(base string, set *entitySet, id string) string {
+	return fmt.Sprintf("%s/%s('%s')", base, set.name, url.PathEscape(strings.Replace(id, "'", "''", -1)))
+}
+
+// checkExpand checks that expanded properties are navigation properties.
+func checkExpand(set *entitySet, expands []Expand, name string) []observations.FieldError {
+	var errs []observations.FieldError
+	for _, expand := range expands {
+		target, ok := set.toOne[expand.Property]
+		if !ok {
+			target, ok = set.toMany[expand.Property]
+		}
+		if !ok {
+			errs = append(errs, observations.FieldError{Field: name, Error: fmt.Sprintf("%s is not a navigation property of %s", expand.Property, set.name)})
+			continue
+		}
+		errs = append(errs, checkExpand(sets[target], expand.Options.Expand, name+"("+expand.Property+")")...)
+	}
+
+	return errs
+}
+
+// render represents the entity of a set made from an observation, with the
+// properties selected and navigation properties expanded by opts.
+func render(ctx context.Context, repo observations.Repository, base string, set *entitySet, obs observations.Observation, opts Options) (map[string]interface{}, error) {
+	id := set.id(obs)
+	self := selfLink(base, set, id)
+
+	entity := set.render(obs)
+	for nav := range set.toOne {
+		entity[nav+"@iot.navigationLink"] = self + "/" + nav
+	}
+	for nav := range set.toMany {
+		entity[nav+"@iot.navigationLink"] = self + "/" + nav
+	}
+
+	if len(opts.Select) > 0 {
+		selected := map[string]bool{}
+		for _, property := range opts.Select {
+			selected[property] = true
+		}
+		for key := range entity {
+			if !selected[strings.TrimSuffix(key, "@iot.navigationLink")] {
+				delete(entity, key)
+			}
+		}
+	}
+
+	entity["@iot.id"] = id
+	entity["@iot.selfLink"] = self
+
+	if len(opts.Expand) == 0 {
+		return entity, nil
+	}
+
+	filters, err := set.keyFilters(id)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, expand := range opts.Expand {
+		if name, ok := set.toOne[expand.Property]; ok {
+			obss, _, err := list(ctx, repo, sets[name], observations.Query{Filters: filters}, 1)
+			if err != nil {
+				return nil, err
+			}
+			if len(obss) == 0 {
+				continue
+			}
+			related, err := render(ctx, repo, base, sets[name], obss[0], expand.Options)
+			if err != nil {
+				return nil, err
+			}
+			entity[expand.Property] = related
+			continue
+		}
+
+		link := self + "/" + expand.Property
+		related, err := readCollection(ctx, repo, base, link, sets[set.toMany[expand.Property]], filters, expand.Options)
+		if err != nil {
+			return nil, err
+		}
+		entity[expand.Property] = related["value"]
+		if n, ok := related["@iot.count"]; ok {
+			entity[expand.Property+"@iot.count"] = n
+		}
+		if next, ok := related["@iot.nextLink"]; ok {
+			entity[expand.Property+"@iot.nextLink"] = next
+		}
+	}
+
+	return entity, nil
+}
+
+// Entity is an entity in a request body. Entities given only by @iot.id refer
+// to existing entities.
+type Entity struct {
+	ID          string            `json:"@iot.id"`
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Definition  string            `json:"definition"`
+	Metadata    string            `json:"metadata"`
+	Properties  map[string]string `json:"properties"`
+}
+
+// NewDatastream is a datastream in a request body. A datastream without an
+// @iot.id is made from the Thing, Sensor and ObservedProperty it links. The
+// feature type of its observations is the featureTypeId property of the
+// datastream or its Thing, and the property type is the propertyTypeId
+// property of the datastream or its ObservedProperty.
+type NewDatastream struct {
+	ID                string            `json:"@iot.id"`
+	Properties        map[string]string `json:"properties"`
+	UnitOfMeasurement struct {
+		Symbol string `json:"symbol"`
+	} `json:"unitOfMeasurement"`
+	Thing            *Entity `json:"Thing"`
+	Sensor           *Entity `json:"Sensor"`
+	ObservedProperty *Entity `json:"ObservedProperty"`
+}
+
+// FeatureOfInterest is a feature of interest in a request body. Features of
+// interest are the features of observations, so an @iot.id must be the id of
+// the Thing of the datastream. The feature is the phenomenon location of the
+// observation.
+type FeatureOfInterest struct {
+	ID      string            `json:"@iot.id"`
+	Feature *geojson.Geometry `json:"feature"`
+}
+
+// NewObservation is an observation in a request body. PhenomenonTime and
+// ResultTime are RFC3339 times and ValidTime is a start/end period. Results
+// that are not objects are stored as the value field of the result.
+type NewObservation struct {
+	PhenomenonTime    string                 `json:"phenomenonTime"`
+	ResultTime        string                 `json:"resultTime"`
+	ValidTime         string                 `json:"validTime"`
+	Result            interface{}            `json:"result"`
+	Parameters        map[string]interface{} `json:"parameters"`
+	Datastream        *NewDatastream         `json:"Datastream"`
+	FeatureOfInterest *FeatureOfInterest     `json:"FeatureOfInterest"`
+}
+
+// Create creates an entity in the collection at a resource path from a
+// request body. Observations are created in Observations or in the
+// Observations of a Datastream. Creating a Datastream does not store it, the
+// datastream exists once it has observations. Other entity sets are read only.
+func Create(ctx context.Context, repo observations.Repository, base, path string, body []byte, by string, now time.Time) (map[string]interface{}, error) {
+	t, err := resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	if t.single {
+		return nil, pathError("entities are created in collections")
+	}
+
+	switch t.set.name {
+	case "Datastreams":
+		if t.parent != nil {
+			return nil, ErrorNotSupported
+		}
+		var newDs NewDatastream
+		if err := decode(body, &newDs); err != nil {
+			return nil, err
+		}
+		obs, errs := datastreamFields(ctx, repo, newDs, "")
+		if len(errs) > 0 {
+			return nil, &observations.ValidationError{Err: "error validating datastream", Fields: errs}
+		}
+		return render(ctx, repo, base, t.set, obs, Options{})
+
+	case "Observations":
+		var newObs NewObservation
+		if err := decode(body, &newObs); err != nil {
+			return nil, err
+		}
+		if t.parent != nil {
+			if t.parent.name != "Datastreams" || t.parentID == "" {
+				return nil, ErrorNotSupported
+			}
+			newObs.Datastream = &NewDatastream{ID: t.parentID}
+		}
+
+		obs, err := newObservation(ctx, repo, newObs, now)
+		if err != nil {
+			return nil, err
+		}
+		obs.ModifiedBy = by
+
+		if err := repo.Save(ctx, obs); err != nil {
+			return nil, errors.Wrap(err, "saving observation")
+		}
+
+		return render(ctx, repo, base, t.set, obs, Options{})
+	}
+
+	return nil, ErrorReadOnly
+}
+
+// Update amends the observation at a resource path with the fields of a
+// request body in a new revision. Other entities are read only.
+func Update(ctx context.Context, repo observations.Repository, base, path string, body []byte, by string, now time.Time) (map[string]interface{}, error) {
+	t, err := resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	if !t.single {
+		return nil, pathError("only single entities may be updated")
+	}
+	if t.set.name != "Observations" || t.id == "" {
+		return nil, ErrorReadOnly
+	}
+
+	prev, err := repo.Find(ctx, t.id)
+	if err != nil {
+		if err == observations.ErrorNotFound {
+			return nil, ErrorNotFound
+		}
+		return nil, err
+	}
+
+	var patch map[string]json.RawMessage
+	if err := decode(body, &patch); err != nil {
+		return nil, err
+	}
+
+	var fields NewObservation
+	if err := decode(body, &fields); err != nil {
+		return nil, err
+	}
+
+	newObs := prev.AsNew()
+	var errs []observations.FieldError
+	for key := range patch {
+		switch key {
+		case "@iot.id", "phenomenonTime", "resultTime", "validTime", "result", "parameters":
+		default:
+			errs = append(errs, observations.FieldError{Field: key, Error: fmt.Sprintf("%s cannot be updated", key)})
+		}
+	}
+	if _, ok := patch["result"]; ok {
+		newObs.Result = resultOf(fields.Result)
+	}
+	if _, ok := patch["parameters"]; ok {
+		newObs.Tags = tags(fields.Parameters)
+	}
+	errs = append(errs, setTimes(&newObs, fields)...)
+	if len(errs) > 0 {
+		return nil, &observations.ValidationError{Err: "error validating observation", Fields: errs}
+	}
+
+	obs, err := observations.Revise(prev, newObs, by, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := repo.Supersede(ctx, obs); err != nil {
+		return nil, err
+	}
+
+	return render(ctx, repo, base, t.set, obs, Options{})
+}
+
+// decode reads a request body.
+func decode(body []byte, val interface{}) error {
+	if err := json.Unmarshal(body, val); err != nil {
+		return &observations.ValidationError{Err: "error decoding request body", Fields: []observations.FieldError{{Field: "body", Error: err.Error()}}}
+	}
+	return nil
+}
+
+// newObservation converts an observation in a request body to an observation.
+func newObservation(ctx context.Context, repo observations.Repository, newObs NewObservation, now time.Time) (observations.Observation, error) {
+	var errs []observations.FieldError
+
+	var fields observations.Observation
+	if newObs.Datastream == nil {
+		errs = append(errs, observations.FieldError{Field: "Datastream", Error: "Datastream is required"})
+	} else {
+		var dsErrs []observations.FieldError
+		fields, dsErrs = datastreamFields(ctx, repo, *newObs.Datastream, "Datastream/")
+		errs = append(errs, dsErrs...)
+	}
+
+	obs := observations.NewObservation{
+		Feature:      fields.Feature,
+		FeatureType:  fields.FeatureType,
+		Property:     fields.Property,
+		PropertyType: fields.PropertyType,
+		Process:      fields.Process,
+		Scale:        fields.Scale,
+		Result:       resultOf(newObs.Result),
+		Tags:         tags(newObs.Parameters),
+	}
+
+	if foi := newObs.FeatureOfInterest; foi != nil {
+		if foi.ID != "" && foi.ID != fields.Feature.ID {
+			errs = append(errs, observations.FieldError{Field: "FeatureOfInterest/@iot.id", Error: "the feature of interest must be the Thing of the Datastream"})
+		}
+		obs.PhenomenonLocation = foi.Feature
+	}
+
+	errs = append(errs, setTimes(&obs, newObs)...)
+	if len(errs) > 0 {
+		return observations.Observation{}, &observations.ValidationError{Err: "error validating observation", Fields: errs}
+	}
+
+	return observations.New(obs, uuid.New().String(), now)
+}
+
+// datastreamFields finds the fields of the observations of a datastream. The
+// fields of a datastream given by @iot.id are copied from one of its
+// observations, or only the ids are known when it has none. Names of errors
+// are prefixed with prefix.
+func datastreamFields(ctx context.Context, repo observations.Repository, newDs NewDatastream, prefix string) (observations.Observation, []observations.FieldError) {
+	if newDs.ID != "" {
+		ds, err := parseDatastreamID(newDs.ID)
+		if err != nil {
+			return observations.Observation{}, []observations.FieldError{{Field: prefix + "@iot.id", Error: err.Error()}}
+		}
+
+		filters, _ := sets["Datastreams"].keyFilters(newDs.ID)
+		obss, _, err := list(ctx, repo, sets["Datastreams"], observations.Query{Filters: filters}, 1)
+		if err == nil && len(obss) > 0 {
+			return obss[0], nil
+		}
+
+		return observations.Observation{
+			Feature:      observations.Referenceable{ID: ds.FeatureID},
+			FeatureType:  observations.Referenceable{ID: ds.FeatureTypeID},
+			Property:     observations.Referenceable{ID: ds.PropertyID},
+			PropertyType: observations.Referenceable{ID: ds.PropertyTypeID},
+			Process:      observations.Referenceable{ID: ds.ProcessID},
+		}, nil
+	}
+
+	var errs []observations.FieldError
+	required := map[string]*Entity{"Thing": newDs.Thing, "Sensor": newDs.Sensor, "ObservedProperty": newDs.ObservedProperty}
+	for _, name := range []string{"Thing", "Sensor", "ObservedProperty"} {
+		if required[name] == nil {
+			errs = append(errs, observations.FieldError{Field: prefix + name, Error: name + " is required"})
+		}
+	}
+	if len(errs) > 0 {
+		return observations.Observation{}, errs
+	}
+
+	featureType := newDs.Properties["featureTypeId"]
+	if featureType == "" {
+		featureType = newDs.Thing.Properties["featureTypeId"]
+	}
+	if featureType == "" {
+		errs = append(errs, observations.FieldError{Field: prefix + "properties/featureTypeId", Error: "featureTypeId is required on the Datastream or its Thing"})
+	}
+
+	propertyType := newDs.Properties["propertyTypeId"]
+	if propertyType == "" {
+		propertyType = newDs.ObservedProperty.Properties["propertyTypeId"]
+	}
+	if propertyType == "" {
+		errs = append(errs, observations.FieldError{Field: prefix + "properties/propertyTypeId", Error: "propertyTypeId is required on the Datastream or its ObservedProperty"})
+	}
+
+	return observations.Observation{
+		Feature:      referenceable(*newDs.Thing, ""),
+		FeatureType:  observations.Referenceable{ID: featureType},
+		Property:     referenceable(*newDs.ObservedProperty, newDs.ObservedProperty.Definition),
+		PropertyType: observations.Referenceable{ID: propertyType},
+		Process:      referenceable(*newDs.Sensor, newDs.Sensor.Metadata),
+		Scale:        newDs.UnitOfMeasurement.Symbol,
+	}, errs
+}
+
+// referenceable converts an entity in a request body to a referenceable field
+// of an observation. Entities without an id are given a new one.
+func referenceable(e Entity, reference string) observations.Referenceable {
+	id := e.ID
+	if id == "" {
+		id = uuid.New().String()
+	}
+	return observations.Referenceable{ID: id, Label: e.Name, Description: e.Description, Reference: reference}
+}
+
+// resultOf converts a SensorThings result to the result of an observation.
+func resultOf(r interface{}) bson.M {
+	if r == nil {
+		return nil
+	}
+	if m, ok := r.(map[string]interface{}); ok {
+		return bson.M(m)
+	}
+	return bson.M{"value": r}
+}
+
+// tags converts the parameters of an observation to its tags.
+func tags(parameters map[string]interface{}) map[string]string {
+	if parameters == nil {
+		return nil
+	}
+	t := map[string]string{}
+	for key, value := range parameters {
+		if s, ok := value.(string); ok {
+			t[key] = s
+			continue
+		}
+		data, _ := json.Marshal(value)
+		t[key] = string(data)
+	}
+	return t
+}
+
+// setTimes sets the times of an observation from the times in a request body.
+// Times that are not given are left unchanged.
+func setTimes(obs *observations.NewObservation, newObs NewObservation) []observations.FieldError {
+	var errs []observations.FieldError
+
+	instants := []struct {
+		name  string
+		value string
+		to    *time.Time
+	}{
+		{"phenomenonTime", newObs.PhenomenonTime, &obs.PhenomenonTime},
+		{"resultTime", newObs.ResultTime, &obs.ResultTime},
+	}
+	for _, instant := range instants {
+		if instant.value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339Nano, instant.value)
+		if err != nil {
+			errs = append(errs, observations.FieldError{Field: instant.name, Error: fmt.Sprintf("%q is not an RFC3339 time", instant.value)})
+			continue
+		}
+		*instant.to = t
+	}
+
+	if newObs.ValidTime != "" {
+		parts := strings.Split(newObs.ValidTime, "/")
+		var start, end time.Time
+		var err error
+		if len(parts) == 2 {
+			if start, err = time.Parse(time.RFC3339Nano, parts[0]); err == nil {
+				end, err = time.Parse(time.RFC3339Nano, parts[1])
+			}
+		}
+		if len(parts) != 2 || err != nil || !start.Before(end) {
+			errs = append(errs, observations.FieldError{Field: "validTime", Error: fmt.Sprintf("%q is not a period in the form start/end", newObs.ValidTime)})
+		} else {
+			obs.ValidInterval = observations.Interval{StartTime: start, Duration: end.Sub(start)}
+		}
+	}
+
+	return errs
+}
@@ -0,0 +1,105 @@
+package sensorthings_test
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/schafer14/obs/internal/observations"
+	"github.com/schafer14/obs/internal/sensorthings"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const newObservation = `{
+	"phenomenonTime": "2020-03-01T00:00:00Z",
+	"result": 5,
+	"parameters": {"observed by": "Banner"},
+	"Datastream": {
+		"unitOfMeasurement": {"symbol": "{score}"},
+		"properties": {"featureTypeId": "urn:example:garden", "propertyTypeId": "urn:example:scale-1-5"},
+		"Thing": {"@iot.id": "https://example.com/banners-garden", "name": "Banner's Garden"},
+		"Sensor": {"@iot.id": "urn:example:measurement:by-eye", "name": "Walk of garden"},
+		"ObservedProperty": {"@iot.id": "urn:example:health", "name": "Health"}
+	}
+}`
+
+func TestCreatingAndReadingObservations(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Arrange
+	ctx := context.Background()
+	require.Nil(t, coll.Drop(ctx), "dropping collection")
+	repo := observations.NewMongo(coll)
+	now := time.Date(2020, 3, 2, 0, 0, 0, 0, time.UTC)
+
+	created, err := sensorthings.Create(ctx, repo, base, "Observations", []byte(newObservation), "banner@example.com", now)
+	require.Nil(t, err, "creating observation")
+	datastream, err := sensorthings.Read(ctx, repo, base, "Things('https://example.com/banners-garden')/Datastreams", sensorthings.Options{Top: 10})
+	require.Nil(t, err, "reading datastreams")
+	datastreams := datastream["value"].([]map[string]interface{})
+	require.Equal(t, 1, len(datastreams), "datastreams mismatch")
+	dsID := datastreams[0]["@iot.id"].(string)
+
+	second := `{"phenomenonTime": "2020-03-02T00:00:00Z", "result": 2}`
+	_, err = sensorthings.Create(ctx, repo, base, "Datastreams('"+dsID+"')/Observations", []byte(second), "banner@example.com", now)
+	require.Nil(t, err, "creating observation in datastream")
+
+	opts, err := sensorthings.ParseOptions(url.Values{
+		"$filter":  {"result gt 3 and Datastream/Thing/name eq 'Banner''s Garden'"},
+		"$expand":  {"Datastream($expand=ObservedProperty)"},
+		"$count":   {"true"},
+		"$orderby": {"phenomenonTime desc"},
+	})
+	require.Nil(t, err, "parsing options")
+
+	// Act
+	filtered, err := sensorthings.Read(ctx, repo, base, "Datastreams('"+dsID+"')/Observations", opts)
+	require.Nil(t, err, "reading observations")
+	all, err := sensorthings.Read(ctx, repo, base, "Observations", sensorthings.Options{Top: 1})
+	require.Nil(t, err, "reading page of observations")
+
+	// Assert
+	assert.Equal(t, float64(5), created["result"], "created result mismatch")
+	values := filtered["value"].([]map[string]interface{})
+	require.Equal(t, 1, len(values), "filtered observations mismatch")
+	assert.Equal(t, int64(1), filtered["@iot.count"], "count mismatch")
+	assert.Equal(t, created["@iot.id"], values[0]["@iot.id"], "filtered observation mismatch")
+	assert.Equal(t, map[string]string{"observed by": "Banner"}, values[0]["parameters"], "parameters mismatch")
+	expanded := values[0]["Datastream"].(map[string]interface{})
+	assert.Equal(t, dsID, expanded["@iot.id"], "expanded datastream mismatch")
+	property := expanded["ObservedProperty"].(map[string]interface{})
+	assert.Equal(t, "Health", property["name"], "expanded property mismatch")
+	assert.Equal(t, 1, len(all["value"].([]map[string]interface{})), "page size mismatch")
+	assert.Contains(t, all["@iot.nextLink"], "%24skip=1", "next link mismatch")
+}
+
+func TestUpdatingObservations(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Arrange
+	ctx := context.Background()
+	require.Nil(t, coll.Drop(ctx), "dropping collection")
+	repo := observations.NewMongo(coll)
+	now := time.Date(2020, 3, 2, 0, 0, 0, 0, time.UTC)
+	created, err := sensorthings.Create(ctx, repo, base, "Observations", []byte(newObservation), "banner@example.com", now)
+	require.Nil(t, err, "creating observation")
+	path := "Observations('" + created["@iot.id"].(string) + "')"
+
+	// Act
+	updated, err := sensorthings.Update(ctx, repo, base, path, []byte(`{"result": 4}`), "banner@example.com", now.Add(time.Hour))
+	require.Nil(t, err, "updating observation")
+	_, err = sensorthings.Update(ctx, repo, base, "Things('https://example.com/banners-garden')", []byte(`{"name": "Garden"}`), "banner@example.com", now)
+
+	// Assert
+	assert.Equal(t, float64(4), updated["result"], "result not updated")
+	assert.Equal(t, created["phenomenonTime"], updated["phenomenonTime"], "phenomenon time changed")
+	assert.Equal(t, sensorthings.ErrorReadOnly, err, "thing was updated")
+}
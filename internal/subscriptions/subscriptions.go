@@ -0,0 +1,202 @@
+// Package subscriptions follows observations as they are saved so they can be
+// pushed to clients.
+//
+// Subscriptions read new observations from the database in the order they
+// were saved, using the same queries as listing observations, so they match
+// exactly the observations a client would see by polling. A Broker wakes
+// subscriptions as soon as observations are saved by this instance of the
+// API, and subscriptions also poll so observations saved by other instances
+// are found. Each event has a token, and a client that reconnects with the
+// token of the last event it received is sent every matching observation
+// saved since.
+package subscriptions
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/schafer14/obs/internal/observations"
+)
+
+// PollInterval is how often subscriptions look for observations when they
+// have not been woken by a broker.
+const PollInterval = 5 * time.Second
+
+// settle is how long after its modified time an observation may still be
+// being saved. Observations saved concurrently may become visible out of
+// order, so subscriptions read again from this long before the last
+// observation they sent.
+const settle = 5 * time.Second
+
+// batchSize is the most observations read from the database at a time.
+const batchSize = 100
+
+// Types of events.
+const (
+	Created = "created"
+	Revised = "revised"
+)
+
+// Event is an observation sent to a subscription. Type is Created for the
+// first revision of an observation and Revised for later revisions. Token
+// resumes the subscription after this event.
+type Event struct {
+	Token       string                   `json:"token"`
+	Type        string                   `json:"type"`
+	Observation observations.Observation `json:"observation"`
+}
+
+// Broker wakes subscriptions when observations are saved, and ends them when
+// it is closed.
+type Broker struct {
+	mu          sync.Mutex
+	subscribers map[chan struct{}]bool
+	closed      chan struct{}
+	closeOnce   sync.Once
+}
+
+// NewBroker creates a broker without any subscriptions.
+func NewBroker() *Broker {
+	return &Broker{subscribers: map[chan struct{}]bool{}, closed: make(chan struct{})}
+}
+
+// Close ends every subscription, and those that follow after it, so the
+// server can shut down without waiting for clients to leave. It may be called
+// more than once.
+func (b *Broker) Close() {
+	b.closeOnce.Do(func() { close(b.closed) })
+}
+
+// Notify wakes every subscription. It should be called after observations are
+// saved and never blocks.
+func (b *Broker) Notify() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for wake := range b.subscribers {
+		select {
+		case wake <- struct{}{}:
+		default:
+			// The subscription has already been woken and will read
+			// every observation saved so far.
+		}
+	}
+}
+
+// subscribe adds a subscription that is woken through the returned channel
+// until it is cancelled.
+func (b *Broker) subscribe() (<-chan struct{}, func()) {
+	wake := make(chan struct{}, 1)
+
+	b.mu.Lock()
+	b.subscribers[wake] = true
+	b.mu.Unlock()
+
+	return wake, func() {
+		b.mu.Lock()
+		delete(b.subscribers, wake)
+		b.mu.Unlock()
+	}
+}
+
+// Follow calls fn with an event for each observation matching a query that is
+// saved after a token, until the context is done, the broker is closed or fn
+// returns an error. It returns nil when the broker is closed. The sort order,
+// cursor, offset and limit of the query are ignored.
+//
+// Events are sent at least once. Observations saved more than a few seconds
+// after their modified time may not be sent.
+func Follow(ctx context.Context, repo observations.Repository, b *Broker, q observations.Query, from observations.Token, fn func(Event) error) error {
+	if err := q.Validate(); err != nil {
+		return err
+	}
+
+	select {
+	case <-b.closed:
+		return nil
+	default:
+	}
+
+	wake, cancel := b.subscribe()
+	defer cancel()
+
+	ticker := time.NewTicker(PollInterval)
+	defer ticker.Stop()
+
+	f := follower{from: from, last: from, sent: map[string]time.Time{}}
+	for {
+		if err := f.read(ctx, repo, q, fn); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-b.closed:
+			return nil
+		case <-wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// follower is the position of a subscription. From is where the subscription
+// started, last is the latest observation it has sent and sent holds the
+// revisions it has sent that may be read again.
+type follower struct {
+	from observations.Token
+	last observations.Token
+	sent map[string]time.Time
+}
+
+// read sends every observation saved since the last read.
+func (f *follower) read(ctx context.Context, repo observations.Repository, q observations.Query, fn func(Event) error) error {
+	after := observations.TokenAt(f.last.ModifiedAt.Add(-settle))
+	if after.ModifiedAt.Before(f.from.ModifiedAt) {
+		after = f.from
+	}
+
+	for {
+		obss, err := repo.Changes(ctx, q, after, batchSize)
+		if err != nil {
+			return err
+		}
+
+		for _, obs := range obss {
+			after = observations.TokenOf(obs)
+
+			key := obs.ID + "/" + strconv.Itoa(obs.Revision)
+			if _, ok := f.sent[key]; ok {
+				continue
+			}
+
+			e := Event{Token: after.String(), Type: Created, Observation: obs}
+			if obs.Revision > 1 {
+				e.Type = Revised
+			}
+			if err := fn(e); err != nil {
+				return err
+			}
+
+			f.sent[key] = obs.ModifiedAt
+			if obs.ModifiedAt.After(f.last.ModifiedAt) {
+				f.last = after
+			}
+		}
+
+		if len(obss) < batchSize {
+			break
+		}
+	}
+
+	// Revisions are only remembered while they may be read again.
+	for key, modifiedAt := range f.sent {
+		if modifiedAt.Before(f.last.ModifiedAt.Add(-settle)) {
+			delete(f.sent, key)
+		}
+	}
+
+	return nil
+}
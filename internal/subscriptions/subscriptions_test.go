@@ -0,0 +1,141 @@
+package subscriptions_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/schafer14/obs/internal/observations"
+	"github.com/schafer14/obs/internal/subscriptions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInvalidQueriesAreRejected(t *testing.T) {
+
+	// Arrange
+	q := observations.Query{Filters: []observations.Filter{{Path: "colour", Op: "=", Matcher: "red"}}}
+
+	// Act
+	err := subscriptions.Follow(context.Background(), nil, subscriptions.NewBroker(), q, observations.Token{}, nil)
+
+	// Assert
+	_, ok := err.(*observations.ValidationError)
+	assert.True(t, ok, "invalid query accepted")
+}
+
+func TestNotifyingWithoutSubscriptions(t *testing.T) {
+
+	// Arrange
+	b := subscriptions.NewBroker()
+
+	// Act
+	done := make(chan bool)
+	go func() {
+		b.Notify()
+		b.Notify()
+		done <- true
+	}()
+
+	// Assert
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("notify blocked")
+	}
+}
+
+func TestClosingTheBroker(t *testing.T) {
+
+	// Arrange
+	b := subscriptions.NewBroker()
+	followed := make(chan error)
+	go func() {
+		followed <- subscriptions.Follow(context.Background(), observations.NewMemory(), b, observations.Query{}, observations.TokenAt(time.Now()), func(subscriptions.Event) error {
+			return nil
+		})
+	}()
+
+	// Act
+	time.Sleep(10 * time.Millisecond)
+	b.Close()
+	b.Close()
+
+	// Assert
+	select {
+	case err := <-followed:
+		assert.Nil(t, err, "subscription not ended cleanly")
+	case <-time.After(time.Second):
+		t.Fatal("subscription not ended when the broker closed")
+	}
+	err := subscriptions.Follow(context.Background(), observations.NewMemory(), b, observations.Query{}, observations.TokenAt(time.Now()), nil)
+	assert.Nil(t, err, "subscription started after the broker closed")
+}
+
+func TestFollowingObservations(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Arrange
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.Nil(t, coll.Drop(ctx), "deleting collection")
+
+	b := subscriptions.NewBroker()
+	start := time.Now().Add(-time.Minute)
+	old := save(t, ctx, "urn:example:health", start)
+	q := observations.Query{Filters: []observations.Filter{{Path: "propertyId", Op: "=", Matcher: "urn:example:health"}}}
+
+	events := make(chan subscriptions.Event, 10)
+	done := make(chan error)
+	go func() {
+		done <- subscriptions.Follow(ctx, observations.NewMongo(coll), b, q, observations.TokenOf(old), func(e subscriptions.Event) error {
+			events <- e
+			return nil
+		})
+	}()
+
+	// Act
+	save(t, ctx, "urn:example:yield", time.Now())
+	created := save(t, ctx, "urn:example:health", time.Now())
+	b.Notify()
+
+	// Assert
+	select {
+	case e := <-events:
+		assert.Equal(t, created.ID, e.Observation.ID, "observation mismatch")
+		assert.Equal(t, subscriptions.Created, e.Type, "event type mismatch")
+		token, err := observations.ParseToken(e.Token)
+		require.Nil(t, err, "parsing event token")
+		assert.Equal(t, created.ID, token.ID, "token mismatch")
+	case <-time.After(subscriptions.PollInterval / 2):
+		t.Fatal("observation not sent after notify")
+	}
+
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected event for %s", e.Observation.Property.ID)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-done, "subscription not ended")
+}
+
+// save saves an observation of a property.
+func save(t *testing.T, ctx context.Context, property string, now time.Time) observations.Observation {
+	obs, err := observations.New(observations.NewObservation{
+		Feature:      observations.Referenceable{ID: "https://example.com/banners-garden"},
+		FeatureType:  observations.Referenceable{ID: "urn:example:garden"},
+		Property:     observations.Referenceable{ID: property},
+		PropertyType: observations.Referenceable{ID: "urn:example:scale-1-5"},
+		Process:      observations.Referenceable{ID: "urn:example:measurement:by-eye"},
+		Result:       map[string]interface{}{"wisteria": int64(5)},
+	}, uuid.New().String(), now)
+	require.Nil(t, err, "creating observation")
+	require.Nil(t, observations.Save(ctx, coll, obs), "saving observation")
+	return obs
+}
@@ -5,12 +5,19 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"os"
 	"os/exec"
 	"testing"
 	"time"
 
+	gcfirestore "cloud.google.com/go/firestore"
+	driver "github.com/arangodb/go-driver"
+	"github.com/jmoiron/sqlx"
 	"github.com/pkg/errors"
+	"github.com/schafer14/obs/internal/platform/arango"
 	"github.com/schafer14/obs/internal/platform/database"
+	"github.com/schafer14/obs/internal/platform/firestore"
+	"github.com/schafer14/obs/internal/platform/postgres"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
@@ -29,7 +36,7 @@ func DatabaseTest(t *testing.T, c *Container) (*mongo.Database, error) {
 	maxAttempts := 30
 	var db *mongo.Database
 	for attempts := 1; attempts <= maxAttempts; attempts++ {
-		dbTry, err := database.Open(ctx, c.Host, "observations")
+		dbTry, err := database.Open(ctx, database.Config{URI: "mongodb://" + c.Host, Name: "observations"})
 
 		if err == nil {
 			db = dbTry
@@ -102,7 +109,216 @@ func SetupDatabase(t *testing.T) *Container {
 
 	c := Container{
 		ID:   id,
-		Host: "mongodb://" + network.HostIP + ":" + network.HostPort,
+		Host: network.HostIP + ":" + network.HostPort,
+	}
+
+	t.Log("DB Host:", c.Host)
+
+	return &c
+}
+
+// PostgresTest connects to the postgres database in a container started with
+// SetupPostgres, waiting for it to be ready.
+func PostgresTest(t *testing.T, c *Container) (*sqlx.DB, error) {
+	t.Helper()
+
+	maxAttempts := 30
+	var err error
+	for attempts := 1; attempts <= maxAttempts; attempts++ {
+		var db *sqlx.DB
+		db, err = postgres.Open(context.Background(), "postgres://postgres:postgres@"+c.Host+"/postgres?sslmode=disable")
+		if err == nil {
+			return db, nil
+		}
+		time.Sleep(time.Second)
+	}
+
+	dumpContainerLogs(t, c)
+	TeardownDatabase(t, c)
+	return nil, errors.Wrap(err, "waiting for database to be ready")
+}
+
+// SetupPostgres runs a postgres container with the PostGIS extension.
+func SetupPostgres(t *testing.T) *Container {
+	t.Helper()
+
+	cmd := exec.Command("docker", "run", "-P", "-d", "-e", "POSTGRES_PASSWORD=postgres", "postgis/postgis:12-3.0")
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("could not start container: %v", err)
+	}
+
+	id := out.String()[:12]
+
+	cmd = exec.Command("docker", "inspect", id)
+	out.Reset()
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("could not inspect container %s: %v", id, err)
+	}
+
+	var doc []struct {
+		NetworkSettings struct {
+			Ports struct {
+				TCP5432 []struct {
+					HostIP   string `json:"HostIp"`
+					HostPort string `json:"HostPort"`
+				} `json:"5432/tcp"`
+			} `json:"Ports"`
+		} `json:"NetworkSettings"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &doc); err != nil {
+		t.Fatalf("could not decode json: %v", err)
+	}
+
+	network := doc[0].NetworkSettings.Ports.TCP5432[0]
+
+	c := Container{
+		ID:   id,
+		Host: network.HostIP + ":" + network.HostPort,
+	}
+
+	t.Log("DB Host:", c.Host)
+
+	return &c
+}
+
+// FirestoreTest connects to the firestore emulator in a container started
+// with SetupFirestore, waiting for it to be ready. FIRESTORE_EMULATOR_HOST is
+// set so that every firestore client connects to the emulator.
+func FirestoreTest(t *testing.T, c *Container) (*gcfirestore.Client, error) {
+	t.Helper()
+
+	if err := os.Setenv("FIRESTORE_EMULATOR_HOST", c.Host); err != nil {
+		return nil, errors.Wrap(err, "setting emulator host")
+	}
+
+	ctx := context.Background()
+	client, err := firestore.Open(ctx, "observations")
+	if err != nil {
+		return nil, err
+	}
+
+	maxAttempts := 30
+	for attempts := 1; attempts <= maxAttempts; attempts++ {
+		if err = firestore.Check(ctx, client); err == nil {
+			return client, nil
+		}
+		time.Sleep(time.Second)
+	}
+
+	dumpContainerLogs(t, c)
+	TeardownDatabase(t, c)
+	return nil, errors.Wrap(err, "waiting for emulator to be ready")
+}
+
+// SetupFirestore runs a container with the firestore emulator.
+func SetupFirestore(t *testing.T) *Container {
+	t.Helper()
+
+	cmd := exec.Command("docker", "run", "-P", "-d", "-e", "FIRESTORE_PROJECT_ID=observations", "-e", "PORT=8080", "mtlynch/firestore-emulator")
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("could not start container: %v", err)
+	}
+
+	id := out.String()[:12]
+
+	cmd = exec.Command("docker", "inspect", id)
+	out.Reset()
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("could not inspect container %s: %v", id, err)
+	}
+
+	var doc []struct {
+		NetworkSettings struct {
+			Ports struct {
+				TCP8080 []struct {
+					HostIP   string `json:"HostIp"`
+					HostPort string `json:"HostPort"`
+				} `json:"8080/tcp"`
+			} `json:"Ports"`
+		} `json:"NetworkSettings"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &doc); err != nil {
+		t.Fatalf("could not decode json: %v", err)
+	}
+
+	network := doc[0].NetworkSettings.Ports.TCP8080[0]
+
+	c := Container{
+		ID:   id,
+		Host: network.HostIP + ":" + network.HostPort,
+	}
+
+	t.Log("Emulator Host:", c.Host)
+
+	return &c
+}
+
+// ArangoTest connects to the observations database on the arango server in a
+// container started with SetupArango, waiting for it to be ready.
+func ArangoTest(t *testing.T, c *Container) (driver.Database, error) {
+	t.Helper()
+
+	maxAttempts := 30
+	var err error
+	for attempts := 1; attempts <= maxAttempts; attempts++ {
+		var db driver.Database
+		db, err = arango.Open(context.Background(), "http://"+c.Host, "observations", "", "")
+		if err == nil {
+			return db, nil
+		}
+		time.Sleep(time.Second)
+	}
+
+	dumpContainerLogs(t, c)
+	TeardownDatabase(t, c)
+	return nil, errors.Wrap(err, "waiting for database to be ready")
+}
+
+// SetupArango runs an arango container without authentication.
+func SetupArango(t *testing.T) *Container {
+	t.Helper()
+
+	cmd := exec.Command("docker", "run", "-P", "-d", "-e", "ARANGO_NO_AUTH=1", "arangodb:3.6")
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("could not start container: %v", err)
+	}
+
+	id := out.String()[:12]
+
+	cmd = exec.Command("docker", "inspect", id)
+	out.Reset()
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("could not inspect container %s: %v", id, err)
+	}
+
+	var doc []struct {
+		NetworkSettings struct {
+			Ports struct {
+				TCP8529 []struct {
+					HostIP   string `json:"HostIp"`
+					HostPort string `json:"HostPort"`
+				} `json:"8529/tcp"`
+			} `json:"Ports"`
+		} `json:"NetworkSettings"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &doc); err != nil {
+		t.Fatalf("could not decode json: %v", err)
+	}
+
+	network := doc[0].NetworkSettings.Ports.TCP8529[0]
+
+	c := Container{
+		ID:   id,
+		Host: network.HostIP + ":" + network.HostPort,
 	}
 
 	t.Log("DB Host:", c.Host)
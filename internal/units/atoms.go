@@ -0,0 +1,229 @@
+package units
+
+import (
+	"fmt"
+	"math"
+)
+
+// atom is a unit that is not made of other symbols. Metric atoms may have a
+// prefix. Special atoms are measured from a different zero than their base
+// unit, which is offset in the atom.
+type atom struct {
+	factor  float64
+	offset  float64
+	dims    dimensions
+	metric  bool
+	special bool
+}
+
+// prefixes are the scales of the metric prefixes.
+var prefixes = map[string]float64{
+	"Y": 1e24, "Z": 1e21, "E": 1e18, "P": 1e15, "T": 1e12, "G": 1e9, "M": 1e6,
+	"k": 1e3, "h": 1e2, "da": 1e1, "d": 1e-1, "c": 1e-2, "m": 1e-3, "u": 1e-6,
+	"n": 1e-9, "p": 1e-12, "f": 1e-15, "a": 1e-18, "z": 1e-21, "y": 1e-24,
+	"Ki": 1024, "Mi": 1048576, "Gi": 1073741824, "Ti": 1099511627776,
+}
+
+// base are the base units of each dimension.
+var base = map[string]int{"m": 0, "g": 1, "s": 2, "rad": 3, "K": 4, "C": 5, "cd": 6}
+
+// definition defines an atom as a value of another unit.
+type definition struct {
+	value  float64
+	unit   string
+	metric bool
+}
+
+// definitions are the atoms that are not base units. They are the common
+// units of the UCUM base, SI, customary and clinical tables.
+var definitions = map[string]definition{
+	// Dimensionless
+	"10*":    {10, "1", false},
+	"10^":    {10, "1", false},
+	"[pi]":   {math.Pi, "1", false},
+	"%":      {1, "10*-2", false},
+	"[ppth]": {1, "10*-3", false},
+	"[ppm]":  {1, "10*-6", false},
+	"[ppb]":  {1, "10*-9", false},
+	"[pptr]": {1, "10*-12", false},
+	"mol":    {6.02214076, "10*23", true},
+	"sr":     {1, "rad2", true},
+	"bit":    {1, "1", true},
+	"By":     {8, "bit", true},
+
+	// SI
+	"Hz":  {1, "s-1", true},
+	"N":   {1, "kg.m/s2", true},
+	"Pa":  {1, "N/m2", true},
+	"J":   {1, "N.m", true},
+	"W":   {1, "J/s", true},
+	"A":   {1, "C/s", true},
+	"V":   {1, "J/C", true},
+	"F":   {1, "C/V", true},
+	"Ohm": {1, "V/A", true},
+	"S":   {1, "Ohm-1", true},
+	"Wb":  {1, "V.s", true},
+	"T":   {1, "Wb/m2", true},
+	"H":   {1, "Wb/A", true},
+	"lm":  {1, "cd.sr", true},
+	"lx":  {1, "lm/m2", true},
+	"Bq":  {1, "s-1", true},
+	"Gy":  {1, "J/kg", true},
+	"Sv":  {1, "J/kg", true},
+	"kat": {1, "mol/s", true},
+
+	// Other units used with SI
+	"gon":  {0.9, "deg", false},
+	"deg":  {2, "[pi].rad/360", false},
+	"'":    {1, "deg/60", false},
+	"''":   {1, "'/60", false},
+	"l":    {1, "dm3", true},
+	"L":    {1, "l", true},
+	"ar":   {100, "m2", true},
+	"min":  {60, "s", false},
+	"h":    {60, "min", false},
+	"d":    {24, "h", false},
+	"a_t":  {365.24219, "d", false},
+	"a_j":  {365.25, "d", false},
+	"a_g":  {365.2425, "d", false},
+	"a":    {1, "a_j", false},
+	"wk":   {7, "d", false},
+	"mo_s": {29.53059, "d", false},
+	"mo_j": {1, "a_j/12", false},
+	"mo_g": {1, "a_g/12", false},
+	"mo":   {1, "mo_j", false},
+	"t":    {1e3, "kg", true},
+	"bar":  {1e5, "Pa", true},
+	"u":    {1.66053906660e-24, "g", true},
+	"eV":   {1.602176634e-19, "J", true},
+	"AU":   {149597.870691, "Mm", false},
+	"pc":   {3.085678e16, "m", true},
+
+	// Constants and units defined by them
+	"[c]":      {299792458, "m/s", true},
+	"[g]":      {9.80665, "m/s2", true},
+	"[ly]":     {1, "[c].a_j", true},
+	"gf":       {1, "g.[g]", true},
+	"atm":      {101325, "Pa", false},
+	"m[Hg]":    {133.3220, "kPa", true},
+	"m[H2O]":   {9.80665, "kPa", true},
+	"cal":      {4.184, "J", true},
+	"[Cal]":    {1, "kcal", false},
+	"[degR]":   {5, "K/9", false},
+	"[Btu]":    {1.05505585262, "kJ", false},
+	"[HP]":     {550, "[ft_i].[lbf_av]/s", false},
+	"[psi]":    {1, "[lbf_av]/[in_i]2", false},
+	"[lbf_av]": {1, "[lb_av].[g]", false},
+
+	// International customary length, area and volume
+	"[in_i]":   {2.54, "cm", false},
+	"[ft_i]":   {12, "[in_i]", false},
+	"[yd_i]":   {3, "[ft_i]", false},
+	"[mi_i]":   {5280, "[ft_i]", false},
+	"[nmi_i]":  {1852, "m", false},
+	"[kn_i]":   {1, "[nmi_i]/h", false},
+	"[sin_i]":  {1, "[in_i]2", false},
+	"[sft_i]":  {1, "[ft_i]2", false},
+	"[syd_i]":  {1, "[yd_i]2", false},
+	"[cin_i]":  {1, "[in_i]3", false},
+	"[cft_i]":  {1, "[ft_i]3", false},
+	"[cyd_i]":  {1, "[yd_i]3", false},
+	"[ft_us]":  {1200, "m/3937", false},
+	"[rd_us]":  {16.5, "[ft_us]", false},
+	"[acr_us]": {160, "[rd_us]2", false},
+
+	// US and British volumes
+	"[gal_us]": {231, "[in_i]3", false},
+	"[bbl_us]": {42, "[gal_us]", false},
+	"[qt_us]":  {1, "[gal_us]/4", false},
+	"[pt_us]":  {1, "[qt_us]/2", false},
+	"[gil_us]": {1, "[pt_us]/4", false},
+	"[foz_us]": {1, "[gil_us]/4", false},
+	"[cup_us]": {16, "[tbs_us]", false},
+	"[tbs_us]": {1, "[foz_us]/2", false},
+	"[tsp_us]": {1, "[tbs_us]/3", false},
+	"[bu_us]":  {2150.42, "[in_i]3", false},
+	"[gal_br]": {4.54609, "l", false},
+	"[qt_br]":  {1, "[gal_br]/4", false},
+	"[pt_br]":  {1, "[qt_br]/2", false},
+
+	// Avoirdupois weights
+	"[gr]":       {64.79891, "mg", false},
+	"[lb_av]":    {7000, "[gr]", false},
+	"[oz_av]":    {1, "[lb_av]/16", false},
+	"[dr_av]":    {1, "[oz_av]/16", false},
+	"[stone_av]": {14, "[lb_av]", false},
+	"[ston_av]":  {2000, "[lb_av]", false},
+	"[lton_av]":  {2240, "[lb_av]", false},
+}
+
+// special are the atoms measured from a different zero than their base unit.
+// A value v is (v + offset) * factor kelvin.
+var special = map[string]atom{
+	"Cel":    {factor: 1, offset: 273.15},
+	"[degF]": {factor: 5.0 / 9, offset: 459.67},
+}
+
+// atoms are every atom, resolved from the base units, definitions and special
+// units when the package is initialized.
+var atoms = map[string]atom{}
+
+func init() {
+	for symbol, i := range base {
+		a := atom{factor: 1, metric: true}
+		a.dims[i] = 1
+		atoms[symbol] = a
+	}
+
+	for symbol, a := range special {
+		a.dims[base["K"]] = 1
+		a.special = true
+		atoms[symbol] = a
+	}
+
+	for symbol := range definitions {
+		if _, err := resolve(symbol); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// resolving is the symbols being resolved, which must not refer to each
+// other.
+var resolving = map[string]bool{}
+
+// resolve resolves the atom of a definition, resolving the atoms it is
+// defined by first.
+func resolve(symbol string) (atom, error) {
+	if a, ok := atoms[symbol]; ok {
+		return a, nil
+	}
+	if resolving[symbol] {
+		return atom{}, fmt.Errorf("unit %s is defined by itself", symbol)
+	}
+	resolving[symbol] = true
+	defer delete(resolving, symbol)
+
+	d := definitions[symbol]
+	u, err := Parse(d.unit)
+	if err != nil {
+		return atom{}, fmt.Errorf("defining %s: %v", symbol, err)
+	}
+
+	a := atom{factor: d.value * u.factor, dims: u.dims, metric: d.metric}
+	atoms[symbol] = a
+	return a, nil
+}
+
+// atomOf finds the atom of a symbol. While the package is initialized, atoms
+// are resolved as they are needed.
+func atomOf(symbol string) (atom, bool) {
+	if a, ok := atoms[symbol]; ok {
+		return a, true
+	}
+	if _, ok := definitions[symbol]; !ok {
+		return atom{}, false
+	}
+	a, err := resolve(symbol)
+	return a, err == nil
+}
@@ -0,0 +1,339 @@
+// Package units parses and converts units of measure written as codes of the
+// Unified Code for Units of Measure (UCUM), such as cm, m/s2, kg.m2 or Cel.
+//
+// Codes are case sensitive. A code is a product of units separated by . and
+// /, where each unit is an atom such as m or [in_i], optionally with a metric
+// prefix such as k or m and an integer exponent such as 2 or -1. Parentheses
+// group units, positive integers are factors, and annotations in braces such
+// as {count} label a unit without changing it.
+//
+// Units with the same dimension can be converted to each other. Cel and
+// [degF] are measured from a different zero than K, so they may not be
+// combined with other units.
+package units
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrorIncompatible is returned when units measure different dimensions.
+var ErrorIncompatible = errors.New("units are incompatible")
+
+// dimensions are the exponents of the base units length, mass, time, plane
+// angle, temperature, electric charge and luminous intensity.
+type dimensions [7]int
+
+// add adds the exponents of another set of dimensions raised to a power.
+func (d dimensions) add(o dimensions, power int) dimensions {
+	for i := range d {
+		d[i] += o[i] * power
+	}
+	return d
+}
+
+// Unit is a parsed unit of measure. A value v of the unit is
+// (v + offset) * factor in the base units of its dimensions.
+type Unit struct {
+	code   string
+	factor float64
+	offset float64
+	dims   dimensions
+}
+
+// String returns the canonical code of the unit. Codes that differ only in
+// how exponents are written have the same canonical code.
+func (u Unit) String() string {
+	return u.code
+}
+
+// Compatible reports whether values of the unit can be converted to another.
+func (u Unit) Compatible(to Unit) bool {
+	return u.dims == to.dims
+}
+
+// Conversion converts values between units by multiplying them by Scale and
+// adding Shift. Converted values are rounded to 12 significant digits so
+// floating point errors do not show, such as 100 Cel being 211.99999999999991
+// [degF].
+type Conversion struct {
+	Scale float64
+	Shift float64
+}
+
+// Apply converts a value.
+func (c Conversion) Apply(v float64) float64 {
+	rounded, _ := strconv.ParseFloat(strconv.FormatFloat(v*c.Scale+c.Shift, 'g', 12, 64), 64)
+	return rounded
+}
+
+// Converter returns the conversion of values from one unit to another, or
+// ErrorIncompatible when the units measure different dimensions.
+func Converter(from, to Unit) (Conversion, error) {
+	if !from.Compatible(to) {
+		return Conversion{}, ErrorIncompatible
+	}
+	return Conversion{
+		Scale: from.factor / to.factor,
+		Shift: from.offset*from.factor/to.factor - to.offset,
+	}, nil
+}
+
+// Convert converts a value from one unit code to another.
+func Convert(v float64, from, to string) (float64, error) {
+	f, err := Parse(from)
+	if err != nil {
+		return 0, err
+	}
+	t, err := Parse(to)
+	if err != nil {
+		return 0, err
+	}
+	c, err := Converter(f, t)
+	if err != nil {
+		return 0, err
+	}
+	return c.Apply(v), nil
+}
+
+// Parse parses a UCUM code.
+func Parse(code string) (Unit, error) {
+	if code == "" {
+		return Unit{}, errors.New("unit is empty")
+	}
+
+	p := parser{s: code}
+	u, err := p.term()
+	if err == nil && p.pos < len(p.s) {
+		err = p.errorf("unexpected %q", p.s[p.pos])
+	}
+	if err != nil {
+		return Unit{}, errors.Wrapf(err, "%q is not a UCUM unit", code)
+	}
+
+	return u.Unit, nil
+}
+
+// parsed is a unit being parsed. Special units may only be parsed on their
+// own, so the number of components is tracked.
+type parsed struct {
+	Unit
+	components int
+	special    bool
+}
+
+// parser is a recursive descent parser of UCUM codes.
+type parser struct {
+	s   string
+	pos int
+}
+
+// errorf creates an error at the current position.
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("at %d: %s", p.pos+1, fmt.Sprintf(format, args...))
+}
+
+// peek returns the next byte, or zero at the end.
+func (p *parser) peek() byte {
+	if p.pos >= len(p.s) {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+// term parses components separated by . and /. A term may start with / to
+// mean the reciprocal of the rest.
+func (p *parser) term() (parsed, error) {
+	u := parsed{Unit: Unit{factor: 1}}
+	op := byte('.')
+	if p.peek() == '/' {
+		op = '/'
+		u.code = "/"
+		p.pos++
+	}
+
+	for {
+		c, err := p.component()
+		if err != nil {
+			return u, err
+		}
+
+		power := 1
+		if op == '/' {
+			power = -1
+		}
+		u.factor *= math.Pow(c.factor, float64(power))
+		u.dims = u.dims.add(c.dims, power)
+		u.offset = c.offset
+		u.special = u.special || c.special
+		u.components += c.components
+		if u.code != "" && u.code != "/" {
+			u.code += string(op)
+		}
+		u.code += c.code
+
+		next := p.peek()
+		if next != '.' && next != '/' {
+			break
+		}
+		op = next
+		p.pos++
+	}
+
+	if u.special && (u.components > 1 || strings.HasPrefix(u.code, "/")) {
+		return u, p.errorf("%s cannot be combined with other units", u.code)
+	}
+	if u.components > 1 {
+		u.offset = 0
+	}
+
+	return u, nil
+}
+
+// component parses a parenthesised term, an annotation, a factor or a unit
+// with an optional exponent and annotation.
+func (p *parser) component() (parsed, error) {
+	switch p.peek() {
+	case '(':
+		p.pos++
+		u, err := p.term()
+		if err != nil {
+			return u, err
+		}
+		if p.peek() != ')' {
+			return u, p.errorf("missing )")
+		}
+		p.pos++
+		if u.special {
+			return u, p.errorf("%s cannot be combined with other units", u.code)
+		}
+		u.code = "(" + u.code + ")"
+		u.components = 2
+		return u, nil
+	case '{':
+		a, err := p.annotation()
+		return parsed{Unit: Unit{code: a, factor: 1}, components: 1}, err
+	case 0, '.', '/', ')':
+		return parsed{}, p.errorf("missing unit")
+	}
+
+	start := p.pos
+	depth := 0
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		if c == '[' {
+			depth++
+		} else if c == ']' {
+			depth--
+		} else if depth == 0 && strings.IndexByte("./(){}", c) >= 0 {
+			break
+		}
+		p.pos++
+	}
+	if depth != 0 {
+		return parsed{}, p.errorf("missing ]")
+	}
+
+	u, err := simple(p.s[start:p.pos])
+	if err != nil {
+		return u, err
+	}
+
+	if p.peek() == '{' {
+		a, err := p.annotation()
+		if err != nil {
+			return u, err
+		}
+		u.code += a
+	}
+
+	return u, nil
+}
+
+// annotation parses an annotation in braces.
+func (p *parser) annotation() (string, error) {
+	end := strings.IndexByte(p.s[p.pos:], '}')
+	if end < 0 {
+		return "", p.errorf("missing }")
+	}
+	a := p.s[p.pos : p.pos+end+1]
+	if strings.ContainsAny(a[1:len(a)-1], "{") {
+		return "", p.errorf("annotations may not be nested")
+	}
+	p.pos += end + 1
+	return a, nil
+}
+
+// exponent matches the exponent at the end of a unit.
+var exponent = regexp.MustCompile(`[+-]?[0-9]+$`)
+
+// factor matches a positive integer factor.
+var factor = regexp.MustCompile(`^[0-9]+$`)
+
+// simple parses a factor, or an atom with an optional prefix and exponent.
+func simple(s string) (parsed, error) {
+	if factor.MatchString(s) {
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil || n == 0 {
+			return parsed{}, fmt.Errorf("invalid factor %q", s)
+		}
+		return parsed{Unit: Unit{code: strings.TrimLeft(s, "0"), factor: n}, components: 1}, nil
+	}
+
+	symbol, power := s, 1
+	if loc := exponent.FindStringIndex(s); loc != nil && loc[0] > 0 {
+		n, err := strconv.Atoi(strings.TrimPrefix(s[loc[0]:], "+"))
+		if err != nil {
+			return parsed{}, fmt.Errorf("invalid exponent in %q", s)
+		}
+		symbol, power = s[:loc[0]], n
+	}
+
+	a, scale, err := lookup(symbol)
+	if err != nil {
+		return parsed{}, err
+	}
+
+	u := parsed{Unit: Unit{code: symbol, factor: math.Pow(scale*a.factor, float64(power))}, components: 1}
+	u.dims = u.dims.add(a.dims, power)
+	if power != 1 {
+		u.code += strconv.Itoa(power)
+	}
+	if a.special {
+		if power != 1 || scale != 1 {
+			return u, fmt.Errorf("%s cannot have a prefix or exponent", symbol)
+		}
+		u.offset = a.offset
+		u.special = true
+	}
+
+	return u, nil
+}
+
+// lookup finds the atom of a symbol and the scale of its prefix. Symbols that
+// are atoms are never read as a prefixed atom.
+func lookup(symbol string) (atom, float64, error) {
+	if a, ok := atomOf(symbol); ok {
+		return a, 1, nil
+	}
+
+	for _, n := range []int{2, 1} {
+		if len(symbol) <= n {
+			continue
+		}
+		scale, ok := prefixes[symbol[:n]]
+		if !ok {
+			continue
+		}
+		if a, ok := atomOf(symbol[n:]); ok && a.metric {
+			return a, scale, nil
+		}
+	}
+
+	return atom{}, 0, fmt.Errorf("unknown unit %q", symbol)
+}
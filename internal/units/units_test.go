@@ -0,0 +1,102 @@
+package units_test
+
+import (
+	"testing"
+
+	"github.com/schafer14/obs/internal/units"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsingUnits(t *testing.T) {
+
+	// Arrange
+	tt := []struct {
+		code      string
+		canonical string
+	}{
+		{"cm", "cm"},
+		{"km/h", "km/h"},
+		{"kg.m2/s2", "kg.m2/s2"},
+		{"m+2", "m2"},
+		{"s1", "s"},
+		{"/min", "/min"},
+		{"10*3.{cells}/uL", "10*3.{cells}/uL"},
+		{"mm[Hg]", "mm[Hg]"},
+		{"(m/s)/s", "(m/s)/s"},
+		{"{score}", "{score}"},
+		{"[degF]", "[degF]"},
+		{"%", "%"},
+	}
+
+	for _, tc := range tt {
+
+		// Act
+		u, err := units.Parse(tc.code)
+
+		// Assert
+		require.Nil(t, err, "parsing %q", tc.code)
+		assert.Equal(t, tc.canonical, u.String(), "canonical code of %q mismatch", tc.code)
+	}
+}
+
+func TestInvalidUnits(t *testing.T) {
+
+	// Arrange
+	codes := []string{"", "CM", "centimetre", "ha", "m/", "m.(s", "[in_i", "{score", "Cel/h", "Cel2", "kCel", "m.Cel", "0.m"}
+
+	for _, code := range codes {
+
+		// Act
+		_, err := units.Parse(code)
+
+		// Assert
+		assert.Error(t, err, "invalid unit %q accepted", code)
+	}
+}
+
+func TestConvertingUnits(t *testing.T) {
+
+	// Arrange
+	tt := []struct {
+		value    float64
+		from, to string
+		expected float64
+	}{
+		{1500, "mm", "m", 1.5},
+		{100, "Cel", "[degF]", 212},
+		{212, "[degF]", "Cel", 100},
+		{0, "Cel", "K", 273.15},
+		{60, "[mi_i]/h", "km/h", 96.56064},
+		{1, "[lb_av]", "g", 453.59237},
+		{2, "L", "dm3", 2},
+		{101.325, "kPa", "atm", 1},
+		{5, "%", "1", 0.05},
+		{3, "h", "min", 180},
+	}
+
+	for _, tc := range tt {
+
+		// Act
+		v, err := units.Convert(tc.value, tc.from, tc.to)
+
+		// Assert
+		require.Nil(t, err, "converting %s to %s", tc.from, tc.to)
+		assert.InDelta(t, tc.expected, v, 1e-9, "converting %v %s to %s", tc.value, tc.from, tc.to)
+	}
+}
+
+func TestIncompatibleUnits(t *testing.T) {
+
+	// Arrange
+	pairs := [][2]string{{"m", "s"}, {"Cel", "m"}, {"kg", "N"}, {"m2", "m3"}}
+
+	for _, pair := range pairs {
+
+		// Act
+		_, err := units.Convert(1, pair[0], pair[1])
+
+		// Assert
+		assert.Equal(t, units.ErrorIncompatible, err, "converting %s to %s", pair[0], pair[1])
+	}
+}
@@ -0,0 +1,454 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/schafer14/obs/internal/events"
+	"github.com/schafer14/obs/internal/observations"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Statuses of deliveries.
+const (
+	Pending   = "pending"
+	Succeeded = "succeeded"
+	Failed    = "failed"
+)
+
+// ErrorNoDelivery is returned by Lease when no delivery is due.
+var ErrorNoDelivery = errors.New("no delivery is due")
+
+// Delivery is an event to be sent to a webhook and the attempts made to send
+// it. NextAttemptAt is when the next attempt will be made, and is nil once the
+// delivery has succeeded or failed.
+type Delivery struct {
+	ID            string       `json:"id"`
+	WebhookID     string       `json:"webhookId"`
+	Event         events.Event `json:"event"`
+	Status        string       `json:"status"`
+	Attempts      []Attempt    `json:"attempts"`
+	NextAttemptAt *time.Time   `json:"nextAttemptAt,omitempty"`
+	CreatedAt     time.Time    `json:"createdAt"`
+}
+
+// Attempt is an attempt to send a delivery. StatusCode is the status of the
+// response, or zero when no response was received and Error says why.
+type Attempt struct {
+	At         time.Time     `json:"at"`
+	StatusCode int           `json:"statusCode,omitempty"`
+	Error      string        `json:"error,omitempty"`
+	Duration   time.Duration `json:"duration"`
+}
+
+// Dispatcher schedules deliveries of events to the webhooks they match and
+// sends them. Backoff is the wait before the first retry of a failed
+// delivery, which doubles with each attempt up to MaxBackoff. A delivery
+// fails once MaxAttempts attempts have been made.
+//
+// Deliveries are only sent to public addresses, so a webhook cannot reach the
+// services next to the API, unless AllowPrivate is set. Redirects are not
+// followed, and a delivery that is redirected fails.
+type Dispatcher struct {
+	webhooks Repository
+	queue    Queue
+	client   *http.Client
+
+	Backoff      time.Duration
+	MaxBackoff   time.Duration
+	MaxAttempts  int
+	AllowPrivate bool
+}
+
+// NewDispatcher creates a dispatcher for the webhooks in a repository, which
+// schedules deliveries in a queue.
+func NewDispatcher(webhooks Repository, queue Queue) *Dispatcher {
+	d := &Dispatcher{
+		webhooks:    webhooks,
+		queue:       queue,
+		Backoff:     30 * time.Second,
+		MaxBackoff:  time.Hour,
+		MaxAttempts: 8,
+	}
+
+	// Addresses are checked as they are dialled, after the url has been
+	// resolved, so a host cannot resolve to a public address when it is
+	// checked and a private address when it is dialled. Proxies are not
+	// used, as the proxy would be dialled instead of the webhook.
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: d.control}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	d.client = &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	return d
+}
+
+// privateNetworks are the networks of private, shared, documentation,
+// benchmarking and reserved addresses. They are global unicast addresses that
+// cannot be reached from the internet.
+var privateNetworks = parseNetworks("0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "172.16.0.0/12", "192.0.0.0/24", "192.0.2.0/24", "192.168.0.0/16", "198.18.0.0/15", "198.51.100.0/24", "203.0.113.0/24", "240.0.0.0/4", "2001:db8::/32", "fc00::/7")
+
+// parseNetworks parses networks in CIDR notation.
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
+
+// public reports whether an address can be reached from the internet. Only
+// global unicast addresses outside the private networks can be, which leaves
+// out loopback, link-local, multicast, broadcast and unspecified addresses.
+func public(ip net.IP) bool {
+	if !ip.IsGlobalUnicast() {
+		return false
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// control refuses connections to addresses that are not public, unless
+// AllowPrivate is set.
+func (d *Dispatcher) control(network, address string, c syscall.RawConn) error {
+	if d.AllowPrivate {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !public(ip) {
+		return errors.Errorf("webhook address %s is not public", host)
+	}
+
+	return nil
+}
+
+// lease is how long a dispatcher has to send a delivery before another may
+// try.
+const lease = time.Minute
+
+// deliverBatch is the most deliveries sent at a time.
+const deliverBatch = 100
+
+// Publish schedules a delivery of an event to every webhook whose filters
+// match its observation. The dispatcher is an events.Publisher, so events are
+// relayed to it from the outbox. An event is only scheduled once for each
+// webhook however many times it is published. A webhook whose filters cannot
+// be matched is skipped, so it does not stop the event from reaching the
+// others.
+func (d *Dispatcher) Publish(ctx context.Context, e events.Event) error {
+	hooks, err := d.webhooks.All(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, hook := range hooks {
+		ok, err := d.matches(hook, e.Observation)
+		if err != nil {
+			log.Printf("webhooks : Skipping webhook : %v", err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		delivery := Delivery{
+			ID:            uuid.New().String(),
+			WebhookID:     hook.ID,
+			Event:         e,
+			Status:        Pending,
+			Attempts:      []Attempt{},
+			NextAttemptAt: &now,
+			CreatedAt:     now,
+		}
+		if err := d.queue.Schedule(ctx, delivery); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// matches reports whether the revision of an observation in an event matches
+// the filters of a webhook. The revision is matched as it is, as it may have
+// been revised again before its event is published.
+func (d *Dispatcher) matches(hook Webhook, obs observations.Observation) (bool, error) {
+	ok, err := hook.query().Matches(obs)
+	return ok, errors.Wrapf(err, "matching webhook %s", hook.ID)
+}
+
+// Deliver sends every delivery that is due and reports how many were sent.
+// Each delivery is leased before it is sent, so dispatchers in other
+// instances of the API do not send it at the same time.
+func (d *Dispatcher) Deliver(ctx context.Context) (int, error) {
+	sent := 0
+	for sent < deliverBatch {
+		now := time.Now()
+
+		delivery, err := d.queue.Lease(ctx, now, now.Add(lease))
+		if err == ErrorNoDelivery {
+			return sent, nil
+		}
+		if err != nil {
+			return sent, err
+		}
+
+		if err := d.attempt(ctx, delivery); err != nil {
+			return sent, err
+		}
+		sent++
+	}
+
+	return sent, nil
+}
+
+// attempt sends a delivery and records the outcome.
+func (d *Dispatcher) attempt(ctx context.Context, delivery Delivery) error {
+	var attempt Attempt
+	hook, err := d.webhooks.Get(ctx, delivery.WebhookID)
+	switch {
+	case err == ErrorNotFound:
+		attempt = Attempt{At: time.Now(), Error: "webhook has been deleted"}
+		return d.queue.Record(ctx, delivery.ID, attempt, Failed, nil)
+	case err != nil:
+		return err
+	}
+
+	attempt = d.send(ctx, hook, delivery)
+	delivery.Attempts = append(delivery.Attempts, attempt)
+
+	if attempt.Error == "" {
+		return d.queue.Record(ctx, delivery.ID, attempt, Succeeded, nil)
+	}
+	if len(delivery.Attempts) >= d.MaxAttempts {
+		return d.queue.Record(ctx, delivery.ID, attempt, Failed, nil)
+	}
+
+	next := attempt.At.Add(d.backoff(len(delivery.Attempts)))
+	return d.queue.Record(ctx, delivery.ID, attempt, Pending, &next)
+}
+
+// backoff is the wait after a number of failed attempts.
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	wait := d.Backoff
+	for i := 1; i < attempts && wait < d.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > d.MaxBackoff {
+		wait = d.MaxBackoff
+	}
+	return wait
+}
+
+// send posts a delivery to a webhook. Deliveries succeed when the webhook
+// responds with a 2xx status.
+func (d *Dispatcher) send(ctx context.Context, hook Webhook, delivery Delivery) Attempt {
+	start := time.Now()
+	attempt := Attempt{At: start}
+
+	body, err := json.Marshal(delivery.Event)
+	if err != nil {
+		attempt.Error = errors.Wrap(err, "encoding event").Error()
+		return attempt
+	}
+
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		attempt.Error = errors.Wrap(err, "creating request").Error()
+		return attempt
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "obs-webhooks/1")
+	req.Header.Set("X-Obs-Event", delivery.Event.Type)
+	req.Header.Set("X-Obs-Delivery", delivery.ID)
+	req.Header.Set(SignatureHeader, Sign(hook.Secret, start, body))
+
+	resp, err := d.client.Do(req)
+	attempt.Duration = time.Since(start)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	attempt.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		attempt.Error = fmt.Sprintf("webhook responded with %s", resp.Status)
+	}
+
+	return attempt
+}
+
+// Run sends deliveries every interval until the context is done. Failures are
+// reported to onError and retried at the next interval.
+func (d *Dispatcher) Run(ctx context.Context, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := d.Deliver(ctx); err != nil && ctx.Err() == nil {
+			onError(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Deliveries retrieves the latest deliveries to a webhook, newest first.
+func Deliveries(ctx context.Context, collection *mongo.Collection, webhookID string, limit int) ([]Delivery, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "createdat", Value: -1}, {Key: "id", Value: 1}}).SetLimit(int64(limit))
+	cursor, err := collection.Find(ctx, bson.D{{Key: "webhookid", Value: webhookID}}, opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching deliveries")
+	}
+
+	var deliveries []Delivery
+	if err := cursor.All(ctx, &deliveries); err != nil {
+		return nil, errors.Wrap(err, "decoding deliveries")
+	}
+
+	return deliveries, nil
+}
+
+// Schedule adds a delivery to the queue in a collection. A delivery of an
+// event that has already been scheduled for the webhook is ignored.
+func Schedule(ctx context.Context, collection *mongo.Collection, d Delivery) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if _, err := collection.InsertOne(ctx, d); err != nil && !duplicate(err) {
+		return errors.Wrap(err, "scheduling delivery")
+	}
+
+	return nil
+}
+
+// duplicate reports whether an error is caused by a delivery that has
+// already been scheduled.
+func duplicate(err error) bool {
+	wErr, ok := err.(mongo.WriteException)
+	if !ok {
+		return false
+	}
+	for _, e := range wErr.WriteErrors {
+		if e.Code == 11000 {
+			return true
+		}
+	}
+	return false
+}
+
+// Lease takes the delivery in a collection that has been due the longest at
+// now, and puts off its next attempt until another time, so no other
+// dispatcher sends it before then. ErrorNoDelivery is returned when no
+// delivery is due.
+func Lease(ctx context.Context, collection *mongo.Collection, now, until time.Time) (Delivery, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var delivery Delivery
+	err := collection.FindOneAndUpdate(ctx,
+		bson.D{
+			{Key: "status", Value: Pending},
+			{Key: "nextattemptat", Value: bson.M{"$lte": now}},
+		},
+		bson.D{{Key: "$set", Value: bson.M{"nextattemptat": until}}},
+		options.FindOneAndUpdate().SetSort(bson.D{{Key: "nextattemptat", Value: 1}}),
+	).Decode(&delivery)
+	if err == mongo.ErrNoDocuments {
+		return delivery, ErrorNoDelivery
+	}
+	if err != nil {
+		return delivery, errors.Wrap(err, "leasing delivery")
+	}
+
+	return delivery, nil
+}
+
+// Record saves the outcome of an attempt to send a delivery in a
+// collection, with the status of the delivery and when it is next attempted.
+func Record(ctx context.Context, collection *mongo.Collection, id string, attempt Attempt, status string, next *time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	set := bson.M{"status": status}
+	update := bson.D{{Key: "$push", Value: bson.M{"attempts": attempt}}}
+	if next != nil {
+		set["nextattemptat"] = *next
+	} else {
+		update = append(update, bson.E{Key: "$unset", Value: bson.M{"nextattemptat": ""}})
+	}
+	update = append(update, bson.E{Key: "$set", Value: set})
+
+	if _, err := collection.UpdateOne(ctx, bson.D{{Key: "id", Value: id}}, update); err != nil {
+		return errors.Wrap(err, "recording delivery attempt")
+	}
+	return nil
+}
+
+// EnsureIndexes creates the indexes used to find webhooks and deliveries.
+func EnsureIndexes(ctx context.Context, webhooks, deliveries *mongo.Collection) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	_, err := webhooks.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "createdby", Value: 1}, {Key: "createdat", Value: 1}}},
+	})
+	if err != nil {
+		return errors.Wrap(err, "creating webhook indexes")
+	}
+
+	_, err = deliveries.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "webhookid", Value: 1}, {Key: "event.id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "webhookid", Value: 1}, {Key: "createdat", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "nextattemptat", Value: 1}}},
+	})
+	if err != nil {
+		return errors.Wrap(err, "creating delivery indexes")
+	}
+
+	return nil
+}
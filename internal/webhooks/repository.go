@@ -0,0 +1,279 @@
+package webhooks
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Repository stores the webhooks of users and their delivery logs. Mongo
+// stores them in mongo collections, and Memory stores them in the process so
+// they can be used without a database. The package functions of the same
+// name describe each method.
+type Repository interface {
+	Save(ctx context.Context, w Webhook) error
+	Find(ctx context.Context, id, by string) (Webhook, error)
+	Get(ctx context.Context, id string) (Webhook, error)
+	List(ctx context.Context, by string) ([]Webhook, error)
+	All(ctx context.Context) ([]Webhook, error)
+	Delete(ctx context.Context, id, by string) error
+	Deliveries(ctx context.Context, webhookID string, limit int) ([]Delivery, error)
+}
+
+// Queue stores the deliveries a Dispatcher schedules until they have been
+// sent. Mongo and Memory are queues of the deliveries listed by their
+// Deliveries method. The package functions of the same name describe each
+// method.
+type Queue interface {
+	Schedule(ctx context.Context, d Delivery) error
+	Lease(ctx context.Context, now, until time.Time) (Delivery, error)
+	Record(ctx context.Context, id string, attempt Attempt, status string, next *time.Time) error
+}
+
+// Mongo is a repository of the webhooks in one mongo collection and their
+// deliveries in another.
+type Mongo struct {
+	webhooks   *mongo.Collection
+	deliveries *mongo.Collection
+}
+
+// NewMongo creates a repository of the webhooks and deliveries in
+// collections.
+func NewMongo(webhooks, deliveries *mongo.Collection) *Mongo {
+	return &Mongo{webhooks: webhooks, deliveries: deliveries}
+}
+
+// Save persists a webhook.
+func (m *Mongo) Save(ctx context.Context, w Webhook) error {
+	return Save(ctx, m.webhooks, w)
+}
+
+// Find retrieves a webhook created by a user.
+func (m *Mongo) Find(ctx context.Context, id, by string) (Webhook, error) {
+	return Find(ctx, m.webhooks, id, by)
+}
+
+// Get retrieves a webhook created by any user.
+func (m *Mongo) Get(ctx context.Context, id string) (Webhook, error) {
+	return Get(ctx, m.webhooks, id)
+}
+
+// List retrieves the webhooks created by a user, oldest first.
+func (m *Mongo) List(ctx context.Context, by string) ([]Webhook, error) {
+	return List(ctx, m.webhooks, by)
+}
+
+// All retrieves every webhook.
+func (m *Mongo) All(ctx context.Context) ([]Webhook, error) {
+	return All(ctx, m.webhooks)
+}
+
+// Delete removes a webhook created by a user.
+func (m *Mongo) Delete(ctx context.Context, id, by string) error {
+	return Delete(ctx, m.webhooks, id, by)
+}
+
+// Deliveries retrieves the latest deliveries to a webhook, newest first.
+func (m *Mongo) Deliveries(ctx context.Context, webhookID string, limit int) ([]Delivery, error) {
+	return Deliveries(ctx, m.deliveries, webhookID, limit)
+}
+
+// Schedule adds a delivery to the queue.
+func (m *Mongo) Schedule(ctx context.Context, d Delivery) error {
+	return Schedule(ctx, m.deliveries, d)
+}
+
+// Lease takes the delivery that has been due the longest.
+func (m *Mongo) Lease(ctx context.Context, now, until time.Time) (Delivery, error) {
+	return Lease(ctx, m.deliveries, now, until)
+}
+
+// Record saves the outcome of an attempt to send a delivery.
+func (m *Mongo) Record(ctx context.Context, id string, attempt Attempt, status string, next *time.Time) error {
+	return Record(ctx, m.deliveries, id, attempt, status, next)
+}
+
+// Memory is a repository and queue of webhooks and their deliveries held in
+// the process. Webhooks and deliveries are lost when the process stops.
+type Memory struct {
+	mu         sync.RWMutex
+	hooks      []Webhook
+	deliveries []Delivery
+}
+
+// NewMemory creates an empty repository of webhooks.
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+// Save persists a webhook.
+func (m *Memory) Save(ctx context.Context, w Webhook) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.hooks = append(m.hooks, w)
+	return nil
+}
+
+// Find retrieves a webhook created by a user.
+func (m *Memory) Find(ctx context.Context, id, by string) (Webhook, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, w := range m.hooks {
+		if w.ID == id && w.CreatedBy == by {
+			return w, nil
+		}
+	}
+
+	return Webhook{}, ErrorNotFound
+}
+
+// Get retrieves a webhook created by any user.
+func (m *Memory) Get(ctx context.Context, id string) (Webhook, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, w := range m.hooks {
+		if w.ID == id {
+			return w, nil
+		}
+	}
+
+	return Webhook{}, ErrorNotFound
+}
+
+// List retrieves the webhooks created by a user, oldest first.
+func (m *Memory) List(ctx context.Context, by string) ([]Webhook, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var hooks []Webhook
+	for _, w := range m.hooks {
+		if w.CreatedBy == by {
+			hooks = append(hooks, w)
+		}
+	}
+
+	sort.SliceStable(hooks, func(i, j int) bool {
+		if !hooks[i].CreatedAt.Equal(hooks[j].CreatedAt) {
+			return hooks[i].CreatedAt.Before(hooks[j].CreatedAt)
+		}
+		return hooks[i].ID < hooks[j].ID
+	})
+
+	return hooks, nil
+}
+
+// All retrieves every webhook.
+func (m *Memory) All(ctx context.Context) ([]Webhook, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return append([]Webhook(nil), m.hooks...), nil
+}
+
+// Delete removes a webhook created by a user.
+func (m *Memory) Delete(ctx context.Context, id, by string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, w := range m.hooks {
+		if w.ID == id && w.CreatedBy == by {
+			m.hooks = append(m.hooks[:i], m.hooks[i+1:]...)
+			return nil
+		}
+	}
+
+	return ErrorNotFound
+}
+
+// Deliveries retrieves the latest deliveries to a webhook, newest first.
+func (m *Memory) Deliveries(ctx context.Context, webhookID string, limit int) ([]Delivery, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var deliveries []Delivery
+	for _, d := range m.deliveries {
+		if d.WebhookID == webhookID {
+			deliveries = append(deliveries, clone(d))
+		}
+	}
+
+	sort.SliceStable(deliveries, func(i, j int) bool {
+		if !deliveries[i].CreatedAt.Equal(deliveries[j].CreatedAt) {
+			return deliveries[i].CreatedAt.After(deliveries[j].CreatedAt)
+		}
+		return deliveries[i].ID < deliveries[j].ID
+	})
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+
+	return deliveries, nil
+}
+
+// Schedule adds a delivery to the queue, unless the event has already been
+// scheduled for the webhook.
+func (m *Memory) Schedule(ctx context.Context, d Delivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, scheduled := range m.deliveries {
+		if scheduled.WebhookID == d.WebhookID && scheduled.Event.ID == d.Event.ID {
+			return nil
+		}
+	}
+
+	m.deliveries = append(m.deliveries, clone(d))
+	return nil
+}
+
+// Lease takes the delivery that has been due the longest.
+func (m *Memory) Lease(ctx context.Context, now, until time.Time) (Delivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	due := -1
+	for i, d := range m.deliveries {
+		if d.Status != Pending || d.NextAttemptAt == nil || d.NextAttemptAt.After(now) {
+			continue
+		}
+		if due < 0 || d.NextAttemptAt.Before(*m.deliveries[due].NextAttemptAt) {
+			due = i
+		}
+	}
+	if due < 0 {
+		return Delivery{}, ErrorNoDelivery
+	}
+
+	m.deliveries[due].NextAttemptAt = &until
+	return clone(m.deliveries[due]), nil
+}
+
+// Record saves the outcome of an attempt to send a delivery.
+func (m *Memory) Record(ctx context.Context, id string, attempt Attempt, status string, next *time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, d := range m.deliveries {
+		if d.ID == id {
+			m.deliveries[i].Attempts = append(d.Attempts, attempt)
+			m.deliveries[i].Status = status
+			m.deliveries[i].NextAttemptAt = next
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// clone copies a delivery so it does not share its attempts with the copy
+// held by Memory.
+func clone(d Delivery) Delivery {
+	d.Attempts = append([]Attempt{}, d.Attempts...)
+	return d
+}
@@ -0,0 +1,66 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SignatureHeader is the header deliveries are signed in.
+const SignatureHeader = "X-Obs-Signature"
+
+// Sign signs the body of a delivery sent at a time. The signature has the
+// form t=<unix time>,sha256=<hex HMAC-SHA256 of "<unix time>.<body>">, keyed
+// by the secret of the webhook. Including the time lets receivers reject
+// deliveries that are replayed later.
+func Sign(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + ts + ",sha256=" + hex.EncodeToString(mac(secret, ts, body))
+}
+
+// Verify checks the signature of a delivery was made with a secret no more
+// than tolerance before now.
+func Verify(secret, signature string, body []byte, tolerance time.Duration, now time.Time) error {
+	var ts, sum string
+	for _, part := range strings.Split(signature, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			ts = kv[1]
+		case "sha256":
+			sum = kv[1]
+		}
+	}
+
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return errors.New("signature has no time")
+	}
+	if d := now.Sub(time.Unix(sec, 0)); d > tolerance || d < -tolerance {
+		return errors.New("signature has expired")
+	}
+
+	expected, err := hex.DecodeString(sum)
+	if err != nil || !hmac.Equal(expected, mac(secret, ts, body)) {
+		return errors.New("signature does not match")
+	}
+
+	return nil
+}
+
+// mac computes the HMAC of a signed time and body.
+func mac(secret, ts string, body []byte) []byte {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(ts))
+	h.Write([]byte("."))
+	h.Write(body)
+	return h.Sum(nil)
+}
@@ -0,0 +1,228 @@
+// Package webhooks delivers events about observations to HTTP callbacks.
+//
+// A webhook has a target url, a secret and filters in the same form as the
+// filters of a search for observations. Each event whose observation matches
+// every filter is delivered to the url as a POST of the event as JSON, signed
+// with the secret. Failed deliveries are retried with exponential backoff,
+// and every attempt is recorded in a delivery log.
+package webhooks
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/schafer14/obs/internal/observations"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/go-playground/validator.v9"
+)
+
+// validate holds the settings and caches for validating request struct values.
+var validate = validator.New()
+
+// ErrorNotFound is returned when a webhook does not exist.
+var ErrorNotFound = errors.New("webhook not found")
+
+// NewWebhook is a webhook that has not yet been validated and is not ready
+// to persist to the database.
+type NewWebhook struct {
+	URL     string                `json:"url" validate:"required,url"`
+	Secret  string                `json:"secret" validate:"required,min=16"`
+	Filters []observations.Filter `json:"filters" validate:"-"`
+}
+
+// Webhook is a webhook that has been validated and is ready to persist to the
+// database. The secret is never sent to clients.
+type Webhook struct {
+	ID        string                `json:"id"`
+	URL       string                `json:"url"`
+	Secret    string                `json:"-"`
+	Filters   []observations.Filter `json:"filters"`
+	CreatedBy string                `json:"createdBy,omitempty"`
+	CreatedAt time.Time             `json:"createdAt"`
+}
+
+// query is the search for observations a webhook is triggered by.
+func (w Webhook) query() observations.Query {
+	return observations.Query{Filters: w.Filters}
+}
+
+// New creates a webhook from a NewWebhook.
+func New(nw NewWebhook, id, by string, now time.Time) (Webhook, error) {
+	if err := validate.Struct(&nw); err != nil {
+		return Webhook{}, webhookError(err)
+	}
+
+	var fieldErrors []observations.FieldError
+	if u, err := url.Parse(nw.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		fieldErrors = append(fieldErrors, observations.FieldError{Field: "url", Error: "url must be an http or https url"})
+	}
+
+	if err := (observations.Query{Filters: nw.Filters}).Validate(); err != nil {
+		vError, ok := err.(*observations.ValidationError)
+		if !ok {
+			return Webhook{}, err
+		}
+		fieldErrors = append(fieldErrors, vError.Fields...)
+	}
+
+	if len(fieldErrors) > 0 {
+		return Webhook{}, &observations.ValidationError{Err: "error validating webhook", Fields: fieldErrors}
+	}
+
+	filters := nw.Filters
+	if filters == nil {
+		filters = []observations.Filter{}
+	}
+
+	return Webhook{
+		ID:        id,
+		URL:       nw.URL,
+		Secret:    nw.Secret,
+		Filters:   filters,
+		CreatedBy: by,
+		CreatedAt: now,
+	}, nil
+}
+
+// webhookError converts the errors of the validator to a validation error
+// naming each invalid field.
+func webhookError(err error) error {
+	vErrs, ok := err.(validator.ValidationErrors)
+	if !ok {
+		return errors.Wrap(err, "validating webhook")
+	}
+
+	var fields []observations.FieldError
+	for _, vErr := range vErrs {
+		var msg string
+		switch vErr.Tag() {
+		case "required":
+			msg = fmt.Sprintf("%s is required", vErr.Field())
+		case "min":
+			msg = fmt.Sprintf("%s must be at least %s characters", vErr.Field(), vErr.Param())
+		case "url":
+			msg = fmt.Sprintf("%s must be a url", vErr.Field())
+		default:
+			msg = fmt.Sprintf("%s is invalid", vErr.Field())
+		}
+		fields = append(fields, observations.FieldError{Field: jsonName(vErr.Field()), Error: msg})
+	}
+
+	return &observations.ValidationError{Err: "error validating webhook", Fields: fields}
+}
+
+// jsonName is the json name of a field of NewWebhook.
+func jsonName(field string) string {
+	switch field {
+	case "URL":
+		return "url"
+	case "Secret":
+		return "secret"
+	}
+	return field
+}
+
+// Save persists a webhook to the database.
+func Save(ctx context.Context, collection *mongo.Collection, w Webhook) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if _, err := collection.InsertOne(ctx, w); err != nil {
+		return errors.Wrap(err, "saving webhook")
+	}
+
+	return nil
+}
+
+// Find retrieves a webhook created by a user.
+func Find(ctx context.Context, collection *mongo.Collection, id, by string) (Webhook, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var w Webhook
+	err := collection.FindOne(ctx, bson.D{{Key: "id", Value: id}, {Key: "createdby", Value: by}}).Decode(&w)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return w, ErrorNotFound
+		}
+		return w, errors.Wrap(err, "finding webhook")
+	}
+
+	return w, nil
+}
+
+// Get retrieves a webhook created by any user.
+func Get(ctx context.Context, collection *mongo.Collection, id string) (Webhook, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var w Webhook
+	err := collection.FindOne(ctx, bson.D{{Key: "id", Value: id}}).Decode(&w)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return w, ErrorNotFound
+		}
+		return w, errors.Wrap(err, "finding webhook")
+	}
+
+	return w, nil
+}
+
+// List retrieves the webhooks created by a user, oldest first.
+func List(ctx context.Context, collection *mongo.Collection, by string) ([]Webhook, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "createdat", Value: 1}, {Key: "id", Value: 1}})
+	cursor, err := collection.Find(ctx, bson.D{{Key: "createdby", Value: by}}, opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching webhooks")
+	}
+
+	var hooks []Webhook
+	if err := cursor.All(ctx, &hooks); err != nil {
+		return nil, errors.Wrap(err, "decoding webhooks")
+	}
+
+	return hooks, nil
+}
+
+// Delete removes a webhook created by a user. Deliveries that have not been
+// made are abandoned.
+func Delete(ctx context.Context, collection *mongo.Collection, id, by string) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	res, err := collection.DeleteOne(ctx, bson.D{{Key: "id", Value: id}, {Key: "createdby", Value: by}})
+	if err != nil {
+		return errors.Wrap(err, "deleting webhook")
+	}
+	if res.DeletedCount == 0 {
+		return ErrorNotFound
+	}
+
+	return nil
+}
+
+// All retrieves every webhook.
+func All(ctx context.Context, collection *mongo.Collection) ([]Webhook, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, bson.D{})
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching webhooks")
+	}
+
+	var hooks []Webhook
+	if err := cursor.All(ctx, &hooks); err != nil {
+		return nil, errors.Wrap(err, "decoding webhooks")
+	}
+
+	return hooks, nil
+}
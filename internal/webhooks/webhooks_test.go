@@ -0,0 +1,416 @@
+package webhooks_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/schafer14/obs/internal/events"
+	"github.com/schafer14/obs/internal/observations"
+	"github.com/schafer14/obs/internal/webhooks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const secret = "banners-garden-secret"
+
+func TestSigningDeliveries(t *testing.T) {
+
+	// Arrange
+	now := time.Now()
+	body := []byte(`{"id":"7c1e2d2e-91b5-4b43-9f0a-5d2b7c9a3b11"}`)
+
+	// Act
+	signature := webhooks.Sign(secret, now, body)
+
+	// Assert
+	assert.Nil(t, webhooks.Verify(secret, signature, body, time.Minute, now), "valid signature rejected")
+	assert.Error(t, webhooks.Verify("another-secret-entirely", signature, body, time.Minute, now), "signature with wrong secret accepted")
+	assert.Error(t, webhooks.Verify(secret, signature, []byte(`{"id":"tampered"}`), time.Minute, now), "signature of tampered body accepted")
+	assert.Error(t, webhooks.Verify(secret, signature, body, time.Minute, now.Add(time.Hour)), "expired signature accepted")
+	assert.Error(t, webhooks.Verify(secret, "sha256=abc", body, time.Minute, now), "signature without time accepted")
+}
+
+func TestInvalidWebhooksAreRejected(t *testing.T) {
+
+	// Arrange
+	nw := webhooks.NewWebhook{
+		URL:     "ftp://example.com/hooks",
+		Secret:  secret,
+		Filters: []observations.Filter{{Path: "wisteria", Op: "=", Matcher: "5"}},
+	}
+
+	// Act
+	_, err := webhooks.New(nw, uuid.New().String(), "banner", time.Now())
+
+	// Assert
+	require.Error(t, err, "invalid webhook accepted")
+	vError, ok := err.(*observations.ValidationError)
+	require.True(t, ok, "error is not a validation error: %v", err)
+	var fields []string
+	for _, f := range vError.Fields {
+		fields = append(fields, f.Field)
+	}
+	assert.Contains(t, fields, "url", "invalid url accepted")
+	assert.Equal(t, 2, len(fields), "field errors mismatch: %v", vError.Fields)
+
+	_, err = webhooks.New(webhooks.NewWebhook{URL: "https://example.com/hooks", Secret: "short"}, uuid.New().String(), "banner", time.Now())
+	assert.Error(t, err, "short secret accepted")
+}
+
+func TestMemoryDeliversEvents(t *testing.T) {
+
+	// Act and Assert
+	deliverEvents(t, webhooks.NewMemory())
+}
+
+func TestMongoDeliversEvents(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Arrange
+	ctx := context.Background()
+	hookColl, deliveryColl := db.Collection("webhooks"), db.Collection("deliveries")
+	for _, c := range []string{"webhooks", "deliveries"} {
+		require.Nil(t, db.Collection(c).Drop(ctx), "deleting collection")
+	}
+	require.Nil(t, webhooks.EnsureIndexes(ctx, hookColl, deliveryColl), "creating indexes")
+
+	// Act and Assert
+	deliverEvents(t, webhooks.NewMongo(hookColl, deliveryColl))
+}
+
+// store is a repository of webhooks that is also the queue of their
+// deliveries.
+type store interface {
+	webhooks.Repository
+	webhooks.Queue
+}
+
+func deliverEvents(t *testing.T, hooks store) {
+
+	// Arrange
+	ctx := context.Background()
+
+	receiver := &receiver{fail: 1}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	hook, err := webhooks.New(webhooks.NewWebhook{
+		URL:     server.URL,
+		Secret:  secret,
+		Filters: []observations.Filter{{Path: "propertyId", Op: "=", Matcher: "urn:example:health"}},
+	}, uuid.New().String(), "banner", time.Now())
+	require.Nil(t, err, "creating webhook")
+	require.Nil(t, hooks.Save(ctx, hook), "saving webhook")
+
+	dispatcher := webhooks.NewDispatcher(hooks, hooks)
+	dispatcher.Backoff = time.Millisecond
+	dispatcher.AllowPrivate = true
+
+	health := observation(t, "urn:example:health")
+	yield := observation(t, "urn:example:yield")
+	e := events.Created(health, time.Now())
+
+	// Act
+	require.Nil(t, dispatcher.Publish(ctx, e), "publishing event")
+	require.Nil(t, dispatcher.Publish(ctx, e), "publishing event again")
+	require.Nil(t, dispatcher.Publish(ctx, events.Created(yield, time.Now())), "publishing unmatched event")
+	failed, err := dispatcher.Deliver(ctx)
+	require.Nil(t, err, "delivering events")
+	time.Sleep(10 * time.Millisecond)
+	retried, err := dispatcher.Deliver(ctx)
+	require.Nil(t, err, "retrying events")
+
+	// Assert
+	assert.Equal(t, 1, failed, "deliveries attempted mismatch")
+	assert.Equal(t, 1, retried, "deliveries retried mismatch")
+
+	require.Equal(t, 2, len(receiver.received), "requests received mismatch")
+	for _, req := range receiver.received {
+		assert.Nil(t, webhooks.Verify(secret, req.signature, req.body, time.Minute, time.Now()), "signature invalid")
+		var got events.Event
+		require.Nil(t, json.Unmarshal(req.body, &got), "decoding event")
+		assert.Equal(t, e.ID, got.ID, "event mismatch")
+		assert.Equal(t, health.ID, got.Observation.ID, "observation mismatch")
+	}
+
+	deliveries, err := hooks.Deliveries(ctx, hook.ID, 10)
+	require.Nil(t, err, "fetching deliveries")
+	require.Equal(t, 1, len(deliveries), "deliveries mismatch")
+	assert.Equal(t, webhooks.Succeeded, deliveries[0].Status, "delivery status mismatch")
+	require.Equal(t, 2, len(deliveries[0].Attempts), "attempts mismatch")
+	assert.Equal(t, http.StatusServiceUnavailable, deliveries[0].Attempts[0].StatusCode, "failed attempt status mismatch")
+	assert.NotEmpty(t, deliveries[0].Attempts[0].Error, "failed attempt has no error")
+	assert.Equal(t, http.StatusOK, deliveries[0].Attempts[1].StatusCode, "successful attempt status mismatch")
+	assert.Nil(t, deliveries[0].NextAttemptAt, "succeeded delivery is still scheduled")
+}
+
+func TestFailingDeliveries(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Arrange
+	ctx := context.Background()
+	hookColl, deliveryColl := db.Collection("webhooks"), db.Collection("deliveries")
+	for _, c := range []string{"webhooks", "deliveries"} {
+		require.Nil(t, db.Collection(c).Drop(ctx), "deleting collection")
+	}
+
+	receiver := &receiver{fail: -1}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	hook, err := webhooks.New(webhooks.NewWebhook{URL: server.URL, Secret: secret}, uuid.New().String(), "banner", time.Now())
+	require.Nil(t, err, "creating webhook")
+	require.Nil(t, webhooks.Save(ctx, hookColl, hook), "saving webhook")
+
+	hooks := webhooks.NewMongo(hookColl, deliveryColl)
+	dispatcher := webhooks.NewDispatcher(hooks, hooks)
+	dispatcher.Backoff = time.Millisecond
+	dispatcher.AllowPrivate = true
+	dispatcher.MaxAttempts = 3
+	require.Nil(t, dispatcher.Publish(ctx, events.Created(observation(t, "urn:example:health"), time.Now())), "publishing event")
+
+	// Act
+	for i := 0; i < 5; i++ {
+		_, err := dispatcher.Deliver(ctx)
+		require.Nil(t, err, "delivering events")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Assert
+	assert.Equal(t, 3, len(receiver.received), "attempts made mismatch")
+	deliveries, err := webhooks.Deliveries(ctx, deliveryColl, hook.ID, 10)
+	require.Nil(t, err, "fetching deliveries")
+	require.Equal(t, 1, len(deliveries), "deliveries mismatch")
+	assert.Equal(t, webhooks.Failed, deliveries[0].Status, "delivery status mismatch")
+	assert.Equal(t, 3, len(deliveries[0].Attempts), "attempts recorded mismatch")
+}
+
+func TestRefusingPrivateTargets(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Arrange
+	ctx := context.Background()
+	hookColl, deliveryColl := db.Collection("webhooks"), db.Collection("deliveries")
+	for _, c := range []string{"webhooks", "deliveries"} {
+		require.Nil(t, db.Collection(c).Drop(ctx), "deleting collection")
+	}
+
+	receiver := &receiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	redirect := httptest.NewServer(http.RedirectHandler(server.URL, http.StatusTemporaryRedirect))
+	defer redirect.Close()
+
+	private, err := webhooks.New(webhooks.NewWebhook{URL: server.URL, Secret: secret}, uuid.New().String(), "banner", time.Now())
+	require.Nil(t, err, "creating webhook")
+	require.Nil(t, webhooks.Save(ctx, hookColl, private), "saving webhook")
+
+	hooks := webhooks.NewMongo(hookColl, deliveryColl)
+	dispatcher := webhooks.NewDispatcher(hooks, hooks)
+	require.Nil(t, dispatcher.Publish(ctx, events.Created(observation(t, "urn:example:health"), time.Now())), "publishing event")
+
+	// Act
+	refused, err := dispatcher.Deliver(ctx)
+	require.Nil(t, err, "delivering events")
+
+	require.Nil(t, hookColl.Drop(ctx), "deleting webhooks")
+	redirected, err := webhooks.New(webhooks.NewWebhook{URL: redirect.URL, Secret: secret}, uuid.New().String(), "banner", time.Now())
+	require.Nil(t, err, "creating webhook")
+	require.Nil(t, webhooks.Save(ctx, hookColl, redirected), "saving webhook")
+	dispatcher.AllowPrivate = true
+	require.Nil(t, dispatcher.Publish(ctx, events.Created(observation(t, "urn:example:health"), time.Now())), "publishing event")
+	_, err = dispatcher.Deliver(ctx)
+	require.Nil(t, err, "delivering events")
+
+	// Assert
+	assert.Equal(t, 1, refused, "deliveries attempted mismatch")
+	assert.Equal(t, 0, len(receiver.received), "private address or redirect reached")
+
+	deliveries, err := webhooks.Deliveries(ctx, deliveryColl, private.ID, 10)
+	require.Nil(t, err, "fetching deliveries")
+	require.Equal(t, 1, len(deliveries), "deliveries mismatch")
+	require.Equal(t, 1, len(deliveries[0].Attempts), "attempts mismatch")
+	assert.Contains(t, deliveries[0].Attempts[0].Error, "not public", "refusal not recorded")
+
+	deliveries, err = webhooks.Deliveries(ctx, deliveryColl, redirected.ID, 10)
+	require.Nil(t, err, "fetching deliveries")
+	require.Equal(t, 1, len(deliveries), "deliveries mismatch")
+	require.Equal(t, 1, len(deliveries[0].Attempts), "attempts mismatch")
+	assert.Equal(t, http.StatusTemporaryRedirect, deliveries[0].Attempts[0].StatusCode, "redirect followed")
+}
+
+func TestRefusingAddressesThatAreNotGlobalUnicast(t *testing.T) {
+
+	// Arrange
+	ctx := context.Background()
+	hooks := webhooks.NewMemory()
+	targets := map[string]string{
+		"multicast":          "http://224.0.0.251/hooks",
+		"global multicast":   "http://233.252.0.1/hooks",
+		"reserved":           "http://240.0.0.1/hooks",
+		"broadcast":          "http://255.255.255.255/hooks",
+		"documentation":      "http://192.0.2.1/hooks",
+		"ipv6 multicast":     "http://[ff0e::1]/hooks",
+		"ipv6 documentation": "http://[2001:db8::1]/hooks",
+	}
+	ids := map[string]string{}
+	for name, target := range targets {
+		hook, err := webhooks.New(webhooks.NewWebhook{URL: target, Secret: secret}, uuid.New().String(), "banner", time.Now())
+		require.Nil(t, err, "creating %s webhook", name)
+		require.Nil(t, hooks.Save(ctx, hook), "saving %s webhook", name)
+		ids[name] = hook.ID
+	}
+	dispatcher := webhooks.NewDispatcher(hooks, hooks)
+	require.Nil(t, dispatcher.Publish(ctx, events.Created(observation(t, "urn:example:health"), time.Now())), "publishing event")
+
+	// Act
+	attempted, err := dispatcher.Deliver(ctx)
+	require.Nil(t, err, "delivering events")
+
+	// Assert
+	assert.Equal(t, len(targets), attempted, "deliveries attempted mismatch")
+	for name, id := range ids {
+		deliveries, err := hooks.Deliveries(ctx, id, 10)
+		require.Nil(t, err, "fetching %s deliveries", name)
+		require.Equal(t, 1, len(deliveries), "%s deliveries mismatch", name)
+		require.Equal(t, 1, len(deliveries[0].Attempts), "%s attempts mismatch", name)
+		assert.Contains(t, deliveries[0].Attempts[0].Error, "not public", "%s address not refused", name)
+	}
+}
+
+func TestPublishingPastWebhooksThatCannotBeMatched(t *testing.T) {
+
+	// Arrange
+	ctx := context.Background()
+	hooks := webhooks.NewMemory()
+
+	broken, err := webhooks.New(webhooks.NewWebhook{URL: "https://example.com/broken", Secret: secret}, uuid.New().String(), "banner", time.Now())
+	require.Nil(t, err, "creating webhook")
+	broken.Filters = []observations.Filter{{Path: "propertyId", Op: "~", Matcher: "urn:example:health"}}
+	require.Nil(t, hooks.Save(ctx, broken), "saving webhook")
+
+	hook, err := webhooks.New(webhooks.NewWebhook{URL: "https://example.com/hooks", Secret: secret}, uuid.New().String(), "banner", time.Now())
+	require.Nil(t, err, "creating webhook")
+	require.Nil(t, hooks.Save(ctx, hook), "saving webhook")
+
+	dispatcher := webhooks.NewDispatcher(hooks, hooks)
+
+	// Act
+	err = dispatcher.Publish(ctx, events.Created(observation(t, "urn:example:health"), time.Now()))
+
+	// Assert
+	assert.Nil(t, err, "webhook that cannot be matched failed the event")
+	deliveries, err := hooks.Deliveries(ctx, hook.ID, 10)
+	require.Nil(t, err, "fetching deliveries")
+	assert.Equal(t, 1, len(deliveries), "event not scheduled for the other webhook")
+	deliveries, err = hooks.Deliveries(ctx, broken.ID, 10)
+	require.Nil(t, err, "fetching deliveries")
+	assert.Equal(t, 0, len(deliveries), "event scheduled for the webhook that cannot be matched")
+}
+
+func TestDeliveringRevisionsRevisedBeforeTheyAreRelayed(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Arrange
+	ctx := context.Background()
+	hookColl, deliveryColl, obsColl := db.Collection("webhooks"), db.Collection("deliveries"), db.Collection("observations")
+	for _, c := range []string{"webhooks", "deliveries", "observations"} {
+		require.Nil(t, db.Collection(c).Drop(ctx), "deleting collection")
+	}
+	require.Nil(t, webhooks.EnsureIndexes(ctx, hookColl, deliveryColl), "creating indexes")
+	require.Nil(t, observations.EnsureIndexes(ctx, obsColl), "creating indexes")
+
+	hook, err := webhooks.New(webhooks.NewWebhook{
+		URL:     "https://example.com/hooks",
+		Secret:  secret,
+		Filters: []observations.Filter{{Path: "propertyId", Op: "=", Matcher: "urn:example:health"}},
+	}, uuid.New().String(), "banner", time.Now())
+	require.Nil(t, err, "creating webhook")
+	require.Nil(t, webhooks.Save(ctx, hookColl, hook), "saving webhook")
+
+	hooks := webhooks.NewMongo(hookColl, deliveryColl)
+	dispatcher := webhooks.NewDispatcher(hooks, hooks)
+
+	first := observation(t, "urn:example:health")
+	require.Nil(t, observations.Save(ctx, obsColl, first), "saving observation")
+	changed := first.AsNew()
+	changed.Property = observations.Referenceable{ID: "urn:example:yield"}
+	revised, err := observations.Revise(first, changed, "banner", time.Now())
+	require.Nil(t, err, "revising observation")
+	require.Nil(t, observations.Supersede(ctx, obsColl, revised), "superseding observation")
+
+	// Act
+	relayed, err := events.NewOutbox(observations.NewMongo(obsColl)).Relay(ctx, dispatcher)
+	require.Nil(t, err, "relaying events")
+
+	// Assert
+	assert.Equal(t, 2, relayed, "events relayed mismatch")
+	deliveries, err := hooks.Deliveries(ctx, hook.ID, 10)
+	require.Nil(t, err, "fetching deliveries")
+	require.Equal(t, 1, len(deliveries), "superseded revision not delivered")
+	assert.Equal(t, events.ObservationCreated, deliveries[0].Event.Type, "event type mismatch")
+	assert.Equal(t, 1, deliveries[0].Event.Observation.Revision, "revision mismatch")
+}
+
+// request is a request received by a receiver.
+type request struct {
+	signature string
+	body      []byte
+}
+
+// receiver records the webhook requests it receives. It responds with 503 to
+// the first fail requests, or to every request when fail is negative.
+type receiver struct {
+	fail int
+
+	mu       sync.Mutex
+	received []request
+}
+
+// ServeHTTP records a request.
+func (rcv *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+
+	rcv.received = append(rcv.received, request{r.Header.Get(webhooks.SignatureHeader), body})
+	if rcv.fail < 0 || len(rcv.received) <= rcv.fail {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// observation creates an observation of a property.
+func observation(t *testing.T, property string) observations.Observation {
+	obs, err := observations.New(observations.NewObservation{
+		Feature:      observations.Referenceable{ID: "https://example.com/banners-garden"},
+		FeatureType:  observations.Referenceable{ID: "urn:example:garden"},
+		Property:     observations.Referenceable{ID: property},
+		PropertyType: observations.Referenceable{ID: "urn:example:scale-1-5"},
+		Process:      observations.Referenceable{ID: "urn:example:measurement:by-eye"},
+		Result:       map[string]interface{}{"wisteria": int64(5)},
+	}, uuid.New().String(), time.Now())
+	require.Nil(t, err, "creating observation")
+	return obs
+}